@@ -0,0 +1,272 @@
+package rsync
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dchest/blake2b"
+)
+
+// 断点续传的patch
+//
+// 设置PatchOptions.Checkpoint后，patch每输出CheckpointInterval字节，在命令结束时sync
+// merged文件并写入checkpoint文件。patch中断后，使用相同的delta、basis和已经输出的merged
+// 文件再次调用，从checkpoint记录的位置继续patch；继续之前重新计算merged中已经输出部分的
+// hash，与checkpoint中的hash状态比较，不一致时返回ErrCheckpointMismatch。patch完成后
+// 删除checkpoint文件。
+//
+// 要求：delta从位置0开始并且可以seek，merged为*os.File并且从位置0开始输出，delta不能是VCDIFF格式。
+// 单个命令不会被拆分，命令很长时两个checkpoint之间的间隔会超过CheckpointInterval。
+//
+// checkpoint文件格式：
+//   magic:        4字节，CheckpointMagic
+//   deltaOffset:  8字节，下一个命令在delta中的位置
+//   outputOffset: 8字节，已经输出的长度
+//   stateLen:     4字节
+//   state:        stateLen字节，输出数据的sha256 hash状态
+
+const (
+	CheckpointMagic = 0x72730437
+
+	defaultCheckpointInterval = 64 << 20
+)
+
+var ErrCheckpointMismatch = errors.New("partial output does not match checkpoint")
+
+type checkpoint struct {
+	deltaOffset  int64
+	outputOffset int64
+	state        []byte
+}
+
+func (cp *checkpoint) toBytes() (res []byte) {
+	res = append(res, htonl(CheckpointMagic)...)
+	res = append(res, Htonll(uint64(cp.deltaOffset))...)
+	res = append(res, Htonll(uint64(cp.outputOffset))...)
+	res = append(res, htonl(uint32(len(cp.state)))...)
+	res = append(res, cp.state...)
+	return
+}
+
+func loadCheckpoint(fn string) (cp *checkpoint, err error) {
+	var (
+		buf   []byte
+		magic uint32
+		l     uint32
+		u     uint64
+	)
+
+	if buf, err = ioutil.ReadFile(fn); err != nil {
+		return
+	}
+	rd := bytes.NewReader(buf)
+	cp = &checkpoint{}
+	if magic, err = ntohl(rd); err != nil || magic != CheckpointMagic {
+		return nil, fmt.Errorf("invalid checkpoint file %s: magic wrong", fn)
+	}
+	if u, err = ntohll(rd); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %v", fn, err)
+	}
+	cp.deltaOffset = int64(u)
+	if u, err = ntohll(rd); err != nil {
+		return nil, fmt.Errorf("invalid checkpoint file %s: %v", fn, err)
+	}
+	cp.outputOffset = int64(u)
+	if l, err = ntohl(rd); err != nil || int(l) != rd.Len() {
+		return nil, fmt.Errorf("invalid checkpoint file %s: state length wrong", fn)
+	}
+	cp.state = buf[len(buf)-int(l):]
+	return
+}
+
+// 计算delta的读取位置
+type countReader struct {
+	rd  io.Reader
+	off int64
+}
+
+func (r *countReader) Read(p []byte) (n int, err error) {
+	n, err = r.rd.Read(p)
+	r.off += int64(n)
+	return
+}
+
+// patch时记录输出的长度和hash，定期写入checkpoint
+type checkpointer struct {
+	path     string
+	interval int64
+	delta    *countReader
+	out      *os.File
+	w        io.Writer // merged文件或sparseWriter
+	sw       *sparseWriter
+	h        hash.Hash
+	sum      hash.Hash // 输出的blake2b-512 hash，恢复时包含已经输出的部分，用于校验trailer
+	off      int64     // 已经输出的长度
+	last     int64     // 上次checkpoint时输出的长度
+	tail     []byte    // 恢复时merged最后的数据，用于self copy
+}
+
+// 如果checkpoint文件存在，检查merged文件，并将delta和merged文件seek到checkpoint的位置
+// deltaRd已经读取了magic
+func newCheckpointer(deltaRd io.Reader, out *os.File, opts *PatchOptions) (c *checkpointer, err error) {
+	var cp *checkpoint
+
+	c = &checkpointer{
+		path:     opts.Checkpoint,
+		interval: opts.CheckpointInterval,
+		delta:    &countReader{rd: deltaRd, off: 4},
+		out:      out,
+		h:        sha256.New(),
+		sum:      blake2b.New512(),
+	}
+	if c.interval <= 0 {
+		c.interval = defaultCheckpointInterval
+	}
+
+	if cp, err = loadCheckpoint(c.path); err != nil {
+		if os.IsNotExist(err) {
+			err = nil
+		}
+		return
+	}
+	if err = c.verify(cp); err != nil {
+		return
+	}
+
+	// 丢弃checkpoint之后输出的数据
+	if err = out.Truncate(cp.outputOffset); err != nil {
+		return
+	}
+	if _, err = out.Seek(cp.outputOffset, 0); err != nil {
+		return
+	}
+	seeker, ok := deltaRd.(io.Seeker)
+	if !ok {
+		return nil, errors.New("resume patch failed: delta is not seekable")
+	}
+	if _, err = seeker.Seek(cp.deltaOffset, 0); err != nil {
+		return
+	}
+	c.delta.off = cp.deltaOffset
+	c.off = cp.outputOffset
+	c.last = cp.outputOffset
+	return
+}
+
+// 重新计算merged文件中已经输出部分的hash，与checkpoint比较
+func (c *checkpointer) verify(cp *checkpoint) (err error) {
+	var (
+		n     int
+		fi    os.FileInfo
+		state []byte
+		buf   = make([]byte, 1<<16)
+	)
+
+	if fi, err = c.out.Stat(); err != nil {
+		return
+	}
+	if fi.Size() < cp.outputOffset {
+		return fmt.Errorf("%w: output length %d, checkpoint %d", ErrCheckpointMismatch, fi.Size(), cp.outputOffset)
+	}
+
+	rd := io.NewSectionReader(c.out, 0, cp.outputOffset)
+	tailStart := cp.outputOffset - selfCopyWindow
+	for pos := int64(0); pos < cp.outputOffset; pos += int64(n) {
+		if n, err = rd.Read(buf); n == 0 {
+			if err == nil || err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		c.h.Write(buf[0:n])
+		c.sum.Write(buf[0:n])
+		if end := pos + int64(n); end > tailStart {
+			start := int64(0)
+			if tailStart > pos {
+				start = tailStart - pos
+			}
+			c.tail = append(c.tail, buf[start:n]...)
+		}
+	}
+	err = nil
+
+	if state, err = c.h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return
+	}
+	if !bytes.Equal(state, cp.state) {
+		return fmt.Errorf("%w: output hash differs at offset %d", ErrCheckpointMismatch, cp.outputOffset)
+	}
+	return
+}
+
+func (c *checkpointer) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	c.h.Write(p[0:n])
+	c.off += int64(n)
+	return
+}
+
+// 命令结束时调用，输出超过interval时写入checkpoint
+func (c *checkpointer) check() (err error) {
+	if c.off-c.last < c.interval {
+		return
+	}
+	return c.save()
+}
+
+func (c *checkpointer) save() (err error) {
+	var (
+		tmp *os.File
+		cp  = checkpoint{deltaOffset: c.delta.off, outputOffset: c.off}
+	)
+
+	// 稀疏文件结尾的hole需要设置文件长度
+	if c.sw != nil {
+		if err = c.sw.finish(); err != nil {
+			return
+		}
+	}
+	if err = c.out.Sync(); err != nil {
+		return
+	}
+	if cp.state, err = c.h.(encoding.BinaryMarshaler).MarshalBinary(); err != nil {
+		return
+	}
+
+	// 先写入临时文件再rename，避免checkpoint文件不完整
+	dir, base := filepath.Split(c.path)
+	if tmp, err = ioutil.TempFile(dir, "."+base+"."); err != nil {
+		return
+	}
+	if _, err = tmp.Write(cp.toBytes()); err == nil {
+		err = tmp.Sync()
+	}
+	if e := tmp.Close(); err == nil {
+		err = e
+	}
+	if err == nil {
+		err = os.Rename(tmp.Name(), c.path)
+	}
+	if err != nil {
+		os.Remove(tmp.Name())
+		return fmt.Errorf("write checkpoint failed: %s", err.Error())
+	}
+	c.last = c.off
+	return
+}
+
+// patch完成，删除checkpoint文件
+func (c *checkpointer) done() (err error) {
+	if err = os.Remove(c.path); os.IsNotExist(err) {
+		err = nil
+	}
+	return
+}
@@ -0,0 +1,96 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// 读取limit字节后出错，模拟patch中断
+type brokenReader struct {
+	*bytes.Reader
+	limit int64
+}
+
+func (r *brokenReader) Read(p []byte) (n int, err error) {
+	pos := r.Size() - int64(r.Len())
+	if pos >= r.limit {
+		return 0, errors.New("broken reader")
+	}
+	if int64(len(p)) > r.limit-pos {
+		p = p[0 : r.limit-pos]
+	}
+	return r.Reader.Read(p)
+}
+
+func TestCheckpoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-checkpoint")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basis := randBytes(15, 100000)
+	fresh := randBytes(16, 3000)
+	var src []byte
+	for i := 0; i < 20; i++ {
+		src = append(src, basis[i*4000:i*4000+3000]...)
+		src = append(src, fresh...)
+		src = append(src, bytes.Repeat([]byte{byte(i)}, 100)...)
+	}
+
+	sig, result := new(bytes.Buffer), new(bytes.Buffer)
+	if err = GenSign(bytes.NewReader(basis), int64(len(basis)), 500, sig); err != nil {
+		t.Fatal(err)
+	}
+	dopts := &DeltaOptions{SelfCopy: true, RunLength: true}
+	if err = GenDeltaWith(sig, bytes.NewReader(src), int64(len(src)), result, dopts); err != nil {
+		t.Fatal(err)
+	}
+	delta := result.Bytes()
+
+	cpFn := filepath.Join(dir, "checkpoint")
+	popts := &PatchOptions{Checkpoint: cpFn, CheckpointInterval: 5000}
+	out, err := os.Create(filepath.Join(dir, "merged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer out.Close()
+
+	interrupt := func() {
+		out.Seek(0, 0)
+		out.Truncate(0)
+		os.Remove(cpFn)
+		rd := &brokenReader{bytes.NewReader(delta), int64(len(delta) - 20)}
+		if err = PatchWith(rd, bytes.NewReader(basis), out, popts); err == nil {
+			t.Fatal("patch should be interrupted")
+		}
+		cp, err := loadCheckpoint(cpFn)
+		if err != nil || cp.outputOffset == 0 || cp.deltaOffset <= 4 {
+			t.Fatal("checkpoint should be saved:", err)
+		}
+	}
+
+	// 中断后继续
+	interrupt()
+	if err = PatchWith(bytes.NewReader(delta), bytes.NewReader(basis), out, popts); err != nil {
+		t.Fatal("resume patch failed:", err)
+	}
+	if content, _ := ioutil.ReadFile(out.Name()); !bytes.Equal(content, src) {
+		t.Fatal("resume patch result not equal")
+	}
+	if _, err = os.Stat(cpFn); !os.IsNotExist(err) {
+		t.Fatal("checkpoint should be removed after patch")
+	}
+
+	// 已经输出的数据被修改
+	interrupt()
+	out.WriteAt([]byte{^src[10]}, 10)
+	err = PatchWith(bytes.NewReader(delta), bytes.NewReader(basis), out, popts)
+	if !errors.Is(err, ErrCheckpointMismatch) {
+		t.Fatal("resume patch should fail with checkpoint mismatch:", err)
+	}
+}
@@ -0,0 +1,81 @@
+package rsync
+
+import (
+	"fmt"
+	"io"
+)
+
+// delta命令的类型
+const (
+	opEnd = iota
+	opCopy
+	opLiteral
+	opSelf
+	opRun
+	opMultiCopy
+)
+
+// delta中的一个命令，literal命令的数据紧跟在命令之后，没有被读取
+type command struct {
+	op     int
+	where  uint64 // copy, mcopy: basis中的位置; self copy: 输出中的位置
+	length uint64
+	value  byte   // run
+	basis  uint32 // mcopy: basis文件的序号
+	// 结束命令之后是trailer，trailer没有被读取
+	trailer bool
+	// 在命令之间遇到EOF，没有结束命令
+	eof bool
+}
+
+// 读取一个命令，delta结束(结束命令或EOF)时op为opEnd
+func readCommand(rd io.Reader) (c command, err error) {
+	var (
+		cmd uint8
+		lb  uint32
+	)
+
+	if cmd, err = readByte(rd); err == io.EOF {
+		c.eof = true
+		return c, nil
+	} else if err != nil {
+		return
+	}
+
+	switch {
+	case cmd == 0:
+		c.op = opEnd
+	case cmd == RS_OP_TRAILER:
+		c.op = opEnd
+		c.trailer = true
+	case cmd >= RS_OP_COPY_N1_N1 && cmd <= RS_OP_COPY_N8_N8:
+		c.op = opCopy
+		c.where, c.length, err = matchParams(rd, whereBytes[cmd], lengthBytes[cmd])
+	case cmd >= RS_OP_SELF_N1_N1 && cmd <= RS_OP_SELF_N8_N8:
+		c.op = opSelf
+		c.where, c.length, err = matchParams(rd, whereBytes[cmd], lengthBytes[cmd])
+	case cmd >= RS_OP_MCOPY_N1_N1 && cmd <= RS_OP_MCOPY_N8_N8:
+		c.op = opMultiCopy
+		if c.basis, err = ntohl(rd); err != nil {
+			break
+		}
+		c.where, c.length, err = matchParams(rd, whereBytes[cmd], lengthBytes[cmd])
+	case cmd >= RS_OP_RUN_N1 && cmd <= RS_OP_RUN_N8:
+		c.op = opRun
+		lb = lengthBytes[cmd]
+		if c.length, err = vRead(rd, lb); err != nil {
+			return
+		}
+		c.value, err = readByte(rd)
+	case cmd >= RS_OP_LITERAL_N1 && cmd <= RS_OP_LITERAL_N8:
+		c.op = opLiteral
+		lb = lengthBytes[cmd]
+		c.length, err = vRead(rd, lb)
+	default:
+		err = fmt.Errorf("invalid delta command: 0x%x", cmd)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
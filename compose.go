@@ -0,0 +1,122 @@
+package rsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// 合并delta
+//
+// d1: v1->v2, d2: v2->v3 ... 合并为一个v1->vn的delta。最后一个delta的命令按照输出位置依次
+// 处理：COPY的范围是前一个版本中的位置，通过前一个delta的命令索引映射，直到第一个delta的
+// COPY，即v1中的位置；LITERAL和RUN保持不变；中间delta中的self copy映射到同一个版本中更早
+// 的位置继续处理；最后一个delta的self copy位置就是输出位置，保持不变。
+// LITERAL的数据通过PatchedReader从各个delta中读取，不会读取v1。
+
+var errComposeBasis = errors.New("compose deltas: basis should not be read")
+
+// 合并delta时的basis，不能被读取
+type noBasis struct{}
+
+func (noBasis) ReadAt(p []byte, off int64) (int, error) {
+	return 0, errComposeBasis
+}
+
+// compose a chain of deltas d1(v1->v2), d2(v2->v3) ... into one delta v1->vn.
+// the deltas must be in rsync format, VCDIFF is not supported
+func ComposeDeltas(result io.Writer, deltas ...io.ReaderAt) (err error) {
+	var (
+		df    delta
+		basis io.ReaderAt = noBasis{}
+		rs    []*PatchedReader
+	)
+
+	if len(deltas) == 0 {
+		return errors.New("compose deltas: no delta")
+	}
+	for i, d := range deltas {
+		var r *PatchedReader
+
+		size := readerAtSize(d)
+		if size < 0 {
+			return fmt.Errorf("compose deltas: unknown length of delta %d", i+1)
+		}
+		if r, err = NewPatchedReader(basis, d, size); err != nil {
+			return fmt.Errorf("compose deltas: parse delta %d failed: %s", i+1, err.Error())
+		}
+		rs = append(rs, r)
+		basis = r
+	}
+
+	last := len(rs) - 1
+	for _, c := range rs[last].cmds {
+		if c.op == opSelf {
+			df.mss = append(df.mss, matchStat{match: 2, pos: int64(c.where), length: int64(c.length)})
+			continue
+		}
+		if df.mss, err = resolveRange(df.mss, rs, last, c.off, int64(c.length), c.off); err != nil {
+			return
+		}
+	}
+	df.mss = mergeMatchStats(df.mss)
+
+	df.outer = result
+	return df.flush(rs[last])
+}
+
+// 将第k个delta输出中[off, off+length)的数据映射为matchStat
+// outPos: 对应的最终输出中的位置，literal从最终输出中读取
+func resolveRange(mss []matchStat, rs []*PatchedReader, k int, off, length, outPos int64) ([]matchStat, error) {
+	r := rs[k]
+	if off < 0 || off+length > r.size {
+		return mss, fmt.Errorf("compose deltas: copy out of range in delta %d: offset=%d length=%d size=%d",
+			k+1, off, length, r.size)
+	}
+
+	i := sort.Search(len(r.cmds), func(i int) bool {
+		return r.cmds[i].off+int64(r.cmds[i].length) > off
+	})
+	for length > 0 {
+		var err error
+
+		c := &r.cmds[i]
+		d := off - c.off
+		l := int64(c.length) - d
+		if l > length {
+			l = length
+		}
+		switch c.op {
+		case opCopy:
+			if k == 0 {
+				mss = append(mss, matchStat{match: 1, pos: int64(c.where) + d, length: l})
+			} else if mss, err = resolveRange(mss, rs, k-1, int64(c.where)+d, l, outPos); err != nil {
+				return mss, err
+			}
+		case opLiteral:
+			mss = append(mss, matchStat{match: -1, pos: outPos, length: l})
+		case opRun:
+			mss = append(mss, matchStat{match: 3, pos: outPos, length: l, value: c.value})
+		case opSelf:
+			// 重叠时，输出[c.off+d]与输出[where+d%dist]相同
+			dist := c.off - int64(c.where)
+			if dist < int64(c.length) {
+				d %= dist
+				if l > dist-d {
+					l = dist - d
+				}
+			}
+			if mss, err = resolveRange(mss, rs, k, int64(c.where)+d, l, outPos); err != nil {
+				return mss, err
+			}
+		}
+		off += l
+		outPos += l
+		length -= l
+		if off >= c.off+int64(c.length) {
+			i++
+		}
+	}
+	return mss, nil
+}
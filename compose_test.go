@@ -0,0 +1,57 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestComposeDeltas(t *testing.T) {
+	var (
+		vs     [][]byte
+		deltas []*bytes.Reader
+	)
+
+	v := randBytes(21, 40000)
+	vs = append(vs, v)
+	for i := 0; i < 4; i++ {
+		next := append([]byte{}, v[i*3000:i*3000+10000]...)
+		next = append(next, randBytes(int64(22+i), 2000)...)
+		next = append(next, bytes.Repeat([]byte{byte(i)}, 3000)...)
+		next = append(next, bytes.Repeat([]byte("abcd"), 1000)...)
+		next = append(next, v[20000:]...)
+		next = append(next, next[100:3000]...)
+		vs = append(vs, next)
+
+		sig, result := new(bytes.Buffer), new(bytes.Buffer)
+		if err := GenSign(bytes.NewReader(v), int64(len(v)), 300, sig); err != nil {
+			t.Fatal("GenSign failed:", err)
+		}
+		opts := &DeltaOptions{SelfCopy: i%2 == 0, RunLength: i > 1}
+		if err := GenDeltaWith(sig, bytes.NewReader(next), int64(len(next)), result, opts); err != nil {
+			t.Fatal("GenDeltaWith failed:", err)
+		}
+		deltas = append(deltas, bytes.NewReader(result.Bytes()))
+		v = next
+	}
+
+	for n := 1; n <= len(deltas); n++ {
+		var (
+			ds     []io.ReaderAt
+			result = new(bytes.Buffer)
+			merged = new(bytes.Buffer)
+		)
+		for _, d := range deltas[0:n] {
+			ds = append(ds, d)
+		}
+		if err := ComposeDeltas(result, ds...); err != nil {
+			t.Fatal("ComposeDeltas failed:", err)
+		}
+		if err := Patch(result, bytes.NewReader(vs[0]), merged); err != nil {
+			t.Fatal("Patch composed delta failed:", err)
+		}
+		if !bytes.Equal(merged.Bytes(), vs[n]) {
+			t.Fatalf("composed delta of %d deltas result not equal", n)
+		}
+	}
+}
@@ -16,18 +16,25 @@ type delta struct {
 	weakSum  uint32
 	blockLen uint32
 	outer    io.Writer
+	dw       *DeltaWriter
 	ms       matchStat
 	mss      []matchStat
+	basis    io.ReaderAt // 本地basis文件，用于扩展匹配块
+	index    blockIndex  // 为nil时使用sig查找匹配块
+	format   int         // delta文件格式
+	trailer  bool        // 是否在结尾写入trailer
+	multi    *MultiSign  // 不为nil时，匹配位置为multi的虚拟地址，见multisign.go
 	debug    bool
 }
 
 // dst.sig与src比较后，是否匹配的结果输出
 type matchStat struct {
-	match int   // 0: 未知状态，仅第一次出现,不能出现在最终结果中；1：匹配；-1：不匹配
+	match int   // 0: 未知状态，仅第一次出现,不能出现在最终结果中；1：匹配；-1：不匹配；2：与src前面的数据匹配(self copy)；3：重复的字节(run)
 	pos   int64 // 如果match为true，pos为dst文件的match位置，否则，pos为src中不匹配的起点位置
 	// 当生成delta文件时，从src中读取该位置的数据，写入delta文件中
 	length int64 // 如果match为true，length代表dst文件与src文件匹配的长度；否则，length代表src文件中
 	// 没有匹配到的位置的总长度
+	value byte // match为3时，重复的字节
 }
 
 const (
@@ -62,8 +69,77 @@ const (
 	RS_OP_COPY_N8_N2 uint8 = 0x52
 	RS_OP_COPY_N8_N4 uint8 = 0x53
 	RS_OP_COPY_N8_N8 uint8 = 0x54
+
+	// 从已经patch生成的数据中copy，where为merged文件中的位置
+	RS_OP_SELF_N1_N1 uint8 = 0x55
+	RS_OP_SELF_N1_N2 uint8 = 0x56
+	RS_OP_SELF_N1_N4 uint8 = 0x57
+	RS_OP_SELF_N1_N8 uint8 = 0x58
+	RS_OP_SELF_N2_N1 uint8 = 0x59
+	RS_OP_SELF_N2_N2 uint8 = 0x5a
+	RS_OP_SELF_N2_N4 uint8 = 0x5b
+	RS_OP_SELF_N2_N8 uint8 = 0x5c
+	RS_OP_SELF_N4_N1 uint8 = 0x5d
+	RS_OP_SELF_N4_N2 uint8 = 0x5e
+	RS_OP_SELF_N4_N4 uint8 = 0x5f
+	RS_OP_SELF_N4_N8 uint8 = 0x60
+	RS_OP_SELF_N8_N1 uint8 = 0x61
+	RS_OP_SELF_N8_N2 uint8 = 0x62
+	RS_OP_SELF_N8_N4 uint8 = 0x63
+	RS_OP_SELF_N8_N8 uint8 = 0x64
+
+	// 重复的字节
+	RS_OP_RUN_N1 uint8 = 0x65
+	RS_OP_RUN_N2 uint8 = 0x66
+	RS_OP_RUN_N4 uint8 = 0x67
+	RS_OP_RUN_N8 uint8 = 0x68
+
+	// 带trailer的结束命令，见trailer.go
+	RS_OP_TRAILER uint8 = 0x69
+
+	// 从第N个basis文件复制，见multisign.go
+	RS_OP_MCOPY_N1_N1 uint8 = 0x6a
+	RS_OP_MCOPY_N1_N2 uint8 = 0x6b
+	RS_OP_MCOPY_N1_N4 uint8 = 0x6c
+	RS_OP_MCOPY_N1_N8 uint8 = 0x6d
+	RS_OP_MCOPY_N2_N1 uint8 = 0x6e
+	RS_OP_MCOPY_N2_N2 uint8 = 0x6f
+	RS_OP_MCOPY_N2_N4 uint8 = 0x70
+	RS_OP_MCOPY_N2_N8 uint8 = 0x71
+	RS_OP_MCOPY_N4_N1 uint8 = 0x72
+	RS_OP_MCOPY_N4_N2 uint8 = 0x73
+	RS_OP_MCOPY_N4_N4 uint8 = 0x74
+	RS_OP_MCOPY_N4_N8 uint8 = 0x75
+	RS_OP_MCOPY_N8_N1 uint8 = 0x76
+	RS_OP_MCOPY_N8_N2 uint8 = 0x77
+	RS_OP_MCOPY_N8_N4 uint8 = 0x78
+	RS_OP_MCOPY_N8_N8 uint8 = 0x79
 )
 
+// delta生成选项
+type DeltaOptions struct {
+	// basis文件(即签名对应的文件)在本地可读时设置，匹配块会逐字节向前后扩展到相邻的
+	// 不匹配区域，并合并相邻的匹配块，使literal数据尽量少。delta格式不变。
+	Basis io.ReaderAt
+	// Diff建立内存索引时使用的block长度，0表示根据basis文件的长度自动选择
+	BlockLen uint32
+	// delta文件格式：FormatRsync或FormatVCDIFF
+	Format int
+	// 在不匹配的数据中查找src内部重复的数据，生成从已patch数据中copy的命令
+	SelfCopy bool
+	// 在不匹配的数据中查找重复的字节，生成RUN命令
+	RunLength bool
+	// src为*os.File时，src中的hole(SEEK_HOLE/SEEK_DATA)生成RUN(0)命令，delta中不包含hole的数据。
+	// 匹配时仍然读取整个src(hole读出全0)，不减少读取和计算
+	Sparse bool
+	// 使用带trailer的结束命令，记录输出的长度和blake2b-512 hash，patch时校验。
+	// 只支持FormatRsync
+	Trailer bool
+	Debug   bool
+}
+
+var errVcdiffTrailer = errors.New("trailer is not supported by VCDIFF delta")
+
 // generate delta
 // param:
 //     dstSig: reader of dst signature file
@@ -75,13 +151,34 @@ func GenDelta(dstSig io.Reader,
 	srcLen int64,
 	result io.Writer,
 	args ...bool) (err error) {
+	var opts DeltaOptions
+
+	if len(args) > 0 {
+		opts.Debug = args[0]
+	}
+	return GenDeltaWith(dstSig, src, srcLen, result, &opts)
+}
+
+// generate delta with options, opts may be nil
+func GenDeltaWith(dstSig io.Reader,
+	src io.ReadSeeker,
+	srcLen int64,
+	result io.Writer,
+	opts *DeltaOptions) (err error) {
 	var (
 		df delta
 	)
 
-	if len(args) > 0 {
-		df.debug = args[0]
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+	if opts.Trailer && opts.Format == FormatVCDIFF {
+		return errVcdiffTrailer
 	}
+	df.debug = opts.Debug
+	df.basis = opts.Basis
+	df.format = opts.Format
+	df.trailer = opts.Trailer
 	// load signature file
 	if df.sig, err = LoadSign(dstSig, df.debug); err != nil {
 		err = errors.New("Load Signature failed: " + err.Error())
@@ -90,20 +187,43 @@ func GenDelta(dstSig io.Reader,
 	df.blockLen = df.sig.block_len
 	df.outer = result
 
-	if err = df.genDelta(src, srcLen); err != nil {
-		err = errors.New("generate Delta failed: " + err.Error())
-		return
+	return df.generate(src, srcLen, opts)
+}
+
+// 匹配，扩展匹配块，按opts查找hole、重复的字节和src内部重复的数据，最后写入delta
+func (d *delta) generate(src io.ReadSeeker, srcLen int64, opts *DeltaOptions) (err error) {
+	if err = d.genDelta(src, srcLen); err != nil {
+		return errors.New("generate Delta failed: " + err.Error())
+	}
+	if d.basis != nil {
+		if err = d.extendMatches(src); err != nil {
+			return errors.New("extend matches failed: " + err.Error())
+		}
+	}
+	if opts.Sparse {
+		if err = d.findHoles(src, srcLen); err != nil {
+			return errors.New("find holes failed: " + err.Error())
+		}
+	}
+	if opts.RunLength {
+		if err = d.findRuns(src); err != nil {
+			return errors.New("find runs failed: " + err.Error())
+		}
+	}
+	if opts.SelfCopy {
+		if err = d.findSelfCopies(src, srcLen); err != nil {
+			return errors.New("find self copies failed: " + err.Error())
+		}
 	}
 
 	// 打印调试信息
-	if df.debug {
-		df.dump()
+	if d.debug {
+		d.dump()
 	}
 
-	if err = df.flush(src); err != nil {
+	if err = d.flush(src); err != nil {
 		err = errors.New("write Delta failed: " + err.Error())
 	}
-
 	return
 }
 
@@ -202,22 +322,19 @@ func (d *delta) genDelta(src io.ReadSeeker, srcLen int64) (err error) {
 	return
 }
 
-// delta文件的header。
-// 格式：
-//    delta magic
-func (d *delta) writeHeader() (err error) {
-	_, err = d.outer.Write(htonl(DeltaMagic))
-	return
+// 根据weak sum查找与p相同的block，返回basis文件中的位置，没有找到返回-1
+// pos为p在src中的位置，有多个相同的block时，取与pos距离最近的
+type blockIndex interface {
+	lookup(p []byte, pos int64, sum uint32) int64
 }
 
 // matchAt is basic file position
 func (d *delta) findMatch(p []byte, pos int64, sum uint32) (matchAt int64) {
 
-	matchAt = -1
-	if blocks, ok := d.sig.block_sigs[sum]; ok {
-		ssum := strongSum(p, d.sig.strong_sum_len)
-		// 二分查找
-		matchAt = blockSlice(blocks).search(ssum, pos, d.blockLen)
+	if d.index != nil {
+		matchAt = d.index.lookup(p, pos, sum)
+	} else {
+		matchAt = d.sig.lookup(p, pos, sum)
 	}
 
 	if matchAt < 0 {
@@ -330,8 +447,15 @@ func (d *delta) dumpMatchStats(wr io.Writer) {
 		case -1:
 			wr.Write([]byte(fmt.Sprintf("Miss  Block(%d): start at %d %d, length: %d\n", i, pos, ms.pos, ms.length)))
 			pos += ms.length
+		case 2:
+			wr.Write([]byte(fmt.Sprintf("Self  Block(%d): start at %d %d, length: %d\n", i, pos, ms.pos, ms.length)))
+			pos += ms.length
+		case 3:
+			wr.Write([]byte(fmt.Sprintf("Run   Block(%d): start at %d 0x%x, length: %d\n", i, pos, ms.value, ms.length)))
+			pos += ms.length
 		default:
-			panic("ms.match should only be 1 or -1.")
+			wr.Write([]byte(fmt.Sprintf("Unknown Block(%d): match %d, length: %d\n", i, ms.match, ms.length)))
+			pos += ms.length
 		}
 	}
 }
@@ -341,29 +465,39 @@ func (d *delta) dumpMatchStats(wr io.Writer) {
 // 2 将matchStat写入delta文件
 //
 func (d *delta) flush(src io.ReadSeeker) (err error) {
-	err = d.writeHeader()
-	if err != nil {
-		return
+	if d.format == FormatVCDIFF {
+		return d.flushVCDIFF(src)
 	}
 
+	d.dw = NewDeltaWriter(d.outer)
+
 	for _, ms := range d.mss {
 		switch ms.match {
 		case 1:
 			if err = d.flushMatch(ms); err != nil {
-				panic(fmt.Sprintf("flushMatch failed: %s matchStat: %v", err.Error(), ms))
-				return
+				return fmt.Errorf("flushMatch failed: %s matchStat: %v", err.Error(), ms)
 			}
 		case -1:
 			if err = d.flushMiss(ms, src); err != nil {
-				panic(fmt.Sprintf("flushMiss failed: %s: matchStat: %v", err.Error(), ms))
+				return fmt.Errorf("flushMiss failed: %s matchStat: %v", err.Error(), ms)
+			}
+		case 2:
+			if err = d.flushCopy(RS_OP_SELF_N1_N1, ms); err != nil {
+				return
+			}
+		case 3:
+			if err = d.flushRun(ms); err != nil {
 				return
 			}
 		default:
-			panic("ms.match should only be 1 or -1.")
+			return fmt.Errorf("unknown match kind %d: matchStat: %v", ms.match, ms)
 		}
 	}
-	// todo: delta文件结尾
-	return nil
+	// delta文件结尾
+	if d.trailer {
+		return d.flushTrailer(src)
+	}
+	return d.dw.Close()
 }
 
 func int64Length(i uint64) uint8 {
@@ -390,42 +524,18 @@ func intLength(i uint32) uint8 {
 // pos:    变长，1,2,4,8字节，根据cmd决定
 // length: 变长：1,2,4,8字节，根据cmd决定
 func (d *delta) flushMatch(ms matchStat) (err error) {
-	var (
-		cmd uint8
-		buf []byte
-	)
+	if d.multi != nil {
+		return d.flushMultiMatch(ms)
+	}
+	return d.flushCopy(RS_OP_COPY_N1_N1, ms)
+}
 
-	whereBytes := int64Length(uint64(ms.pos))
-	lenBytes := int64Length(uint64(ms.length))
-	switch whereBytes {
-	case 8:
-		cmd = RS_OP_COPY_N8_N1
-	case 4:
-		cmd = RS_OP_COPY_N4_N1
-	case 2:
-		cmd = RS_OP_COPY_N2_N1
-	case 1:
-		cmd = RS_OP_COPY_N1_N1
-	}
-	switch lenBytes {
-	case 8:
-		cmd += 3
-	case 4:
-		cmd += 2
-	case 2:
-		cmd += 1
-	case 1:
-	}
-
-	buf = append(buf, byte(cmd))
-	buf = append(buf, vhtonll(uint64(ms.pos), int8(whereBytes))...)
-	buf = append(buf, vhtonll(uint64(ms.length), int8(lenBytes))...)
-
-	_, err = d.outer.Write(buf)
+// base: RS_OP_COPY_N1_N1或RS_OP_SELF_N1_N1
+func (d *delta) flushCopy(base uint8, ms matchStat) (err error) {
+	err = d.dw.copyCmd(base, ms.pos, ms.length)
 
 	if d.debug {
-		fmt.Printf("   flush Match [where=%d len=%d], buf length: %d\n",
-			ms.pos, ms.length, len(buf))
+		fmt.Printf("   flush Match(0x%x) [where=%d len=%d]\n", base, ms.pos, ms.length)
 	}
 	return
 }
@@ -435,61 +545,14 @@ func (d *delta) flushMatch(ms matchStat) (err error) {
 // 内容区:  变长，长度=length
 // 2015-08-10: todo: 数据压缩
 func (d *delta) flushMiss(ms matchStat, src io.ReadSeeker) (err error) {
-	var (
-		//n   int
-		ml  int64 // miss length
-		cmd uint8
-		hdr []byte
-		buf []byte
-		tmp []byte
-	)
-
-	bytes := int64Length(uint64(ms.length))
-	switch bytes {
-	case 8:
-		cmd = RS_OP_LITERAL_N8
-	case 4:
-		cmd = RS_OP_LITERAL_N4
-	case 2:
-		cmd = RS_OP_LITERAL_N2
-	case 1:
-		cmd = RS_OP_LITERAL_N1
-	}
-
-	// 写入miss block头部
-	hdr = append(hdr, byte(cmd))
-	hdr = append(hdr, vhtonll(uint64(ms.length), int8(bytes))...)
-	if _, err = d.outer.Write(hdr); err != nil {
-		return
-	}
 	if _, err = src.Seek(ms.pos, 0); err != nil {
 		err = errors.New("Seek failed: " + err.Error())
 		return
 	}
-
-	ml = ms.length
-	buf = make([]byte, 4096)
-	for err == nil && ml > 0 {
-		if ml >= 4096 {
-			tmp = buf[0:4096]
-			ml -= 4096
-		} else {
-			tmp = buf[0:ml]
-			ml = 0
-		}
-		// 不应该出现错误
-		_, err = src.Read(tmp)
-		if err != nil {
-			panic(fmt.Sprintf("pipe: read failed: expect %d, error: %s", len(tmp), err.Error()))
-		}
-		if _, err = d.outer.Write(tmp); err != nil {
-			return
-		}
-	}
+	err = d.dw.LiteralFrom(src, ms.length)
 
 	if d.debug {
-		fmt.Printf("   flush miss [where=%d len=%d], hdr len: %d miss len: %d\n",
-			ms.pos, ms.length, len(hdr), ms.length)
+		fmt.Printf("   flush miss [where=%d len=%d]\n", ms.pos, ms.length)
 	}
 	return
 }
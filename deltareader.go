@@ -0,0 +1,173 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+)
+
+// delta命令的类型
+type OpKind int
+
+const (
+	OpCopy    OpKind = opCopy    // 从basis复制
+	OpLiteral OpKind = opLiteral // 数据在delta中
+	OpSelf    OpKind = opSelf    // 从已经输出的数据中复制
+	OpRun     OpKind = opRun     // 重复的字节
+
+	OpMultiCopy OpKind = opMultiCopy // 从第Basis个basis文件复制
+)
+
+func (k OpKind) String() string {
+	switch k {
+	case OpCopy:
+		return "COPY"
+	case OpLiteral:
+		return "LITERAL"
+	case OpSelf:
+		return "SELF"
+	case OpRun:
+		return "RUN"
+	case OpMultiCopy:
+		return "MCOPY"
+	}
+	return fmt.Sprintf("OpKind(%d)", int(k))
+}
+
+// a delta command
+//
+//	Offset: COPY, MCOPY: offset in basis; SELF: offset in output; LITERAL and RUN: 0
+//	Length: output length of the command
+//	Data:   LITERAL: literal data (nil if DeltaReader.SkipData); RUN: the repeated byte
+//	Basis:  MCOPY: index of basis file
+type Op struct {
+	Kind   OpKind
+	Offset int64
+	Length int64
+	Data   []byte
+	Basis  int
+}
+
+// iterator of delta commands, VCDIFF delta is not supported
+type DeltaReader struct {
+	// 为true时跳过literal数据，Op.Data为nil
+	SkipData bool
+
+	rd        *countReader
+	magic     uint32
+	outputOff int64 // 下一个命令在输出中的位置
+	opOff     int64 // 上一个命令在delta中的位置
+	opOutput  int64 // 上一个命令在输出中的位置
+	stream    bool  // literal数据由调用者读取(Patch使用)
+	end       bool
+	endCmd    bool // 读到了结束命令，否则delta在命令之间被截断
+	trailer   *Trailer
+}
+
+// read delta header and return a command iterator
+func NewDeltaReader(rd io.Reader) (r *DeltaReader, err error) {
+	var magic uint32
+
+	if magic, err = ntohl(rd); err != nil {
+		return nil, fmt.Errorf("Read delta file magic failed: %s", err.Error())
+	}
+	if magic == VcdiffMagic || magic == VcdiffExtMagic {
+		return nil, errors.New("VCDIFF delta is not supported by DeltaReader")
+	}
+	if magic != DeltaMagic {
+		return nil, NotDeltaMagic
+	}
+	return newDeltaReader(rd, magic), nil
+}
+
+// magic已经被读取
+func newDeltaReader(rd io.Reader, magic uint32) *DeltaReader {
+	return &DeltaReader{rd: &countReader{rd: rd, off: 4}, magic: magic}
+}
+
+// magic of the delta
+func (r *DeltaReader) Magic() uint32 {
+	return r.magic
+}
+
+// offset in delta of the command returned by the last Next
+func (r *DeltaReader) DeltaOffset() int64 {
+	return r.opOff
+}
+
+// offset in output of the command returned by the last Next
+func (r *DeltaReader) OutputOffset() int64 {
+	return r.opOutput
+}
+
+// total output length of the commands read
+func (r *DeltaReader) OutputLength() int64 {
+	return r.outputOff
+}
+
+// trailer of the delta, nil if the delta has no trailer or the end is not reached
+func (r *DeltaReader) Trailer() *Trailer {
+	return r.trailer
+}
+
+// next command, io.EOF at the end of delta
+func (r *DeltaReader) Next() (op Op, err error) {
+	var c command
+
+	if r.end {
+		return op, io.EOF
+	}
+	r.opOff = r.rd.off
+	r.opOutput = r.outputOff
+	if c, err = readCommand(r.rd); err != nil {
+		return
+	}
+	if c.op == opEnd {
+		if c.trailer {
+			if r.trailer, err = readTrailer(r.rd); err != nil {
+				return
+			}
+		}
+		r.end = true
+		r.endCmd = !c.eof
+		return op, io.EOF
+	}
+
+	op.Kind = OpKind(c.op)
+	op.Length = int64(c.length)
+	switch c.op {
+	case opCopy, opSelf, opMultiCopy:
+		op.Offset = int64(c.where)
+		op.Basis = int(c.basis)
+		if c.op == opSelf && op.Offset >= r.outputOff {
+			return op, fmt.Errorf("invalid self copy: where=%d output=%d", c.where, r.outputOff)
+		}
+	case opRun:
+		op.Data = []byte{c.value}
+	case opLiteral:
+		if r.stream {
+			break
+		}
+		if r.SkipData {
+			_, err = io.CopyN(ioutil.Discard, r.rd, op.Length)
+		} else {
+			// 长度错误的delta不会一次分配很大的内存
+			var buf bytes.Buffer
+			if op.Length < 1<<20 {
+				buf.Grow(int(op.Length))
+			}
+			_, err = io.CopyN(&buf, r.rd, op.Length)
+			op.Data = buf.Bytes()
+		}
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		if err != nil {
+			return op, fmt.Errorf("read literal data failed: length=%d error=%s", op.Length, err.Error())
+		}
+	}
+	r.outputOff += op.Length
+	return
+}
@@ -0,0 +1,70 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDeltaReader(t *testing.T) {
+	basis := randBytes(29, 20000)
+	fresh := randBytes(30, 1000)
+	src := append([]byte{}, basis[5000:15000]...)
+	src = append(src, fresh...)
+	src = append(src, bytes.Repeat([]byte{9}, 3000)...)
+	src = append(src, fresh...)
+
+	sig, result := new(bytes.Buffer), new(bytes.Buffer)
+	if err := GenSign(bytes.NewReader(basis), int64(len(basis)), 500, sig); err != nil {
+		t.Fatal(err)
+	}
+	opts := &DeltaOptions{Basis: bytes.NewReader(basis), SelfCopy: true, RunLength: true}
+	if err := GenDeltaWith(sig, bytes.NewReader(src), int64(len(src)), result, opts); err != nil {
+		t.Fatal(err)
+	}
+	deltaLen := result.Len()
+
+	// 根据命令重新生成src
+	r, err := NewDeltaReader(result)
+	if err != nil {
+		t.Fatal("NewDeltaReader failed:", err)
+	}
+	var (
+		out   []byte
+		kinds = make(map[OpKind]int)
+	)
+	for {
+		op, err := r.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("DeltaReader.Next failed:", err)
+		}
+		if r.OutputOffset() != int64(len(out)) || r.DeltaOffset() < 4 || r.DeltaOffset() >= int64(deltaLen) {
+			t.Fatalf("DeltaReader offsets wrong: output=%d delta=%d", r.OutputOffset(), r.DeltaOffset())
+		}
+		kinds[op.Kind]++
+		switch op.Kind {
+		case OpCopy:
+			out = append(out, basis[op.Offset:op.Offset+op.Length]...)
+		case OpLiteral:
+			out = append(out, op.Data...)
+		case OpSelf:
+			for i := int64(0); i < op.Length; i++ {
+				out = append(out, out[op.Offset+i])
+			}
+		case OpRun:
+			out = append(out, bytes.Repeat(op.Data, int(op.Length))...)
+		}
+	}
+	if !bytes.Equal(out, src) || r.OutputLength() != int64(len(src)) {
+		t.Fatal("DeltaReader commands result not equal")
+	}
+	if kinds[OpCopy] == 0 || kinds[OpLiteral] == 0 || kinds[OpSelf] == 0 || kinds[OpRun] == 0 {
+		t.Fatalf("all kinds of commands should be read: %v", kinds)
+	}
+
+	if _, err = NewDeltaReader(bytes.NewReader(htonl(BlakeMagic))); err != NotDeltaMagic {
+		t.Fatal("NewDeltaReader should fail with signature magic:", err)
+	}
+}
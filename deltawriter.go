@@ -0,0 +1,203 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+)
+
+// writer of delta commands, the width of command parameters is chosen by value.
+// delta magic is written before the first command, Close writes the end command.
+type DeltaWriter struct {
+	w      io.Writer
+	header bool  // 是否已经写入magic
+	output int64 // 输出的长度
+	err    error
+}
+
+func NewDeltaWriter(w io.Writer) *DeltaWriter {
+	return &DeltaWriter{w: w}
+}
+
+// total output length of the commands written
+func (dw *DeltaWriter) OutputLength() int64 {
+	return dw.output
+}
+
+func (dw *DeltaWriter) write(p []byte) (err error) {
+	if dw.err != nil {
+		return dw.err
+	}
+	if !dw.header {
+		dw.header = true
+		if err = dw.write(htonl(DeltaMagic)); err != nil {
+			return
+		}
+	}
+	if _, err = dw.w.Write(p); err != nil {
+		dw.err = err
+	}
+	return
+}
+
+// copy n bytes from basis at off
+func (dw *DeltaWriter) Copy(off, n int64) error {
+	return dw.copyCmd(RS_OP_COPY_N1_N1, off, n)
+}
+
+// copy n bytes from the basis-th basis file at off, basis 0 is the same as Copy.
+// patched by PatchMulti
+//
+// cmd:    1字节
+// basis:  4字节
+// pos:    变长，1,2,4,8字节，根据cmd决定
+// length: 变长：1,2,4,8字节，根据cmd决定
+func (dw *DeltaWriter) CopyFrom(basis int, off, n int64) (err error) {
+	var buf []byte
+
+	if basis == 0 {
+		return dw.Copy(off, n)
+	}
+	if basis < 0 || int64(basis) > math.MaxUint32 || off < 0 || n < 0 {
+		return fmt.Errorf("invalid mcopy command: basis=%d where=%d length=%d", basis, off, n)
+	}
+	if n == 0 {
+		return
+	}
+
+	whereBytes := int64Length(uint64(off))
+	lenBytes := int64Length(uint64(n))
+	buf = append(buf, RS_OP_MCOPY_N1_N1+widthIndex(whereBytes)*4+widthIndex(lenBytes))
+	buf = append(buf, htonl(uint32(basis))...)
+	buf = append(buf, vhtonll(uint64(off), int8(whereBytes))...)
+	buf = append(buf, vhtonll(uint64(n), int8(lenBytes))...)
+	if err = dw.write(buf); err == nil {
+		dw.output += n
+	}
+	return
+}
+
+// copy n bytes from output at off, off should be less than current output length.
+// the source and destination may overlap
+func (dw *DeltaWriter) Self(off, n int64) error {
+	if off >= dw.output {
+		return fmt.Errorf("invalid self copy: where=%d output=%d", off, dw.output)
+	}
+	return dw.copyCmd(RS_OP_SELF_N1_N1, off, n)
+}
+
+// cmd:    1字节
+// pos:    变长，1,2,4,8字节，根据cmd决定
+// length: 变长：1,2,4,8字节，根据cmd决定
+// base: RS_OP_COPY_N1_N1或RS_OP_SELF_N1_N1
+func (dw *DeltaWriter) copyCmd(base uint8, off, n int64) (err error) {
+	var buf []byte
+
+	if off < 0 || n < 0 {
+		return fmt.Errorf("invalid copy command: where=%d length=%d", off, n)
+	}
+	if n == 0 {
+		return
+	}
+
+	whereBytes := int64Length(uint64(off))
+	lenBytes := int64Length(uint64(n))
+	cmd := base + widthIndex(whereBytes)*4 + widthIndex(lenBytes)
+
+	buf = append(buf, cmd)
+	buf = append(buf, vhtonll(uint64(off), int8(whereBytes))...)
+	buf = append(buf, vhtonll(uint64(n), int8(lenBytes))...)
+	if err = dw.write(buf); err == nil {
+		dw.output += n
+	}
+	return
+}
+
+// 参数长度1,2,4,8对应的序号
+func widthIndex(bytes uint8) uint8 {
+	switch bytes {
+	case 8:
+		return 3
+	case 4:
+		return 2
+	case 2:
+		return 1
+	}
+	return 0
+}
+
+// cmd:    1字节
+// length: 变长：1,2,4,8字节，根据cmd决定
+// value:  1字节
+func (dw *DeltaWriter) Run(value byte, n int64) (err error) {
+	var buf []byte
+
+	if n < 0 {
+		return fmt.Errorf("invalid run command: length=%d", n)
+	}
+	if n == 0 {
+		return
+	}
+
+	bytes := int64Length(uint64(n))
+	buf = append(buf, RS_OP_RUN_N1+widthIndex(bytes))
+	buf = append(buf, vhtonll(uint64(n), int8(bytes))...)
+	buf = append(buf, value)
+	if err = dw.write(buf); err == nil {
+		dw.output += n
+	}
+	return
+}
+
+// literal data
+func (dw *DeltaWriter) Literal(p []byte) error {
+	return dw.LiteralFrom(bytes.NewReader(p), int64(len(p)))
+}
+
+// literal data of n bytes read from rd
+//
+// cmd:    1字节
+// length: 变长：1,2,4,8字节，根据cmd决定
+// 内容区:  变长，长度=length
+func (dw *DeltaWriter) LiteralFrom(rd io.Reader, n int64) (err error) {
+	var (
+		hdr []byte
+		m   int64
+	)
+
+	if n < 0 {
+		return fmt.Errorf("invalid literal command: length=%d", n)
+	}
+	if n == 0 {
+		return
+	}
+
+	bytes := int64Length(uint64(n))
+	hdr = append(hdr, RS_OP_LITERAL_N1+widthIndex(bytes))
+	hdr = append(hdr, vhtonll(uint64(n), int8(bytes))...)
+	if err = dw.write(hdr); err != nil {
+		return
+	}
+	m, err = io.CopyN(dw.w, rd, n)
+	dw.output += m
+	if err != nil {
+		// literal数据不完整，delta已经损坏
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		dw.err = err
+	}
+	return
+}
+
+var errDeltaWriterClosed = errors.New("write to closed DeltaWriter")
+
+// write the end command, the underlying writer is not closed
+func (dw *DeltaWriter) Close() (err error) {
+	if err = dw.write([]byte{0}); err == nil {
+		dw.err = errDeltaWriterClosed
+	}
+	return
+}
@@ -0,0 +1,111 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDeltaWriter(t *testing.T) {
+	var (
+		basis  = randBytes(31, 70000)
+		result = new(bytes.Buffer)
+		merged = new(bytes.Buffer)
+		expect []byte
+	)
+
+	dw := NewDeltaWriter(result)
+	check := func(err error) {
+		if err != nil {
+			t.Fatal("DeltaWriter failed:", err)
+		}
+	}
+	check(dw.Copy(0x100, 0x10000))
+	expect = append(expect, basis[0x100:0x10100]...)
+	check(dw.Literal([]byte("hello")))
+	expect = append(expect, "hello"...)
+	check(dw.Run('z', 300))
+	expect = append(expect, bytes.Repeat([]byte{'z'}, 300)...)
+	check(dw.Self(int64(len(expect))-2, 10))
+	for i := 0; i < 10; i++ {
+		expect = append(expect, expect[len(expect)-2])
+	}
+	check(dw.Copy(5, 0))
+	if dw.Self(int64(len(expect)), 1) == nil {
+		t.Fatal("self copy from future output should fail")
+	}
+	if dw.OutputLength() != int64(len(expect)) {
+		t.Fatal("DeltaWriter output length wrong:", dw.OutputLength())
+	}
+	check(dw.Close())
+	if dw.Literal([]byte("x")) == nil {
+		t.Fatal("write to closed DeltaWriter should fail")
+	}
+
+	delta := result.Bytes()
+	// magic + copy(N2_N4)
+	if !bytes.Equal(delta[0:5], append(htonl(DeltaMagic), RS_OP_COPY_N2_N4)) || delta[len(delta)-1] != 0 {
+		t.Fatalf("DeltaWriter output wrong: % x", delta)
+	}
+	if err := Patch(bytes.NewReader(delta), bytes.NewReader(basis), merged); err != nil {
+		t.Fatal("Patch failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), expect) {
+		t.Fatal("DeltaWriter patch result not equal")
+	}
+
+	// DeltaReader读取的命令与写入的相同
+	dr, err := NewDeltaReader(bytes.NewReader(delta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ops []Op
+	for {
+		op, err := dr.Next()
+		if err == io.EOF {
+			break
+		}
+		check(err)
+		ops = append(ops, op)
+	}
+	if len(ops) != 4 || ops[0].Kind != OpCopy || ops[1].Kind != OpLiteral || string(ops[1].Data) != "hello" ||
+		ops[2].Kind != OpRun || ops[2].Data[0] != 'z' || ops[3].Kind != OpSelf || ops[3].Length != 10 {
+		t.Fatalf("DeltaReader commands wrong: %+v", ops)
+	}
+}
+
+// 写入n字节后出错
+type failWriter struct {
+	n int
+}
+
+func (w *failWriter) Write(p []byte) (int, error) {
+	if len(p) > w.n {
+		n := w.n
+		w.n = 0
+		return n, io.ErrClosedPipe
+	}
+	w.n -= len(p)
+	return len(p), nil
+}
+
+// 输出出错时GenDelta返回错误，不能panic
+func TestGenDeltaWriteError(t *testing.T) {
+	var (
+		basis = randBytes(33, 100000)
+		src   = append(append(append([]byte{}, basis[:40000]...), randBytes(34, 30000)...), basis[40000:]...)
+		sig   = new(bytes.Buffer)
+	)
+	if err := GenSign(bytes.NewReader(basis), int64(len(basis)), 1024, sig); err != nil {
+		t.Fatal(err)
+	}
+	for _, format := range []int{FormatRsync, FormatVCDIFF} {
+		for _, n := range []int{0, 3, 100, 20000} {
+			err := GenDeltaWith(bytes.NewReader(sig.Bytes()), bytes.NewReader(src), int64(len(src)),
+				&failWriter{n}, &DeltaOptions{Format: format})
+			if err == nil {
+				t.Fatal("GenDeltaWith should fail when write failed:", format, n)
+			}
+		}
+	}
+}
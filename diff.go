@@ -0,0 +1,208 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"io/ioutil"
+	"math"
+	"os"
+)
+
+// 两个文件都在本地时，直接生成delta，不需要先生成签名文件再LoadSign
+//
+// Diff在内存中对old文件建立索引：以较小的block为单位计算weak sum，weak sum相同的block
+// 组成hash链；查找时直接读取old文件比较字节，不需要计算strong sum。找到匹配后，
+// 再将匹配块向前后逐字节扩展。生成的delta与GenDelta的格式相同，可以直接用于Patch。
+
+const (
+	minDiffBlockLen uint32 = 16
+	maxDiffBlockLen uint32 = 1024
+	maxHashChain           = 64 // 每次查找最多比较的候选block数
+)
+
+// 内存中的block索引
+type hashIndex struct {
+	basis    io.ReaderAt
+	length   int64 // basis文件长度
+	blockLen int64
+	chains   map[uint32][]int64 // weak sum -> block index
+	buf      []byte
+}
+
+// generate delta from old file and new file directly
+//
+//	old: basis file
+//	new: new file, if it is an io.ReadSeeker, it is read from the beginning
+//	out: delta file writer
+func Diff(old io.ReaderAt, new io.Reader, out io.Writer) (err error) {
+	return DiffWith(old, new, out, nil)
+}
+
+// generate delta from old file and new file with options, opts may be nil
+// opts.Basis is ignored, old is always used as basis to extend matches
+func DiffWith(old io.ReaderAt, new io.Reader, out io.Writer, opts *DeltaOptions) (err error) {
+	var (
+		df     delta
+		src    io.ReadSeeker
+		srcLen int64
+		idx    *hashIndex
+	)
+
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+	if opts.Trailer && opts.Format == FormatVCDIFF {
+		return errVcdiffTrailer
+	}
+	if src, srcLen, err = seekableSource(new); err != nil {
+		err = errors.New("read new file failed: " + err.Error())
+		return
+	}
+	if idx, err = newHashIndex(old, opts.BlockLen); err != nil {
+		err = errors.New("index old file failed: " + err.Error())
+		return
+	}
+
+	df.debug = opts.Debug
+	df.format = opts.Format
+	df.trailer = opts.Trailer
+	df.basis = old
+	df.index = idx
+	df.blockLen = uint32(idx.blockLen)
+	df.outer = out
+	df.sig = &Signature{
+		flength:   idx.length,
+		count:     int((idx.length + idx.blockLen - 1) / idx.blockLen),
+		block_len: uint32(idx.blockLen),
+		magic:     BlakeMagic,
+	}
+
+	return df.generate(src, srcLen, opts)
+}
+
+// 将new转换为io.ReadSeeker，并得到其长度
+func seekableSource(new io.Reader) (src io.ReadSeeker, srcLen int64, err error) {
+	if rs, ok := new.(io.ReadSeeker); ok {
+		if srcLen, err = rs.Seek(0, 2); err != nil {
+			return
+		}
+		if _, err = rs.Seek(0, 0); err != nil {
+			return
+		}
+		src = rs
+		return
+	}
+
+	var buf []byte
+	if buf, err = ioutil.ReadAll(new); err != nil {
+		return
+	}
+	return bytes.NewReader(buf), int64(len(buf)), nil
+}
+
+// 获取io.ReaderAt的长度，未知时返回-1
+func readerAtSize(r io.ReaderAt) int64 {
+	switch v := r.(type) {
+	case interface {
+		Size() int64
+	}:
+		return v.Size()
+	case *os.File:
+		if fi, err := v.Stat(); err == nil {
+			return fi.Size()
+		}
+	}
+	return -1
+}
+
+// 根据文件长度选择block长度：sqrt(length)/4
+func diffBlockLen(length int64) uint32 {
+	if length < 0 {
+		return maxDiffBlockLen / 4
+	}
+	bl := uint32(math.Sqrt(float64(length)) / 4)
+	if bl < minDiffBlockLen {
+		bl = minDiffBlockLen
+	}
+	if bl > maxDiffBlockLen {
+		bl = maxDiffBlockLen
+	}
+	return bl
+}
+
+// 顺序读取old文件，建立weak sum索引
+func newHashIndex(old io.ReaderAt, blockLen uint32) (idx *hashIndex, err error) {
+	var n int
+
+	if blockLen == 0 {
+		blockLen = diffBlockLen(readerAtSize(old))
+	}
+	idx = &hashIndex{
+		basis:    old,
+		blockLen: int64(blockLen),
+		chains:   make(map[uint32][]int64),
+		buf:      make([]byte, blockLen),
+	}
+
+	rd := io.NewSectionReader(old, 0, math.MaxInt64)
+	buf := make([]byte, blockLen)
+	for i := int64(0); ; i++ {
+		n, err = io.ReadFull(rd, buf)
+		if n > 0 {
+			sum := weakSum(buf[0:n])
+			idx.chains[sum] = append(idx.chains[sum], i)
+			idx.length += int64(n)
+		}
+		if err != nil {
+			break
+		}
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		err = nil
+	}
+	return
+}
+
+// 在hash链中查找与p相同的block，直接比较basis文件中的字节
+func (idx *hashIndex) lookup(p []byte, pos int64, sum uint32) (matchAt int64) {
+	var minDist int64 = -1
+
+	matchAt = -1
+	chain, ok := idx.chains[sum]
+	if !ok {
+		return
+	}
+
+	// 优先检查相同位置的block
+	if pos%idx.blockLen == 0 && idx.equal(p, pos) {
+		return pos
+	}
+	for i, blk := range chain {
+		if i >= maxHashChain {
+			break
+		}
+		at := blk * idx.blockLen
+		if dist := abs(at - pos); (minDist < 0 || dist < minDist) && idx.equal(p, at) {
+			matchAt = at
+			minDist = dist
+		}
+	}
+	return
+}
+
+// basis文件at位置的block是否与p相同
+func (idx *hashIndex) equal(p []byte, at int64) bool {
+	l := idx.length - at
+	if l > idx.blockLen {
+		l = idx.blockLen
+	}
+	if l != int64(len(p)) {
+		return false
+	}
+	buf := idx.buf[0:l]
+	if n, _ := idx.basis.ReadAt(buf, at); n != len(buf) {
+		return false
+	}
+	return bytes.Equal(buf, p)
+}
@@ -0,0 +1,43 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestDiff(t *testing.T) {
+	for _, s1 := range ss {
+		for _, s2 := range chs {
+			for _, bl := range []uint32{1, 2, 5, 16} {
+				roundTrip(t, []byte(s1), []byte(s2), 0, &DeltaOptions{BlockLen: bl})
+				roundTrip(t, []byte(s2), []byte(s1), 0, &DeltaOptions{BlockLen: bl})
+			}
+		}
+	}
+
+	old := randBytes(3, 100000)
+	cur := append(append(append([]byte{}, old[0:40000]...), []byte("some new content")...), old[40100:]...)
+	cur[80000] ^= 0x55
+	if dl := roundTrip(t, old, cur, 0, nil); dl > 128 {
+		t.Fatalf("delta too large: %d", dl)
+	}
+
+	// new不是io.ReadSeeker
+	result := new(bytes.Buffer)
+	merged := new(bytes.Buffer)
+	pr, pw := io.Pipe()
+	go func() {
+		pw.Write(cur)
+		pw.Close()
+	}()
+	if err := Diff(bytes.NewReader(old), pr, result); err != nil {
+		t.Fatal("Diff failed:", err)
+	}
+	if err := Patch(result, bytes.NewReader(old), merged); err != nil {
+		t.Fatal("Patch failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), cur) {
+		t.Fatal("patch result not equal")
+	}
+}
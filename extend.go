@@ -0,0 +1,151 @@
+package rsync
+
+import (
+	"io"
+)
+
+// 匹配块扩展
+//
+// findMatch只能识别整块的匹配，当一个block中间有一个字节被修改时，整个block都会变成不匹配
+// 的literal数据。当basis文件在本地可读时(patch端，或者本地做delta)，可以将每个匹配块逐字节
+// 地向前、向后扩展到相邻的不匹配区域，直到字节不同为止；扩展后再合并相邻的匹配块。
+//
+// 扩展只修改matchStat的pos/length，delta文件格式不变。
+
+const extendBufSize = 4096
+
+// 将匹配块向前后扩展，并合并相邻的matchStat
+func (d *delta) extendMatches(src io.ReadSeeker) (err error) {
+	var (
+		n      int64
+		srcPos int64 // 当前matchStat在src中的位置
+	)
+
+	for i := 0; i < len(d.mss); i++ {
+		ms := &d.mss[i]
+		if ms.match != 1 {
+			srcPos += ms.length
+			continue
+		}
+
+		// 向前扩展到上一个不匹配区域
+		if i > 0 && d.mss[i-1].match == -1 {
+			prev := &d.mss[i-1]
+			max := prev.length
+			if ms.pos < max {
+				max = ms.pos
+			}
+			if n, err = d.matchBackward(src, ms.pos, srcPos, max); err != nil {
+				return
+			}
+			ms.pos -= n
+			ms.length += n
+			prev.length -= n
+			srcPos -= n
+		}
+
+		// 向后扩展到下一个不匹配区域
+		if i+1 < len(d.mss) && d.mss[i+1].match == -1 {
+			next := &d.mss[i+1]
+			max := next.length
+			if left := d.sig.flength - (ms.pos + ms.length); left < max {
+				max = left
+			}
+			if n, err = d.matchForward(src, ms.pos+ms.length, next.pos, max); err != nil {
+				return
+			}
+			ms.length += n
+			next.pos += n
+			next.length -= n
+		}
+		srcPos += ms.length
+	}
+
+	d.mss = mergeMatchStats(d.mss)
+	return
+}
+
+// 从basisPos和srcPos开始向后比较，返回相同字节的长度，最多比较max个字节
+func (d *delta) matchForward(src io.ReadSeeker, basisPos, srcPos, max int64) (n int64, err error) {
+	var (
+		bbuf [extendBufSize]byte
+		sbuf [extendBufSize]byte
+	)
+
+	for n < max {
+		l := max - n
+		if l > extendBufSize {
+			l = extendBufSize
+		}
+		if err = readBoth(d.basis, basisPos+n, bbuf[0:l], src, srcPos+n, sbuf[0:l]); err != nil {
+			return
+		}
+		for i := int64(0); i < l; i++ {
+			if bbuf[i] != sbuf[i] {
+				return n + i, nil
+			}
+		}
+		n += l
+	}
+	return
+}
+
+// 从basisPos和srcPos开始向前比较(不包括basisPos和srcPos)，返回相同字节的长度，最多比较max个字节
+func (d *delta) matchBackward(src io.ReadSeeker, basisPos, srcPos, max int64) (n int64, err error) {
+	var (
+		bbuf [extendBufSize]byte
+		sbuf [extendBufSize]byte
+	)
+
+	for n < max {
+		l := max - n
+		if l > extendBufSize {
+			l = extendBufSize
+		}
+		if err = readBoth(d.basis, basisPos-n-l, bbuf[0:l], src, srcPos-n-l, sbuf[0:l]); err != nil {
+			return
+		}
+		for i := l - 1; i >= 0; i-- {
+			if bbuf[i] != sbuf[i] {
+				return n + (l - 1 - i), nil
+			}
+		}
+		n += l
+	}
+	return
+}
+
+// 分别从basis和src的指定位置读满缓冲区
+func readBoth(basis io.ReaderAt, basisPos int64, bbuf []byte, src io.ReadSeeker, srcPos int64, sbuf []byte) (err error) {
+	var n int
+
+	if n, err = basis.ReadAt(bbuf, basisPos); n != len(bbuf) {
+		if err == nil || err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	if _, err = src.Seek(srcPos, 0); err != nil {
+		return
+	}
+	_, err = io.ReadFull(src, sbuf)
+	return
+}
+
+// 去掉长度为0的matchStat，合并相邻并且连续的matchStat
+func mergeMatchStats(mss []matchStat) (res []matchStat) {
+	for _, ms := range mss {
+		if ms.length == 0 {
+			continue
+		}
+		if l := len(res); l > 0 {
+			last := &res[l-1]
+			if last.match == ms.match && last.value == ms.value && last.pos+last.length == ms.pos {
+				last.length += ms.length
+				continue
+			}
+		}
+		res = append(res, ms)
+	}
+	return
+}
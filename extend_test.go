@@ -0,0 +1,36 @@
+package rsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestExtendMatches(t *testing.T) {
+	basis := randBytes(1, 10000)
+
+	// 修改中间一个字节
+	src := append([]byte{}, basis...)
+	src[5000] ^= 0xff
+	plain := roundTrip(t, basis, src, 1024, nil)
+	ext := roundTrip(t, basis, src, 1024, &DeltaOptions{Basis: bytes.NewReader(basis)})
+	if ext >= plain || ext > 64 {
+		t.Fatalf("extended delta should be smaller: plain=%d extend=%d", plain, ext)
+	}
+
+	// 插入和删除
+	src = append(append(append([]byte{}, basis[0:3000]...), []byte("inserted")...), basis[3100:]...)
+	plain = roundTrip(t, basis, src, 512, nil)
+	ext = roundTrip(t, basis, src, 512, &DeltaOptions{Basis: bytes.NewReader(basis)})
+	if ext >= plain {
+		t.Fatalf("extended delta should be smaller: plain=%d extend=%d", plain, ext)
+	}
+
+	// 完全不同及短数据
+	roundTrip(t, basis, randBytes(2, 3000), 256, &DeltaOptions{Basis: bytes.NewReader(basis)})
+	last := []byte(ss[len(ss)-1])
+	for _, s := range ss {
+		for _, bl := range []uint32{1, 2, 3, 7} {
+			roundTrip(t, last, []byte(s), bl, &DeltaOptions{Basis: bytes.NewReader(last)})
+		}
+	}
+}
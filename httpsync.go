@@ -0,0 +1,315 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/smtc/rollsum"
+)
+
+// 通过HTTP Range请求同步(类似zsync)
+//
+// 发布方用GenSign生成新文件的签名，作为控制文件与文件一起放在普通的web服务器上，例如file和file.sig。
+// 与GenDelta的方向相反，客户端在本地的旧文件中查找新文件的block：对旧文件的每个位置计算rolling
+// checksum，在签名中找到weak sum和strong sum都相同的block，这些block从旧文件复制，其余block合并为
+// 连续的区间，用Range请求从服务器下载。下载的每个block也用签名的strong sum校验，文件在发布签名后
+// 被修改时返回ErrChecksumMismatch。最后一个不完整的block只与旧文件的结尾比较。
+
+var (
+	// the server ignored the Range header
+	ErrRangeNotSupported = errors.New("server does not support range requests")
+)
+
+// 签名是下载的，不可信，block长度过大时查找会分配很大的内存
+const maxHTTPSyncBlockLen = 16 << 20
+
+// options of HTTPSync
+type HTTPSyncOptions struct {
+	Client *http.Client // default http.DefaultClient
+	Header http.Header  // extra headers of range requests
+}
+
+// statistics of HTTPSync
+type HTTPSyncStats struct {
+	Reused   int64 // bytes copied from the old file
+	Fetched  int64 // bytes downloaded by range requests
+	Requests int   // number of range requests
+}
+
+// build the file of url into out, with sig (signature of the file by GenSign) and the
+// local old file. Blocks found in old are copied, the others are fetched by HTTP range
+// requests. opts may be nil
+func HTTPSync(url string, sig io.Reader, old io.ReaderAt, oldLen int64, out io.Writer, opts *HTTPSyncOptions) (st *HTTPSyncStats, err error) {
+	var (
+		r      *SignReader
+		bs     BlockSum
+		weaks  = make(map[uint32][]int)
+		weak   []uint32
+		sums   [][]byte
+		have   []int64 // 每个block在旧文件中的位置，-1为需要下载
+		length int64
+	)
+
+	if opts == nil {
+		opts = &HTTPSyncOptions{}
+	}
+	if r, err = NewSignReader(sig); err != nil {
+		return
+	}
+	hdr := r.Header()
+	if hdr.Magic() != BlakeMagic {
+		return nil, fmt.Errorf("signature magic 0x%x not supported", hdr.Magic())
+	}
+	if hdr.BlockLen() == 0 || hdr.BlockLen() > maxHTTPSyncBlockLen {
+		return nil, fmt.Errorf("invalid signature block length: %d", hdr.BlockLen())
+	}
+	bl := int64(hdr.BlockLen())
+	if length = hdr.TotalLen(); length < 0 {
+		return nil, fmt.Errorf("invalid signature total length: %d", length)
+	}
+	for {
+		if bs, err = r.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		weaks[bs.Weak] = append(weaks[bs.Weak], len(sums))
+		weak = append(weak, bs.Weak)
+		sums = append(sums, bs.Strong)
+		have = append(have, -1)
+	}
+	err = nil
+	if int64(len(sums)) != (length+bl-1)/bl {
+		return nil, fmt.Errorf("signature has %d blocks, total length %d", len(sums), length)
+	}
+
+	hs := &httpSync{
+		url:    url,
+		opts:   opts,
+		sumLen: hdr.SumLen(),
+		blocks: sums,
+		weak:   weak,
+		weaks:  weaks,
+		have:   have,
+		bl:     bl,
+		length: length,
+		st:     &HTTPSyncStats{},
+	}
+	if old != nil && oldLen > 0 {
+		if err = hs.search(old, oldLen); err != nil {
+			return
+		}
+	}
+	if err = hs.assemble(old, out); err != nil {
+		return
+	}
+	return hs.st, nil
+}
+
+type httpSync struct {
+	url    string
+	opts   *HTTPSyncOptions
+	sumLen uint32
+	blocks [][]byte // strong sum
+	weak   []uint32
+	weaks  map[uint32][]int // weak sum -> block
+	have   []int64
+	bl     int64
+	length int64
+	st     *HTTPSyncStats
+}
+
+// block i的长度
+func (hs *httpSync) blockLen(i int) int64 {
+	if l := hs.length - int64(i)*hs.bl; l < hs.bl {
+		return l
+	}
+	return hs.bl
+}
+
+// 在旧文件中查找签名中的block
+func (hs *httpSync) search(old io.ReaderAt, oldLen int64) (err error) {
+	var (
+		rs     rollsum.Rollsum
+		bl     = int(hs.bl)
+		window = make([]byte, 2*bl) // 环形缓冲，window[k:k+bl]为当前block，后半部分是前半部分的副本
+		k      int
+		pos    int64
+		found  int
+	)
+
+	// 最后一个不完整的block与旧文件的结尾比较
+	if n := len(hs.blocks); n > 0 && hs.blockLen(n-1) < hs.bl {
+		l := hs.blockLen(n - 1)
+		if l <= oldLen {
+			p := make([]byte, l)
+			if _, err = old.ReadAt(p, oldLen-l); err != nil && err != io.EOF {
+				return
+			}
+			hs.check(n-1, p, oldLen-l)
+		}
+	}
+	if oldLen < hs.bl {
+		return nil
+	}
+
+	rd := bufio.NewReaderSize(io.NewSectionReader(old, 0, oldLen), 64<<10)
+	// 读取完整的block，重新计算rolling checksum
+	next := func() error {
+		if _, err := io.ReadFull(rd, window[:bl]); err != nil {
+			return err
+		}
+		copy(window[bl:], window[:bl])
+		k = 0
+		rs.Init()
+		rs.Update(window[:bl])
+		return nil
+	}
+	if err = next(); err != nil {
+		return
+	}
+	for found < len(hs.blocks) {
+		matched := false
+		if idx, ok := hs.weaks[rs.Digest()]; ok {
+			p := window[k : k+bl]
+			if hs.check(-1, p, pos, idx...) {
+				matched = true
+				found++
+			}
+		}
+		if matched {
+			// 匹配后跳过这个block
+			if pos+2*hs.bl > oldLen {
+				break
+			}
+			pos += hs.bl
+			if err = next(); err != nil {
+				return
+			}
+			continue
+		}
+		c, e := rd.ReadByte()
+		if e == io.EOF {
+			break
+		} else if e != nil {
+			return e
+		}
+		out := window[k]
+		window[k], window[k+bl] = c, c
+		k = (k + 1) % bl
+		pos++
+		rs.Rotate(out, c)
+	}
+	return nil
+}
+
+// p在旧文件的位置off，与block i(i为-1时为idx中的block)比较，记录匹配的block
+func (hs *httpSync) check(i int, p []byte, off int64, idx ...int) (ok bool) {
+	if i >= 0 {
+		idx = []int{i}
+		if weakSum(p) != hs.weak[i] {
+			return false
+		}
+	}
+	var ssum []byte
+	for _, j := range idx {
+		if hs.have[j] >= 0 || hs.blockLen(j) != int64(len(p)) {
+			continue
+		}
+		if ssum == nil {
+			ssum = strongSum(p, hs.sumLen)
+		}
+		if bytes.Equal(ssum, hs.blocks[j]) {
+			hs.have[j] = off
+			ok = true
+		}
+	}
+	return
+}
+
+// 按顺序写入block，连续的缺失block用一个Range请求下载
+func (hs *httpSync) assemble(old io.ReaderAt, out io.Writer) (err error) {
+	buf := make([]byte, hs.bl)
+	for i := 0; i < len(hs.blocks); {
+		if off := hs.have[i]; off >= 0 {
+			n := hs.blockLen(i)
+			if _, err = old.ReadAt(buf[:n], off); err != nil && err != io.EOF {
+				return
+			}
+			if _, err = out.Write(buf[:n]); err != nil {
+				return
+			}
+			hs.st.Reused += n
+			i++
+			continue
+		}
+		j := i + 1
+		for j < len(hs.blocks) && hs.have[j] < 0 {
+			j++
+		}
+		if err = hs.fetch(i, j, out); err != nil {
+			return
+		}
+		i = j
+	}
+	return nil
+}
+
+// 下载block [i, j)，校验每个block后写入out
+func (hs *httpSync) fetch(i, j int, out io.Writer) (err error) {
+	start := int64(i) * hs.bl
+	end := start
+	for k := i; k < j; k++ {
+		end += hs.blockLen(k)
+	}
+
+	req, err := http.NewRequest("GET", hs.url, nil)
+	if err != nil {
+		return
+	}
+	for k, v := range hs.opts.Header {
+		req.Header[k] = v
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=%d-%d", start, end-1))
+	client := hs.opts.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return
+	}
+	defer resp.Body.Close()
+	hs.st.Requests++
+	if resp.StatusCode == http.StatusOK {
+		return ErrRangeNotSupported
+	}
+	if resp.StatusCode != http.StatusPartialContent {
+		return fmt.Errorf("range request %s failed: %s", hs.url, resp.Status)
+	}
+	if cr := resp.Header.Get("Content-Range"); !strings.HasPrefix(cr, "bytes "+strconv.FormatInt(start, 10)+"-") {
+		return fmt.Errorf("unexpected Content-Range %q, expect bytes %d-%d", cr, start, end-1)
+	}
+
+	buf := make([]byte, hs.bl)
+	for k := i; k < j; k++ {
+		n := hs.blockLen(k)
+		if _, err = io.ReadFull(resp.Body, buf[:n]); err != nil {
+			return fmt.Errorf("read range of %s failed: %s", hs.url, err.Error())
+		}
+		if !bytes.Equal(strongSum(buf[:n], hs.sumLen), hs.blocks[k]) {
+			return fmt.Errorf("%w: block %d of %s", ErrChecksumMismatch, k, hs.url)
+		}
+		if _, err = out.Write(buf[:n]); err != nil {
+			return
+		}
+		hs.st.Fetched += n
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestHTTPSync(t *testing.T) {
+	old := randBytes(91, 200000)
+	// 新文件：开头插入数据，中间修改，结尾追加不完整的block
+	content := append([]byte("new header"), old[:80000]...)
+	content = append(content, randBytes(92, 3000)...)
+	content = append(content, old[83000:]...)
+	content = append(content, "tail"...)
+
+	var ranges []string
+	ts := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		ranges = append(ranges, r.Header.Get("Range"))
+		http.ServeContent(w, r, "file", time.Time{}, bytes.NewReader(content))
+	}))
+	defer ts.Close()
+
+	sig := new(bytes.Buffer)
+	if err := GenSign(bytes.NewReader(content), int64(len(content)), 1024, sig); err != nil {
+		t.Fatal(err)
+	}
+	out := new(bytes.Buffer)
+	st, err := HTTPSync(ts.URL, bytes.NewReader(sig.Bytes()), bytes.NewReader(old), int64(len(old)), out, nil)
+	if err != nil {
+		t.Fatal("HTTPSync failed:", err)
+	}
+	if !bytes.Equal(out.Bytes(), content) {
+		t.Fatal("HTTPSync result wrong")
+	}
+	if st.Reused+st.Fetched != int64(len(content)) || st.Fetched > 8*1024 || st.Requests != len(ranges) || st.Requests > 4 {
+		t.Fatalf("stats wrong: %+v %v", st, ranges)
+	}
+	if !strings.HasPrefix(ranges[0], "bytes=0-") {
+		t.Fatal("first block should be fetched:", ranges)
+	}
+
+	// 没有旧文件时下载整个文件
+	ranges = nil
+	out.Reset()
+	st, err = HTTPSync(ts.URL, bytes.NewReader(sig.Bytes()), nil, 0, out, nil)
+	if err != nil || !bytes.Equal(out.Bytes(), content) || st.Requests != 1 || st.Reused != 0 {
+		t.Fatal("HTTPSync without old file failed:", err, st)
+	}
+
+	// 签名发布后文件被修改
+	sig.Reset()
+	GenSign(bytes.NewReader(old), int64(len(old)), 1024, sig)
+	_, err = HTTPSync(ts.URL, bytes.NewReader(sig.Bytes()), nil, 0, new(bytes.Buffer), nil)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("changed file should fail:", err)
+	}
+
+	full := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Write(content)
+	}))
+	defer full.Close()
+	if _, err = HTTPSync(full.URL, bytes.NewReader(sig.Bytes()), nil, 0, new(bytes.Buffer), nil); err != ErrRangeNotSupported {
+		t.Fatal("server without range should fail:", err)
+	}
+
+	// 签名中的block长度过大
+	bad := append(append(htonl(BlakeMagic), htonl(1<<31)...), htonl(32)...)
+	bad = append(bad, Htonll(0)...)
+	_, err = HTTPSync(ts.URL, bytes.NewReader(bad), bytes.NewReader(old), int64(len(old)), new(bytes.Buffer), nil)
+	if err == nil || !strings.Contains(err.Error(), "block length") {
+		t.Fatal("huge block length should fail:", err)
+	}
+}
@@ -0,0 +1,247 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// 多个basis文件的签名
+//
+// 多个文件的签名加载到同一个索引中，新文件可以复用其中任何一个文件的block，例如目录树中
+// 被移动、合并或拆分的文件，容器镜像层中只有少量变化的文件。所有basis文件按加入的顺序依次
+// 排列在一个虚拟的地址空间中，genDelta在这个地址空间中查找和合并匹配块，生成delta时再按
+// 文件边界切分为复制命令：basis 0使用COPY命令，其他basis使用MCOPY命令。
+//
+// MCOPY命令：
+//   cmd:    1字节，RS_OP_MCOPY_N1_N1 ~ RS_OP_MCOPY_N8_N8，参数长度的编码与COPY相同
+//   basis:  4字节，basis文件的序号，从0开始
+//   where:  变长，basis文件中的位置
+//   length: 变长
+//
+// 包含MCOPY命令的delta只能用PatchMulti，Patch只能处理basis 0，PatchedReader等不支持。
+
+// signatures of several basis files in one lookup index
+type MultiSign struct {
+	blockLen uint32
+	sumLen   uint32
+	starts   []int64 // 每个basis文件在虚拟地址空间中的起点
+	lengths  []int64
+	total    int64
+	blocks   map[uint32][]multiBlock // weak sum -> blocks
+}
+
+type multiBlock struct {
+	ssum   []byte
+	off    int64 // 虚拟地址空间中的位置
+	length int   // 最后一个block可能小于blockLen
+}
+
+func NewMultiSign() *MultiSign {
+	return &MultiSign{blocks: make(map[uint32][]multiBlock)}
+}
+
+// load signatures, the i-th signature is basis i
+func LoadMultiSign(sigs ...io.Reader) (ms *MultiSign, err error) {
+	ms = NewMultiSign()
+	for i, sig := range sigs {
+		if _, err = ms.Add(sig); err != nil {
+			return nil, fmt.Errorf("load signature %d failed: %s", i, err.Error())
+		}
+	}
+	return
+}
+
+// add signature of the next basis file and return its basis index. all signatures
+// should have the same block length and strong sum length
+func (ms *MultiSign) Add(sig io.Reader) (n int, err error) {
+	var (
+		r     *SignReader
+		bs    BlockSum
+		weaks []uint32
+		sums  [][]byte
+	)
+
+	if r, err = NewSignReader(sig); err != nil {
+		return
+	}
+	hdr := r.Header()
+	if hdr.Magic() != BlakeMagic {
+		return 0, fmt.Errorf("signature magic 0x%x not supported", hdr.Magic())
+	}
+	if hdr.BlockLen() == 0 {
+		return 0, errors.New("invalid signature block length: 0")
+	}
+	if len(ms.starts) > 0 && (hdr.BlockLen() != ms.blockLen || hdr.SumLen() != ms.sumLen) {
+		return 0, fmt.Errorf("signature block length %d sum length %d, expect %d %d",
+			hdr.BlockLen(), hdr.SumLen(), ms.blockLen, ms.sumLen)
+	}
+	bl := int64(hdr.BlockLen())
+	length := hdr.TotalLen()
+	if length < 0 {
+		return 0, fmt.Errorf("invalid signature total length: %d", length)
+	}
+
+	// 先读取全部block，出错时不修改索引
+	for {
+		if bs, err = r.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		weaks = append(weaks, bs.Weak)
+		sums = append(sums, bs.Strong)
+	}
+	err = nil
+	if int64(len(weaks)) != (length+bl-1)/bl {
+		return 0, fmt.Errorf("signature has %d blocks, total length %d", len(weaks), length)
+	}
+
+	ms.blockLen = hdr.BlockLen()
+	ms.sumLen = hdr.SumLen()
+	for i, weak := range weaks {
+		off := int64(i) * bl
+		l := length - off
+		if l > bl {
+			l = bl
+		}
+		ms.blocks[weak] = append(ms.blocks[weak], multiBlock{ssum: sums[i], off: ms.total + off, length: int(l)})
+	}
+	n = len(ms.starts)
+	ms.starts = append(ms.starts, ms.total)
+	ms.lengths = append(ms.lengths, length)
+	ms.total += length
+	return
+}
+
+// number of basis files
+func (ms *MultiSign) Len() int {
+	return len(ms.starts)
+}
+
+// block length of the signatures
+func (ms *MultiSign) BlockLen() uint32 {
+	return ms.blockLen
+}
+
+// 虚拟地址pos所在的basis文件
+func (ms *MultiSign) basisAt(pos int64) int {
+	return sort.Search(len(ms.starts), func(i int) bool {
+		return ms.starts[i]+ms.lengths[i] > pos
+	})
+}
+
+// MultiSign的blockIndex，优先选择与上一个匹配块相邻的block，使匹配块可以合并
+type multiIndex struct {
+	ms *MultiSign
+	d  *delta
+}
+
+func (idx *multiIndex) lookup(p []byte, pos int64, sum uint32) (matchAt int64) {
+	matchAt = -1
+	blocks, ok := idx.ms.blocks[sum]
+	if !ok {
+		return
+	}
+	next := int64(-1)
+	if idx.d.ms.match == 1 {
+		next = idx.d.ms.pos + idx.d.ms.length
+	}
+	ssum := strongSum(p, idx.ms.sumLen)
+	for _, b := range blocks {
+		if b.length != len(p) || !bytes.Equal(b.ssum, ssum) {
+			continue
+		}
+		if b.off == next {
+			return next
+		}
+		if matchAt < 0 {
+			matchAt = b.off
+		}
+	}
+	return
+}
+
+// generate delta of src against all basis files in ms, opts may be nil.
+// opts.Basis is ignored, only FormatRsync is supported
+func GenDeltaMulti(ms *MultiSign, src io.ReadSeeker, srcLen int64, result io.Writer, opts *DeltaOptions) (err error) {
+	var df delta
+
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+	if opts.Format == FormatVCDIFF {
+		return errors.New("VCDIFF delta can not copy from multiple basis files")
+	}
+	if ms.Len() == 0 {
+		return errors.New("no basis signature")
+	}
+	df.debug = opts.Debug
+	df.format = opts.Format
+	df.trailer = opts.Trailer
+	df.multi = ms
+	df.index = &multiIndex{ms: ms, d: &df}
+	df.blockLen = ms.blockLen
+	df.outer = result
+	df.sig = &Signature{
+		flength:        ms.total,
+		block_len:      ms.blockLen,
+		strong_sum_len: ms.sumLen,
+		magic:          BlakeMagic,
+	}
+
+	return df.generate(src, srcLen, opts)
+}
+
+// 虚拟地址空间中的匹配块按basis文件的边界切分
+func (d *delta) flushMultiMatch(ms matchStat) (err error) {
+	pos, n := ms.pos, ms.length
+	for n > 0 {
+		i := d.multi.basisAt(pos)
+		if i >= d.multi.Len() {
+			return fmt.Errorf("match [%d, %d) out of basis files", pos, pos+n)
+		}
+		l := d.multi.starts[i] + d.multi.lengths[i] - pos
+		if l > n {
+			l = n
+		}
+		if err = d.dw.CopyFrom(i, pos-d.multi.starts[i], l); err != nil {
+			return
+		}
+		if d.debug {
+			fmt.Printf("   flush MultiMatch [basis=%d where=%d len=%d]\n", i, pos-d.multi.starts[i], l)
+		}
+		pos += l
+		n -= l
+	}
+	return
+}
+
+// patch delta with MCOPY commands, bases[i] is basis i. opts may be nil
+func PatchMulti(deltaRd io.Reader, bases []io.ReadSeeker, merged io.Writer, opts *PatchOptions) (err error) {
+	if len(bases) == 0 {
+		return errors.New("no basis file")
+	}
+	return patchWith(deltaRd, bases, merged, opts)
+}
+
+func errMultiCopy(basis uint32) error {
+	return fmt.Errorf("mcopy from basis %d is only supported by PatchMulti", basis)
+}
+
+// multi-basis signature of all files in tree signature, paths[i] is the path of basis i
+func (ts *TreeSign) MultiSign() (ms *MultiSign, paths []string, err error) {
+	ms = NewMultiSign()
+	for _, e := range ts.Entries {
+		if e.Type != TreeFile {
+			continue
+		}
+		if _, err = ms.Add(bytes.NewReader(e.Sign)); err != nil {
+			return nil, nil, fmt.Errorf("signature of %s: %s", e.Path, err.Error())
+		}
+		paths = append(paths, e.Path)
+	}
+	return
+}
@@ -0,0 +1,148 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestMultiSign(t *testing.T) {
+	var (
+		sigs   []io.Reader
+		bases  []io.ReadSeeker
+		result = new(bytes.Buffer)
+		merged = new(bytes.Buffer)
+	)
+
+	old := [][]byte{randBytes(1, 30000), randBytes(2, 20000), {}, randBytes(3, 40003)}
+	for _, b := range old {
+		sig := new(bytes.Buffer)
+		if err := GenSign(bytes.NewReader(b), int64(len(b)), 512, sig); err != nil {
+			t.Fatal("GenSign failed:", err)
+		}
+		sigs = append(sigs, sig)
+		bases = append(bases, bytes.NewReader(b))
+	}
+	ms, err := LoadMultiSign(sigs...)
+	if err != nil {
+		t.Fatal("LoadMultiSign failed:", err)
+	}
+	if ms.Len() != 4 || ms.BlockLen() != 512 {
+		t.Fatal("MultiSign wrong:", ms.Len(), ms.BlockLen())
+	}
+
+	// 新文件由各个basis文件的片段组成，包括跨越basis 0和basis 1边界的数据
+	var cur []byte
+	cur = append(cur, old[3][10000:20000]...)
+	cur = append(cur, "literal data"...)
+	cur = append(cur, old[0][25000:]...)
+	cur = append(cur, old[1][:8000]...)
+	cur = append(cur, old[3][39000:]...)
+	cur = append(cur, old[0][:4096]...)
+
+	err = GenDeltaMulti(ms, bytes.NewReader(cur), int64(len(cur)), result, &DeltaOptions{Trailer: true})
+	if err != nil {
+		t.Fatal("GenDeltaMulti failed:", err)
+	}
+	if result.Len() > 2048 {
+		t.Fatal("delta too large:", result.Len())
+	}
+	delta := result.Bytes()
+
+	// delta中有从basis 1和basis 3复制的命令
+	used := map[int]bool{}
+	dr, err := NewDeltaReader(bytes.NewReader(delta))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for {
+		op, err := dr.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("read delta failed:", err)
+		}
+		switch op.Kind {
+		case OpCopy:
+			used[0] = true
+		case OpMultiCopy:
+			used[op.Basis] = true
+		}
+	}
+	if !used[0] || !used[1] || !used[3] {
+		t.Fatal("delta should copy from basis 0, 1 and 3:", used)
+	}
+	if n, err := ValidateDelta(bytes.NewReader(delta), int64(len(old[0]))); err != nil || n != int64(len(cur)) {
+		t.Fatal("ValidateDelta failed:", n, err)
+	}
+
+	if err = PatchMulti(bytes.NewReader(delta), bases, merged, nil); err != nil {
+		t.Fatal("PatchMulti failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), cur) {
+		t.Fatal("PatchMulti result not equal")
+	}
+
+	// 只有basis 0时不能patch
+	if err = Patch(bytes.NewReader(delta), bytes.NewReader(old[0]), ioutil.Discard); err == nil {
+		t.Fatal("Patch should fail with mcopy from other basis")
+	}
+	if _, err = NewPatchedReader(bytes.NewReader(old[0]), bytes.NewReader(delta), int64(len(delta))); err == nil {
+		t.Fatal("PatchedReader should not support mcopy")
+	}
+
+	// block长度不同的签名不能加入
+	sig := new(bytes.Buffer)
+	GenSign(bytes.NewReader(old[0]), int64(len(old[0])), 256, sig)
+	if _, err = ms.Add(sig); err == nil || ms.Len() != 4 {
+		t.Fatal("signature of different block length should not be added")
+	}
+}
+
+func TestTreeMultiSign(t *testing.T) {
+	var sig, result, merged bytes.Buffer
+
+	dir, err := ioutil.TempDir("", "rsync-multisign-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	a, b := randBytes(4, 50000), randBytes(5, 30000)
+	os.Mkdir(filepath.Join(dir, "d"), 0755)
+	if err = ioutil.WriteFile(filepath.Join(dir, "a"), a, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(dir, "d/b"), b, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err = GenTreeSign(dir, 1024, &sig); err != nil {
+		t.Fatal("GenTreeSign failed:", err)
+	}
+	ts, err := LoadTreeSign(&sig)
+	if err != nil {
+		t.Fatal("LoadTreeSign failed:", err)
+	}
+	ms, paths, err := ts.MultiSign()
+	if err != nil || len(paths) != 2 || paths[0] != "a" || paths[1] != "d/b" {
+		t.Fatal("MultiSign of tree wrong:", paths, err)
+	}
+
+	// a和b合并为一个文件
+	cur := append(append([]byte{}, b...), a...)
+	if err = GenDeltaMulti(ms, bytes.NewReader(cur), int64(len(cur)), &result, nil); err != nil {
+		t.Fatal("GenDeltaMulti failed:", err)
+	}
+	// b最后不足一个block的数据不在src的结尾，是literal
+	if result.Len() > 512 {
+		t.Fatal("delta too large:", result.Len())
+	}
+	if err = PatchMulti(&result, []io.ReadSeeker{bytes.NewReader(a), bytes.NewReader(b)}, &merged, nil); err != nil {
+		t.Fatal("PatchMulti failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), cur) {
+		t.Fatal("PatchMulti result not equal")
+	}
+}
@@ -0,0 +1,11 @@
+//go:build windows || plan9
+// +build windows plan9
+
+package rsync
+
+import "os"
+
+// 不支持文件所有者
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	return
+}
@@ -0,0 +1,18 @@
+//go:build !windows && !plan9
+// +build !windows,!plan9
+
+package rsync
+
+import (
+	"os"
+	"syscall"
+)
+
+// 文件的所有者
+func fileOwner(fi os.FileInfo) (uid, gid int, ok bool) {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return
+	}
+	return int(st.Uid), int(st.Gid), true
+}
@@ -3,8 +3,12 @@ package rsync
 import (
 	"errors"
 	"fmt"
+	"hash"
 	"io"
+	"os"
 	//"log"
+
+	"github.com/dchest/blake2b"
 )
 
 var (
@@ -48,14 +52,36 @@ var (
 		RS_OP_LITERAL_N2: 2,
 		RS_OP_LITERAL_N4: 4,
 		RS_OP_LITERAL_N8: 8,
+
+		RS_OP_RUN_N1: 1,
+		RS_OP_RUN_N2: 2,
+		RS_OP_RUN_N4: 4,
+		RS_OP_RUN_N8: 8,
 	}
 	NotDeltaMagic = errors.New("Not delta file format: magic wrong")
 )
 
+func init() {
+	// self copy和mcopy命令的参数长度与copy命令相同
+	for i := uint8(0); i <= RS_OP_COPY_N8_N8-RS_OP_COPY_N1_N1; i++ {
+		whereBytes[RS_OP_SELF_N1_N1+i] = whereBytes[RS_OP_COPY_N1_N1+i]
+		lengthBytes[RS_OP_SELF_N1_N1+i] = lengthBytes[RS_OP_COPY_N1_N1+i]
+		whereBytes[RS_OP_MCOPY_N1_N1+i] = whereBytes[RS_OP_COPY_N1_N1+i]
+		lengthBytes[RS_OP_MCOPY_N1_N1+i] = lengthBytes[RS_OP_COPY_N1_N1+i]
+	}
+}
+
 type Patcher struct {
 	deltaRd io.Reader
 	target  io.ReadSeeker
+	bases   []io.ReadSeeker // PatchMulti的basis文件，bases[0]为target
 	merged  io.Writer
+	hist    *history // merged最近的数据，用于self copy
+	cp      *checkpointer
+	reverse bool        // 是否记录COPY命令
+	copies  []copyRange // 生成反向delta
+	sum     hash.Hash   // 输出的hash，与delta的trailer比较
+	vcdExt  bool        // open-vcdiff的扩展格式
 	debug   bool
 }
 
@@ -66,68 +92,175 @@ func PatchSelf(deltaRd io.Reader, target io.ReadWriteSeeker, args ...bool) (err
 	return
 }
 
+// patch选项
+type PatchOptions struct {
+	// merged为*os.File时，全为0的数据不写入，而是seek跳过(覆盖已有数据时punch hole)，
+	// 使输出文件为稀疏文件
+	Sparse bool
+	// checkpoint文件路径，设置后patch可以在中断后继续，见checkpoint.go
+	Checkpoint string
+	// 两次checkpoint之间输出的长度，0表示64M
+	CheckpointInterval int64
+	// 设置后，patch完成时写入反向delta(merged->target)，格式与delta相同，见reverse.go
+	// 不能与Checkpoint同时使用
+	Reverse io.Writer
+	Debug   bool
+}
+
 // 将差异merged文件
 // deltaRd: delta文件
 // target:  本地文件
 // merged:  合并后的文件
 func Patch(deltaRd io.Reader, target io.ReadSeeker, merged io.Writer, args ...bool) (err error) {
+	var opts PatchOptions
+
+	if len(args) > 0 {
+		opts.Debug = args[0]
+	}
+	return PatchWith(deltaRd, target, merged, &opts)
+}
+
+// patch with options, opts may be nil
+func PatchWith(deltaRd io.Reader, target io.ReadSeeker, merged io.Writer, opts *PatchOptions) (err error) {
+	return patchWith(deltaRd, []io.ReadSeeker{target}, merged, opts)
+}
+
+// bases[0]为target，其他basis文件只用于MCOPY命令
+func patchWith(deltaRd io.Reader, bases []io.ReadSeeker, merged io.Writer, opts *PatchOptions) (err error) {
 	var (
-		p      Patcher
-		cmd    uint8
-		wb     uint32
-		lb     uint32
-		magic  uint32
-		where  uint64
-		length uint64
+		p     Patcher
+		sw    *sparseWriter
+		cp    *checkpointer
+		magic uint32
 	)
 
+	if opts == nil {
+		opts = &PatchOptions{}
+	}
 	// delta文件头：magic字段
 	if magic, err = ntohl(deltaRd); err != nil {
 		return fmt.Errorf("Read delta file magic failed: %s", err.Error())
 	}
-	if magic != DeltaMagic {
+	if magic == VcdiffExtMagic {
+		p.vcdExt = true
+		magic = VcdiffMagic
+	}
+	if magic != VcdiffMagic && magic != DeltaMagic {
 		return NotDeltaMagic
 	}
 
-	if len(args) > 0 {
-		p.debug = args[0]
+	if opts.Reverse != nil && opts.Checkpoint != "" {
+		return errors.New("reverse delta can not be generated with checkpoint")
 	}
-	p.deltaRd = deltaRd
-	p.merged = merged
-	p.target = target
-	// 分析matchStat
-	for {
-		if cmd, err = readByte(deltaRd); err == io.EOF {
-			err = nil
-			break
+	f, isFile := merged.(*os.File)
+	if opts.Checkpoint != "" {
+		if magic == VcdiffMagic || !isFile {
+			return errors.New("checkpoint requires rsync delta and *os.File output")
 		}
-		if cmd == 0 { // delta的结束命令
-			break
+		// 如果checkpoint存在，delta和merged被seek到checkpoint的位置
+		if cp, err = newCheckpointer(deltaRd, f, opts); err != nil {
+			return
 		}
-		//log.Printf("Patch cmd: 0x%x\n", cmd)
-		if cmd >= RS_OP_COPY_N1_N1 && cmd <= RS_OP_COPY_N8_N8 {
-			wb = whereBytes[cmd]
-			lb = lengthBytes[cmd]
-			if where, length, err = matchParams(deltaRd, wb, lb); err != nil {
-				return
+		deltaRd = cp.delta
+	}
+	if isFile && opts.Sparse {
+		if sw, err = newSparseWriter(f); err != nil {
+			return
+		}
+		merged = sw
+	}
+	if cp != nil {
+		cp.w = merged
+		cp.sw = sw
+		merged = cp
+	}
+	if magic == DeltaMagic {
+		// delta结束时才知道是否有trailer，所以总是计算hash
+		if p.sum = blake2b.New512(); cp != nil {
+			p.sum = cp.sum
+		}
+		merged = io.MultiWriter(merged, p.sum)
+	}
+	p.debug = opts.Debug
+	p.deltaRd = deltaRd
+	p.hist = newHistory(merged)
+	p.merged = p.hist
+	p.target = bases[0]
+	p.bases = bases
+	p.cp = cp
+	p.reverse = opts.Reverse != nil
+	if cp != nil && cp.off > 0 {
+		p.hist.restore(cp.tail, cp.off)
+	}
+
+	if magic == VcdiffMagic {
+		err = p.patchVCDIFF()
+	} else {
+		err = p.patch()
+	}
+	if err == nil && sw != nil {
+		err = sw.finish()
+	}
+	if err == nil && cp != nil {
+		err = cp.done()
+	}
+	if err == nil && opts.Reverse != nil {
+		format := FormatRsync
+		if magic == VcdiffMagic {
+			format = FormatVCDIFF
+		}
+		err = genReverse(p.target, p.copies, p.hist.size, opts.Reverse, format)
+	}
+	return
+}
+
+// 已经读取了magic，处理所有的命令
+func (p *Patcher) patch() (err error) {
+	var op Op
+
+	// literal的数据由patchMiss读取
+	dr := newDeltaReader(p.deltaRd, DeltaMagic)
+	dr.stream = true
+	dr.outputOff = p.hist.size // 从checkpoint继续时不为0
+	p.deltaRd = dr.rd
+	for {
+		if op, err = dr.Next(); err == io.EOF { // delta的结束命令
+			if t := dr.Trailer(); t != nil {
+				return t.check(p.hist.size, p.sum.Sum(nil))
 			}
-			if err = p.patchMatch(where, length); err != nil {
-				return
+			return nil
+		} else if err != nil {
+			return
+		}
+		//log.Printf("Patch cmd: %v\n", op)
+		switch op.Kind {
+		case OpCopy:
+			p.recordCopy(op.Offset, op.Length, p.hist.size)
+			err = p.patchMatch(uint64(op.Offset), uint64(op.Length))
+		case OpMultiCopy:
+			if op.Basis >= len(p.bases) {
+				return fmt.Errorf("mcopy from basis %d, only %d basis files", op.Basis, len(p.bases))
 			}
-		} else if cmd >= RS_OP_LITERAL_N1 && cmd <= RS_OP_LITERAL_N8 {
-			lb = lengthBytes[cmd]
-			if length, err = vRead(deltaRd, lb); err != nil {
-				return
+			if op.Basis == 0 {
+				p.recordCopy(op.Offset, op.Length, p.hist.size)
 			}
-			if err = p.patchMiss(length); err != nil {
+			err = p.patchMatchFrom(p.bases[op.Basis], uint64(op.Offset), uint64(op.Length))
+		case OpSelf:
+			err = p.patchSelf(uint64(op.Offset), uint64(op.Length))
+		case OpRun:
+			err = p.patchRun(uint64(op.Length), op.Data[0])
+		case OpLiteral:
+			err = p.patchMiss(uint64(op.Length))
+		}
+		if err != nil {
+			return
+		}
+		if p.cp != nil {
+			if err = p.cp.check(); err != nil {
 				return
 			}
-		} else {
-			panic(fmt.Sprintf("invalid delta command: %d", cmd))
 		}
 	}
-
-	return
 }
 
 // 读取copy command的where和length参数
@@ -188,9 +321,14 @@ func pipe(r io.Reader, w io.Writer, l int64, debug bool) (err error) {
 
 // 处理match部分
 func (p *Patcher) patchMatch(where, length uint64) (err error) {
+	return p.patchMatchFrom(p.target, where, length)
+}
+
+// 从basis文件rs中复制
+func (p *Patcher) patchMatchFrom(rs io.ReadSeeker, where, length uint64) (err error) {
 	var offset int64
 
-	if offset, err = p.target.Seek(int64(where), 0); err != nil {
+	if offset, err = rs.Seek(int64(where), 0); err != nil {
 		err = fmt.Errorf("seek target failed: where=%d error=%s", where, err.Error())
 		return
 	}
@@ -198,7 +336,7 @@ func (p *Patcher) patchMatch(where, length uint64) (err error) {
 		return errors.New(fmt.Sprintf("should seek to %d but %d", where, offset))
 	}
 
-	err = pipe(p.target, p.merged, int64(length), p.debug)
+	err = pipe(rs, p.merged, int64(length), p.debug)
 	if err != nil {
 		err = fmt.Errorf("patch match failed: where=%d length=%d error=%s", where, length, err.Error())
 	}
@@ -214,3 +352,34 @@ func (p *Patcher) patchMiss(length uint64) (err error) {
 	}
 	return
 }
+
+// 处理self copy部分，从merged已经写入的数据中复制，源和目的可以重叠
+func (p *Patcher) patchSelf(where, length uint64) (err error) {
+	var (
+		l   int64
+		buf [4096]byte
+	)
+
+	for length > 0 {
+		// 重叠时，每次最多复制已经写入的部分
+		l = p.hist.size - int64(where)
+		if l > int64(len(buf)) {
+			l = int64(len(buf))
+		}
+		if uint64(l) > length {
+			l = int64(length)
+		}
+		if l <= 0 {
+			return fmt.Errorf("patch self failed: where=%d written=%d", where, p.hist.size)
+		}
+		if err = p.hist.readAt(buf[0:l], int64(where)); err != nil {
+			return
+		}
+		if _, err = p.merged.Write(buf[0:l]); err != nil {
+			return fmt.Errorf("patch self failed: where=%d length=%d error=%s", where, length, err.Error())
+		}
+		where += uint64(l)
+		length -= uint64(l)
+	}
+	return
+}
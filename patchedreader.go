@@ -0,0 +1,215 @@
+package rsync
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"sort"
+)
+
+// 不执行patch，直接读取patch之后的文件
+//
+// 创建时读取一次delta，建立命令在输出中的位置索引；读取时根据位置找到对应的命令，从basis
+// 或delta中读取数据。self copy从输出中已经读取的位置读取，重叠时只读取一个周期，其余的数据成倍复制。
+// 可以用于http.ServeContent等需要io.ReadSeeker的场合。
+
+// 输出中一个命令对应的区域
+type patchedCmd struct {
+	command
+	off  int64 // 在输出中的位置
+	data int64 // literal: 数据在delta中的位置
+}
+
+// random access reader of the file patched by delta
+type PatchedReader struct {
+	basis io.ReaderAt
+	delta io.ReaderAt
+	cmds  []patchedCmd
+	size  int64
+	off   int64 // Read和Seek的位置
+}
+
+// parse delta and build index. If delta has a trailer, the output length is checked
+// (ErrLengthMismatch), the checksum is not. VCDIFF delta is not supported
+//
+//	basis:    basis file
+//	delta:    delta file
+//	deltaLen: delta file length
+func NewPatchedReader(basis io.ReaderAt, delta io.ReaderAt, deltaLen int64) (r *PatchedReader, err error) {
+	var (
+		magic uint32
+		c     command
+	)
+
+	sr := io.NewSectionReader(delta, 0, deltaLen)
+	cr := &countReader{rd: bufio.NewReader(sr)}
+	if magic, err = ntohl(cr); err != nil {
+		return nil, fmt.Errorf("Read delta file magic failed: %s", err.Error())
+	}
+	if magic == VcdiffMagic || magic == VcdiffExtMagic {
+		return nil, errors.New("VCDIFF delta is not supported")
+	}
+	if magic != DeltaMagic {
+		return nil, NotDeltaMagic
+	}
+
+	r = &PatchedReader{basis: basis, delta: delta}
+	for {
+		if c, err = readCommand(cr); err != nil {
+			return nil, err
+		}
+		if c.op == opEnd {
+			// 不读取全部输出，只比较长度
+			if c.trailer {
+				var t *Trailer
+				if t, err = readTrailer(cr); err != nil {
+					return nil, err
+				}
+				if t.Length != r.size {
+					return nil, fmt.Errorf("%w: expect %d, got %d", ErrLengthMismatch, t.Length, r.size)
+				}
+			}
+			break
+		}
+		if c.op == opMultiCopy {
+			return nil, errMultiCopy(c.basis)
+		}
+		pc := patchedCmd{command: c, off: r.size}
+		if c.op == opSelf && int64(c.where) >= r.size {
+			return nil, fmt.Errorf("invalid self copy: where=%d output=%d", c.where, r.size)
+		}
+		if c.op == opLiteral {
+			// 跳过literal数据
+			pc.data = cr.off
+			if pc.data+int64(c.length) > deltaLen {
+				return nil, io.ErrUnexpectedEOF
+			}
+			cr.off += int64(c.length)
+			if _, err = sr.Seek(cr.off, 0); err != nil {
+				return
+			}
+			cr.rd = bufio.NewReader(sr)
+		}
+		if c.length > 0 {
+			r.cmds = append(r.cmds, pc)
+		}
+		r.size += int64(c.length)
+	}
+	return
+}
+
+// length of the patched file
+func (r *PatchedReader) Size() int64 {
+	return r.size
+}
+
+func (r *PatchedReader) ReadAt(p []byte, off int64) (n int, err error) {
+	if off < 0 {
+		return 0, errors.New("PatchedReader.ReadAt: negative offset")
+	}
+	if off >= r.size {
+		return 0, io.EOF
+	}
+	if rest := r.size - off; int64(len(p)) > rest {
+		p = p[0:rest]
+	}
+
+	// 第一个包含off的命令
+	i := sort.Search(len(r.cmds), func(i int) bool {
+		return r.cmds[i].off+int64(r.cmds[i].length) > off
+	})
+	for n < len(p) {
+		var m int
+
+		c := &r.cmds[i]
+		d := off - c.off // 在命令中的位置
+		q := p[n:]
+		if l := int64(c.length) - d; int64(len(q)) > l {
+			q = q[0:l]
+		}
+		switch c.op {
+		case opCopy:
+			m, err = readFullAt(r.basis, q, int64(c.where)+d)
+		case opLiteral:
+			m, err = readFullAt(r.delta, q, c.data+d)
+		case opRun:
+			for j := range q {
+				q[j] = c.value
+			}
+			m = len(q)
+		case opSelf:
+			dist := c.off - int64(c.where)
+			if dist >= int64(c.length) {
+				m, err = readFullAt(r, q, int64(c.where)+d)
+				break
+			}
+			// 重叠时输出以dist为周期，输出[c.off+d]与输出[where+d%dist]相同。先读取一个周期，
+			// 从where+d%dist开始，到c.off后回到where，其余的数据在q中成倍复制
+			period := q
+			if int64(len(period)) > dist {
+				period = period[0:dist]
+			}
+			d %= dist
+			l := dist - d
+			if int64(len(period)) < l {
+				l = int64(len(period))
+			}
+			if m, err = readFullAt(r, period[0:l], int64(c.where)+d); err == nil {
+				m, err = readFullAt(r, period[l:], int64(c.where))
+				m += int(l)
+			}
+			for err == nil && m < len(q) {
+				m += copy(q[m:], q[0:m])
+			}
+		}
+		n += m
+		off += int64(m)
+		if err != nil {
+			return
+		}
+		if off >= c.off+int64(c.length) {
+			i++
+		}
+	}
+	if off >= r.size {
+		err = io.EOF
+	}
+	return
+}
+
+func (r *PatchedReader) Read(p []byte) (n int, err error) {
+	n, err = r.ReadAt(p, r.off)
+	r.off += int64(n)
+	if err == io.EOF && n > 0 {
+		err = nil
+	}
+	return
+}
+
+func (r *PatchedReader) Seek(offset int64, whence int) (int64, error) {
+	switch whence {
+	case 0:
+	case 1:
+		offset += r.off
+	case 2:
+		offset += r.size
+	default:
+		return 0, errors.New("PatchedReader.Seek: invalid whence")
+	}
+	if offset < 0 {
+		return 0, errors.New("PatchedReader.Seek: negative position")
+	}
+	r.off = offset
+	return offset, nil
+}
+
+// 读取len(p)字节，不足时返回io.ErrUnexpectedEOF
+func readFullAt(rd io.ReaderAt, p []byte, off int64) (n int, err error) {
+	if n, err = rd.ReadAt(p, off); n == len(p) {
+		err = nil
+	} else if err == nil || err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
@@ -0,0 +1,114 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+)
+
+func testPatchedReader(t *testing.T, basis, src []byte, opts *DeltaOptions) {
+	var (
+		sig    = new(bytes.Buffer)
+		result = new(bytes.Buffer)
+	)
+
+	if err := GenSign(bytes.NewReader(basis), int64(len(basis)), 256, sig); err != nil {
+		t.Fatal("GenSign failed:", err)
+	}
+	if err := GenDeltaWith(sig, bytes.NewReader(src), int64(len(src)), result, opts); err != nil {
+		t.Fatal("GenDeltaWith failed:", err)
+	}
+	r, err := NewPatchedReader(bytes.NewReader(basis), bytes.NewReader(result.Bytes()), int64(result.Len()))
+	if err != nil {
+		t.Fatal("NewPatchedReader failed:", err)
+	}
+	if r.Size() != int64(len(src)) {
+		t.Fatalf("PatchedReader size %d, expect %d", r.Size(), len(src))
+	}
+
+	content, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(content, src) {
+		t.Fatalf("PatchedReader read all failed: %v opts=%+v", err, opts)
+	}
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 200 && len(src) > 0; i++ {
+		off := rnd.Int63n(int64(len(src)))
+		buf := make([]byte, rnd.Intn(3000)+1)
+		n, err := r.ReadAt(buf, off)
+		if end := off + int64(len(buf)); end > int64(len(src)) {
+			if err != io.EOF || n != len(src)-int(off) {
+				t.Fatalf("PatchedReader ReadAt at end: n=%d err=%v", n, err)
+			}
+		} else if n != len(buf) {
+			t.Fatalf("PatchedReader ReadAt failed: n=%d err=%v", n, err)
+		}
+		if !bytes.Equal(buf[0:n], src[off:off+int64(n)]) {
+			t.Fatalf("PatchedReader ReadAt(%d, %d) not equal: opts=%+v", off, len(buf), opts)
+		}
+	}
+
+	if pos, err := r.Seek(-10, 2); err != nil || pos != int64(len(src))-10 {
+		t.Fatal("PatchedReader Seek failed:", pos, err)
+	}
+	if content, err = ioutil.ReadAll(r); err != nil || !bytes.Equal(content, src[len(src)-10:]) {
+		t.Fatal("PatchedReader read after seek failed:", err)
+	}
+}
+
+func TestPatchedReader(t *testing.T) {
+	basis := randBytes(17, 30000)
+	fresh := randBytes(18, 2000)
+
+	src := append([]byte{}, basis[5000:15000]...)
+	src = append(src, fresh...)
+	src = append(src, bytes.Repeat([]byte{7}, 5000)...)
+	src = append(src, fresh...)
+	src = append(src, bytes.Repeat([]byte("xyz"), 1000)...)
+	src = append(src, basis[0:5000]...)
+
+	testPatchedReader(t, basis, src, nil)
+	testPatchedReader(t, basis, src, &DeltaOptions{SelfCopy: true, RunLength: true})
+	testPatchedReader(t, basis, src, &DeltaOptions{Basis: bytes.NewReader(basis), SelfCopy: true})
+
+	// 距离很短的重叠self copy，不会每个周期读取一次
+	result := new(bytes.Buffer)
+	dw := NewDeltaWriter(result)
+	dw.Literal([]byte("abc"))
+	dw.Self(1, 4<<20)
+	dw.Close()
+	src = append([]byte("a"), bytes.Repeat([]byte("bc"), 2<<20+1)...)
+	delta := &countReaderAt{ReaderAt: bytes.NewReader(result.Bytes())}
+	r, err := NewPatchedReader(bytes.NewReader(basis), delta, int64(result.Len()))
+	if err != nil {
+		t.Fatal("NewPatchedReader failed:", err)
+	}
+	for _, off := range []int64{0, 1, 2, 3, 1000, 1001, int64(len(src)) - 5} {
+		buf := make([]byte, len(src))
+		delta.n = 0
+		n, _ := r.ReadAt(buf, off)
+		if !bytes.Equal(buf[0:n], src[off:]) {
+			t.Fatal("PatchedReader overlap self copy wrong:", off)
+		}
+		if delta.n > 10 {
+			t.Fatal("PatchedReader overlap self copy reads too many times:", off, delta.n)
+		}
+	}
+
+	_, err = NewPatchedReader(bytes.NewReader(basis), bytes.NewReader([]byte("abcd")), 4)
+	if err != NotDeltaMagic {
+		t.Fatal("NewPatchedReader should fail with wrong magic:", err)
+	}
+}
+
+type countReaderAt struct {
+	io.ReaderAt
+	n int
+}
+
+func (r *countReaderAt) ReadAt(p []byte, off int64) (int, error) {
+	r.n++
+	return r.ReaderAt.ReadAt(p, off)
+}
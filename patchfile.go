@@ -0,0 +1,186 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+
+	"github.com/dchest/blake2b"
+)
+
+var (
+	ErrLengthMismatch   = errors.New("patch result length mismatch")
+	ErrChecksumMismatch = errors.New("patch result checksum mismatch")
+)
+
+// PatchFile选项
+type PatchFileOptions struct {
+	PatchOptions
+
+	// 直接写入destPath，不使用临时文件。destPath不能与basisPath是同一个文件
+	// 设置了Checkpoint并且checkpoint文件存在时，继续中断的patch。Checkpoint必须与Inplace一起使用
+	Inplace bool
+	// 期望的结果文件长度，nil表示不检查
+	Length *int64
+	// 期望的结果文件的blake2b-512校验和，为空时不检查
+	Checksum []byte
+
+	// 保留原文件的权限、所有者和修改时间。原文件为destPath，destPath不存在时为basisPath
+	// 不保留权限或没有原文件时，结果文件的权限为0644
+	PreserveMode  bool
+	PreserveOwner bool
+	PreserveTimes bool
+}
+
+// patch basis file with delta, the result is written to a temp file in the same directory
+// as destPath, and renamed to destPath after verified and synced.
+// destPath may be the same as basisPath. opts may be nil
+func PatchFile(basisPath string, deltaRd io.Reader, destPath string, opts *PatchFileOptions) (err error) {
+	var (
+		basis *os.File
+		out   *os.File
+		orig  os.FileInfo
+		bi    os.FileInfo
+		outFn string
+	)
+
+	if opts == nil {
+		opts = &PatchFileOptions{}
+	}
+	// 不是inplace时输出到新的临时文件，无法从checkpoint继续
+	if opts.Checkpoint != "" && !opts.Inplace {
+		return errors.New("patch file failed: checkpoint requires inplace")
+	}
+	if basis, err = os.Open(basisPath); err != nil {
+		return
+	}
+	defer basis.Close()
+	if bi, err = basis.Stat(); err != nil {
+		return
+	}
+
+	// 原文件，用于保留权限等属性
+	if orig, err = os.Stat(destPath); err == nil {
+		if opts.Inplace && os.SameFile(orig, bi) {
+			return fmt.Errorf("patch inplace failed: %s is the basis file", destPath)
+		}
+	} else if os.IsNotExist(err) {
+		orig = bi
+	} else {
+		return
+	}
+
+	if opts.Inplace {
+		flag := os.O_CREATE | os.O_TRUNC | os.O_RDWR
+		// 继续中断的patch，保留已经输出的数据
+		if _, e := os.Stat(opts.Checkpoint); opts.Checkpoint != "" && e == nil {
+			flag &^= os.O_TRUNC
+		}
+		if out, err = os.OpenFile(destPath, flag, 0644); err != nil {
+			return
+		}
+	} else {
+		dir, base := filepath.Split(destPath)
+		if out, err = ioutil.TempFile(dir, "."+base+"."); err != nil {
+			return
+		}
+		// 出错时删除临时文件
+		defer func() {
+			if err != nil {
+				os.Remove(outFn)
+			}
+		}()
+	}
+	outFn = out.Name()
+	defer func() {
+		if out != nil {
+			out.Close()
+		}
+	}()
+
+	if err = PatchWith(deltaRd, basis, out, &opts.PatchOptions); err != nil {
+		return
+	}
+	if err = verifyFile(out, opts.Length, opts.Checksum); err != nil {
+		return
+	}
+	if err = preserveAttrs(out, orig, opts); err != nil {
+		return
+	}
+	if err = out.Sync(); err != nil {
+		return
+	}
+	err = out.Close()
+	out = nil
+	if err != nil {
+		return
+	}
+	// mtime在写入完成后设置
+	if opts.PreserveTimes {
+		if err = os.Chtimes(outFn, orig.ModTime(), orig.ModTime()); err != nil {
+			return
+		}
+	}
+	if opts.Inplace {
+		return
+	}
+
+	if err = os.Rename(outFn, destPath); err != nil {
+		return
+	}
+	syncDir(filepath.Dir(destPath))
+	return
+}
+
+// 检查结果文件的长度和校验和
+func verifyFile(f *os.File, length *int64, checksum []byte) (err error) {
+	var fi os.FileInfo
+
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	if length != nil && fi.Size() != *length {
+		return fmt.Errorf("%w: expect %d, got %d", ErrLengthMismatch, *length, fi.Size())
+	}
+	if len(checksum) == 0 {
+		return
+	}
+
+	h := blake2b.New512()
+	if _, err = io.Copy(h, io.NewSectionReader(f, 0, fi.Size())); err != nil {
+		return
+	}
+	if sum := h.Sum(nil); !bytes.Equal(sum, checksum) {
+		return fmt.Errorf("%w: expect %x, got %x", ErrChecksumMismatch, checksum, sum)
+	}
+	return
+}
+
+// 设置结果文件的权限和所有者
+func preserveAttrs(f *os.File, orig os.FileInfo, opts *PatchFileOptions) (err error) {
+	mode := os.FileMode(0644)
+	if opts.PreserveMode {
+		mode = orig.Mode().Perm()
+	}
+	if err = f.Chmod(mode); err != nil {
+		return
+	}
+	if opts.PreserveOwner {
+		if uid, gid, ok := fileOwner(orig); ok {
+			err = f.Chown(uid, gid)
+		}
+	}
+	return
+}
+
+// rename之后sync目录，出错时忽略
+func syncDir(dir string) {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+}
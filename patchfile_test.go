@@ -0,0 +1,102 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/dchest/blake2b"
+)
+
+func TestPatchFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-patchfile")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basis := randBytes(13, 50000)
+	src := append(append([]byte{}, basis[20000:]...), basis[0:10000]...)
+	src = append(src, randBytes(14, 3000)...)
+	fn := filepath.Join(dir, "file")
+	if err = ioutil.WriteFile(fn, basis, 0600); err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Unix(1400000000, 0)
+	os.Chtimes(fn, mtime, mtime)
+
+	sig, delta := new(bytes.Buffer), new(bytes.Buffer)
+	if err = GenSign(bytes.NewReader(basis), int64(len(basis)), 0, sig); err != nil {
+		t.Fatal(err)
+	}
+	if err = GenDelta(sig, bytes.NewReader(src), int64(len(src)), delta); err != nil {
+		t.Fatal(err)
+	}
+	sum := blake2b.Sum512(src)
+
+	// 校验失败时原文件不变，临时文件被删除
+	length := int64(len(src))
+	opts := &PatchFileOptions{Length: &length, Checksum: make([]byte, 64)}
+	err = PatchFile(fn, bytes.NewReader(delta.Bytes()), fn, opts)
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("PatchFile should fail with checksum mismatch:", err)
+	}
+	length++
+	err = PatchFile(fn, bytes.NewReader(delta.Bytes()), fn, opts)
+	if !errors.Is(err, ErrLengthMismatch) {
+		t.Fatal("PatchFile should fail with length mismatch:", err)
+	}
+	// 期望空文件
+	length = 0
+	if err = PatchFile(fn, bytes.NewReader(delta.Bytes()), fn, &PatchFileOptions{Length: &length}); !errors.Is(err, ErrLengthMismatch) {
+		t.Fatal("PatchFile should fail with length 0:", err)
+	}
+	// checkpoint只能与inplace一起使用
+	cp := &PatchFileOptions{PatchOptions: PatchOptions{Checkpoint: filepath.Join(dir, "checkpoint")}}
+	if err = PatchFile(fn, bytes.NewReader(delta.Bytes()), fn, cp); err == nil {
+		t.Fatal("PatchFile should fail with checkpoint but not inplace")
+	}
+	if content, _ := ioutil.ReadFile(fn); !bytes.Equal(content, basis) {
+		t.Fatal("basis file should not be changed")
+	}
+	if fis, _ := ioutil.ReadDir(dir); len(fis) != 1 {
+		t.Fatal("temp file should be removed:", len(fis))
+	}
+
+	// 原子替换basis文件
+	length = int64(len(src))
+	opts = &PatchFileOptions{Length: &length, Checksum: sum[:], PreserveMode: true, PreserveTimes: true}
+	if err = PatchFile(fn, bytes.NewReader(delta.Bytes()), fn, opts); err != nil {
+		t.Fatal("PatchFile failed:", err)
+	}
+	if content, _ := ioutil.ReadFile(fn); !bytes.Equal(content, src) {
+		t.Fatal("PatchFile result not equal")
+	}
+	fi, _ := os.Stat(fn)
+	if fi.Mode().Perm() != 0600 || !fi.ModTime().Equal(mtime) {
+		t.Fatalf("PatchFile should preserve mode and mtime: %v %v", fi.Mode(), fi.ModTime())
+	}
+
+	// inplace
+	out := filepath.Join(dir, "out")
+	if err = PatchFile(fn, bytes.NewReader(delta.Bytes()), fn, &PatchFileOptions{Inplace: true}); err == nil {
+		t.Fatal("PatchFile inplace should fail when dest is basis")
+	}
+	delta.Reset()
+	if err = Diff(bytes.NewReader(src), bytes.NewReader(basis), delta); err != nil {
+		t.Fatal(err)
+	}
+	if err = PatchFile(fn, delta, out, &PatchFileOptions{Inplace: true}); err != nil {
+		t.Fatal("PatchFile inplace failed:", err)
+	}
+	if content, _ := ioutil.ReadFile(out); !bytes.Equal(content, basis) {
+		t.Fatal("PatchFile inplace result not equal")
+	}
+	if fi, _ = os.Stat(out); fi.Mode().Perm() != 0644 {
+		t.Fatal("PatchFile inplace mode:", fi.Mode())
+	}
+}
@@ -0,0 +1,130 @@
+package rsync
+
+import (
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+
+	"github.com/dchest/blake2b"
+)
+
+var errPatchReaderClosed = errors.New("read from closed PatchReader")
+
+// 在Read时执行patch，不需要io.Pipe和goroutine
+type patchReader struct {
+	delta io.Reader
+	basis io.ReaderAt
+	hist  *history  // 已经输出的数据，用于self copy
+	c     command   // 当前命令
+	done  uint64    // 当前命令已经输出的长度
+	magic bool      // 是否已经读取了magic
+	sum   hash.Hash // 输出的hash，与delta的trailer比较
+	err   error
+}
+
+// returns a reader of the patched file, the file is reconstructed lazily on Read.
+// errors in delta or basis are returned by the Read that hits them, and the trailer of delta
+// is checked by the last Read (ErrLengthMismatch or ErrChecksumMismatch).
+// Close does not close delta. VCDIFF delta is not supported
+func NewPatchReader(delta io.Reader, basis io.ReaderAt) io.ReadCloser {
+	return &patchReader{
+		delta: delta,
+		basis: basis,
+		hist:  newHistory(nil),
+		sum:   blake2b.New512(),
+	}
+}
+
+func (r *patchReader) Read(p []byte) (n int, err error) {
+	if r.err != nil {
+		return 0, r.err
+	}
+	if len(p) == 0 {
+		return
+	}
+	if n, err = r.read(p); err != nil {
+		r.err = err
+	}
+	return
+}
+
+// 读取当前命令的数据，当前命令结束时读取下一个命令
+func (r *patchReader) read(p []byte) (n int, err error) {
+	var magic uint32
+
+	if !r.magic {
+		if magic, err = ntohl(r.delta); err != nil {
+			return 0, fmt.Errorf("Read delta file magic failed: %s", err.Error())
+		}
+		if magic == VcdiffMagic || magic == VcdiffExtMagic {
+			return 0, errors.New("VCDIFF delta is not supported by PatchReader")
+		}
+		if magic != DeltaMagic {
+			return 0, NotDeltaMagic
+		}
+		r.magic = true
+	}
+
+	for r.done == r.c.length {
+		if r.c, err = readCommand(r.delta); err != nil {
+			return
+		}
+		if r.c.op == opEnd {
+			if r.c.trailer {
+				var t *Trailer
+				if t, err = readTrailer(r.delta); err == nil {
+					err = t.check(r.hist.size, r.sum.Sum(nil))
+				}
+				if err != nil {
+					return
+				}
+			}
+			return 0, io.EOF
+		}
+		if r.c.op == opMultiCopy {
+			return 0, errMultiCopy(r.c.basis)
+		}
+		r.done = 0
+	}
+
+	if rest := r.c.length - r.done; uint64(len(p)) > rest {
+		p = p[0:rest]
+	}
+	switch r.c.op {
+	case opCopy:
+		n, err = readFullAt(r.basis, p, int64(r.c.where+r.done))
+	case opLiteral:
+		n, err = io.ReadFull(r.delta, p)
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+	case opRun:
+		for i := range p {
+			p[i] = r.c.value
+		}
+		n = len(p)
+	case opSelf:
+		// 重叠时，每次最多读取已经输出的部分
+		where := int64(r.c.where + r.done)
+		if l := r.hist.size - where; int64(len(p)) > l {
+			p = p[0:l]
+		}
+		if len(p) == 0 {
+			return 0, fmt.Errorf("patch self failed: where=%d written=%d", where, r.hist.size)
+		}
+		if err = r.hist.readAt(p, where); err == nil {
+			n = len(p)
+		}
+	}
+	r.hist.record(p[0:n])
+	r.sum.Write(p[0:n])
+	r.done += uint64(n)
+	return
+}
+
+func (r *patchReader) Close() error {
+	r.err = errPatchReaderClosed
+	r.hist = nil
+	return nil
+}
@@ -0,0 +1,64 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"io/ioutil"
+	"testing"
+)
+
+func TestPatchReader(t *testing.T) {
+	basis := randBytes(19, 30000)
+	fresh := randBytes(20, 2000)
+
+	src := append([]byte{}, basis[5000:15000]...)
+	src = append(src, fresh...)
+	src = append(src, bytes.Repeat([]byte{7}, 5000)...)
+	src = append(src, fresh...)
+	src = append(src, bytes.Repeat([]byte("xyz"), 1000)...)
+	src = append(src, basis[0:5000]...)
+
+	sig, result := new(bytes.Buffer), new(bytes.Buffer)
+	if err := GenSign(bytes.NewReader(basis), int64(len(basis)), 256, sig); err != nil {
+		t.Fatal("GenSign failed:", err)
+	}
+	opts := &DeltaOptions{SelfCopy: true, RunLength: true}
+	if err := GenDeltaWith(sig, bytes.NewReader(src), int64(len(src)), result, opts); err != nil {
+		t.Fatal("GenDeltaWith failed:", err)
+	}
+	delta := result.Bytes()
+
+	r := NewPatchReader(bytes.NewReader(delta), bytes.NewReader(basis))
+	content, err := ioutil.ReadAll(r)
+	if err != nil || !bytes.Equal(content, src) {
+		t.Fatal("PatchReader result not equal:", err)
+	}
+	r.Close()
+	if _, err = r.Read(make([]byte, 1)); err == nil {
+		t.Fatal("read from closed PatchReader should fail")
+	}
+
+	// 小的buffer
+	r = NewPatchReader(bytes.NewReader(delta), bytes.NewReader(basis))
+	content = content[:0]
+	buf := make([]byte, 7)
+	for {
+		n, err := r.Read(buf)
+		content = append(content, buf[0:n]...)
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal("PatchReader read failed:", err)
+		}
+	}
+	if !bytes.Equal(content, src) {
+		t.Fatal("PatchReader result not equal with small buffer")
+	}
+
+	// delta不完整时，在读取到对应位置时返回错误
+	r = NewPatchReader(bytes.NewReader(delta[0:len(delta)-10]), bytes.NewReader(basis))
+	content, err = ioutil.ReadAll(r)
+	if err != io.ErrUnexpectedEOF || !bytes.Equal(content, src[0:len(content)]) {
+		t.Fatal("PatchReader should fail with truncated delta:", err)
+	}
+}
@@ -0,0 +1,722 @@
+package rsync
+
+import (
+	"bytes"
+	"compress/flate"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"io/ioutil"
+	"os"
+	"time"
+
+	"github.com/dchest/blake2b"
+)
+
+// 网络同步协议
+//
+// 在任意io.ReadWriter(TCP连接、ssh的stdin/stdout、测试中的net.Pipe)上同步文件：接收方发送basis
+// 文件的签名，发送方发送delta，接收方patch后回复输出的长度和hash。双方严格交替读写，连接不需要
+// 缓冲。
+//
+// 所有数据都以frame传输：
+//   type:   1字节
+//   length: 4字节，不超过maxFrameLen
+//   data:   length字节
+//
+// 握手：客户端发送frameHello，服务端回复frameHello，或者frameError后关闭连接。
+//   magic:    4字节，ProtocolMagic
+//   version:  4字节，客户端为支持的最高版本，服务端回复协商的版本
+//   blockLen: 4字节，签名的block长度，客户端为0时使用服务端的设置，都为0时使用默认值
+//   hashes:   1字节个数 + 每个(1字节长度 + 名称)，文件校验的hash算法，客户端按优先级排列，
+//             服务端回复选中的一个。签名和delta trailer总是使用blake2b
+//   compress: 格式与hashes相同，签名和delta数据的压缩方式
+//
+// 握手之后双方都可以发送文件，一个文件的过程：
+//   发送方 frameFile:  size 8字节 + mode 4字节 + mtime 8字节(unix纳秒) + 相对路径
+//   接收方 签名数据流，frameSkip(不需要更新)或者frameError(不能接收)
+//   发送方 delta数据流(带trailer)
+//   接收方 frameAck: 输出长度8字节 + hash，或者frameError(patch失败)
+// 发送方没有更多文件时发送frameDone。
+//
+// 数据流是一组frameData，以长度为0的frameData结束，压缩时整个数据流是一个压缩流。发送数据流的
+// 一方出错时发送frameError代替剩余的数据，这个文件失败，连接仍然可以继续使用。
+
+const (
+	ProtocolMagic   uint32 = 0x72730536
+	ProtocolVersion uint32 = 1
+
+	maxFrameLen = 1 << 20
+	chunkLen    = 64 << 10 // 数据流中frameData的长度
+)
+
+const (
+	frameHello uint8 = iota + 1
+	frameFile
+	frameData
+	frameSkip
+	frameAck
+	frameError
+	frameDone
+)
+
+const (
+	HashBlake2b = "blake2b"
+	HashSHA256  = "sha256"
+
+	CompressNone  = "none"
+	CompressFlate = "flate"
+)
+
+var (
+	// protocol errors wrap ErrProtocol
+	ErrProtocol = errors.New("sync protocol error")
+
+	supportedHashes   = []string{HashBlake2b, HashSHA256}
+	supportedCompress = []string{CompressFlate, CompressNone}
+)
+
+// error reported by the peer
+type RemoteError struct {
+	Msg string
+}
+
+func (e *RemoteError) Error() string {
+	return "remote: " + e.Msg
+}
+
+// protocol options, nil lists mean all supported algorithms
+type ProtocolOptions struct {
+	// 签名的block长度，客户端为0时使用服务端的设置
+	BlockLen uint32
+	// 支持的hash算法，客户端按优先级排列：HashBlake2b、HashSHA256
+	Hashes []string
+	// 支持的压缩方式，客户端按优先级排列：CompressFlate、CompressNone
+	Compress []string
+}
+
+// file announced by the sender
+type FileHeader struct {
+	Name    string // relative path, separated by /
+	Size    int64
+	Mode    os.FileMode
+	ModTime time.Time
+}
+
+// connection of sync protocol, after handshake both sides may send or receive files
+type Conn struct {
+	rw       io.ReadWriter
+	version  uint32
+	blockLen uint32
+	hash     string
+	compress string
+	sent     int64
+	received int64
+	file     *FileHeader // NextFile返回的文件，等待ReceiveFile或SkipFile
+}
+
+// 握手的参数
+type hello struct {
+	version  uint32
+	blockLen uint32
+	hashes   []string
+	compress []string
+}
+
+// client handshake: propose options and wait for the server's choice
+func NewClientConn(rw io.ReadWriter, opts *ProtocolOptions) (c *Conn, err error) {
+	var h hello
+
+	if opts == nil {
+		opts = &ProtocolOptions{}
+	}
+	c = &Conn{rw: rw}
+	err = c.writeHello(&hello{ProtocolVersion, opts.BlockLen, orDefault(opts.Hashes, supportedHashes),
+		orDefault(opts.Compress, supportedCompress)})
+	if err != nil {
+		return nil, err
+	}
+	if h, err = c.readHello(); err != nil {
+		return nil, err
+	}
+	if h.version == 0 || h.version > ProtocolVersion || len(h.hashes) != 1 || len(h.compress) != 1 ||
+		!contains(supportedHashes, h.hashes[0]) || !contains(supportedCompress, h.compress[0]) {
+		return nil, fmt.Errorf("%w: invalid server hello", ErrProtocol)
+	}
+	c.version, c.blockLen, c.hash, c.compress = h.version, h.blockLen, h.hashes[0], h.compress[0]
+	return
+}
+
+// server handshake: choose options from the client's proposal
+func NewServerConn(rw io.ReadWriter, opts *ProtocolOptions) (c *Conn, err error) {
+	var h hello
+
+	if opts == nil {
+		opts = &ProtocolOptions{}
+	}
+	c = &Conn{rw: rw}
+	if h, err = c.readHello(); err != nil {
+		return nil, err
+	}
+	c.version = h.version
+	if c.version > ProtocolVersion {
+		c.version = ProtocolVersion
+	}
+	if c.blockLen = h.blockLen; c.blockLen == 0 {
+		c.blockLen = opts.BlockLen
+	}
+	c.hash = choose(h.hashes, orDefault(opts.Hashes, supportedHashes), supportedHashes)
+	c.compress = choose(h.compress, orDefault(opts.Compress, supportedCompress), supportedCompress)
+
+	switch {
+	case c.version == 0:
+		err = errors.New("unsupported protocol version 0")
+	case c.hash == "":
+		err = fmt.Errorf("no common hash algorithm in %v", h.hashes)
+	case c.compress == "":
+		err = fmt.Errorf("no common compression in %v", h.compress)
+	}
+	if err != nil {
+		c.writeFrame(frameError, []byte(err.Error()))
+		return nil, fmt.Errorf("%w: %s", ErrProtocol, err.Error())
+	}
+	if err = c.writeHello(&hello{c.version, c.blockLen, []string{c.hash}, []string{c.compress}}); err != nil {
+		return nil, err
+	}
+	return
+}
+
+// negotiated protocol version
+func (c *Conn) Version() uint32 {
+	return c.version
+}
+
+// negotiated signature block length, 0 means default
+func (c *Conn) BlockLen() uint32 {
+	return c.blockLen
+}
+
+// negotiated hash algorithm of file checksum
+func (c *Conn) Hash() string {
+	return c.hash
+}
+
+// negotiated compression of signature and delta
+func (c *Conn) Compression() string {
+	return c.compress
+}
+
+// bytes written to the connection
+func (c *Conn) BytesSent() int64 {
+	return c.sent
+}
+
+// bytes read from the connection
+func (c *Conn) BytesReceived() int64 {
+	return c.received
+}
+
+func orDefault(list, def []string) []string {
+	if len(list) == 0 {
+		return def
+	}
+	return list
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+// proposed中第一个本地允许并且支持的
+func choose(proposed, local, supported []string) string {
+	for _, s := range proposed {
+		if contains(local, s) && contains(supported, s) {
+			return s
+		}
+	}
+	return ""
+}
+
+func (c *Conn) writeHello(h *hello) error {
+	var buf []byte
+
+	buf = append(buf, htonl(ProtocolMagic)...)
+	buf = append(buf, htonl(h.version)...)
+	buf = append(buf, htonl(h.blockLen)...)
+	for _, list := range [][]string{h.hashes, h.compress} {
+		buf = append(buf, byte(len(list)))
+		for _, s := range list {
+			buf = append(buf, byte(len(s)))
+			buf = append(buf, s...)
+		}
+	}
+	return c.writeFrame(frameHello, buf)
+}
+
+func (c *Conn) readHello() (h hello, err error) {
+	var (
+		typ     uint8
+		payload []byte
+		magic   uint32
+	)
+
+	if typ, payload, err = c.readFrame(); err != nil {
+		return
+	}
+	if typ == frameError {
+		return h, &RemoteError{string(payload)}
+	}
+	if typ != frameHello {
+		return h, fmt.Errorf("%w: expect hello, got frame %d", ErrProtocol, typ)
+	}
+	rd := bytes.NewReader(payload)
+	if magic, err = ntohl(rd); err == nil && magic != ProtocolMagic {
+		return h, fmt.Errorf("%w: magic 0x%x", ErrProtocol, magic)
+	}
+	if err == nil {
+		if h.version, err = ntohl(rd); err == nil {
+			h.blockLen, err = ntohl(rd)
+		}
+	}
+	if err == nil {
+		if h.hashes, err = readNames(rd); err == nil {
+			h.compress, err = readNames(rd)
+		}
+	}
+	if err != nil {
+		err = fmt.Errorf("%w: invalid hello: %s", ErrProtocol, err.Error())
+	}
+	return
+}
+
+// 1字节个数 + 每个(1字节长度 + 名称)
+func readNames(rd io.Reader) (names []string, err error) {
+	var n, l uint8
+
+	if n, err = readByte(rd); err != nil {
+		return
+	}
+	for i := 0; i < int(n); i++ {
+		if l, err = readByte(rd); err != nil {
+			return
+		}
+		b := make([]byte, l)
+		if _, err = io.ReadFull(rd, b); err != nil {
+			return
+		}
+		names = append(names, string(b))
+	}
+	return
+}
+
+func (c *Conn) writeFrame(typ uint8, payload []byte) (err error) {
+	var n int
+
+	if len(payload) > maxFrameLen {
+		return fmt.Errorf("%w: frame too large: %d", ErrProtocol, len(payload))
+	}
+	buf := make([]byte, 0, 5+len(payload))
+	buf = append(buf, typ)
+	buf = append(buf, htonl(uint32(len(payload)))...)
+	buf = append(buf, payload...)
+	n, err = c.rw.Write(buf)
+	c.sent += int64(n)
+	return
+}
+
+func (c *Conn) readFrame() (typ uint8, payload []byte, err error) {
+	var (
+		hdr [5]byte
+		n   int
+	)
+
+	n, err = io.ReadFull(c.rw, hdr[:])
+	c.received += int64(n)
+	if err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	typ = hdr[0]
+	l := uint32(hdr[1])<<24 | uint32(hdr[2])<<16 | uint32(hdr[3])<<8 | uint32(hdr[4])
+	if l > maxFrameLen {
+		return 0, nil, fmt.Errorf("%w: frame too large: %d", ErrProtocol, l)
+	}
+	payload = make([]byte, l)
+	n, err = io.ReadFull(c.rw, payload)
+	c.received += int64(n)
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// 读取一个数据流，读取完成后必须调用drain
+type streamReader struct {
+	c   *Conn
+	buf []byte
+	err error
+}
+
+func (r *streamReader) Read(p []byte) (n int, err error) {
+	var (
+		typ     uint8
+		payload []byte
+	)
+
+	for len(r.buf) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		if typ, payload, err = r.c.readFrame(); err != nil {
+			r.err = err
+			continue
+		}
+		r.frame(typ, payload)
+	}
+	n = copy(p, r.buf)
+	r.buf = r.buf[n:]
+	return
+}
+
+func (r *streamReader) frame(typ uint8, payload []byte) {
+	switch {
+	case typ == frameData && len(payload) == 0:
+		r.err = io.EOF
+	case typ == frameData:
+		r.buf = payload
+	case typ == frameError:
+		r.err = &RemoteError{string(payload)}
+	default:
+		r.err = fmt.Errorf("%w: unexpected frame %d in data stream", ErrProtocol, typ)
+	}
+}
+
+// 读取到数据流结束，数据流正常结束时返回nil
+func (r *streamReader) drain() error {
+	if _, err := io.Copy(ioutil.Discard, r); err != nil {
+		return err
+	}
+	return nil
+}
+
+// 写入数据流，Close写入结束frame
+type streamWriter struct {
+	c   *Conn
+	buf []byte
+	err error // 连接的写错误
+}
+
+func (w *streamWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		if w.err != nil {
+			return n, w.err
+		}
+		m := chunkLen - len(w.buf)
+		if m > len(p) {
+			m = len(p)
+		}
+		w.buf = append(w.buf, p[:m]...)
+		p = p[m:]
+		n += m
+		if len(w.buf) == chunkLen {
+			w.flush()
+		}
+	}
+	return
+}
+
+func (w *streamWriter) flush() {
+	if len(w.buf) > 0 && w.err == nil {
+		w.err = w.c.writeFrame(frameData, w.buf)
+		w.buf = w.buf[:0]
+	}
+}
+
+func (w *streamWriter) Close() error {
+	w.flush()
+	if w.err == nil {
+		w.err = w.c.writeFrame(frameData, nil)
+	}
+	return w.err
+}
+
+// 写入数据流出错时，用frameError代替剩余的数据
+func (w *streamWriter) abort(err error) error {
+	if w.err != nil {
+		return w.err
+	}
+	w.buf = w.buf[:0]
+	w.err = w.c.writeFrame(frameError, []byte(err.Error()))
+	return w.err
+}
+
+// 压缩后写入数据流，返回的WriteCloser关闭时结束数据流
+func (c *Conn) newStream() (sw *streamWriter, wc io.WriteCloser) {
+	sw = &streamWriter{c: c}
+	if c.compress == CompressFlate {
+		fw, _ := flate.NewWriter(sw, flate.DefaultCompression)
+		return sw, &flateStream{fw, sw}
+	}
+	return sw, sw
+}
+
+type flateStream struct {
+	*flate.Writer
+	sw *streamWriter
+}
+
+func (f *flateStream) Close() error {
+	if err := f.Writer.Close(); err != nil {
+		return err
+	}
+	return f.sw.Close()
+}
+
+// 读取数据流，返回解压后的reader
+func (c *Conn) openStream(sr *streamReader) io.Reader {
+	if c.compress == CompressFlate {
+		return flate.NewReader(sr)
+	}
+	return sr
+}
+
+func (c *Conn) newHash() hash.Hash {
+	if c.hash == HashSHA256 {
+		return sha256.New()
+	}
+	return blake2b.New512()
+}
+
+func (h *FileHeader) bytes() (buf []byte) {
+	buf = append(buf, Htonll(uint64(h.Size))...)
+	buf = append(buf, htonl(uint32(h.Mode))...)
+	buf = append(buf, Htonll(uint64(h.ModTime.UnixNano()))...)
+	buf = append(buf, h.Name...)
+	return
+}
+
+// send file hdr.Name of hdr.Size bytes read from src. skipped is true if the receiver
+// does not need it. the receiver's checksum is verified, error is ErrLengthMismatch or
+// ErrChecksumMismatch if not matched, or *RemoteError if the receiver failed
+func (c *Conn) SendFile(hdr *FileHeader, src io.ReadSeeker) (skipped bool, err error) {
+	var (
+		typ     uint8
+		payload []byte
+		sig     bytes.Buffer
+		length  uint64
+	)
+
+	if hdr.Name, err = cleanTreePath(hdr.Name); err != nil {
+		return
+	}
+	if err = c.writeFrame(frameFile, hdr.bytes()); err != nil {
+		return
+	}
+
+	// 接收方回复签名或者frameSkip
+	if typ, payload, err = c.readFrame(); err != nil {
+		return
+	}
+	if typ == frameSkip {
+		return true, nil
+	}
+	sr := &streamReader{c: c}
+	sr.frame(typ, payload)
+	_, err = io.Copy(&sig, c.openStream(sr))
+	if e := sr.drain(); e != nil {
+		// 接收方出错或者连接断开，不再发送delta
+		return false, e
+	}
+	sw, wc := c.newStream()
+	if err != nil {
+		return false, sw.abort(fmt.Errorf("read signature failed: %s", err.Error()))
+	}
+
+	err = GenDeltaWith(&sig, src, hdr.Size, wc, &DeltaOptions{Trailer: true})
+	if err == nil {
+		err = wc.Close()
+	}
+	if sw.err != nil {
+		return false, sw.err
+	}
+	if err != nil {
+		if e := sw.abort(err); e != nil {
+			return false, e
+		}
+		return
+	}
+
+	// 接收方回复输出的长度和hash
+	if typ, payload, err = c.readFrame(); err != nil {
+		return
+	}
+	switch typ {
+	case frameAck:
+	case frameError:
+		return false, &RemoteError{string(payload)}
+	default:
+		return false, fmt.Errorf("%w: expect ack, got frame %d", ErrProtocol, typ)
+	}
+	if length, err = ntohll(bytes.NewReader(payload)); err != nil {
+		return false, fmt.Errorf("%w: invalid ack", ErrProtocol)
+	}
+	if int64(length) != hdr.Size {
+		return false, fmt.Errorf("%w: expect %d, remote %d", ErrLengthMismatch, hdr.Size, length)
+	}
+	return false, c.verify(src, hdr.Size, payload[8:])
+}
+
+// 重新读取src计算hash，与接收方的hash比较
+func (c *Conn) verify(src io.ReadSeeker, size int64, sum []byte) (err error) {
+	if _, err = src.Seek(0, 0); err != nil {
+		return
+	}
+	h := c.newHash()
+	if _, err = io.CopyN(h, src, size); err != nil {
+		return
+	}
+	if local := h.Sum(nil); !bytes.Equal(local, sum) {
+		return fmt.Errorf("%w: expect %x, remote %x", ErrChecksumMismatch, local, sum)
+	}
+	return
+}
+
+// no more files to send
+func (c *Conn) Done() error {
+	return c.writeFrame(frameDone, nil)
+}
+
+// wait for the next file from the sender, io.EOF when the sender is done.
+// the file should be received by ReceiveFile, skipped by SkipFile or rejected by RejectFile
+func (c *Conn) NextFile() (hdr *FileHeader, err error) {
+	var (
+		typ     uint8
+		payload []byte
+		size    uint64
+		mode    uint32
+		mtime   uint64
+	)
+
+	if c.file != nil {
+		return nil, errors.New("previous file is not received, skipped or rejected")
+	}
+	if typ, payload, err = c.readFrame(); err != nil {
+		return
+	}
+	switch typ {
+	case frameDone:
+		return nil, io.EOF
+	case frameError:
+		return nil, &RemoteError{string(payload)}
+	case frameFile:
+	default:
+		return nil, fmt.Errorf("%w: expect file, got frame %d", ErrProtocol, typ)
+	}
+	rd := bytes.NewReader(payload)
+	if size, err = ntohll(rd); err == nil {
+		if mode, err = ntohl(rd); err == nil {
+			mtime, err = ntohll(rd)
+		}
+	}
+	if err != nil || int64(size) < 0 {
+		return nil, fmt.Errorf("%w: invalid file header", ErrProtocol)
+	}
+	hdr = &FileHeader{
+		Size:    int64(size),
+		Mode:    os.FileMode(mode),
+		ModTime: time.Unix(0, int64(mtime)),
+	}
+	if hdr.Name, err = cleanTreePath(string(payload[20:])); err != nil {
+		return nil, fmt.Errorf("%w: %s", ErrProtocol, err.Error())
+	}
+	c.file = hdr
+	return
+}
+
+// tell the sender the file returned by NextFile is not needed
+func (c *Conn) SkipFile() error {
+	if c.file == nil {
+		return errors.New("no file to skip")
+	}
+	c.file = nil
+	return c.writeFrame(frameSkip, nil)
+}
+
+// tell the sender the file returned by NextFile can not be received, SendFile returns
+// *RemoteError of err
+func (c *Conn) RejectFile(err error) error {
+	if c.file == nil {
+		return errors.New("no file to reject")
+	}
+	c.file = nil
+	return c.writeFrame(frameError, []byte(err.Error()))
+}
+
+// receive the file returned by NextFile: send signature of basis (nil if there is no basis),
+// patch the delta to merged and acknowledge with the checksum of merged
+func (c *Conn) ReceiveFile(basis io.ReadSeeker, merged io.Writer) (err error) {
+	var basisLen int64
+
+	if c.file == nil {
+		return errors.New("no file to receive")
+	}
+	c.file = nil
+	if basis == nil {
+		basis = bytes.NewReader(nil)
+	}
+
+	sw, wc := c.newStream()
+	if basisLen, err = basis.Seek(0, 2); err == nil {
+		if _, err = basis.Seek(0, 0); err == nil {
+			err = GenSign(basis, basisLen, c.blockLen, wc)
+		}
+	}
+	if err == nil {
+		err = wc.Close()
+	}
+	if sw.err != nil {
+		return sw.err
+	}
+	if err != nil {
+		if e := sw.abort(err); e != nil {
+			return e
+		}
+		return
+	}
+
+	h := c.newHash()
+	cw := &countWriter{w: io.MultiWriter(merged, h)}
+	sr := &streamReader{c: c}
+	perr := PatchWith(c.openStream(sr), basis, cw, nil)
+	if err = sr.drain(); err != nil {
+		// 发送方出错或者连接断开，不回复
+		return
+	}
+	if perr != nil {
+		if err = c.writeFrame(frameError, []byte(perr.Error())); err != nil {
+			return
+		}
+		return perr
+	}
+	return c.writeFrame(frameAck, append(Htonll(uint64(cw.n)), h.Sum(nil)...))
+}
+
+type countWriter struct {
+	w io.Writer
+	n int64
+}
+
+func (cw *countWriter) Write(p []byte) (n int, err error) {
+	n, err = cw.w.Write(p)
+	cw.n += int64(n)
+	return
+}
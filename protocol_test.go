@@ -0,0 +1,195 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net"
+	"testing"
+	"time"
+)
+
+// 读取时出错的basis
+type badReader struct {
+	io.ReadSeeker
+}
+
+func (r badReader) Read(p []byte) (int, error) {
+	return 0, errors.New("bad basis")
+}
+
+func TestProtocol(t *testing.T) {
+	var (
+		old    = randBytes(1, 300000)
+		cur    = append(append(append([]byte{}, old[:100000]...), "changed"...), old[100000:]...)
+		added  = bytes.Repeat([]byte("new file "), 10000)
+		mtime  = time.Now().Truncate(time.Second)
+		server = make(chan error, 1)
+	)
+
+	for _, compress := range []string{CompressFlate, CompressNone} {
+		got := map[string][]byte{}
+		cc, sc := net.Pipe()
+		// 服务端接收文件
+		go func() {
+			var err error
+			defer func() { sc.Close(); server <- err }()
+			c, err := NewServerConn(sc, &ProtocolOptions{BlockLen: 1024})
+			if err != nil {
+				return
+			}
+			for {
+				var hdr *FileHeader
+				if hdr, err = c.NextFile(); err == io.EOF {
+					err = nil
+					return
+				} else if err != nil {
+					return
+				}
+				if !hdr.ModTime.Equal(mtime) || hdr.Mode != 0640 {
+					err = errors.New("file header wrong: " + hdr.Name)
+					return
+				}
+				merged := new(bytes.Buffer)
+				switch hdr.Name {
+				case "skip":
+					err = c.SkipFile()
+				case "reject":
+					err = c.RejectFile(errors.New("rejected"))
+				case "dir/big":
+					err = c.ReceiveFile(bytes.NewReader(old), merged)
+				case "bad":
+					if e := c.ReceiveFile(badReader{bytes.NewReader(old)}, merged); e == nil {
+						err = errors.New("ReceiveFile should fail with bad basis")
+					}
+				default:
+					err = c.ReceiveFile(nil, merged)
+				}
+				if err != nil {
+					return
+				}
+				got[hdr.Name] = merged.Bytes()
+			}
+		}()
+
+		c, err := NewClientConn(cc, &ProtocolOptions{Hashes: []string{HashSHA256, HashBlake2b}, Compress: []string{compress}})
+		if err != nil {
+			t.Fatal("client handshake failed:", err)
+		}
+		if c.Version() != ProtocolVersion || c.BlockLen() != 1024 || c.Hash() != HashSHA256 || c.Compression() != compress {
+			t.Fatal("negotiated options wrong:", c.Version(), c.BlockLen(), c.Hash(), c.Compression())
+		}
+		send := func(name string, data []byte) (bool, error) {
+			return c.SendFile(&FileHeader{name, int64(len(data)), 0640, mtime}, bytes.NewReader(data))
+		}
+		if skipped, err := send("dir/big", cur); err != nil || skipped {
+			t.Fatal("send dir/big failed:", skipped, err)
+		}
+		// 只发送签名和delta，远小于文件长度
+		if c.BytesSent() > 20000 {
+			t.Fatal("too many bytes sent:", c.BytesSent())
+		}
+		if skipped, err := send("added", added); err != nil || skipped {
+			t.Fatal("send added failed:", skipped, err)
+		}
+		if skipped, err := send("skip", added); err != nil || !skipped {
+			t.Fatal("send skip failed:", skipped, err)
+		}
+		// 接收方出错，连接可以继续使用
+		var re *RemoteError
+		if _, err := send("bad", cur); !errors.As(err, &re) {
+			t.Fatal("send bad should fail with remote error:", err)
+		}
+		if _, err := send("reject", cur); !errors.As(err, &re) || re.Msg != "rejected" {
+			t.Fatal("send reject should fail with remote error:", err)
+		}
+		if _, err := send("../escape", cur); err == nil {
+			t.Fatal("path out of tree should be rejected")
+		}
+		if skipped, err := send("empty", nil); err != nil || skipped {
+			t.Fatal("send empty file failed:", skipped, err)
+		}
+		if err = c.Done(); err != nil {
+			t.Fatal(err)
+		}
+		if err = <-server; err != nil {
+			t.Fatal("server failed:", err)
+		}
+		cc.Close()
+
+		if !bytes.Equal(got["dir/big"], cur) || !bytes.Equal(got["added"], added) || len(got["empty"]) != 0 {
+			t.Fatal("received files wrong")
+		}
+		if _, ok := got["skip"]; !ok {
+			t.Fatal("file not skipped")
+		}
+	}
+}
+
+func TestProtocolHandshake(t *testing.T) {
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	errc := make(chan error, 1)
+	go func() {
+		_, err := NewServerConn(sc, &ProtocolOptions{Compress: []string{CompressNone}})
+		sc.Close()
+		errc <- err
+	}()
+	_, err := NewClientConn(cc, &ProtocolOptions{Compress: []string{CompressFlate}})
+	var re *RemoteError
+	if !errors.As(err, &re) {
+		t.Fatal("client should get remote error:", err)
+	}
+	if err = <-errc; !errors.Is(err, ErrProtocol) {
+		t.Fatal("server should fail with ErrProtocol:", err)
+	}
+}
+
+// 写入n字节后断开的连接
+type brokenConn struct {
+	net.Conn
+	n int
+}
+
+func (c *brokenConn) Write(p []byte) (int, error) {
+	if len(p) > c.n {
+		c.Conn.Close()
+		return 0, io.ErrClosedPipe
+	}
+	c.n -= len(p)
+	return c.Conn.Write(p)
+}
+
+// 发送delta时连接断开，SendFile返回错误
+func TestProtocolBrokenConn(t *testing.T) {
+	var (
+		old    = randBytes(3, 100000)
+		cur    = randBytes(4, 300000)
+		server = make(chan error, 1)
+	)
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	go func() {
+		var err error
+		defer func() { sc.Close(); server <- err }()
+		c, err := NewServerConn(sc, nil)
+		if err != nil {
+			return
+		}
+		if _, err = c.NextFile(); err != nil {
+			return
+		}
+		err = c.ReceiveFile(bytes.NewReader(old), new(bytes.Buffer))
+	}()
+
+	c, err := NewClientConn(&brokenConn{cc, 50000}, &ProtocolOptions{Compress: []string{CompressNone}})
+	if err != nil {
+		t.Fatal("client handshake failed:", err)
+	}
+	if _, err = c.SendFile(&FileHeader{"file", int64(len(cur)), 0644, time.Now()}, bytes.NewReader(cur)); err == nil {
+		t.Fatal("SendFile should fail when connection is broken")
+	}
+	if err = <-server; err == nil {
+		t.Fatal("ReceiveFile should fail when connection is broken")
+	}
+}
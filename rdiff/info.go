@@ -0,0 +1,396 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+
+	"github.com/codegangsta/cli"
+	"github.com/smtc/rsync"
+)
+
+// 打开文件，根据magic判断文件类型
+func openByMagic(fn string) (f *os.File, magic uint32, err error) {
+	var buf [4]byte
+
+	if f, err = os.Open(fn); err != nil {
+		return
+	}
+	if _, err = io.ReadFull(f, buf[:]); err == nil {
+		_, err = f.Seek(0, 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, 0, err
+	}
+	magic = binary.BigEndian.Uint32(buf[:])
+	return
+}
+
+// rdiff info {file}
+func doInfo(c *cli.Context) {
+	var (
+		err   error
+		f     *os.File
+		magic uint32
+		fi    os.FileInfo
+	)
+
+	if len(c.Args()) != 1 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	fn := c.Args().First()
+	if f, magic, err = openByMagic(fn); err != nil {
+		fmt.Printf("open file %s failed: %v\n", fn, err)
+		return
+	}
+	defer f.Close()
+	if fi, err = f.Stat(); err != nil {
+		fmt.Printf("stat file %s failed: %v\n", fn, err)
+		return
+	}
+
+	switch magic {
+	case rsync.BlakeMagic, rsync.Md4Magic:
+		err = signInfo(f, fi.Size())
+	case rsync.DeltaMagic:
+		err = deltaInfo(f, fi.Size())
+	case rsync.TreeSignMagic:
+		err = treeSignInfo(f, fi.Size())
+	case rsync.VcdiffMagic, rsync.VcdiffExtMagic:
+		fmt.Printf("type:          VCDIFF delta\nlength:        %d\n", fi.Size())
+	default:
+		err = fmt.Errorf("unknown magic 0x%08x", magic)
+	}
+	if err != nil {
+		fmt.Printf("file %s: %v\n", fn, err)
+	}
+}
+
+func signInfo(f *os.File, size int64) (err error) {
+	var (
+		sr     *rsync.SignReader
+		blocks int
+	)
+
+	if sr, err = rsync.NewSignReader(f); err != nil {
+		return
+	}
+	for {
+		if _, err = sr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		blocks++
+	}
+	hdr := sr.Header()
+	fmt.Printf("type:          signature\n")
+	fmt.Printf("magic:         0x%08x\n", hdr.Magic())
+	fmt.Printf("length:        %d\n", size)
+	fmt.Printf("block length:  %d\n", hdr.BlockLen())
+	fmt.Printf("sum length:    %d\n", hdr.SumLen())
+	fmt.Printf("file length:   %d\n", hdr.TotalLen())
+	fmt.Printf("blocks:        %d\n", blocks)
+	return nil
+}
+
+func deltaInfo(f *os.File, size int64) (err error) {
+	var (
+		dr     *rsync.DeltaReader
+		op     rsync.Op
+		counts = make(map[rsync.OpKind]int64)
+		bytes  = make(map[rsync.OpKind]int64)
+	)
+
+	if dr, err = rsync.NewDeltaReader(f); err != nil {
+		return
+	}
+	dr.SkipData = true
+	for {
+		if op, err = dr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		counts[op.Kind]++
+		bytes[op.Kind] += op.Length
+	}
+	fmt.Printf("type:          delta\n")
+	fmt.Printf("magic:         0x%08x\n", dr.Magic())
+	fmt.Printf("length:        %d\n", size)
+	fmt.Printf("output length: %d\n", dr.OutputLength())
+	for _, kind := range []rsync.OpKind{rsync.OpCopy, rsync.OpMultiCopy, rsync.OpLiteral, rsync.OpSelf, rsync.OpRun} {
+		fmt.Printf("%-14s %d commands, %d bytes\n", kind.String()+":", counts[kind], bytes[kind])
+	}
+	return nil
+}
+
+func treeSignInfo(f *os.File, size int64) (err error) {
+	var (
+		tr     *rsync.TreeSignReader
+		e      *rsync.TreeEntry
+		counts = make(map[rsync.TreeEntryType]int)
+		total  int64
+	)
+
+	if tr, err = rsync.NewTreeSignReader(f); err != nil {
+		return
+	}
+	for {
+		if e, err = tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		counts[e.Type]++
+		total += e.Size
+	}
+	fmt.Printf("type:          tree signature\n")
+	fmt.Printf("length:        %d\n", size)
+	fmt.Printf("block length:  %d\n", tr.BlockLen())
+	fmt.Printf("files:         %d, %d bytes\n", counts[rsync.TreeFile], total)
+	fmt.Printf("dirs:          %d\n", counts[rsync.TreeDir])
+	fmt.Printf("symlinks:      %d\n", counts[rsync.TreeSymlink])
+	return nil
+}
+
+// rdiff dump [--json] {file}
+func doDump(c *cli.Context) {
+	var (
+		err   error
+		f     *os.File
+		magic uint32
+	)
+
+	if len(c.Args()) != 1 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	fn := c.Args().First()
+	if f, magic, err = openByMagic(fn); err != nil {
+		fmt.Printf("open file %s failed: %v\n", fn, err)
+		return
+	}
+	defer f.Close()
+
+	switch magic {
+	case rsync.BlakeMagic, rsync.Md4Magic:
+		err = dumpSign(f, os.Stdout, c.Bool("json"))
+	case rsync.DeltaMagic:
+		err = dumpDelta(f, os.Stdout, c.Bool("json"))
+	case rsync.TreeSignMagic:
+		err = dumpTreeSign(f, os.Stdout, c.Bool("json"))
+	default:
+		err = fmt.Errorf("unknown or unsupported magic 0x%08x", magic)
+	}
+	if err != nil {
+		fmt.Printf("\nfile %s: %v\n", fn, err)
+	}
+}
+
+// json输出时的signature block
+type jsonBlock struct {
+	Index  int    `json:"index"`
+	Weak   uint32 `json:"weak"`
+	Strong string `json:"strong"`
+}
+
+func dumpSign(rd io.Reader, w io.Writer, asJSON bool) (err error) {
+	var (
+		sr *rsync.SignReader
+		bs rsync.BlockSum
+	)
+
+	if sr, err = rsync.NewSignReader(rd); err != nil {
+		return
+	}
+	hdr := sr.Header()
+	if asJSON {
+		fmt.Fprintf(w, `{"type":"signature","magic":%d,"block_len":%d,"sum_len":%d,"total_len":%d,"blocks":[`,
+			hdr.Magic(), hdr.BlockLen(), hdr.SumLen(), hdr.TotalLen())
+	} else {
+		fmt.Fprintf(w, "signature: magic=0x%08x block_len=%d sum_len=%d total_len=%d\n",
+			hdr.Magic(), hdr.BlockLen(), hdr.SumLen(), hdr.TotalLen())
+	}
+	for {
+		if bs, err = sr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if asJSON {
+			if sr.Index() > 0 {
+				fmt.Fprint(w, ",")
+			}
+			b, _ := json.Marshal(jsonBlock{sr.Index(), bs.Weak, hex.EncodeToString(bs.Strong)})
+			w.Write(b)
+		} else {
+			fmt.Fprintf(w, "block %d: offset=%d weak=0x%08x strong=%x\n",
+				sr.Index(), int64(sr.Index())*int64(hdr.BlockLen()), bs.Weak, bs.Strong)
+		}
+	}
+	if asJSON {
+		fmt.Fprintln(w, "]}")
+	}
+	return nil
+}
+
+// json输出时的tree signature entry
+type jsonEntry struct {
+	Path    string `json:"path"`
+	Type    string `json:"type"`
+	Mode    uint32 `json:"mode"`
+	ModTime int64  `json:"mtime"`
+	Size    int64  `json:"size"`
+	Link    string `json:"link,omitempty"`
+}
+
+func dumpTreeSign(rd io.Reader, w io.Writer, asJSON bool) (err error) {
+	var (
+		tr *rsync.TreeSignReader
+		e  *rsync.TreeEntry
+		n  int
+	)
+
+	if tr, err = rsync.NewTreeSignReader(rd); err != nil {
+		return
+	}
+	if asJSON {
+		fmt.Fprintf(w, `{"type":"tree signature","block_len":%d,"entries":[`, tr.BlockLen())
+	} else {
+		fmt.Fprintf(w, "tree signature: block_len=%d\n", tr.BlockLen())
+	}
+	for ; ; n++ {
+		if e, err = tr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if asJSON {
+			if n > 0 {
+				fmt.Fprint(w, ",")
+			}
+			b, _ := json.Marshal(jsonEntry{e.Path, e.Type.String(), uint32(e.Mode), e.ModTime.Unix(), e.Size, e.Link})
+			w.Write(b)
+			continue
+		}
+		fmt.Fprintf(w, "%-8s %s %12d %s %s", e.Type, e.Mode, e.Size, e.ModTime.Format("2006-01-02 15:04:05"), e.Path)
+		if e.Type == rsync.TreeSymlink {
+			fmt.Fprintf(w, " -> %s", e.Link)
+		}
+		fmt.Fprintln(w)
+	}
+	if asJSON {
+		fmt.Fprintln(w, "]}")
+	}
+	return nil
+}
+
+// json输出时的delta命令
+type jsonOp struct {
+	DeltaOffset  int64  `json:"delta_offset"`
+	OutputOffset int64  `json:"output_offset"`
+	Kind         string `json:"kind"`
+	Offset       int64  `json:"offset"`
+	Length       int64  `json:"length"`
+	Value        *byte  `json:"value,omitempty"`
+	Basis        *int   `json:"basis,omitempty"`
+}
+
+func dumpDelta(rd io.Reader, w io.Writer, asJSON bool) (err error) {
+	var (
+		dr *rsync.DeltaReader
+		op rsync.Op
+		n  int
+	)
+
+	if dr, err = rsync.NewDeltaReader(rd); err != nil {
+		return
+	}
+	dr.SkipData = true
+	if asJSON {
+		fmt.Fprintf(w, `{"type":"delta","magic":%d,"commands":[`, dr.Magic())
+	} else {
+		fmt.Fprintf(w, "delta: magic=0x%08x\n", dr.Magic())
+		fmt.Fprintf(w, "%12s %12s  %-8s %12s %12s\n", "DELTA", "OUTPUT", "KIND", "OFFSET", "LENGTH")
+	}
+	for ; ; n++ {
+		if op, err = dr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		if asJSON {
+			jop := jsonOp{dr.DeltaOffset(), dr.OutputOffset(), op.Kind.String(), op.Offset, op.Length, nil, nil}
+			if op.Kind == rsync.OpRun {
+				jop.Value = &op.Data[0]
+			}
+			if op.Kind == rsync.OpMultiCopy {
+				jop.Basis = &op.Basis
+			}
+			if n > 0 {
+				fmt.Fprint(w, ",")
+			}
+			b, _ := json.Marshal(jop)
+			w.Write(b)
+			continue
+		}
+		fmt.Fprintf(w, "%12d %12d  %-8s %12d %12d", dr.DeltaOffset(), dr.OutputOffset(), op.Kind, op.Offset, op.Length)
+		if op.Kind == rsync.OpRun {
+			fmt.Fprintf(w, " value=0x%02x", op.Data[0])
+		}
+		if op.Kind == rsync.OpMultiCopy {
+			fmt.Fprintf(w, " basis=%d", op.Basis)
+		}
+		fmt.Fprintln(w)
+	}
+	if asJSON {
+		fmt.Fprintf(w, `],"output_length":%d}`+"\n", dr.OutputLength())
+	} else {
+		fmt.Fprintf(w, "output length: %d\n", dr.OutputLength())
+	}
+	return nil
+}
+
+// rdiff verify-delta [-l {basis_len}] {delta_file} [basis_file]
+func doVerifyDelta(c *cli.Context) {
+	var (
+		err       error
+		f         *os.File
+		fi        os.FileInfo
+		basisLen  int64
+		outputLen int64
+	)
+
+	args := len(c.Args())
+	if args < 1 || args > 2 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	fn := c.Args().First()
+	basisLen = int64(c.Int("basis-len"))
+	if args == 2 {
+		if fi, err = os.Stat(c.Args().Get(1)); err != nil {
+			fmt.Printf("stat basis file %s failed: %v\n", c.Args().Get(1), err)
+			return
+		}
+		basisLen = fi.Size()
+	}
+
+	if f, err = os.Open(fn); err != nil {
+		fmt.Printf("open delta file %s failed: %v\n", fn, err)
+		return
+	}
+	defer f.Close()
+
+	if outputLen, err = rsync.ValidateDelta(f, basisLen); err != nil {
+		fmt.Printf("delta %s: %v\n", fn, err)
+		os.Exit(1)
+	}
+	fmt.Printf("delta %s: ok, output length %d\n", fn, outputLen)
+}
@@ -4,7 +4,7 @@ import (
 	"path"
 	//"bytes"
 	"fmt"
-	//"io"
+	"io"
 	"os"
 
 	"github.com/codegangsta/cli"
@@ -28,8 +28,16 @@ func setupApp() *cli.App {
 	app.Name = "rdiff"
 	app.Version = version
 	app.Usage = "    signature [OPTIONS] BASIS [SIGNATURE]\n" +
+		"               signature-tree [OPTIONS] DIR [SIGNATURE]\n" +
 		"               delta [OPTIONS] SIGNATURE NEWFILE [DELTA]\n" +
-		"               patch [OPTIONS] BASIS DELTA [NEWFILE]\n"
+		"               delta-tree [OPTIONS] TREE-SIGNATURE NEWDIR [BUNDLE]\n" +
+		"               patch [OPTIONS] BASIS DELTA [NEWFILE]\n" +
+		"               patch-tree DIR BUNDLE\n" +
+		"               diff [OPTIONS] OLDFILE NEWFILE [DELTA]\n" +
+		"               compose [OPTIONS] DELTA1 DELTA2 [DELTA...]\n" +
+		"               info FILE\n" +
+		"               dump [OPTIONS] FILE\n" +
+		"               verify-delta [OPTIONS] DELTA [BASIS]\n"
 
 	app.Flags = []cli.Flag{
 		cli.BoolFlag{
@@ -50,7 +58,8 @@ func setupCommands(app *cli.App) {
 			Aliases: []string{"s"},
 			Usage: "Signature generate use blake2 algorithm\n" +
 				"     -b, --block-size=BYTES    Signature block size\n" +
-				"     -s, --sum-size=BYTES      Set signature strength\n",
+				"     -s, --sum-size=BYTES      Set signature strength\n" +
+				"     --sparse                  Skip reading holes of sparse basis file\n",
 			Flags: []cli.Flag{
 				cli.IntFlag{
 					Name:  "block-size,b",
@@ -62,27 +71,223 @@ func setupCommands(app *cli.App) {
 					Value: 32,
 					Usage: "Set signature strong checksum strength, 32 or 64",
 				},
+				cli.BoolFlag{
+					Name:  "sparse",
+					Usage: "Skip reading holes of sparse basis file",
+				},
 			},
 			Action: doSign,
 		},
+		{
+			Name: "signature-tree",
+			Usage: "Signature of every file in directory tree, with path, type, size, mode and mtime\n" +
+				"     -b, --block-size=BYTES    Signature block size\n",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "block-size,b",
+					Value: 2048,
+					Usage: "Set signature block size",
+				},
+			},
+			Action: doSignTree,
+		},
 		{
 			Name:    "delta",
 			Aliases: []string{"d"},
 			Usage: "Delta-encoding options:\n" +
 				"     -b, --block-size=BYTES    Signature block size\n" +
-				"     -s, --sum-size=BYTES      Set signature strength\n",
-
+				"     -s, --sum-size=BYTES      Set signature strength\n" +
+				"     --vcdiff                  Output VCDIFF (RFC 3284) delta\n" +
+				"     --self-copy               Copy repeated data from patched output\n" +
+				"     --run-length              Encode repeated bytes as RUN command\n" +
+				"     --sparse                  Encode holes of sparse file as RUN command\n" +
+				"     --trailer                 Append output length and checksum, verified by patch\n",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "vcdiff",
+					Usage: "Output VCDIFF (RFC 3284) delta",
+				},
+				cli.BoolFlag{
+					Name:  "self-copy",
+					Usage: "Copy repeated data from patched output",
+				},
+				cli.BoolFlag{
+					Name:  "run-length",
+					Usage: "Encode repeated bytes as RUN command",
+				},
+				cli.BoolFlag{
+					Name:  "sparse",
+					Usage: "Encode holes of sparse file as RUN command",
+				},
+				cli.BoolFlag{
+					Name:  "trailer",
+					Usage: "Append output length and checksum, verified by patch",
+				},
+			},
 			Action: doDelta,
 		},
+		{
+			Name: "delta-tree",
+			Usage: "Bundle of adds, deletes, renames, metadata changes and deltas from tree signature to NEWDIR\n" +
+				"     --compress                Compress new files\n" +
+				"     -c, --checksum            Compare files of the same size and mtime by signature\n",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "compress",
+					Usage: "Compress new files",
+				},
+				cli.BoolFlag{
+					Name:  "checksum,c",
+					Usage: "Compare files of the same size and mtime by signature",
+				},
+			},
+			Action: doDeltaTree,
+		},
 		{
 			Name:    "patch",
 			Aliases: []string{"p"},
 			Usage: "complete a task on the list\n" +
 				"     -b, --block-size=BYTES    Signature block size\n" +
-				"     -s, --sum-size=BYTES      Set signature strength\n",
-
+				"     -s, --sum-size=BYTES      Set signature strength\n" +
+				"     --sparse                  Write zero data as holes\n" +
+				"     --atomic                  Write to temp file and rename to NEWFILE (default)\n" +
+				"     --inplace                 Write to NEWFILE directly\n" +
+				"     --checkpoint=FILE         Save checkpoint to FILE, resume from it (with --inplace)\n" +
+				"     --reverse=FILE            Write reverse delta (NEWFILE->BASIS) to FILE\n",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "sparse",
+					Usage: "Write zero data as holes",
+				},
+				cli.BoolFlag{
+					Name:  "atomic",
+					Usage: "Write to temp file and rename to NEWFILE (default)",
+				},
+				cli.BoolFlag{
+					Name:  "inplace",
+					Usage: "Write to NEWFILE directly",
+				},
+				cli.StringFlag{
+					Name:  "checkpoint",
+					Usage: "Save checkpoint to FILE, resume from it (with --inplace)",
+				},
+				cli.StringFlag{
+					Name:  "reverse",
+					Usage: "Write reverse delta (NEWFILE->BASIS) to FILE",
+				},
+			},
 			Action: doPatch,
 		},
+		{
+			Name:   "patch-tree",
+			Usage:  "Apply bundle to directory tree, the tree is either unchanged or completely updated\n",
+			Action: doPatchTree,
+		},
+		{
+			Name: "diff",
+			Usage: "Delta generate from old file and new file directly, without signature\n" +
+				"     -b, --block-size=BYTES    Index block size, 0 means auto\n" +
+				"     --vcdiff                  Output VCDIFF (RFC 3284) delta\n" +
+				"     --self-copy               Copy repeated data from patched output\n" +
+				"     --run-length              Encode repeated bytes as RUN command\n" +
+				"     --trailer                 Append output length and checksum, verified by patch\n",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "block-size,b",
+					Value: 0,
+					Usage: "Set index block size, 0 means chosen by old file length",
+				},
+				cli.BoolFlag{
+					Name:  "vcdiff",
+					Usage: "Output VCDIFF (RFC 3284) delta",
+				},
+				cli.BoolFlag{
+					Name:  "self-copy",
+					Usage: "Copy repeated data from patched output",
+				},
+				cli.BoolFlag{
+					Name:  "run-length",
+					Usage: "Encode repeated bytes as RUN command",
+				},
+				cli.BoolFlag{
+					Name:  "trailer",
+					Usage: "Append output length and checksum, verified by patch",
+				},
+			},
+			Action: doDiff,
+		},
+		{
+			Name: "delta-multi",
+			Usage: "Delta of NEWFILE against several basis files, blocks are copied from any of them\n" +
+				"     SIGNATURE... are signatures of basis files in order, with the same block size\n" +
+				"     -o, --output=FILE         Delta file, default NEWFILE-delta\n" +
+				"     --trailer                 Append output length and checksum, verified by patch\n",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Delta file, default NEWFILE-delta",
+				},
+				cli.BoolFlag{
+					Name:  "trailer",
+					Usage: "Append output length and checksum, verified by patch",
+				},
+			},
+			Action: doDeltaMulti,
+		},
+		{
+			Name: "patch-multi",
+			Usage: "Patch delta generated by delta-multi, BASIS... in the same order as the signatures\n" +
+				"     -o, --output=FILE         Patched file, default BASIS1-patch\n",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Patched file, default BASIS1-patch",
+				},
+			},
+			Action: doPatchMulti,
+		},
+		{
+			Name: "compose",
+			Usage: "Compose a chain of deltas (v1->v2, v2->v3 ...) into one delta against v1\n" +
+				"     -o, --output=FILE         Composed delta file, default DELTA1-composed\n",
+			Flags: []cli.Flag{
+				cli.StringFlag{
+					Name:  "output,o",
+					Usage: "Composed delta file, default DELTA1-composed",
+				},
+			},
+			Action: doCompose,
+		},
+		{
+			Name:   "info",
+			Usage:  "Print summary of signature or delta file, file type is detected by magic\n",
+			Action: doInfo,
+		},
+		{
+			Name: "dump",
+			Usage: "List every block of signature file or every command of delta file\n" +
+				"     --json                    Output JSON\n",
+			Flags: []cli.Flag{
+				cli.BoolFlag{
+					Name:  "json",
+					Usage: "Output JSON",
+				},
+			},
+			Action: doDump,
+		},
+		{
+			Name: "verify-delta",
+			Usage: "Check delta file without patching, COPY commands are checked against basis length\n" +
+				"     -l, --basis-len=BYTES     Basis length, used if BASIS is not given\n",
+			Flags: []cli.Flag{
+				cli.IntFlag{
+					Name:  "basis-len,l",
+					Value: -1,
+					Usage: "Basis length, -1 means unknown",
+				},
+			},
+			Action: doVerifyDelta,
+		},
 	}
 }
 
@@ -130,17 +335,52 @@ func doSign(c *cli.Context) {
 	}
 	defer outWr.Close()
 
-	err = rsync.GenSign(inRd,
-		fnLen,
-		//uint32(c.Int("sum-size")),
-		uint32(c.Int("block-size")),
-		outWr)
+	if c.Bool("sparse") {
+		err = rsync.GenSignSparse(inRd, uint32(c.Int("block-size")), outWr)
+	} else {
+		err = rsync.GenSign(inRd,
+			fnLen,
+			//uint32(c.Int("sum-size")),
+			uint32(c.Int("block-size")),
+			outWr)
+	}
 	if err != nil {
 		fmt.Println("Generate signature failed:", err)
 		return
 	}
 }
 
+// rdiff signature-tree [-b {block_size}] {dir} [signature_file]
+func doSignTree(c *cli.Context) {
+	var (
+		err   error
+		dir   string
+		outFn string
+		outWr *os.File
+	)
+
+	args := len(c.Args())
+	if args == 0 || args > 2 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	dir = c.Args().First()
+	if args == 2 {
+		outFn = c.Args().Get(1)
+	} else {
+		outFn = path.Clean(dir) + ".tsign"
+	}
+	if outWr, err = os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644); err != nil {
+		fmt.Println("Open", outFn, "failed:", err)
+		return
+	}
+	defer outWr.Close()
+
+	if err = rsync.GenTreeSign(dir, uint32(c.Int("block-size")), outWr); err != nil {
+		fmt.Println("Generate tree signature failed:", err)
+	}
+}
+
 // rdiff delta {signature_file} {source_file} [delta_file]
 func doDelta(c *cli.Context) {
 	var (
@@ -196,7 +436,14 @@ func doDelta(c *cli.Context) {
 	}
 	defer outWr.Close()
 
-	err = rsync.GenDelta(signRd, srcRd, srcLen, outWr)
+	err = rsync.GenDeltaWith(signRd, srcRd, srcLen, outWr, &rsync.DeltaOptions{
+		Format:    deltaFormat(c),
+		SelfCopy:  c.Bool("self-copy"),
+		RunLength: c.Bool("run-length"),
+		Sparse:    c.Bool("sparse"),
+		Trailer:   c.Bool("trailer"),
+		Debug:     c.GlobalBool("verbose"),
+	})
 	if err != nil {
 		fmt.Printf("generate delta file %s failed: %v\n", outFn, err)
 	}
@@ -211,8 +458,6 @@ func doPatch(c *cli.Context) {
 		destFn  string
 		outFn   string
 		deltaRd *os.File
-		destRd  *os.File
-		outWr   *os.File
 	)
 
 	args := len(c.Args())
@@ -220,6 +465,14 @@ func doPatch(c *cli.Context) {
 		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
 		return
 	}
+	if c.Bool("atomic") && c.Bool("inplace") {
+		fmt.Println("--atomic and --inplace can not be used together")
+		return
+	}
+	if c.String("checkpoint") != "" && !c.Bool("inplace") {
+		fmt.Println("--checkpoint should be used with --inplace")
+		return
+	}
 
 	// delta文件
 	destFn = c.Args().First()
@@ -238,22 +491,315 @@ func doPatch(c *cli.Context) {
 	}
 	defer deltaRd.Close()
 
+	opts := rsync.PatchOptions{
+		Sparse:     c.Bool("sparse"),
+		Checkpoint: c.String("checkpoint"),
+		Debug:      c.GlobalBool("verbose"),
+	}
+	// open & close reverse delta file
+	if fn = c.String("reverse"); fn != "" {
+		var reverseWr *os.File
+		if reverseWr, err = os.OpenFile(fn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm); err != nil {
+			fmt.Printf("open reverse delta file %s failed: %v\n", fn, err)
+			return
+		}
+		defer reverseWr.Close()
+		opts.Reverse = reverseWr
+	}
+
+	err = rsync.PatchFile(destFn, deltaRd, outFn, &rsync.PatchFileOptions{
+		PatchOptions: opts,
+		Inplace:      c.Bool("inplace"),
+		PreserveMode: true,
+	})
+	if err != nil {
+		fmt.Printf("patch file %s failed: %v\n", outFn, err)
+	}
+}
+
+// rdiff diff [-b {block_size}] {old_file} {new_file} [delta_file]
+func doDiff(c *cli.Context) {
+	var (
+		err   error
+		oldFn string
+		newFn string
+		outFn string
+		oldRd *os.File
+		newRd *os.File
+		outWr *os.File
+	)
+
+	args := len(c.Args())
+	if args < 2 || args > 3 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	oldFn = c.Args().First()
+	newFn = c.Args().Get(1)
+	if args == 3 {
+		outFn = c.Args().Get(2)
+	} else {
+		outFn = newFn + "-delta"
+	}
+
+	// open & close old file
+	if oldRd, err = os.Open(oldFn); err != nil {
+		fmt.Printf("open old file %s failed: %v\n", oldFn, err)
+		return
+	}
+	defer oldRd.Close()
+
+	// open & close new file
+	if newRd, err = os.Open(newFn); err != nil {
+		fmt.Printf("open new file %s failed: %v\n", newFn, err)
+		return
+	}
+	defer newRd.Close()
+
+	// open & close delta file
+	if outWr, err = os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm); err != nil {
+		fmt.Printf("open delta file %s failed: %v\n", outFn, err)
+		return
+	}
+	defer outWr.Close()
+
+	err = rsync.DiffWith(oldRd, newRd, outWr, &rsync.DeltaOptions{
+		BlockLen:  uint32(c.Int("block-size")),
+		Format:    deltaFormat(c),
+		SelfCopy:  c.Bool("self-copy"),
+		RunLength: c.Bool("run-length"),
+		Trailer:   c.Bool("trailer"),
+		Debug:     c.GlobalBool("verbose"),
+	})
+	if err != nil {
+		fmt.Printf("generate delta file %s failed: %v\n", outFn, err)
+	}
+}
+
+// rdiff delta-multi [-o {delta_file}] {new_file} {signature_file}...
+func doDeltaMulti(c *cli.Context) {
+	var (
+		err   error
+		outFn string
+		srcRd *os.File
+		outWr *os.File
+		fi    os.FileInfo
+		ms    = rsync.NewMultiSign()
+	)
+
+	if len(c.Args()) < 2 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	srcFn := c.Args().First()
+	if outFn = c.String("output"); outFn == "" {
+		outFn = srcFn + "-delta"
+	}
+
+	for _, fn := range c.Args()[1:] {
+		var signRd *os.File
+		if signRd, err = os.Open(fn); err != nil {
+			fmt.Printf("Open signature file %s failed: %v\n", fn, err)
+			return
+		}
+		_, err = ms.Add(signRd)
+		signRd.Close()
+		if err != nil {
+			fmt.Printf("load signature file %s failed: %v\n", fn, err)
+			return
+		}
+	}
+
 	// open & close source file
-	if destRd, err = os.Open(destFn); err != nil {
-		fmt.Printf("open source file %s failed: %v\n", destFn, err)
+	if srcRd, err = os.Open(srcFn); err != nil {
+		fmt.Printf("open source file %s failed: %v\n", srcFn, err)
+		return
+	}
+	defer srcRd.Close()
+	if fi, err = srcRd.Stat(); err != nil {
+		fmt.Printf("stat source file %s failed: %v\n", srcFn, err)
 		return
 	}
-	defer destRd.Close()
 
-	// open & close patch result file
+	// open & close delta file
+	if outWr, err = os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm); err != nil {
+		fmt.Printf("open delta file %s failed: %v\n", outFn, err)
+		return
+	}
+	defer outWr.Close()
+
+	err = rsync.GenDeltaMulti(ms, srcRd, fi.Size(), outWr, &rsync.DeltaOptions{
+		Trailer: c.Bool("trailer"),
+		Debug:   c.GlobalBool("verbose"),
+	})
+	if err != nil {
+		fmt.Printf("generate delta file %s failed: %v\n", outFn, err)
+	}
+}
+
+// rdiff patch-multi [-o {result_file}] {delta_file} {basis_file}...
+func doPatchMulti(c *cli.Context) {
+	var (
+		err     error
+		outFn   string
+		deltaRd *os.File
+		outWr   *os.File
+		bases   []io.ReadSeeker
+	)
+
+	if len(c.Args()) < 2 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	fn := c.Args().First()
+	if outFn = c.String("output"); outFn == "" {
+		destFn := c.Args().Get(1)
+		ext := path.Ext(destFn)
+		outFn = destFn[0:len(destFn)-len(ext)] + "-patch" + ext
+	}
+
+	if deltaRd, err = os.Open(fn); err != nil {
+		fmt.Printf("Open delta file %s failed: %v\n", fn, err)
+		return
+	}
+	defer deltaRd.Close()
+
+	for _, bfn := range c.Args()[1:] {
+		var f *os.File
+		if f, err = os.Open(bfn); err != nil {
+			fmt.Printf("open basis file %s failed: %v\n", bfn, err)
+			return
+		}
+		defer f.Close()
+		bases = append(bases, f)
+	}
+
 	if outWr, err = os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm); err != nil {
-		fmt.Printf("open patch result file %s failed: %v\n", outFn, err)
+		fmt.Printf("open result file %s failed: %v\n", outFn, err)
 		return
 	}
 	defer outWr.Close()
 
-	err = rsync.Patch(deltaRd, destRd, outWr)
+	err = rsync.PatchMulti(deltaRd, bases, outWr, &rsync.PatchOptions{Debug: c.GlobalBool("verbose")})
 	if err != nil {
 		fmt.Printf("patch file %s failed: %v\n", outFn, err)
 	}
 }
+
+// rdiff delta-tree [--compress] [-c] {tree_signature_file} {new_dir} [bundle_file]
+func doDeltaTree(c *cli.Context) {
+	var (
+		err   error
+		outFn string
+		sigRd *os.File
+		outWr *os.File
+		ts    *rsync.TreeSign
+	)
+
+	args := len(c.Args())
+	if args < 2 || args > 3 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	sigFn, dir := c.Args().First(), c.Args().Get(1)
+	if args == 3 {
+		outFn = c.Args().Get(2)
+	} else {
+		outFn = path.Clean(dir) + ".bundle"
+	}
+
+	if sigRd, err = os.Open(sigFn); err != nil {
+		fmt.Printf("open tree signature file %s failed: %v\n", sigFn, err)
+		return
+	}
+	defer sigRd.Close()
+	if ts, err = rsync.LoadTreeSign(sigRd); err != nil {
+		fmt.Printf("load tree signature file %s failed: %v\n", sigFn, err)
+		return
+	}
+
+	if outWr, err = os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0644); err != nil {
+		fmt.Printf("open bundle file %s failed: %v\n", outFn, err)
+		return
+	}
+	defer outWr.Close()
+
+	err = rsync.GenTreeDelta(ts, dir, outWr, &rsync.TreeDeltaOptions{
+		Compress: c.Bool("compress"),
+		Checksum: c.Bool("checksum"),
+	})
+	if err != nil {
+		fmt.Printf("generate bundle file %s failed: %v\n", outFn, err)
+	}
+}
+
+// rdiff patch-tree {dir} {bundle_file}
+func doPatchTree(c *cli.Context) {
+	var (
+		err error
+		rd  *os.File
+	)
+
+	if len(c.Args()) != 2 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+	dir, fn := c.Args().First(), c.Args().Get(1)
+	if rd, err = os.Open(fn); err != nil {
+		fmt.Printf("open bundle file %s failed: %v\n", fn, err)
+		return
+	}
+	defer rd.Close()
+
+	if err = rsync.ApplyTreeDelta(rd, dir); err != nil {
+		fmt.Printf("apply bundle %s to %s failed: %v\n", fn, dir, err)
+	}
+}
+
+// rdiff compose [-o {output}] {delta_file1} {delta_file2} [delta_file...]
+func doCompose(c *cli.Context) {
+	var (
+		err    error
+		outFn  string
+		deltas []io.ReaderAt
+		outWr  *os.File
+	)
+
+	if len(c.Args()) < 2 {
+		fmt.Println("At least two deltas should be provided.\nUsage:", c.App.Usage)
+		return
+	}
+	if outFn = c.String("output"); outFn == "" {
+		outFn = c.Args().First() + "-composed"
+	}
+
+	// open & close delta files
+	for _, fn := range c.Args() {
+		var f *os.File
+		if f, err = os.Open(fn); err != nil {
+			fmt.Printf("open delta file %s failed: %v\n", fn, err)
+			return
+		}
+		defer f.Close()
+		deltas = append(deltas, f)
+	}
+
+	// open & close composed delta file
+	if outWr, err = os.OpenFile(outFn, os.O_CREATE|os.O_TRUNC|os.O_RDWR, os.ModePerm); err != nil {
+		fmt.Printf("open delta file %s failed: %v\n", outFn, err)
+		return
+	}
+	defer outWr.Close()
+
+	if err = rsync.ComposeDeltas(outWr, deltas...); err != nil {
+		fmt.Printf("compose delta file %s failed: %v\n", outFn, err)
+	}
+}
+
+// delta文件格式
+func deltaFormat(c *cli.Context) int {
+	if c.Bool("vcdiff") {
+		return rsync.FormatVCDIFF
+	}
+	return rsync.FormatRsync
+}
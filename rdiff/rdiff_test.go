@@ -1,8 +1,14 @@
 package main
 
 import (
-	//"os"
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"testing"
+
+	"github.com/smtc/rsync"
 )
 
 func TestCli(t *testing.T) {
@@ -15,3 +21,74 @@ func TestCli(t *testing.T) {
 func TestRdiff(t *testing.T) {
 
 }
+
+func TestDump(t *testing.T) {
+	var (
+		basis  = bytes.Repeat([]byte("0123456789abcdef"), 1000)
+		src    = append(append([]byte("new data"), basis[100:9000]...), bytes.Repeat([]byte{0}, 100)...)
+		sig    = new(bytes.Buffer)
+		result = new(bytes.Buffer)
+		out    = new(bytes.Buffer)
+	)
+
+	if err := rsync.GenSign(bytes.NewReader(basis), int64(len(basis)), 512, sig); err != nil {
+		t.Fatal(err)
+	}
+	signature := sig.Bytes()
+	err := rsync.GenDeltaWith(bytes.NewReader(signature), bytes.NewReader(src), int64(len(src)), result,
+		&rsync.DeltaOptions{RunLength: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, asJSON := range []bool{false, true} {
+		out.Reset()
+		if err = dumpSign(bytes.NewReader(signature), out, asJSON); err != nil {
+			t.Fatal("dump signature failed:", err)
+		}
+		if asJSON && !json.Valid(out.Bytes()) {
+			t.Fatal("dump signature json invalid:", out.String())
+		}
+		out.Reset()
+		if err = dumpDelta(bytes.NewReader(result.Bytes()), out, asJSON); err != nil {
+			t.Fatal("dump delta failed:", err)
+		}
+		if asJSON && !json.Valid(out.Bytes()) {
+			t.Fatal("dump delta json invalid:", out.String())
+		}
+		if !bytes.Contains(out.Bytes(), []byte("RUN")) {
+			t.Fatal("dump delta should list RUN command:", out.String())
+		}
+	}
+}
+
+func TestDumpTreeSign(t *testing.T) {
+	var (
+		sig = new(bytes.Buffer)
+		out = new(bytes.Buffer)
+	)
+
+	dir, err := ioutil.TempDir("", "rdiff-tree")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	os.Mkdir(filepath.Join(dir, "sub"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "sub", "file"), []byte("hello"), 0644)
+
+	if err = rsync.GenTreeSign(dir, 0, sig); err != nil {
+		t.Fatal(err)
+	}
+	for _, asJSON := range []bool{false, true} {
+		out.Reset()
+		if err = dumpTreeSign(bytes.NewReader(sig.Bytes()), out, asJSON); err != nil {
+			t.Fatal("dump tree signature failed:", err)
+		}
+		if asJSON && !json.Valid(out.Bytes()) {
+			t.Fatal("dump tree signature json invalid:", out.String())
+		}
+		if !bytes.Contains(out.Bytes(), []byte("sub/file")) {
+			t.Fatal("dump tree signature should list sub/file:", out.String())
+		}
+	}
+}
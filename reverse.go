@@ -0,0 +1,71 @@
+package rsync
+
+import (
+	"errors"
+	"io"
+	"sort"
+)
+
+// 反向delta
+//
+// patch时记录所有从basis(old)复制到merged(new)的COPY命令：new[off:off+length]与
+// old[where:where+length]相同。patch完成后按照old中的位置排序，old中被复制过的区域生成
+// 从new复制的COPY命令，其他区域生成LITERAL命令，数据从old中读取，得到new->old的delta，
+// 不需要再计算签名和delta。
+
+// 一个COPY命令
+type copyRange struct {
+	where  int64 // 在basis(old)中的位置
+	off    int64 // 在merged(new)中的位置
+	length int64
+}
+
+// 记录COPY命令
+func (p *Patcher) recordCopy(where, length, off int64) {
+	if p.reverse && length > 0 {
+		p.copies = append(p.copies, copyRange{where: where, off: off, length: length})
+	}
+}
+
+// 生成反向delta，格式与patch的delta相同
+// old:    basis文件
+// newLen: patch结果的长度
+func genReverse(old io.ReadSeeker, copies []copyRange, newLen int64, result io.Writer, format int) (err error) {
+	var (
+		df     delta
+		pos    int64
+		oldLen int64
+	)
+
+	if oldLen, err = old.Seek(0, 2); err != nil {
+		return errors.New("seek basis failed: " + err.Error())
+	}
+
+	sort.Slice(copies, func(i, j int) bool {
+		return copies[i].where < copies[j].where
+	})
+	for _, c := range copies {
+		end := c.where + c.length
+		if end <= pos {
+			continue
+		}
+		start := c.where
+		if start < pos {
+			start = pos
+		}
+		if start > pos {
+			df.mss = append(df.mss, matchStat{match: -1, pos: pos, length: start - pos})
+		}
+		df.mss = append(df.mss, matchStat{match: 1, pos: c.off + start - c.where, length: end - start})
+		pos = end
+	}
+	if oldLen > pos {
+		df.mss = append(df.mss, matchStat{match: -1, pos: pos, length: oldLen - pos})
+	}
+	df.mss = mergeMatchStats(df.mss)
+
+	df.outer = result
+	df.format = format
+	df.sig = &Signature{flength: newLen}
+	return df.flush(old)
+}
@@ -0,0 +1,58 @@
+package rsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func testReverse(t *testing.T, old, cur []byte, format int) int {
+	var (
+		sig     = new(bytes.Buffer)
+		result  = new(bytes.Buffer)
+		merged  = new(bytes.Buffer)
+		reverse = new(bytes.Buffer)
+		back    = new(bytes.Buffer)
+	)
+
+	if err := GenSign(bytes.NewReader(old), int64(len(old)), 256, sig); err != nil {
+		t.Fatal("GenSign failed:", err)
+	}
+	opts := &DeltaOptions{Basis: bytes.NewReader(old), Format: format, SelfCopy: true}
+	if err := GenDeltaWith(sig, bytes.NewReader(cur), int64(len(cur)), result, opts); err != nil {
+		t.Fatal("GenDeltaWith failed:", err)
+	}
+	if err := PatchWith(result, bytes.NewReader(old), merged, &PatchOptions{Reverse: reverse}); err != nil {
+		t.Fatal("PatchWith failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), cur) {
+		t.Fatalf("patch result not equal: format=%d", format)
+	}
+	rl := reverse.Len()
+	if err := Patch(reverse, bytes.NewReader(cur), back); err != nil {
+		t.Fatal("Patch reverse delta failed:", err)
+	}
+	if !bytes.Equal(back.Bytes(), old) {
+		t.Fatalf("reverse patch result not equal: format=%d", format)
+	}
+	return rl
+}
+
+func TestReverse(t *testing.T) {
+	old := randBytes(26, 50000)
+	cur := append([]byte{}, old[10000:30000]...)
+	cur = append(cur, randBytes(27, 5000)...)
+	cur = append(cur, old[0:8000]...)
+	cur = append(cur, old[35000:]...)
+
+	for _, format := range []int{FormatRsync, FormatVCDIFF} {
+		// old中只有[8000,10000)和[30000,35000)没有被复制
+		if rl := testReverse(t, old, cur, format); rl > 7500 {
+			t.Fatalf("reverse delta too large: format=%d length=%d", format, rl)
+		}
+	}
+	for _, s1 := range ss {
+		for _, s2 := range chs {
+			testReverse(t, []byte(s1), []byte(s2), FormatRsync)
+		}
+	}
+}
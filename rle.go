@@ -0,0 +1,122 @@
+package rsync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+)
+
+// 重复字节(run)
+//
+// 稀疏文件、用0填充的镜像文件中有大量重复的字节，如果basis文件中没有对应的block，这些数据
+// 都会作为literal写入delta文件。生成delta时，在不匹配的区域中查找长度不小于minRunLen的
+// 重复字节，使用RUN命令(长度 + 字节值)代替literal。
+//
+// RUN命令格式：
+//   cmd:    1字节，RS_OP_RUN_N1 ~ RS_OP_RUN_N8
+//   length: 变长：1,2,4,8字节，根据cmd决定
+//   value:  1字节，重复的字节
+
+const minRunLen = 32
+
+// 在不匹配的区域中查找重复的字节，将matchStat拆分为literal和run
+func (d *delta) findRuns(src io.ReadSeeker) (err error) {
+	var mss []matchStat
+
+	for _, ms := range d.mss {
+		if ms.match != -1 {
+			mss = append(mss, ms)
+			continue
+		}
+		if mss, err = scanRuns(mss, src, ms.pos, ms.length); err != nil {
+			return
+		}
+	}
+
+	if d.debug {
+		fmt.Printf("run length: %d match stats before, %d after\n", len(d.mss), len(mss))
+	}
+	d.mss = mss
+	return
+}
+
+// 扫描src中[start, start+length)的数据
+func scanRuns(mss []matchStat, src io.ReadSeeker, start, length int64) (res []matchStat, err error) {
+	var (
+		c        byte
+		runByte  byte
+		runStart = start
+		runLen   int64
+		litStart = start
+	)
+
+	res = mss
+	if _, err = src.Seek(start, 0); err != nil {
+		return
+	}
+	rd := bufio.NewReader(io.LimitReader(src, length))
+
+	// 遇到不同的字节或结尾时，检查之前的run是否足够长
+	endRun := func() {
+		if runLen < minRunLen {
+			return
+		}
+		if runStart > litStart {
+			res = append(res, matchStat{match: -1, pos: litStart, length: runStart - litStart})
+		}
+		res = append(res, matchStat{match: 3, pos: runStart, length: runLen, value: runByte})
+		litStart = runStart + runLen
+	}
+
+	for pos := start; pos < start+length; pos++ {
+		if c, err = rd.ReadByte(); err != nil {
+			if err == io.EOF {
+				err = io.ErrUnexpectedEOF
+			}
+			return
+		}
+		if runLen > 0 && c == runByte {
+			runLen++
+			continue
+		}
+		endRun()
+		runByte = c
+		runStart = pos
+		runLen = 1
+	}
+	endRun()
+
+	if end := start + length; end > litStart {
+		res = append(res, matchStat{match: -1, pos: litStart, length: end - litStart})
+	}
+	return
+}
+
+func (d *delta) flushRun(ms matchStat) (err error) {
+	err = d.dw.Run(ms.value, ms.length)
+
+	if d.debug {
+		fmt.Printf("   flush run [value=0x%x len=%d]\n", ms.value, ms.length)
+	}
+	return
+}
+
+// 处理run部分
+func (p *Patcher) patchRun(length uint64, value byte) (err error) {
+	var buf [4096]byte
+
+	for i := range buf {
+		buf[i] = value
+	}
+	for length > 0 {
+		l := uint64(len(buf))
+		if l > length {
+			l = length
+		}
+		if _, err = p.merged.Write(buf[0:l]); err != nil {
+			return fmt.Errorf("patch run failed: length=%d error=%s", length, err.Error())
+		}
+		length -= l
+	}
+	return
+}
@@ -0,0 +1,48 @@
+package rsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestRunLength(t *testing.T) {
+	basis := randBytes(10, 8000)
+
+	src := append([]byte{}, basis[0:1000]...)
+	src = append(src, make([]byte, 1<<20)...)
+	src = append(src, basis[1000:]...)
+	src = append(src, bytes.Repeat([]byte{'a'}, minRunLen)...)
+	src = append(src, 'x')
+	src = append(src, bytes.Repeat([]byte{'b'}, minRunLen-1)...)
+
+	for _, opts := range []*DeltaOptions{
+		{RunLength: true},
+		{RunLength: true, Format: FormatVCDIFF},
+		{RunLength: true, SelfCopy: true},
+	} {
+		if dl := roundTrip(t, basis, src, 512, opts); dl > 2048 {
+			t.Fatalf("delta too large with run length: opts=%+v length=%d", opts, dl)
+		}
+	}
+}
+
+func TestScanRuns(t *testing.T) {
+	src := []byte("12" + string(bytes.Repeat([]byte{0}, minRunLen)) + "34" + string(bytes.Repeat([]byte{1}, minRunLen-1)))
+	mss, err := scanRuns(nil, bytes.NewReader(src), 0, int64(len(src)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	expect := []matchStat{
+		{match: -1, pos: 0, length: 2},
+		{match: 3, pos: 2, length: minRunLen, value: 0},
+		{match: -1, pos: minRunLen + 2, length: minRunLen + 1},
+	}
+	if len(mss) != len(expect) {
+		t.Fatalf("scanRuns: %v", mss)
+	}
+	for i := range mss {
+		if mss[i] != expect[i] {
+			t.Fatalf("scanRuns: %v expect %v", mss, expect)
+		}
+	}
+}
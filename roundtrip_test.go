@@ -0,0 +1,48 @@
+package rsync
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+)
+
+func randBytes(seed int64, n int) []byte {
+	r := rand.New(rand.NewSource(seed))
+	p := make([]byte, n)
+	r.Read(p)
+	return p
+}
+
+// 生成从basis到src的delta并patch，比较patch的结果，返回delta的长度。blockLen为签名的block长度，
+// 为0时不使用签名，由DiffWith生成delta(block长度为opts.BlockLen)
+func roundTrip(t *testing.T, basis, src []byte, blockLen uint32, opts *DeltaOptions) int {
+	var (
+		sig    = new(bytes.Buffer)
+		result = new(bytes.Buffer)
+		merged = new(bytes.Buffer)
+		err    error
+	)
+
+	if opts == nil {
+		opts = &DeltaOptions{}
+	}
+	if blockLen == 0 {
+		err = DiffWith(bytes.NewReader(basis), bytes.NewReader(src), result, opts)
+	} else if err = GenSign(bytes.NewReader(basis), int64(len(basis)), blockLen, sig); err == nil {
+		err = GenDeltaWith(sig, bytes.NewReader(src), int64(len(src)), result, opts)
+	}
+	if err != nil {
+		t.Fatalf("generate delta failed: opts=%+v error=%v", opts, err)
+	}
+	if opts.Format == FormatVCDIFF && !bytes.HasPrefix(result.Bytes(), []byte{0xd6, 0xc3, 0xc4, 0x00}) {
+		t.Fatalf("delta should start with vcdiff magic: %x", result.Bytes())
+	}
+	dl := result.Len()
+	if err = Patch(result, bytes.NewReader(basis), merged); err != nil {
+		t.Fatalf("Patch failed: opts=%+v error=%v", opts, err)
+	}
+	if !bytes.Equal(merged.Bytes(), src) {
+		t.Fatalf("patch result not equal: opts=%+v basis=%d src=%d merged=%d", opts, len(basis), len(src), merged.Len())
+	}
+	return dl
+}
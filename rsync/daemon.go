@@ -0,0 +1,679 @@
+package main
+
+import (
+	"bufio"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smtc/rsync"
+)
+
+// daemon模式
+//
+// rsync --daemon读取配置文件，监听TCP或unix socket，客户端使用HOST::MODULE/PATH访问配置文件中的模块。
+// 连接建立后先以文本行交换daemon的握手，再在同一个连接上使用rsync库的同步协议(见protocol.go)，
+// 与remote shell的--server相同：
+//
+//   daemon  @RSYNCD: VERSION
+//   客户端  @RSYNCD: VERSION
+//   客户端  MODULE
+//   daemon  @RSYNCD: AUTHREQD CHALLENGE      模块配置了auth users时
+//   客户端  USER RESPONSE                     RESPONSE = hex(HMAC-SHA256(password, CHALLENGE))
+//   daemon  @RSYNCD: OK 或 @ERROR: MESSAGE
+//   客户端  参数，每行一个，以空行结束: --server [--sender] [OPTIONS] PATH
+//   daemon  @RSYNCD: OK 或 @ERROR: MESSAGE    例如模块只读
+//
+// 配置文件：
+//
+//   listen = :873                     或 unix:/run/rsyncd.sock
+//   log file = /var/log/rsyncd.log    默认为stderr
+//   timeout = 600                     连接空闲的秒数，超时后断开，0为不限制；握手还需要在30秒内完成
+//
+//   [backup]
+//   path = /data/backup
+//   comment = backup files
+//   read only = no                    默认为yes，只能拉取
+//   auth users = alice, bob           为空时不需要认证
+//   secrets file = /etc/rsyncd.secrets  每行USER:PASSWORD，其他用户不能读写
+//   exclude = *.tmp cache/            不同步的文件，以/结尾只匹配目录，包含/时匹配模块中的路径
+//   include = keep.tmp                匹配include的文件不被exclude
+//   max connections = 4               模块的最大连接数，0为不限制
+//
+// 客户端的PATH在模块中，不能访问模块以外的文件：PATH中不能有符号链接，接收的文件的父目录不能是
+// 符号链接，客户端推送的符号链接的目标不能是绝对路径或者包含..。模块中的符号链接可以被拉取，但是
+// 不会被跟随。
+
+const (
+	defaultListen  = ":873"
+	daemonGreeting = "@RSYNCD: "
+	daemonError    = "@ERROR: "
+	daemonAuth     = "@RSYNCD: AUTHREQD "
+	daemonOK       = "@RSYNCD: OK"
+
+	defaultTimeout   = 600 * time.Second
+	handshakeTimeout = 30 * time.Second
+)
+
+type daemon struct {
+	listen  string
+	logFile string
+	timeout time.Duration // 连接的空闲时间
+	modules map[string]*module
+	log     *log.Logger
+}
+
+type module struct {
+	name        string
+	path        string
+	comment     string
+	readOnly    bool
+	authUsers   []string
+	secretsFile string
+	include     []string
+	exclude     []string
+	maxConns    int
+	conns       chan struct{}
+}
+
+// 读取配置文件
+func loadConfig(fn string) (d *daemon, err error) {
+	var (
+		data []byte
+		m    *module
+	)
+
+	if data, err = ioutil.ReadFile(fn); err != nil {
+		return
+	}
+	d = &daemon{listen: defaultListen, timeout: defaultTimeout, modules: make(map[string]*module)}
+	for i, line := range strings.Split(string(data), "\n") {
+		if err = d.parseLine(&m, strings.TrimSpace(line)); err != nil {
+			return nil, fmt.Errorf("%s line %d: %v", fn, i+1, err)
+		}
+	}
+	for _, m = range d.modules {
+		if m.path == "" {
+			return nil, fmt.Errorf("%s: module %s has no path", fn, m.name)
+		}
+		if len(m.authUsers) > 0 && m.secretsFile == "" {
+			return nil, fmt.Errorf("%s: module %s has auth users but no secrets file", fn, m.name)
+		}
+		if m.maxConns > 0 {
+			m.conns = make(chan struct{}, m.maxConns)
+		}
+	}
+	return
+}
+
+// m为当前的模块，nil时为全局配置
+func (d *daemon) parseLine(m **module, line string) (err error) {
+	if line == "" || line[0] == '#' || line[0] == ';' {
+		return
+	}
+	if line[0] == '[' {
+		name := strings.TrimSpace(strings.TrimSuffix(line[1:], "]"))
+		if !strings.HasSuffix(line, "]") || name == "" || strings.ContainsAny(name, "/ ") {
+			return fmt.Errorf("invalid module %s", line)
+		}
+		if _, ok := d.modules[name]; ok {
+			return fmt.Errorf("duplicate module %s", name)
+		}
+		*m = &module{name: name, readOnly: true}
+		d.modules[name] = *m
+		return
+	}
+
+	i := strings.IndexByte(line, '=')
+	if i < 0 {
+		return fmt.Errorf("invalid line %s", line)
+	}
+	key := strings.ToLower(strings.Join(strings.Fields(line[:i]), " "))
+	value := strings.TrimSpace(line[i+1:])
+	if *m == nil {
+		switch key {
+		case "listen":
+			d.listen = value
+		case "log file":
+			d.logFile = value
+		case "timeout":
+			var n int
+			if n, err = strconv.Atoi(value); err == nil && n < 0 {
+				err = fmt.Errorf("invalid timeout %d", n)
+			}
+			d.timeout = time.Duration(n) * time.Second
+		default:
+			return fmt.Errorf("unknown global parameter %s", key)
+		}
+		return
+	}
+
+	mod := *m
+	switch key {
+	case "path":
+		mod.path, err = filepath.Abs(value)
+	case "comment":
+		mod.comment = value
+	case "read only":
+		mod.readOnly, err = parseBool(value)
+	case "auth users":
+		mod.authUsers = strings.FieldsFunc(value, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	case "secrets file":
+		mod.secretsFile = value
+	case "include":
+		mod.include = append(mod.include, strings.Fields(value)...)
+	case "exclude":
+		mod.exclude = append(mod.exclude, strings.Fields(value)...)
+	case "max connections":
+		if mod.maxConns, err = strconv.Atoi(value); err == nil && mod.maxConns < 0 {
+			err = fmt.Errorf("invalid max connections %d", mod.maxConns)
+		}
+	default:
+		err = fmt.Errorf("unknown module parameter %s", key)
+	}
+	return
+}
+
+func parseBool(s string) (bool, error) {
+	switch strings.ToLower(s) {
+	case "yes", "true", "1":
+		return true, nil
+	case "no", "false", "0":
+		return false, nil
+	}
+	return false, fmt.Errorf("invalid boolean %s", s)
+}
+
+// rel为模块中的路径，rel或者它的上级目录匹配exclude并且不匹配include时不同步
+func (m *module) excluded(rel string, dir bool) bool {
+	parts := strings.Split(rel, "/")
+	for i := range parts {
+		p := strings.Join(parts[:i+1], "/")
+		isDir := dir || i < len(parts)-1
+		if matchPatterns(m.exclude, p, isDir) && !matchPatterns(m.include, p, isDir) {
+			return true
+		}
+	}
+	return false
+}
+
+func matchPatterns(patterns []string, rel string, dir bool) bool {
+	for _, pat := range patterns {
+		if strings.HasSuffix(pat, "/") {
+			if !dir {
+				continue
+			}
+			pat = strings.TrimSuffix(pat, "/")
+		}
+		name := path.Base(rel)
+		if strings.Contains(pat, "/") {
+			pat, name = strings.TrimPrefix(pat, "/"), rel
+		}
+		if ok, _ := path.Match(pat, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// 密码文件中user的密码
+func (m *module) password(user string) (password string, err error) {
+	var (
+		fi   os.FileInfo
+		data []byte
+	)
+
+	if fi, err = os.Stat(m.secretsFile); err != nil {
+		return
+	}
+	if fi.Mode().Perm()&077 != 0 {
+		return "", fmt.Errorf("secrets file %s must not be accessible by others", m.secretsFile)
+	}
+	if data, err = ioutil.ReadFile(m.secretsFile); err != nil {
+		return
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		if i := strings.IndexByte(line, ':'); i > 0 && line[:i] == user {
+			return strings.TrimRight(line[i+1:], "\r"), nil
+		}
+	}
+	return "", fmt.Errorf("no password for user %s", user)
+}
+
+func authResponse(password, challenge string) string {
+	h := hmac.New(sha256.New, []byte(password))
+	h.Write([]byte(challenge))
+	return hex.EncodeToString(h.Sum(nil))
+}
+
+// unix:PATH为unix socket，否则为TCP地址
+func splitAddr(addr string) (network, address string) {
+	if strings.HasPrefix(addr, "unix:") {
+		return "unix", addr[len("unix:"):]
+	}
+	return "tcp", addr
+}
+
+func (d *daemon) openLog() (err error) {
+	w := io.Writer(os.Stderr)
+	if d.logFile != "" {
+		if w, err = os.OpenFile(d.logFile, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644); err != nil {
+			return
+		}
+	}
+	d.log = log.New(w, "rsyncd: ", log.LstdFlags)
+	return
+}
+
+// 监听配置的地址，unix socket文件已经存在时先删除
+func (d *daemon) listenOn() (l net.Listener, err error) {
+	network, addr := splitAddr(d.listen)
+	if network == "unix" {
+		if fi, e := os.Lstat(addr); e == nil && fi.Mode()&os.ModeSocket != 0 {
+			os.Remove(addr)
+		}
+	}
+	return net.Listen(network, addr)
+}
+
+// 接受连接直到l被关闭
+func (d *daemon) serve(l net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+
+	d.log.Printf("listening on %s", d.listen)
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			d.handle(c)
+		}()
+	}
+}
+
+func (d *daemon) handle(c net.Conn) {
+	defer c.Close()
+
+	addr := c.RemoteAddr().String()
+	if addr == "" || addr == "@" {
+		addr = "unix"
+	}
+	// 握手在handshakeTimeout和timeout中较短的时间内完成
+	timeout := handshakeTimeout
+	if d.timeout > 0 && d.timeout < timeout {
+		timeout = d.timeout
+	}
+	c.SetDeadline(time.Now().Add(timeout))
+	ic := &idleConn{Conn: c}
+	br := bufio.NewReader(ic)
+	if err := d.session(br, ic, addr); err != nil {
+		d.log.Printf("%s: %v", addr, err)
+	}
+}
+
+// 每次读写前设置deadline，空闲timeout后读写失败，timeout为0时不设置
+type idleConn struct {
+	net.Conn
+	timeout time.Duration
+}
+
+func (c *idleConn) Read(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetReadDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Read(p)
+}
+
+func (c *idleConn) Write(p []byte) (int, error) {
+	if c.timeout > 0 {
+		c.Conn.SetWriteDeadline(time.Now().Add(c.timeout))
+	}
+	return c.Conn.Write(p)
+}
+
+// 发送@ERROR给客户端并返回错误
+func refuse(w io.Writer, format string, args ...interface{}) error {
+	msg := fmt.Sprintf(format, args...)
+	fmt.Fprintf(w, "%s%s\n", daemonError, msg)
+	return errors.New(msg)
+}
+
+// 读取一行，不包括换行符
+func readLine(br *bufio.Reader) (string, error) {
+	line, err := br.ReadSlice('\n')
+	if err == bufio.ErrBufferFull {
+		return "", fmt.Errorf("%w: line too long", rsync.ErrProtocol)
+	} else if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(line), "\r\n"), nil
+}
+
+// daemon的握手，然后在连接上同步
+func (d *daemon) session(br *bufio.Reader, c *idleConn, addr string) (err error) {
+	var (
+		line   string
+		user   string
+		args   []string
+		sender bool
+	)
+
+	fmt.Fprintf(c, "%s%d\n", daemonGreeting, rsync.ProtocolVersion)
+	if line, err = readLine(br); err != nil {
+		return
+	}
+	if line != fmt.Sprintf("%s%d", daemonGreeting, rsync.ProtocolVersion) {
+		return refuse(c, "protocol version mismatch: %s", line)
+	}
+	if line, err = readLine(br); err != nil {
+		return
+	}
+	m, ok := d.modules[line]
+	if !ok {
+		return refuse(c, "unknown module %s", line)
+	}
+
+	if m.conns != nil {
+		select {
+		case m.conns <- struct{}{}:
+			defer func() { <-m.conns }()
+		default:
+			return refuse(c, "max connections (%d) reached for module %s, try again later", m.maxConns, m.name)
+		}
+	}
+
+	if len(m.authUsers) > 0 {
+		if user, err = d.auth(br, c, m); err != nil {
+			return
+		}
+	}
+	fmt.Fprintln(c, daemonOK)
+
+	// 参数以空行结束
+	for {
+		if line, err = readLine(br); err != nil {
+			return
+		}
+		if line == "" {
+			break
+		}
+		args = append(args, line)
+	}
+	s := &syncer{verbose: true, safeLinks: true, out: &logWriter{d.log, addr + " " + m.name + ": "}}
+	if len(args) < 2 || args[0] != "--server" {
+		return refuse(c, "invalid arguments %v", args)
+	}
+	for _, arg := range args[1 : len(args)-1] {
+		switch arg {
+		case "--sender":
+			sender = true
+		case "--delete":
+			s.delete = true
+		case "--dry-run":
+			s.dryRun = true
+		case "--checksum":
+			s.checksum = true
+		case "--whole-file":
+			s.wholeFile = true
+		default:
+			return refuse(c, "unknown option %s", arg)
+		}
+	}
+	if !sender && m.readOnly {
+		return refuse(c, "module %s is read only", m.name)
+	}
+
+	// PATH限制在模块中
+	p := args[len(args)-1]
+	rel := strings.TrimPrefix(path.Clean("/"+p), "/")
+	if rel == "" {
+		rel = "."
+	}
+	if rel != "." && m.excluded(rel, true) {
+		return refuse(c, "path %s is excluded", rel)
+	}
+	// 不跟随PATH中的符号链接
+	full := m.path
+	for _, name := range strings.Split(rel, "/") {
+		if name == "." {
+			break
+		}
+		full = filepath.Join(full, name)
+		if fi, e := os.Lstat(full); e != nil {
+			break
+		} else if fi.Mode()&os.ModeSymlink != 0 {
+			return refuse(c, "path %s is a symlink", rel)
+		}
+	}
+	full = filepath.Join(m.path, filepath.FromSlash(rel))
+	if hasSlash(p) || rel == "." {
+		full += string(os.PathSeparator)
+	}
+	// 同步的文件名相对于base
+	base := rel
+	if sender && !hasSlash(full) {
+		base = path.Dir(rel)
+	}
+	s.exclude = func(name string, dir bool) bool {
+		return m.excluded(path.Join(base, name), dir)
+	}
+
+	fmt.Fprintln(c, daemonOK)
+
+	// 握手完成，同步时只限制空闲时间
+	c.SetDeadline(time.Time{})
+	c.timeout = d.timeout
+	op := "receive"
+	if sender {
+		op = "send"
+	}
+	d.log.Printf("%s %s: %s %s user=%s", addr, m.name, op, rel, user)
+	err = s.serveOn(struct {
+		io.Reader
+		io.Writer
+	}{br, c}, sender, full)
+	st := s.stats
+	d.log.Printf("%s %s: %s %s done, %d files, %d updated, %d deleted, %d bytes, %d errors",
+		addr, m.name, op, rel, st.files, st.updated, st.deleted, st.size, st.errors)
+	return
+}
+
+// challenge-response认证，返回用户名
+func (d *daemon) auth(br *bufio.Reader, c net.Conn, m *module) (user string, err error) {
+	var (
+		challenge = make([]byte, 16)
+		line      string
+		password  string
+	)
+
+	if _, err = rand.Read(challenge); err != nil {
+		return
+	}
+	ch := hex.EncodeToString(challenge)
+	fmt.Fprintf(c, "%s%s\n", daemonAuth, ch)
+	if line, err = readLine(br); err != nil {
+		return
+	}
+	fields := strings.Fields(line)
+	if len(fields) != 2 {
+		return "", refuse(c, "auth failed on module %s", m.name)
+	}
+	user = fields[0]
+	allowed := false
+	for _, u := range m.authUsers {
+		allowed = allowed || u == user
+	}
+	if !allowed {
+		return "", refuse(c, "auth failed on module %s: user %s not allowed", m.name, user)
+	}
+	if password, err = m.password(user); err != nil {
+		d.log.Printf("module %s: %v", m.name, err)
+		return "", refuse(c, "auth failed on module %s", m.name)
+	}
+	if !hmac.Equal([]byte(fields[1]), []byte(authResponse(password, ch))) {
+		return "", refuse(c, "auth failed on module %s: wrong password for user %s", m.name, user)
+	}
+	return
+}
+
+// syncer的输出写入日志，每次Write是一行
+type logWriter struct {
+	log    *log.Logger
+	prefix string
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	w.log.Print(w.prefix + strings.TrimRight(string(p), "\n"))
+	return len(p), nil
+}
+
+// 客户端
+
+// [USER@]HOST::MODULE[/PATH]，PATH为空时同步整个模块
+func parseDaemon(arg string) (r remoteSpec, ok bool) {
+	i := strings.Index(arg, "::")
+	if i <= 0 {
+		return
+	}
+	host := arg[:i]
+	if j := strings.LastIndexByte(host, '@'); j >= 0 {
+		r.user, host = host[:j], host[j+1:]
+	}
+	if host == "" || (strings.ContainsRune(host, '/') && !strings.HasPrefix(host, "unix:")) {
+		return remoteSpec{}, false
+	}
+	r.daemon, r.host, r.module, r.path = true, host, arg[i+2:], "/"
+	if j := strings.IndexByte(r.module, '/'); j >= 0 {
+		r.module, r.path = r.module[:j], r.module[j:]
+	}
+	return r, true
+}
+
+// 连接daemon的连接，握手时读取的数据在rd中
+type daemonConn struct {
+	rd *bufio.Reader
+	net.Conn
+}
+
+func (dc *daemonConn) Read(p []byte) (int, error) {
+	return dc.rd.Read(p)
+}
+
+// 等待daemon完成(例如--delete)并关闭连接
+func (dc *daemonConn) Close() error {
+	io.Copy(ioutil.Discard, dc.rd)
+	return dc.Conn.Close()
+}
+
+// 连接daemon，完成握手并发送参数
+func (s *syncer) dialDaemon(r remoteSpec, args []string) (dc *daemonConn, err error) {
+	var (
+		c    net.Conn
+		line string
+	)
+
+	if r.module == "" {
+		return nil, errors.New("no module name in " + r.host + "::")
+	}
+	if strings.ContainsAny(r.path, "\r\n") {
+		return nil, errors.New("invalid path " + strconv.Quote(r.path))
+	}
+	network, addr := splitAddr(r.host)
+	if network == "tcp" {
+		if _, _, e := net.SplitHostPort(addr); e != nil {
+			port := s.port
+			if port == 0 {
+				port = 873
+			}
+			addr = net.JoinHostPort(addr, strconv.Itoa(port))
+		}
+	}
+	if c, err = net.Dial(network, addr); err != nil {
+		return
+	}
+	dc = &daemonConn{bufio.NewReader(c), c}
+	defer func() {
+		if err != nil {
+			c.Close()
+			dc = nil
+		}
+	}()
+
+	if line, err = readLine(dc.rd); err != nil {
+		return
+	}
+	if !strings.HasPrefix(line, daemonGreeting) {
+		return nil, fmt.Errorf("%w: invalid daemon greeting %s", rsync.ErrProtocol, line)
+	}
+	fmt.Fprintf(c, "%s%d\n%s\n", daemonGreeting, rsync.ProtocolVersion, r.module)
+	if line, err = readLine(dc.rd); err != nil {
+		return
+	}
+	if strings.HasPrefix(line, daemonAuth) {
+		if err = s.daemonAuth(c, r, line[len(daemonAuth):]); err != nil {
+			return
+		}
+		if line, err = readLine(dc.rd); err != nil {
+			return
+		}
+	}
+	if err = checkDaemonReply(line); err != nil {
+		return
+	}
+	if _, err = fmt.Fprintf(c, "%s\n\n", strings.Join(args, "\n")); err != nil {
+		return
+	}
+	if line, err = readLine(dc.rd); err == nil {
+		err = checkDaemonReply(line)
+	}
+	return
+}
+
+func checkDaemonReply(line string) error {
+	if strings.HasPrefix(line, daemonError) {
+		return errors.New("daemon: " + line[len(daemonError):])
+	}
+	if line != daemonOK {
+		return fmt.Errorf("%w: unexpected daemon response %s", rsync.ErrProtocol, line)
+	}
+	return nil
+}
+
+// 用户名为USER@，或者环境变量USER；密码在--password-file中，或者环境变量RSYNC_PASSWORD
+func (s *syncer) daemonAuth(w io.Writer, r remoteSpec, challenge string) (err error) {
+	user := r.user
+	if user == "" {
+		user = os.Getenv("USER")
+	}
+	password, ok := os.LookupEnv("RSYNC_PASSWORD")
+	if s.password != "" {
+		data, e := ioutil.ReadFile(s.password)
+		if e != nil {
+			return e
+		}
+		password, ok = strings.TrimRight(strings.SplitN(string(data), "\n", 2)[0], "\r"), true
+	}
+	if user == "" || !ok {
+		return errors.New("daemon requires user and password, use USER@HOST::MODULE and --password-file or RSYNC_PASSWORD")
+	}
+	_, err = fmt.Fprintf(w, "%s %s\n", user, authResponse(password, challenge))
+	return
+}
@@ -0,0 +1,337 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"io/ioutil"
+	"log"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestLoadConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-config-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	fn := filepath.Join(dir, "rsyncd.conf")
+	ioutil.WriteFile(fn, []byte(`# global
+listen = unix:/tmp/rsyncd.sock
+timeout = 60
+
+[data]
+  path = /srv/data
+  Read Only = no
+  auth users = alice, bob
+  secrets file = /etc/rsyncd.secrets
+  exclude = *.tmp cache/
+  exclude = /private/*
+  include = keep.tmp
+  max connections = 2
+
+[pub]
+path = /srv/pub
+`), 0644)
+	d, err := loadConfig(fn)
+	if err != nil {
+		t.Fatal("loadConfig failed:", err)
+	}
+	m := d.modules["data"]
+	if d.listen != "unix:/tmp/rsyncd.sock" || d.timeout != time.Minute || len(d.modules) != 2 || m == nil {
+		t.Fatal("config wrong:", d.listen, d.timeout, d.modules)
+	}
+	if m.path != "/srv/data" || m.readOnly || len(m.authUsers) != 2 || m.authUsers[1] != "bob" ||
+		len(m.exclude) != 3 || m.maxConns != 2 || cap(m.conns) != 2 {
+		t.Fatalf("module data wrong: %+v", m)
+	}
+	if !d.modules["pub"].readOnly || d.modules["pub"].conns != nil {
+		t.Fatal("module pub should be read only without connection limit")
+	}
+
+	for rel, excluded := range map[string]bool{
+		"a.tmp": true, "dir/a.tmp": true, "keep.tmp": false, "dir/keep.tmp": false,
+		"cache/file": true, "dir/cache/file": true, "cache": false,
+		"private/file": true, "dir/private/file": false, "a.txt": false,
+	} {
+		// cache作为文件时不匹配cache/
+		if m.excluded(rel, false) != excluded {
+			t.Fatal("excluded wrong:", rel, !excluded)
+		}
+	}
+
+	for _, conf := range []string{
+		"[data]\nread only = maybe\npath = /srv\n",
+		"[data]\npath = /srv\nunknown = 1\n",
+		"[data]\ncomment = no path\n",
+		"[data]\npath = /srv\nauth users = alice\n",
+		"[data\npath = /srv\n",
+		"path = /srv\n",
+		"timeout = -1\n[data]\npath = /srv\n",
+	} {
+		ioutil.WriteFile(fn, []byte(conf), 0644)
+		if _, err = loadConfig(fn); err == nil {
+			t.Fatal("invalid config should fail:", conf)
+		}
+	}
+}
+
+func TestDaemon(t *testing.T) {
+	var (
+		mtime = time.Now().Add(-time.Hour).Truncate(time.Second)
+		out   = new(bytes.Buffer)
+	)
+
+	dir, err := ioutil.TempDir("", "rsync-daemon-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	data := filepath.Join(dir, "data")
+	sock := filepath.Join(dir, "sock")
+
+	secrets := filepath.Join(dir, "secrets")
+	ioutil.WriteFile(secrets, []byte("alice:secret\nbob:other\n"), 0600)
+	password := filepath.Join(dir, "password")
+	ioutil.WriteFile(password, []byte("secret\n"), 0600)
+	conf := filepath.Join(dir, "rsyncd.conf")
+	ioutil.WriteFile(conf, []byte("listen = unix:"+sock+"\n"+
+		"[data]\npath = "+data+"\nread only = no\nauth users = alice\nsecrets file = "+secrets+"\n"+
+		"exclude = *.tmp\nmax connections = 1\n"+
+		"[ro]\npath = "+data+"\n"), 0644)
+
+	d, err := loadConfig(conf)
+	if err != nil {
+		t.Fatal("loadConfig failed:", err)
+	}
+	d.log = log.New(ioutil.Discard, "", 0)
+	l, err := d.listenOn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.serve(l) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	writeFile(t, filepath.Join(src, "a/file"), []byte("file in a"), mtime)
+	writeFile(t, filepath.Join(src, "b.tmp"), []byte("excluded"), mtime)
+	writeFile(t, filepath.Join(data, "dir/extra"), []byte("extra"), mtime)
+	writeFile(t, filepath.Join(data, "dir/old.tmp"), []byte("excluded"), mtime)
+
+	remote := "alice@unix:" + sock + "::data"
+	s := &syncer{password: password, delete: true, out: out}
+	if err = s.syncRemote(src+"/", remote+"/dir"); err != nil {
+		t.Fatal("push failed:", err, out.String())
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(data, "dir/a/file")); err != nil || string(got) != "file in a" {
+		t.Fatal("push result wrong:", string(got), err)
+	}
+	if _, err = os.Lstat(filepath.Join(data, "dir/b.tmp")); !os.IsNotExist(err) {
+		t.Fatal("excluded file should not be pushed")
+	}
+	if _, err = os.Lstat(filepath.Join(data, "dir/extra")); !os.IsNotExist(err) {
+		t.Fatal("extra file should be deleted")
+	}
+	if _, err = os.Lstat(filepath.Join(data, "dir/old.tmp")); err != nil {
+		t.Fatal("excluded file should not be deleted:", err)
+	}
+
+	// 从只读模块拉取，PATH不能访问模块以外的文件
+	pull := filepath.Join(dir, "pull")
+	s = &syncer{out: out}
+	if err = s.syncRemote("unix:"+sock+"::ro/../../dir", pull); err != nil {
+		t.Fatal("pull failed:", err, out.String())
+	}
+	if got, err := ioutil.ReadFile(filepath.Join(pull, "dir/a/file")); err != nil || string(got) != "file in a" {
+		t.Fatal("pull result wrong:", string(got), err)
+	}
+	if fi, err := os.Stat(filepath.Join(pull, "dir/a/file")); err != nil || !fi.ModTime().Equal(mtime) {
+		t.Fatal("mtime not synced:", err)
+	}
+
+	for _, c := range []struct {
+		src, dst, password, msg string
+	}{
+		{src + "/", "unix:" + sock + "::ro/dir", "", "read only"},
+		{"unix:" + sock + "::none", pull, "", "unknown module"},
+		{"bob@unix:" + sock + "::data/dir", pull, password, "not allowed"},
+		{"alice@unix:" + sock + "::data/dir", pull, secrets, "wrong password"},
+	} {
+		s = &syncer{password: c.password, out: out}
+		if err = s.syncRemote(c.src, c.dst); err == nil {
+			t.Fatal("sync should fail:", c.src, c.dst)
+		}
+		if !strings.Contains(err.Error(), c.msg) {
+			t.Fatal("error should contain", c.msg, err)
+		}
+	}
+
+	// 模块data只允许一个连接
+	c, err := net.Dial("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	br := bufio.NewReader(c)
+	readLine(br)
+	c.Write([]byte("@RSYNCD: 1\ndata\n"))
+	if line, _ := readLine(br); !strings.HasPrefix(line, daemonAuth) {
+		t.Fatal("should require auth:", line)
+	}
+	s = &syncer{password: password, out: out}
+	if err = s.syncRemote(remote+"/dir", pull); err == nil || !strings.Contains(err.Error(), "max connections") {
+		t.Fatal("connection limit should be reached:", err)
+	}
+}
+
+func TestParseDaemon(t *testing.T) {
+	for arg, expect := range map[string]remoteSpec{
+		"host::mod":               {daemon: true, host: "host", module: "mod", path: "/"},
+		"u@host:8730::mod/a/b/":   {daemon: true, user: "u", host: "host:8730", module: "mod", path: "/a/b/"},
+		"unix:/run/rsyncd::mod/a": {daemon: true, host: "unix:/run/rsyncd", module: "mod", path: "/a"},
+		"host:path":               {host: "host", path: "path"},
+		"user@host:":              {host: "user@host", path: "."},
+	} {
+		if r, ok := parseRemote(arg); !ok || r != expect {
+			t.Fatalf("parseRemote %s: %+v", arg, r)
+		}
+	}
+	for _, arg := range []string{"dir/a::b", "::mod", "/abs/path", "local"} {
+		if _, ok := parseRemote(arg); ok {
+			t.Fatal("should be local path:", arg)
+		}
+	}
+}
+
+// 客户端推送的符号链接不能用于在之后的连接中读写模块以外的文件
+func TestDaemonSymlink(t *testing.T) {
+	out := new(bytes.Buffer)
+	dir, err := ioutil.TempDir("", "rsync-daemon-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	data := filepath.Join(dir, "data")
+	outside := filepath.Join(dir, "outside")
+	sock := filepath.Join(dir, "sock")
+	conf := filepath.Join(dir, "rsyncd.conf")
+	ioutil.WriteFile(conf, []byte("listen = unix:"+sock+"\n[data]\npath = "+data+"\nread only = no\n"), 0644)
+
+	d, err := loadConfig(conf)
+	if err != nil {
+		t.Fatal("loadConfig failed:", err)
+	}
+	d.log = log.New(ioutil.Discard, "", 0)
+	l, err := d.listenOn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.serve(l) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	mtime := time.Now()
+	writeFile(t, filepath.Join(outside, "secret"), []byte("secret"), mtime)
+	writeFile(t, filepath.Join(src, "file"), []byte("file"), mtime)
+	os.Symlink(outside, filepath.Join(src, "x"))
+	os.Symlink("../outside", filepath.Join(src, "y"))
+	os.Symlink("file", filepath.Join(src, "z"))
+	remote := "unix:" + sock + "::data"
+
+	// 第一次连接推送符号链接，指向模块以外的被拒绝
+	s := &syncer{out: out}
+	if err = s.syncRemote(src+"/", remote); err == nil {
+		t.Fatal("push of unsafe symlinks should fail")
+	}
+	for _, name := range []string{"x", "y"} {
+		if _, err = os.Lstat(filepath.Join(data, name)); !os.IsNotExist(err) {
+			t.Fatal("unsafe symlink should not be created:", name)
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(data, "z")); err != nil || link != "file" {
+		t.Fatal("safe symlink should be created:", link, err)
+	}
+
+	// 模块中已有指向模块以外的符号链接，第二次连接不能通过它读写
+	if err = os.Symlink(outside, filepath.Join(data, "x")); err != nil {
+		t.Fatal(err)
+	}
+	for _, c := range [][2]string{
+		{remote + "/x/secret", filepath.Join(dir, "pull")},
+		{remote + "/x/", filepath.Join(dir, "pull")},
+		{src + "/", remote + "/x/"},
+		{src + "/", remote + "/x/sub"},
+	} {
+		s = &syncer{out: out}
+		if err = s.syncRemote(c[0], c[1]); err == nil || !strings.Contains(err.Error(), "symlink") {
+			t.Fatal("sync through symlink should fail:", c, err)
+		}
+	}
+	if _, err = os.Lstat(filepath.Join(dir, "pull")); !os.IsNotExist(err) {
+		t.Fatal("file outside module should not be pulled")
+	}
+	if _, err = os.Lstat(filepath.Join(outside, "file")); !os.IsNotExist(err) {
+		t.Fatal("file outside module should not be pushed")
+	}
+}
+
+// 不发送数据的客户端在握手和同步时都会超时，不会一直占用连接数
+func TestDaemonTimeout(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-daemon-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "sock")
+	conf := filepath.Join(dir, "rsyncd.conf")
+	ioutil.WriteFile(conf, []byte("listen = unix:"+sock+"\n[data]\npath = "+dir+"\nmax connections = 1\n"), 0644)
+
+	d, err := loadConfig(conf)
+	if err != nil {
+		t.Fatal("loadConfig failed:", err)
+	}
+	d.log = log.New(ioutil.Discard, "", 0)
+	d.timeout = 100 * time.Millisecond
+	l, err := d.listenOn()
+	if err != nil {
+		t.Fatal(err)
+	}
+	done := make(chan error, 1)
+	go func() { done <- d.serve(l) }()
+	defer func() {
+		l.Close()
+		<-done
+	}()
+
+	for _, handshake := range []string{"", "@RSYNCD: 1\ndata\n", "@RSYNCD: 1\ndata\n--server\n--sender\n.\n\n"} {
+		c, err := net.Dial("unix", sock)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c.Write([]byte(handshake))
+		start := time.Now()
+		c.SetReadDeadline(start.Add(5 * time.Second))
+		if _, err = ioutil.ReadAll(c); err != nil || time.Since(start) > 2*time.Second {
+			t.Fatalf("silent client should be disconnected: %q %v", handshake, err)
+		}
+		c.Close()
+	}
+	// 超时的连接已经释放
+	s := &syncer{out: ioutil.Discard}
+	if err = s.syncRemote("unix:"+sock+"::data/rsyncd.conf", filepath.Join(dir, "pull")); err != nil {
+		t.Fatal("pull failed:", err)
+	}
+}
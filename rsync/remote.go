@@ -0,0 +1,536 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/dchest/blake2b"
+	"github.com/smtc/rsync"
+)
+
+// 通过remote shell同步
+//
+// SRC或DST为HOST:PATH时，启动 RSH HOST RSYNC_PATH --server [OPTIONS] PATH (默认为ssh和rsync)，
+// 通过子进程的stdin/stdout使用rsync库的同步协议(见protocol.go)，本地为客户端，远端为服务端。
+// 推送时本地是发送方，远端是接收方；拉取时远端使用--sender，是发送方。
+//
+// 发送方遍历目录树，每个目录、普通文件和符号链接发送一个FileHeader，符号链接的内容是链接目标。
+// 接收方比较长度和修改时间，不需要更新的文件跳过；更新的文件以已有文件为basis接收到同一目录下的
+// 临时文件，rename后设置权限和修改时间。接收方知道发送方的全部路径，--delete由接收方执行，只删除
+// 发送方同步的目录中多余的文件。--dry-run时接收方仍然接收delta，但不写入文件。
+
+// 远程路径，HOST:PATH通过remote shell，HOST::MODULE/PATH连接daemon(见daemon.go)
+type remoteSpec struct {
+	daemon bool
+	user   string // daemon的用户名，remote shell的用户名在host中
+	host   string
+	module string
+	path   string
+}
+
+// HOST:PATH，第一个:之前没有/；或者[USER@]HOST::MODULE[/PATH]，HOST可以是unix:SOCKET
+func parseRemote(arg string) (r remoteSpec, ok bool) {
+	if r, ok = parseDaemon(arg); ok {
+		return
+	}
+	i := strings.IndexByte(arg, ':')
+	if i <= 0 || strings.ContainsRune(arg[:i], '/') {
+		return r, false
+	}
+	r = remoteSpec{host: arg[:i], path: arg[i+1:]}
+	if r.path == "" {
+		r.path = "."
+	}
+	return r, true
+}
+
+// 远端进程的stdin/stdout
+type remoteConn struct {
+	io.Reader
+	io.WriteCloser
+	cmd *exec.Cmd
+}
+
+// 连接远端，sender为true时远端是发送方
+func (s *syncer) openRemote(r remoteSpec, sender bool) (rc io.ReadWriteCloser, err error) {
+	args := append(s.serverArgs(sender), r.path)
+	if r.daemon {
+		return s.dialDaemon(r, args)
+	}
+	return s.startRemote(r.host, args...)
+}
+
+// 启动远端: RSH HOST RSYNC_PATH args...
+func (s *syncer) startRemote(host string, args ...string) (rc *remoteConn, err error) {
+	rsh := strings.Fields(s.rsh)
+	if len(rsh) == 0 {
+		rsh = []string{"ssh"}
+	}
+	rsyncPath := s.rsyncPath
+	if rsyncPath == "" {
+		rsyncPath = "rsync"
+	}
+	argv := append(append(rsh[1:], host, rsyncPath), args...)
+	rc = &remoteConn{cmd: exec.Command(rsh[0], argv...)}
+	rc.cmd.Stderr = os.Stderr
+	if rc.WriteCloser, err = rc.cmd.StdinPipe(); err != nil {
+		return
+	}
+	if rc.Reader, err = rc.cmd.StdoutPipe(); err != nil {
+		return
+	}
+	err = rc.cmd.Start()
+	return
+}
+
+// 关闭远端的stdin，等待远端退出
+func (rc *remoteConn) Close() error {
+	rc.WriteCloser.Close()
+	return rc.cmd.Wait()
+}
+
+// 远端服务端的参数
+func (s *syncer) serverArgs(sender bool) (args []string) {
+	args = append(args, "--server")
+	if sender {
+		return append(args, "--sender")
+	}
+	for _, opt := range []struct {
+		set  bool
+		name string
+	}{{s.delete, "--delete"}, {s.dryRun, "--dry-run"}, {s.checksum, "--checksum"}, {s.wholeFile, "--whole-file"}} {
+		if opt.set {
+			args = append(args, opt.name)
+		}
+	}
+	return
+}
+
+// src或dst为远程路径
+func (s *syncer) syncRemote(src, dst string) (err error) {
+	var (
+		rc   io.ReadWriteCloser
+		conn *rsync.Conn
+		fi   os.FileInfo
+	)
+
+	srcRemote, srcOk := parseRemote(src)
+	dstRemote, dstOk := parseRemote(dst)
+	if srcOk && dstOk {
+		return errors.New("source and destination can not both be remote")
+	}
+
+	if srcOk {
+		// 拉取：远端发送，SRC不以/结尾时同步到DST/SRC
+		if rc, err = s.openRemote(srcRemote, true); err != nil {
+			return
+		}
+		if conn, err = rsync.NewClientConn(rc, &rsync.ProtocolOptions{BlockLen: s.blockLen}); err == nil {
+			err = s.receiveTree(conn, dst, hasSlash(srcRemote.path))
+			s.stats.sent = conn.BytesReceived()
+		}
+	} else {
+		// 推送：本地发送，DST总是目录
+		if fi, err = os.Lstat(src); err != nil {
+			return
+		}
+		delete := s.delete
+		if fi.IsDir() && !hasSlash(src) {
+			dstRemote.path = path.Join(dstRemote.path, filepath.Base(src))
+		} else if !fi.IsDir() {
+			// 单个文件不删除DST中的其他文件
+			s.delete = false
+		}
+		rc, err = s.openRemote(dstRemote, false)
+		s.delete = delete
+		if err != nil {
+			return
+		}
+		if conn, err = rsync.NewClientConn(rc, &rsync.ProtocolOptions{BlockLen: s.blockLen}); err == nil {
+			if err = s.sendTree(conn, src, fi.IsDir()); err == nil {
+				err = conn.Done()
+			}
+			s.stats.sent = conn.BytesSent()
+		}
+	}
+
+	if e := rc.Close(); e != nil && err == nil {
+		err = fmt.Errorf("remote failed: %v", e)
+	}
+	if err == nil {
+		err = s.result()
+	}
+	return
+}
+
+// 远端: rsync --server [--sender] [OPTIONS] PATH，使用stdin/stdout
+func (s *syncer) serve(sender bool, p string) error {
+	rw := struct {
+		io.Reader
+		io.Writer
+	}{os.Stdin, os.Stdout}
+	return s.serveOn(rw, sender, p)
+}
+
+// 在rw上作为服务端，sender为true时发送p，否则接收到p
+func (s *syncer) serveOn(rw io.ReadWriter, sender bool, p string) (err error) {
+	var (
+		conn *rsync.Conn
+		fi   os.FileInfo
+	)
+
+	if conn, err = rsync.NewServerConn(rw, nil); err != nil {
+		return
+	}
+	if !sender {
+		return s.receiveTree(conn, p, true)
+	}
+	if fi, err = os.Lstat(p); err != nil {
+		return
+	}
+	if err = s.sendTree(conn, p, fi.IsDir() && hasSlash(p)); err != nil {
+		return
+	}
+	if err = conn.Done(); err == nil {
+		err = s.result()
+	}
+	return
+}
+
+// 发送目录树，contents为true时发送root中的内容，否则路径以root的文件名开始
+func (s *syncer) sendTree(conn *rsync.Conn, root string, contents bool) error {
+	prefix := ""
+	if !contents {
+		prefix = filepath.Base(root)
+	}
+	return filepath.Walk(root, func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			s.fail(p, err)
+			return nil
+		}
+		rel, err := filepath.Rel(root, p)
+		if err != nil {
+			return err
+		}
+		name := path.Join(prefix, filepath.ToSlash(rel))
+		if name == "." {
+			return nil
+		}
+		if s.excluded(name, fi.IsDir()) {
+			if fi.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		return s.sendEntry(conn, p, name, fi)
+	})
+}
+
+// 只返回连接的错误，单个文件的错误记录后继续
+func (s *syncer) sendEntry(conn *rsync.Conn, p, name string, fi os.FileInfo) (err error) {
+	var (
+		rd      io.ReadSeeker
+		skipped bool
+		re      *rsync.RemoteError
+	)
+
+	hdr := &rsync.FileHeader{Name: name, Mode: fi.Mode(), ModTime: fi.ModTime()}
+	switch {
+	case fi.IsDir():
+		rd = bytes.NewReader(nil)
+	case fi.Mode()&os.ModeSymlink != 0:
+		link, e := os.Readlink(p)
+		if e != nil {
+			s.fail(p, e)
+			return nil
+		}
+		rd = strings.NewReader(link)
+		hdr.Size = int64(len(link))
+	case fi.Mode().IsRegular():
+		s.stats.files++
+		f, e := os.Open(p)
+		if e != nil {
+			s.fail(p, e)
+			return nil
+		}
+		defer f.Close()
+		rd = f
+		hdr.Size = fi.Size()
+	default:
+		s.logf("skipping non-regular file %s\n", p)
+		return nil
+	}
+
+	if skipped, err = conn.SendFile(hdr, rd); err != nil {
+		if errors.As(err, &re) || errors.Is(err, rsync.ErrLengthMismatch) || errors.Is(err, rsync.ErrChecksumMismatch) {
+			s.fail(name, err)
+			return nil
+		}
+		return
+	}
+	if !skipped && fi.Mode().IsRegular() {
+		s.logf("%s\n", name)
+		s.stats.updated++
+		s.stats.size += fi.Size()
+	}
+	return
+}
+
+// FileHeader实现os.FileInfo，用于setAttrs
+type headerInfo struct {
+	hdr *rsync.FileHeader
+}
+
+func (h headerInfo) Name() string       { return path.Base(h.hdr.Name) }
+func (h headerInfo) Size() int64        { return h.hdr.Size }
+func (h headerInfo) Mode() os.FileMode  { return h.hdr.Mode }
+func (h headerInfo) ModTime() time.Time { return h.hdr.ModTime }
+func (h headerInfo) IsDir() bool        { return h.hdr.Mode.IsDir() }
+func (h headerInfo) Sys() interface{}   { return nil }
+
+// 接收目录树到dst。deleteRoot为true时，--delete也删除dst中多余的文件，否则只删除发送方的
+// 目录中多余的文件
+func (s *syncer) receiveTree(conn *rsync.Conn, dst string, deleteRoot bool) (err error) {
+	var (
+		hdr   *rsync.FileHeader
+		dirs  []dirAttr
+		names = make(map[string]os.FileMode)
+		links = make(map[string]bool)
+	)
+
+	if err = s.syncDir(dst); err != nil {
+		return
+	}
+	for {
+		if hdr, err = conn.NextFile(); err == io.EOF {
+			break
+		} else if err != nil {
+			return
+		}
+		target := filepath.Join(dst, filepath.FromSlash(hdr.Name))
+		fi := headerInfo{hdr}
+		// 父目录不能是dst中已有的或者本次同步创建的符号链接。同步的目录已经替换了符号链接，
+		// dry run时没有替换，也拒绝
+		if e := rsync.CheckTreeParents(dst, hdr.Name, links, nil); e != nil {
+			s.fail(target, e)
+			err = conn.RejectFile(e)
+		} else if s.excluded(hdr.Name, fi.IsDir()) {
+			s.logf("skipping excluded %s\n", target)
+			err = conn.SkipFile()
+		} else {
+			names[hdr.Name] = hdr.Mode
+			switch {
+			case fi.IsDir():
+				if e = s.syncDir(target); e != nil {
+					s.fail(target, e)
+					err = conn.RejectFile(e)
+				} else {
+					dirs = append(dirs, dirAttr{target, fi})
+					err = conn.SkipFile()
+				}
+			case hdr.Mode&os.ModeSymlink != 0:
+				links[hdr.Name] = true
+				err = s.receiveLink(conn, target, hdr.Size)
+			case hdr.Mode.IsRegular():
+				s.stats.files++
+				err = s.receiveFile(conn, target, fi)
+			default:
+				err = conn.SkipFile()
+			}
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	err = nil
+	if s.delete {
+		err = s.deleteExtra(dst, func(rel string) bool {
+			rel = filepath.ToSlash(rel)
+			if _, ok := names[rel]; ok {
+				return true
+			}
+			// 不同步的文件不删除
+			if fi, e := os.Lstat(filepath.Join(dst, rel)); e == nil && s.excluded(rel, fi.IsDir()) {
+				return true
+			}
+			if parent := path.Dir(rel); parent != "." {
+				return !names[parent].IsDir()
+			}
+			return !deleteRoot
+		})
+	}
+	for i := len(dirs) - 1; i >= 0 && !s.dryRun; i-- {
+		if e := setAttrs(dirs[i].path, dirs[i].fi); e != nil {
+			s.fail(dirs[i].path, e)
+		}
+	}
+	if err == nil {
+		err = s.result()
+	}
+	return
+}
+
+// 只返回连接的错误
+func (s *syncer) receiveFile(conn *rsync.Conn, target string, fi os.FileInfo) (err error) {
+	var (
+		ti    os.FileInfo
+		basis io.ReadSeeker
+		out   *os.File
+		w     io.Writer = ioutil.Discard
+	)
+
+	if ti, err = os.Lstat(target); err != nil && !os.IsNotExist(err) {
+		s.fail(target, err)
+		return conn.RejectFile(err)
+	}
+	err = nil
+	exists := ti != nil && ti.Mode().IsRegular()
+	sameSize := exists && ti.Size() == fi.Size()
+	if sameSize && !s.checksum && ti.ModTime().Unix() == fi.ModTime().Unix() {
+		if !s.dryRun && ti.Mode().Perm() != fi.Mode().Perm() {
+			if e := setAttrs(target, fi); e != nil {
+				s.fail(target, e)
+			}
+		}
+		return conn.SkipFile()
+	}
+
+	if exists && !s.wholeFile {
+		f, e := os.Open(target)
+		if e != nil {
+			s.fail(target, e)
+			return conn.RejectFile(e)
+		}
+		defer f.Close()
+		basis = f
+	}
+	if !s.dryRun {
+		if ti != nil && !exists {
+			if e := os.RemoveAll(target); e != nil {
+				s.fail(target, e)
+				return conn.RejectFile(e)
+			}
+		}
+		dir, base := filepath.Split(target)
+		if out, err = ioutil.TempFile(dir, "."+base+"."); err != nil {
+			s.fail(target, err)
+			return conn.RejectFile(err)
+		}
+		defer func() {
+			if out != nil {
+				out.Close()
+				os.Remove(out.Name())
+			}
+		}()
+		w = out
+	}
+
+	h := blake2b.New512()
+	if e := conn.ReceiveFile(basis, io.MultiWriter(w, h)); e != nil {
+		s.fail(target, e)
+		return nil
+	}
+	// --checksum时内容相同的文件不更新，只同步权限和修改时间
+	if sameSize && s.checksum {
+		if sum, e := fileSum(target); e == nil && bytes.Equal(sum, h.Sum(nil)) {
+			if !s.dryRun && (ti.Mode().Perm() != fi.Mode().Perm() || ti.ModTime().Unix() != fi.ModTime().Unix()) {
+				if e = setAttrs(target, fi); e != nil {
+					s.fail(target, e)
+				}
+			}
+			return nil
+		}
+	}
+
+	s.logf("%s\n", target)
+	s.stats.updated++
+	s.stats.size += fi.Size()
+	if s.dryRun {
+		return nil
+	}
+	e := out.Chmod(fi.Mode().Perm())
+	if e == nil {
+		e = out.Sync()
+	}
+	if e == nil {
+		e = out.Close()
+	}
+	if e == nil {
+		e = os.Rename(out.Name(), target)
+	}
+	if e == nil {
+		out = nil
+		e = setAttrs(target, fi)
+	}
+	if e != nil {
+		s.fail(target, e)
+	}
+	return nil
+}
+
+// 只返回连接的错误
+func (s *syncer) receiveLink(conn *rsync.Conn, target string, size int64) (err error) {
+	link := &linkWriter{size: size, safe: s.safeLinks}
+
+	if e := conn.ReceiveFile(nil, link); e != nil {
+		s.fail(target, e)
+		return nil
+	}
+	// 长度与FileHeader不同时不会在Write中检查
+	if s.safeLinks && unsafeLink(link.String()) {
+		s.fail(target, fmt.Errorf("unsafe symlink to %s", link.String()))
+		return nil
+	}
+	if old, e := os.Readlink(target); e == nil && old == link.String() {
+		return nil
+	}
+	s.logf("%s -> %s\n", target, link.String())
+	if s.dryRun {
+		return nil
+	}
+	e := os.RemoveAll(target)
+	if e == nil {
+		e = os.Symlink(link.String(), target)
+	}
+	if e != nil {
+		s.fail(target, e)
+	}
+	return nil
+}
+
+// 接收符号链接的目标。safe为true时，目标完整后检查，Write返回错误使发送方收到拒绝
+type linkWriter struct {
+	bytes.Buffer
+	size int64
+	safe bool
+}
+
+func (w *linkWriter) Write(p []byte) (n int, err error) {
+	if n, err = w.Buffer.Write(p); err == nil && w.safe && int64(w.Len()) >= w.size && unsafeLink(w.String()) {
+		err = fmt.Errorf("unsafe symlink to %s", w.String())
+	}
+	return
+}
+
+// 符号链接的目标可能在同步的目录以外
+func unsafeLink(link string) bool {
+	if path.IsAbs(link) {
+		return true
+	}
+	for _, name := range strings.Split(link, "/") {
+		if name == ".." {
+			return true
+		}
+	}
+	return false
+}
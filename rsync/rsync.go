@@ -1,5 +1,187 @@
 package main
 
+import (
+	"fmt"
+	"net"
+	"os"
+
+	"github.com/codegangsta/cli"
+)
+
+const (
+	version = "0.1.0"
+)
+
 func main() {
 
+	app := setupApp()
+
+	app.Run(os.Args)
+}
+
+func setupApp() *cli.App {
+	app := cli.NewApp()
+	app.Name = "rsync"
+	app.Version = version
+	// -v与rsync相同表示--verbose，不注册cli的version, v
+	app.HideVersion = true
+	app.Usage = "    [OPTIONS] SRC DST\n\n" +
+		"     sync local file tree SRC to DST. With trailing slash SRC/ the contents of SRC are synced\n" +
+		"     into DST, without it DST/SRC is created. Files with different size or mtime are updated\n" +
+		"     by signature, delta and patch against the existing DST file, and replaced atomically.\n" +
+		"     SRC or DST may be HOST:PATH, synced over remote shell (-e) running rsync --server on HOST,\n" +
+		"     or [USER@]HOST::MODULE/PATH, synced with rsync --daemon on HOST.\n"
+	app.Flags = []cli.Flag{
+		cli.BoolFlag{
+			Name:  "verbose,v",
+			Usage: "Print every updated file",
+		},
+		cli.BoolFlag{
+			Name:  "dry-run,n",
+			Usage: "Show what would be updated, without changing DST",
+		},
+		cli.BoolFlag{
+			Name:  "checksum,c",
+			Usage: "Compare files of the same size by checksum, not mtime",
+		},
+		cli.BoolFlag{
+			Name:  "whole-file,W",
+			Usage: "Copy changed files without delta",
+		},
+		cli.BoolFlag{
+			Name:  "delete",
+			Usage: "Delete files in DST which do not exist in SRC",
+		},
+		cli.IntFlag{
+			Name:  "block-size,b",
+			Value: 0,
+			Usage: "Signature block size, 0 means default",
+		},
+		cli.StringFlag{
+			Name:  "rsh,e",
+			Value: "ssh",
+			Usage: "Remote shell command for HOST:PATH",
+		},
+		cli.StringFlag{
+			Name:  "rsync-path",
+			Value: "rsync",
+			Usage: "rsync command on the remote host",
+		},
+		cli.BoolFlag{
+			Name:  "server",
+			Usage: "Run as the remote end on stdin/stdout, started by the remote shell",
+		},
+		cli.BoolFlag{
+			Name:  "sender",
+			Usage: "With --server, send PATH instead of receiving into it",
+		},
+		cli.BoolFlag{
+			Name:  "daemon",
+			Usage: "Run as daemon serving modules in config file",
+		},
+		cli.StringFlag{
+			Name:  "config",
+			Value: "/etc/rsyncd.conf",
+			Usage: "Daemon config file",
+		},
+		cli.StringFlag{
+			Name:  "listen",
+			Usage: "Daemon listen address, HOST:PORT or unix:PATH, overrides config file",
+		},
+		cli.IntFlag{
+			Name:  "port",
+			Value: 873,
+			Usage: "Daemon TCP port for HOST::MODULE",
+		},
+		cli.StringFlag{
+			Name:  "password-file",
+			Usage: "Read daemon password from file, default env RSYNC_PASSWORD",
+		},
+	}
+	app.Action = doSync
+
+	return app
+}
+
+// rsync [OPTIONS] {src} {dst}
+func doSync(c *cli.Context) {
+	if c.Bool("server") {
+		doServer(c)
+		return
+	}
+	if c.Bool("daemon") {
+		doDaemon(c)
+		return
+	}
+	if len(c.Args()) != 2 {
+		fmt.Println("No param found or too many params.\nUsage:", c.App.Usage)
+		return
+	}
+
+	s := &syncer{
+		verbose:   c.Bool("verbose"),
+		dryRun:    c.Bool("dry-run"),
+		checksum:  c.Bool("checksum"),
+		wholeFile: c.Bool("whole-file"),
+		delete:    c.Bool("delete"),
+		blockLen:  uint32(c.Int("block-size")),
+		rsh:       c.String("rsh"),
+		rsyncPath: c.String("rsync-path"),
+		password:  c.String("password-file"),
+		port:      c.Int("port"),
+		out:       os.Stdout,
+	}
+	var err error
+	src, dst := c.Args().First(), c.Args().Get(1)
+	_, srcRemote := parseRemote(src)
+	if _, dstRemote := parseRemote(dst); srcRemote || dstRemote {
+		err = s.syncRemote(src, dst)
+	} else {
+		err = s.syncTree(src, dst)
+	}
+	s.printStats()
+	if err != nil {
+		fmt.Println("rsync:", err)
+		os.Exit(1)
+	}
+}
+
+// rsync --server [--sender] [OPTIONS] {path}
+// stdout用于同步协议，错误输出到stderr
+func doServer(c *cli.Context) {
+	if len(c.Args()) != 1 {
+		fmt.Fprintln(os.Stderr, "rsync server: one path should be provided")
+		os.Exit(1)
+	}
+
+	s := &syncer{
+		dryRun:    c.Bool("dry-run"),
+		checksum:  c.Bool("checksum"),
+		wholeFile: c.Bool("whole-file"),
+		delete:    c.Bool("delete"),
+		out:       os.Stderr,
+	}
+	if err := s.serve(c.Bool("sender"), c.Args().First()); err != nil {
+		fmt.Fprintln(os.Stderr, "rsync server:", err)
+		os.Exit(1)
+	}
+}
+
+// rsync --daemon [--config FILE] [--listen ADDR]
+func doDaemon(c *cli.Context) {
+	d, err := loadConfig(c.String("config"))
+	if err == nil {
+		if addr := c.String("listen"); addr != "" {
+			d.listen = addr
+		}
+		err = d.openLog()
+	}
+	if err == nil {
+		var l net.Listener
+		if l, err = d.listenOn(); err == nil {
+			err = d.serve(l)
+		}
+	}
+	fmt.Fprintln(os.Stderr, "rsync daemon:", err)
+	os.Exit(1)
 }
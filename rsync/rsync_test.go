@@ -0,0 +1,266 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"math/rand"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/smtc/rsync"
+)
+
+// TestRemoteSync中作为远端的rsync --server运行
+func TestMain(m *testing.M) {
+	if os.Getenv("RSYNC_TEST_SERVER") == "1" {
+		setupApp().Run(append([]string{"rsync"}, os.Args[1:]...))
+		os.Exit(0)
+	}
+	os.Exit(m.Run())
+}
+
+func writeFile(t *testing.T, fn string, data []byte, mtime time.Time) {
+	if err := os.MkdirAll(filepath.Dir(fn), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(fn, data, 0644); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(fn, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestSyncTree(t *testing.T) {
+	var (
+		big   = make([]byte, 200000)
+		mtime = time.Now().Add(-time.Hour).Truncate(time.Second)
+		out   = new(bytes.Buffer)
+	)
+	rand.New(rand.NewSource(1)).Read(big)
+
+	dir, err := ioutil.TempDir("", "rsync-sync-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	newBig := append(append(append([]byte{}, big[:100000]...), "inserted"...), big[100000:]...)
+	writeFile(t, filepath.Join(src, "big"), newBig, mtime)
+	writeFile(t, filepath.Join(src, "a/b/small"), []byte("small file"), mtime)
+	writeFile(t, filepath.Join(src, "same"), []byte("same"), mtime)
+	if err = os.Symlink("a/b/small", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dst, "big"), big, mtime.Add(-time.Hour))
+	writeFile(t, filepath.Join(dst, "same"), []byte("same"), mtime)
+	writeFile(t, filepath.Join(dst, "extra/file"), []byte("extra"), mtime)
+
+	s := &syncer{delete: true, out: out}
+	if err = s.syncTree(src+"/", dst); err != nil {
+		t.Fatal("syncTree failed:", err, out.String())
+	}
+	if s.stats.files != 3 || s.stats.updated != 2 || s.stats.deleted != 1 {
+		t.Fatalf("sync stats wrong: %+v", s.stats)
+	}
+	// big通过delta更新，发送的数据远小于文件长度
+	if s.stats.sent > 20000 {
+		t.Fatal("big file should be updated by delta, sent:", s.stats.sent)
+	}
+	for fn, expect := range map[string][]byte{"big": newBig, "a/b/small": []byte("small file"), "same": []byte("same")} {
+		data, err := ioutil.ReadFile(filepath.Join(dst, fn))
+		if err != nil || !bytes.Equal(data, expect) {
+			t.Fatal("sync result wrong:", fn, err)
+		}
+		fi, _ := os.Stat(filepath.Join(dst, fn))
+		if !fi.ModTime().Equal(mtime) {
+			t.Fatal("mtime not synced:", fn, fi.ModTime())
+		}
+	}
+	if link, err := os.Readlink(filepath.Join(dst, "link")); err != nil || link != "a/b/small" {
+		t.Fatal("symlink not synced:", link, err)
+	}
+	if _, err = os.Lstat(filepath.Join(dst, "extra")); !os.IsNotExist(err) {
+		t.Fatal("extra dir should be deleted")
+	}
+
+	// 再次同步，没有需要更新的文件
+	s = &syncer{out: out}
+	if err = s.syncTree(src+"/", dst); err != nil || s.stats.updated != 0 {
+		t.Fatalf("second sync should update nothing: %v %+v", err, s.stats)
+	}
+
+	// 不以/结尾时同步到dst/src，dry run不修改dst
+	s = &syncer{dryRun: true, out: out}
+	if err = s.syncTree(src, dst); err != nil || s.stats.updated != 3 {
+		t.Fatalf("dry run stats wrong: %v %+v", err, s.stats)
+	}
+	if _, err = os.Lstat(filepath.Join(dst, "src")); !os.IsNotExist(err) {
+		t.Fatal("dry run should not create dst/src")
+	}
+}
+
+// 通过命令行参数运行，检查flag的定义
+func TestApp(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-app-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+	writeFile(t, filepath.Join(src, "a/file"), []byte("file"), time.Now())
+
+	if err = setupApp().Run([]string{"rsync", "--help"}); err != nil {
+		t.Fatal("help failed:", err)
+	}
+	if err = setupApp().Run([]string{"rsync", "-v", "-c", "--delete", "-b", "1024", src + "/", dst}); err != nil {
+		t.Fatal("run failed:", err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dst, "a/file")); err != nil || string(data) != "file" {
+		t.Fatal("sync by command line failed:", err)
+	}
+}
+
+func TestRemoteSync(t *testing.T) {
+	var (
+		big   = make([]byte, 200000)
+		mtime = time.Now().Add(-time.Hour).Truncate(time.Second)
+		out   = new(bytes.Buffer)
+	)
+	rand.New(rand.NewSource(2)).Read(big)
+
+	dir, err := ioutil.TempDir("", "rsync-remote-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "src")
+	dst := filepath.Join(dir, "dst")
+
+	// remote shell忽略HOST，在本地运行测试程序作为rsync --server
+	rsh := filepath.Join(dir, "rsh")
+	if err = ioutil.WriteFile(rsh, []byte("#!/bin/sh\nshift\nexec \"$@\"\n"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("RSYNC_TEST_SERVER", "1")
+
+	newBig := append(append(append([]byte{}, big[:100000]...), "inserted"...), big[100000:]...)
+	writeFile(t, filepath.Join(src, "big"), newBig, mtime)
+	writeFile(t, filepath.Join(src, "a/b/small"), []byte("small file"), mtime)
+	if err = os.Symlink("a/b/small", filepath.Join(src, "link")); err != nil {
+		t.Fatal(err)
+	}
+	writeFile(t, filepath.Join(dst, "big"), big, mtime.Add(-time.Hour))
+	writeFile(t, filepath.Join(dst, "extra/file"), []byte("extra"), mtime)
+
+	check := func(root string) {
+		for fn, expect := range map[string][]byte{"big": newBig, "a/b/small": []byte("small file")} {
+			data, err := ioutil.ReadFile(filepath.Join(root, fn))
+			if err != nil || !bytes.Equal(data, expect) {
+				t.Fatal("sync result wrong:", root, fn, err)
+			}
+			fi, _ := os.Stat(filepath.Join(root, fn))
+			if !fi.ModTime().Equal(mtime) {
+				t.Fatal("mtime not synced:", root, fn, fi.ModTime())
+			}
+		}
+		if link, err := os.Readlink(filepath.Join(root, "link")); err != nil || link != "a/b/small" {
+			t.Fatal("symlink not synced:", root, link, err)
+		}
+	}
+
+	// 推送
+	s := &syncer{rsh: rsh, rsyncPath: os.Args[0], delete: true, out: out}
+	if err = s.syncRemote(src+"/", "remote:"+dst); err != nil {
+		t.Fatal("push failed:", err, out.String())
+	}
+	if s.stats.files != 2 || s.stats.updated != 2 {
+		t.Fatalf("push stats wrong: %+v", s.stats)
+	}
+	if s.stats.sent > 20000 {
+		t.Fatal("big file should be updated by delta, sent:", s.stats.sent)
+	}
+	check(dst)
+	if _, err = os.Lstat(filepath.Join(dst, "extra")); !os.IsNotExist(err) {
+		t.Fatal("extra dir should be deleted")
+	}
+
+	// 拉取，不以/结尾时同步到pull/src
+	pull := filepath.Join(dir, "pull")
+	s = &syncer{rsh: rsh, rsyncPath: os.Args[0], out: out}
+	if err = s.syncRemote("remote:"+src, pull); err != nil {
+		t.Fatal("pull failed:", err, out.String())
+	}
+	if s.stats.updated != 2 {
+		t.Fatalf("pull stats wrong: %+v", s.stats)
+	}
+	check(filepath.Join(pull, "src"))
+
+	// 再次同步，没有需要更新的文件
+	s = &syncer{rsh: rsh, rsyncPath: os.Args[0], out: out}
+	if err = s.syncRemote("remote:"+src, pull); err != nil || s.stats.updated != 0 {
+		t.Fatalf("second pull should update nothing: %v %+v", err, s.stats)
+	}
+}
+
+// 发送方不发送父目录时，接收方不能通过dst中已有的或者本次同步的符号链接写入dst以外的文件
+func TestReceiveSymlinkParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-receive-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	dst := filepath.Join(dir, "dst")
+	outside := filepath.Join(dir, "outside")
+	os.MkdirAll(dst, 0755)
+	os.MkdirAll(outside, 0755)
+	if err = os.Symlink(outside, filepath.Join(dst, "x")); err != nil {
+		t.Fatal(err)
+	}
+
+	cc, sc := net.Pipe()
+	defer cc.Close()
+	done := make(chan error, 1)
+	go func() {
+		defer sc.Close()
+		s := &syncer{out: ioutil.Discard}
+		done <- s.serveOn(sc, false, dst)
+	}()
+	conn, err := rsync.NewClientConn(cc, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	mtime := time.Now()
+	for _, f := range []struct{ name, data string }{
+		{"x/passwd", "evil"},
+		{"y", outside},
+		{"y/passwd", "evil"},
+	} {
+		hdr := &rsync.FileHeader{Name: f.name, Mode: 0644, Size: int64(len(f.data)), ModTime: mtime}
+		if f.name == "y" {
+			hdr.Mode = os.ModeSymlink | 0777
+		}
+		_, err = conn.SendFile(hdr, strings.NewReader(f.data))
+		var re *rsync.RemoteError
+		if f.name == "y" && err != nil || f.name != "y" && !errors.As(err, &re) {
+			t.Fatal("send wrong:", f.name, err)
+		}
+	}
+	if err = conn.Done(); err != nil {
+		t.Fatal(err)
+	}
+	if err = <-done; err == nil {
+		t.Fatal("receive should fail")
+	}
+	if _, err = os.Lstat(filepath.Join(outside, "passwd")); !os.IsNotExist(err) {
+		t.Fatal("file outside dst should not be written")
+	}
+}
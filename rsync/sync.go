@@ -0,0 +1,418 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/dchest/blake2b"
+	"github.com/smtc/rsync"
+)
+
+// 本地目录树同步
+//
+// 遍历src，dst中不存在、类型不同、长度或修改时间(秒)不同的文件需要更新，--checksum时长度相同的
+// 文件比较blake2b hash。dst中已经存在的普通文件使用rsync库更新：对dst生成signature，用signature
+// 和src生成delta(带trailer)，再用delta patch dst。结果写入同一目录下的临时文件，校验后rename，
+// dst要么是原来的文件，要么是完整的新文件。dst中不存在的文件直接复制，同样写入临时文件后rename。
+//
+// 文件的权限和修改时间与src相同，目录的权限和修改时间在目录中的文件同步完成后设置。符号链接重新
+// 创建，设备文件、socket等其他类型的文件被跳过。单个文件出错时继续同步其他文件。
+
+type syncer struct {
+	verbose   bool
+	dryRun    bool
+	checksum  bool
+	wholeFile bool
+	delete    bool
+	blockLen  uint32
+	rsh       string                           // remote shell命令，见remote.go
+	rsyncPath string                           // 远端的rsync命令
+	password  string                           // daemon的密码文件
+	port      int                              // daemon的TCP端口
+	exclude   func(name string, dir bool) bool // 不同步的文件，见daemon.go
+	safeLinks bool                             // 不接收目标为绝对路径或者包含..的符号链接，见daemon.go
+	out       io.Writer
+
+	stats syncStats
+}
+
+type syncStats struct {
+	files   int   // src中的普通文件数
+	updated int   // 更新或新建的文件数
+	deleted int   // 删除的文件和目录数
+	size    int64 // 更新的文件的总长度
+	sent    int64 // delta和复制的数据长度
+	errors  int
+}
+
+// 目录的权限和修改时间
+type dirAttr struct {
+	path string
+	fi   os.FileInfo
+}
+
+func hasSlash(p string) bool {
+	return strings.HasSuffix(p, "/") || strings.HasSuffix(p, string(os.PathSeparator))
+}
+
+func (s *syncer) logf(format string, args ...interface{}) {
+	if s.verbose {
+		fmt.Fprintf(s.out, format, args...)
+	}
+}
+
+func (s *syncer) excluded(name string, dir bool) bool {
+	return s.exclude != nil && s.exclude(name, dir)
+}
+
+func (s *syncer) fail(path string, err error) {
+	s.stats.errors++
+	fmt.Fprintf(s.out, "%s: %v\n", path, err)
+}
+
+func (s *syncer) result() error {
+	if s.stats.errors > 0 {
+		return fmt.Errorf("%d errors occurred", s.stats.errors)
+	}
+	return nil
+}
+
+func (s *syncer) printStats() {
+	st := s.stats
+	fmt.Fprintf(s.out, "%d files, %d updated, %d deleted, %d bytes updated, %d bytes sent",
+		st.files, st.updated, st.deleted, st.size, st.sent)
+	if s.dryRun {
+		fmt.Fprint(s.out, " (dry run)")
+	}
+	fmt.Fprintln(s.out)
+}
+
+// 同步src到dst，src以/结尾时同步src中的内容，否则同步到dst/src
+func (s *syncer) syncTree(src, dst string) (err error) {
+	var (
+		fi   os.FileInfo
+		dirs []dirAttr
+	)
+
+	if fi, err = os.Lstat(src); err != nil {
+		return
+	}
+	if !fi.IsDir() {
+		// 单个文件，dst为目录时复制到目录中
+		if di, e := os.Stat(dst); (e == nil && di.IsDir()) || hasSlash(dst) {
+			dst = filepath.Join(dst, fi.Name())
+		}
+		s.syncEntry(src, dst, fi)
+		return s.result()
+	}
+	if !hasSlash(src) {
+		dst = filepath.Join(dst, filepath.Base(src))
+	}
+
+	err = filepath.Walk(src, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			s.fail(path, err)
+			return nil
+		}
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dst, rel)
+		if fi.IsDir() {
+			if err = s.syncDir(target); err != nil {
+				s.fail(target, err)
+				return filepath.SkipDir
+			}
+			dirs = append(dirs, dirAttr{target, fi})
+			return nil
+		}
+		s.syncEntry(path, target, fi)
+		return nil
+	})
+	if err == nil && s.delete {
+		err = s.deleteExtra(dst, func(rel string) bool {
+			_, e := os.Lstat(filepath.Join(src, rel))
+			return !os.IsNotExist(e)
+		})
+	}
+
+	// 子目录在父目录之后，倒序设置，子目录的修改不会改变父目录的修改时间
+	for i := len(dirs) - 1; i >= 0 && !s.dryRun; i-- {
+		if e := setAttrs(dirs[i].path, dirs[i].fi); e != nil {
+			s.fail(dirs[i].path, e)
+		}
+	}
+	if err == nil {
+		err = s.result()
+	}
+	return
+}
+
+// 创建目录，dst中同名的其他类型文件被删除
+func (s *syncer) syncDir(target string) (err error) {
+	var ti os.FileInfo
+
+	if ti, err = os.Lstat(target); err == nil && ti.IsDir() {
+		return
+	} else if err != nil && !os.IsNotExist(err) {
+		return
+	}
+	s.logf("%s/\n", target)
+	if s.dryRun {
+		return nil
+	}
+	if ti != nil {
+		if err = os.RemoveAll(target); err != nil {
+			return
+		}
+	}
+	return os.MkdirAll(target, 0755)
+}
+
+func (s *syncer) syncEntry(path, target string, fi os.FileInfo) {
+	var err error
+
+	switch {
+	case fi.Mode().IsRegular():
+		s.stats.files++
+		err = s.syncFile(path, target, fi)
+	case fi.Mode()&os.ModeSymlink != 0:
+		err = s.syncLink(path, target)
+	default:
+		s.logf("skipping non-regular file %s\n", path)
+	}
+	if err != nil {
+		s.fail(target, err)
+	}
+}
+
+func (s *syncer) syncFile(path, target string, fi os.FileInfo) (err error) {
+	var (
+		ti   os.FileInfo
+		same bool
+	)
+
+	if ti, err = os.Lstat(target); err != nil && !os.IsNotExist(err) {
+		return
+	}
+	exists := err == nil && ti.Mode().IsRegular()
+	err = nil
+	if exists && ti.Size() == fi.Size() {
+		if s.checksum {
+			if same, err = sameContent(path, target); err != nil {
+				return
+			}
+		} else {
+			same = ti.ModTime().Unix() == fi.ModTime().Unix()
+		}
+		if same {
+			// 内容相同，只同步权限和修改时间
+			if s.dryRun || (ti.Mode().Perm() == fi.Mode().Perm() && ti.ModTime().Unix() == fi.ModTime().Unix()) {
+				return
+			}
+			return setAttrs(target, fi)
+		}
+	}
+
+	s.logf("%s\n", target)
+	s.stats.updated++
+	s.stats.size += fi.Size()
+	if s.dryRun {
+		return
+	}
+	if ti != nil && !exists {
+		if err = os.RemoveAll(target); err != nil {
+			return
+		}
+	}
+	if exists && !s.wholeFile && ti.Size() > 0 {
+		err = s.patchFile(path, target, fi)
+	} else {
+		err = s.copyFile(path, target, fi)
+	}
+	if err != nil {
+		return
+	}
+	return setAttrs(target, fi)
+}
+
+// signature -> delta -> patch，patch结果rename为target
+func (s *syncer) patchFile(path, target string, fi os.FileInfo) (err error) {
+	var (
+		src   *os.File
+		basis *os.File
+		delta *os.File
+		bi    os.FileInfo
+		di    os.FileInfo
+		sig   bytes.Buffer
+	)
+
+	if basis, err = os.Open(target); err != nil {
+		return
+	}
+	defer basis.Close()
+	if bi, err = basis.Stat(); err != nil {
+		return
+	}
+	if err = rsync.GenSign(basis, bi.Size(), s.blockLen, &sig); err != nil {
+		return
+	}
+
+	if src, err = os.Open(path); err != nil {
+		return
+	}
+	defer src.Close()
+	if delta, err = ioutil.TempFile("", "rsync-delta-"); err != nil {
+		return
+	}
+	defer func() {
+		delta.Close()
+		os.Remove(delta.Name())
+	}()
+	err = rsync.GenDeltaWith(&sig, src, fi.Size(), delta, &rsync.DeltaOptions{Trailer: true})
+	if err != nil {
+		return
+	}
+	if di, err = delta.Stat(); err != nil {
+		return
+	}
+	s.stats.sent += di.Size()
+	if _, err = delta.Seek(0, 0); err != nil {
+		return
+	}
+
+	size := fi.Size()
+	return rsync.PatchFile(target, delta, target, &rsync.PatchFileOptions{
+		Length:       &size,
+		PreserveMode: true,
+	})
+}
+
+// 复制到同一目录下的临时文件，rename为target
+func (s *syncer) copyFile(path, target string, fi os.FileInfo) (err error) {
+	var (
+		n   int64
+		src *os.File
+		out *os.File
+	)
+
+	if src, err = os.Open(path); err != nil {
+		return
+	}
+	defer src.Close()
+	dir, base := filepath.Split(target)
+	if out, err = ioutil.TempFile(dir, "."+base+"."); err != nil {
+		return
+	}
+	defer func() {
+		if err != nil {
+			out.Close()
+			os.Remove(out.Name())
+		}
+	}()
+
+	n, err = io.Copy(out, src)
+	s.stats.sent += n
+	if err != nil {
+		return
+	}
+	if err = out.Chmod(fi.Mode().Perm()); err != nil {
+		return
+	}
+	if err = out.Sync(); err != nil {
+		return
+	}
+	if err = out.Close(); err != nil {
+		return
+	}
+	return os.Rename(out.Name(), target)
+}
+
+func (s *syncer) syncLink(path, target string) (err error) {
+	var link, old string
+
+	if link, err = os.Readlink(path); err != nil {
+		return
+	}
+	if old, err = os.Readlink(target); err == nil && old == link {
+		return
+	}
+	s.logf("%s -> %s\n", target, link)
+	if s.dryRun {
+		return nil
+	}
+	if err = os.RemoveAll(target); err != nil {
+		return
+	}
+	return os.Symlink(link, target)
+}
+
+// 删除dst中keep返回false的文件和目录，rel为相对dst的路径
+func (s *syncer) deleteExtra(dst string, keep func(rel string) bool) error {
+	return filepath.Walk(dst, func(path string, fi os.FileInfo, err error) error {
+		if err != nil {
+			if !os.IsNotExist(err) {
+				s.fail(path, err)
+			}
+			return nil
+		}
+		rel, err := filepath.Rel(dst, path)
+		if err != nil {
+			return err
+		}
+		if rel == "." || keep(rel) {
+			return nil
+		}
+		s.logf("deleting %s\n", path)
+		s.stats.deleted++
+		if !s.dryRun {
+			if err = os.RemoveAll(path); err != nil {
+				s.fail(path, err)
+			}
+		}
+		if fi.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+func setAttrs(path string, fi os.FileInfo) (err error) {
+	if err = os.Chmod(path, fi.Mode().Perm()); err != nil {
+		return
+	}
+	return os.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
+
+// 长度相同的两个文件内容是否相同
+func sameContent(a, b string) (same bool, err error) {
+	var sa, sb []byte
+
+	if sa, err = fileSum(a); err != nil {
+		return
+	}
+	if sb, err = fileSum(b); err != nil {
+		return
+	}
+	return bytes.Equal(sa, sb), nil
+}
+
+func fileSum(fn string) (sum []byte, err error) {
+	var f *os.File
+
+	if f, err = os.Open(fn); err != nil {
+		return
+	}
+	defer f.Close()
+	h := blake2b.New512()
+	if _, err = io.Copy(h, f); err != nil {
+		return
+	}
+	return h.Sum(nil), nil
+}
@@ -0,0 +1,317 @@
+package rsynchttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/smtc/rsync"
+)
+
+// 通过HTTP提供签名和delta，只读取root中的文件
+//
+//   GET  /sig/PATH    文件的签名(GenSign)，按文件长度和修改时间缓存，支持Range和条件请求
+//   POST /delta/PATH  请求为客户端文件的签名，返回从客户端文件到PATH的delta(GenDelta，带trailer)
+//
+// 响应按Accept-Encoding用gzip或deflate压缩，请求可以用Content-Encoding压缩。库的错误按ErrorStatus
+// 转换为状态码，错误消息为响应内容。PATH相对于root，路径中的符号链接被拒绝(403)，所以不能访问root
+// 以外的文件。
+
+const defaultMaxSignLen = 64 << 20
+
+var (
+	// errors of requests, responded with 400 Bad Request
+	ErrBadRequest = errors.New("bad request")
+	// Content-Encoding of request not supported, responded with 415
+	ErrUnsupportedEncoding = errors.New("unsupported Content-Encoding")
+)
+
+// options of Handler
+type Options struct {
+	BlockLen   uint32 // block length of signatures, 0 for the default of GenSign
+	MaxSignLen int64  // max length of uploaded signature, default 64M
+}
+
+// http.Handler serving signature and delta of files in a root directory
+type Handler struct {
+	root string
+	opts Options
+
+	mu   sync.Mutex
+	sigs map[string]*cachedSign
+}
+
+type cachedSign struct {
+	size  int64
+	mtime time.Time
+	data  []byte
+}
+
+// handler of files in root, opts may be nil
+func NewHandler(root string, opts *Options) *Handler {
+	h := &Handler{root: root, sigs: make(map[string]*cachedSign)}
+	if opts != nil {
+		h.opts = *opts
+	}
+	if h.opts.MaxSignLen <= 0 {
+		h.opts.MaxSignLen = defaultMaxSignLen
+	}
+	return h
+}
+
+// status code of error returned by the library or the handler
+func ErrorStatus(err error) int {
+	switch {
+	case err == nil:
+		return http.StatusOK
+	case errors.Is(err, rsync.ErrInvalidDelta), errors.Is(err, ErrBadRequest):
+		return http.StatusBadRequest
+	case errors.Is(err, rsync.ErrLengthMismatch), errors.Is(err, rsync.ErrChecksumMismatch):
+		return http.StatusUnprocessableEntity
+	case errors.Is(err, ErrUnsupportedEncoding):
+		return http.StatusUnsupportedMediaType
+	case errors.Is(err, os.ErrNotExist):
+		return http.StatusNotFound
+	case errors.Is(err, os.ErrPermission):
+		return http.StatusForbidden
+	}
+	return http.StatusInternalServerError
+}
+
+func (h *Handler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	var op, p string
+
+	if parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2); len(parts) == 2 {
+		op, p = parts[0], parts[1]
+	}
+	method := http.MethodPost
+	switch op {
+	case "sig":
+		method = http.MethodGet
+	case "delta":
+	default:
+		http.NotFound(w, r)
+		return
+	}
+	if r.Method != method && !(method == http.MethodGet && r.Method == http.MethodHead) {
+		w.Header().Set("Allow", method)
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	fn, err := h.path(p)
+	if err == nil {
+		switch op {
+		case "sig":
+			err = h.serveSign(w, r, fn)
+		case "delta":
+			err = h.serveDelta(w, r, fn)
+		}
+	}
+	if err != nil {
+		http.Error(w, err.Error(), ErrorStatus(err))
+	}
+}
+
+// root中的文件，p为以/分隔的相对路径
+func (h *Handler) path(p string) (fn string, err error) {
+	if strings.IndexByte(p, 0) >= 0 {
+		return "", fmt.Errorf("%w: invalid path %q", ErrBadRequest, p)
+	}
+	p = path.Clean("/" + p)
+	if p == "/" {
+		return "", fmt.Errorf("%w: no file in path", ErrBadRequest)
+	}
+	// 不跟随符号链接，路径不存在时由打开文件返回404
+	fn = h.root
+	for _, name := range strings.Split(p[1:], "/") {
+		fn = filepath.Join(fn, name)
+		fi, e := os.Lstat(fn)
+		if e != nil {
+			break
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return "", fmt.Errorf("%w: %s is a symlink", os.ErrPermission, name)
+		}
+	}
+	return filepath.Join(h.root, filepath.FromSlash(p)), nil
+}
+
+// 打开普通文件
+func openFile(fn string) (f *os.File, fi os.FileInfo, err error) {
+	if f, err = os.Open(fn); err != nil {
+		return
+	}
+	if fi, err = f.Stat(); err == nil && !fi.Mode().IsRegular() {
+		err = fmt.Errorf("%w: %s is not a regular file", ErrBadRequest, filepath.Base(fn))
+	}
+	if err != nil {
+		f.Close()
+		f = nil
+	}
+	return
+}
+
+// 文件的签名，文件长度和修改时间不变时使用缓存
+func (h *Handler) sign(fn string) (sig []byte, mtime time.Time, err error) {
+	f, fi, err := openFile(fn)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+
+	h.mu.Lock()
+	c := h.sigs[fn]
+	h.mu.Unlock()
+	if c != nil && c.size == fi.Size() && c.mtime.Equal(fi.ModTime()) {
+		return c.data, c.mtime, nil
+	}
+
+	buf := new(bytes.Buffer)
+	if err = rsync.GenSign(f, fi.Size(), h.opts.BlockLen, buf); err != nil {
+		return
+	}
+	c = &cachedSign{size: fi.Size(), mtime: fi.ModTime(), data: buf.Bytes()}
+	h.mu.Lock()
+	h.sigs[fn] = c
+	h.mu.Unlock()
+	return c.data, c.mtime, nil
+}
+
+func (h *Handler) serveSign(w http.ResponseWriter, r *http.Request, fn string) error {
+	sig, mtime, err := h.sign(fn)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Vary", "Accept-Encoding")
+	w.Header().Set("ETag", fmt.Sprintf(`"%x-%x"`, len(sig), mtime.UnixNano()))
+	// 不压缩时支持Range
+	if negotiate(r.Header.Get("Accept-Encoding")) == "" {
+		http.ServeContent(w, r, "", mtime, bytes.NewReader(sig))
+		return nil
+	}
+	cw := compressWriter(w, r)
+	if r.Method != http.MethodHead {
+		cw.Write(sig)
+	}
+	return cw.Close()
+}
+
+func (h *Handler) serveDelta(w http.ResponseWriter, r *http.Request, fn string) error {
+	f, fi, err := openFile(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	body, err := requestBody(r)
+	if err != nil {
+		return err
+	}
+	defer body.Close()
+	sig, err := ioutil.ReadAll(io.LimitReader(body, h.opts.MaxSignLen+1))
+	if err != nil {
+		return fmt.Errorf("%w: read signature failed: %s", ErrBadRequest, err.Error())
+	}
+	if int64(len(sig)) > h.opts.MaxSignLen {
+		return fmt.Errorf("%w: signature larger than %d", ErrBadRequest, h.opts.MaxSignLen)
+	}
+	// 开始输出后不能再返回错误状态，先检查签名
+	if _, err = rsync.LoadSign(bytes.NewReader(sig), false); err != nil {
+		return fmt.Errorf("%w: invalid signature: %s", ErrBadRequest, err.Error())
+	}
+
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Vary", "Accept-Encoding")
+	cw := compressWriter(w, r)
+	err = rsync.GenDeltaWith(bytes.NewReader(sig), f, fi.Size(), cw, &rsync.DeltaOptions{Trailer: true})
+	if err == nil {
+		err = cw.Close()
+	}
+	if err != nil {
+		// 中断连接，客户端得到不完整的响应
+		panic(http.ErrAbortHandler)
+	}
+	return nil
+}
+
+// 按Content-Encoding解压请求
+func requestBody(r *http.Request) (io.ReadCloser, error) {
+	switch enc := strings.ToLower(strings.TrimSpace(r.Header.Get("Content-Encoding"))); enc {
+	case "", "identity":
+		return r.Body, nil
+	case "gzip", "x-gzip":
+		zr, err := gzip.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid gzip body: %s", ErrBadRequest, err.Error())
+		}
+		return zr, nil
+	case "deflate":
+		zr, err := zlib.NewReader(r.Body)
+		if err != nil {
+			return nil, fmt.Errorf("%w: invalid deflate body: %s", ErrBadRequest, err.Error())
+		}
+		return zr, nil
+	default:
+		return nil, fmt.Errorf("%w %s", ErrUnsupportedEncoding, enc)
+	}
+}
+
+// 按Accept-Encoding选择压缩算法，q值最大的gzip或deflate，都不接受时为空
+func negotiate(accept string) (enc string) {
+	best := 0.0
+	for _, part := range strings.Split(accept, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := 1.0
+		for _, param := range fields[1:] {
+			param = strings.TrimSpace(param)
+			if strings.HasPrefix(param, "q=") {
+				if v, err := strconv.ParseFloat(param[2:], 64); err == nil {
+					q = v
+				}
+			}
+		}
+		if name == "*" {
+			name = "gzip"
+		}
+		if (name == "gzip" || name == "deflate") && q > best {
+			enc, best = name, q
+		}
+	}
+	return
+}
+
+// 按Accept-Encoding压缩响应，Close结束压缩
+func compressWriter(w http.ResponseWriter, r *http.Request) io.WriteCloser {
+	switch negotiate(r.Header.Get("Accept-Encoding")) {
+	case "gzip":
+		w.Header().Set("Content-Encoding", "gzip")
+		return gzip.NewWriter(w)
+	case "deflate":
+		w.Header().Set("Content-Encoding", "deflate")
+		return zlib.NewWriter(w)
+	}
+	return nopCloser{w}
+}
+
+type nopCloser struct {
+	io.Writer
+}
+
+func (nopCloser) Close() error {
+	return nil
+}
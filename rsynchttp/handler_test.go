@@ -0,0 +1,156 @@
+package rsynchttp
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/smtc/rsync"
+)
+
+func TestNegotiate(t *testing.T) {
+	for accept, enc := range map[string]string{
+		"":                          "",
+		"identity":                  "",
+		"gzip":                      "gzip",
+		"deflate, gzip;q=0.5":       "deflate",
+		"gzip;q=0, deflate;q=0.1":   "deflate",
+		"br, *;q=0.8":               "gzip",
+		"GZIP ; q=1.0, deflate":     "gzip",
+		"gzip;q=0, deflate;q=0":     "",
+		"x-compress, identity;q=1":  "",
+		"deflate;q=0.5, gzip;q=0.9": "gzip",
+	} {
+		if got := negotiate(accept); got != enc {
+			t.Fatalf("negotiate %q: %q, expect %q", accept, got, enc)
+		}
+	}
+
+	for err, code := range map[error]int{
+		fmt.Errorf("patch: %w", rsync.ErrInvalidDelta):     400,
+		fmt.Errorf("patch: %w", rsync.ErrLengthMismatch):   422,
+		fmt.Errorf("patch: %w", rsync.ErrChecksumMismatch): 422,
+		ErrUnsupportedEncoding:                             415,
+		os.ErrNotExist:                                     404,
+		os.ErrPermission:                                   403,
+		os.ErrClosed:                                       500,
+	} {
+		if got := ErrorStatus(err); got != code {
+			t.Fatal("status wrong:", err, got)
+		}
+	}
+}
+
+func TestHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsynchttp")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	old := make([]byte, 100000)
+	rand.New(rand.NewSource(1)).Read(old)
+	content := append(append(append([]byte{}, old[:50000]...), "changed"...), old[50000:]...)
+	fn := filepath.Join(dir, "data/file")
+	os.MkdirAll(filepath.Dir(fn), 0755)
+	ioutil.WriteFile(fn, content, 0640)
+
+	os.Symlink(filepath.Dir(fn), filepath.Join(dir, "link"))
+	os.Symlink("file", filepath.Join(dir, "data/link"))
+
+	ts := httptest.NewServer(NewHandler(dir, &Options{BlockLen: 1024}))
+	defer ts.Close()
+	// 不自动解压响应
+	client := &http.Client{Transport: &http.Transport{DisableCompression: true}}
+	do := func(method, p string, body []byte, header ...string) (*http.Response, []byte) {
+		req, _ := http.NewRequest(method, ts.URL+p, bytes.NewReader(body))
+		for i := 0; i+1 < len(header); i += 2 {
+			req.Header.Set(header[i], header[i+1])
+		}
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		data, _ := ioutil.ReadAll(resp.Body)
+		return resp, data
+	}
+
+	// 签名
+	expect := new(bytes.Buffer)
+	rsync.GenSign(bytes.NewReader(content), int64(len(content)), 1024, expect)
+	resp, sig := do("GET", "/sig/data/../data/file", nil)
+	if resp.StatusCode != 200 || !bytes.Equal(sig, expect.Bytes()) {
+		t.Fatal("signature wrong:", resp.Status)
+	}
+	resp, data := do("GET", "/sig/data/file", nil, "Accept-Encoding", "gzip")
+	if resp.Header.Get("Content-Encoding") != "gzip" {
+		t.Fatal("signature should be compressed")
+	}
+	zr, err := gzip.NewReader(bytes.NewReader(data))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if data, _ = ioutil.ReadAll(zr); !bytes.Equal(data, expect.Bytes()) {
+		t.Fatal("compressed signature wrong")
+	}
+	if resp, _ = do("GET", "/sig/data/file", nil, "If-None-Match", resp.Header.Get("ETag")); resp.StatusCode != 304 {
+		t.Fatal("signature should not be modified:", resp.Status)
+	}
+
+	// 客户端有old，请求delta
+	oldSig := new(bytes.Buffer)
+	rsync.GenSign(bytes.NewReader(old), int64(len(old)), 1024, oldSig)
+	gz := new(bytes.Buffer)
+	zw := gzip.NewWriter(gz)
+	zw.Write(oldSig.Bytes())
+	zw.Close()
+	resp, delta := do("POST", "/delta/data/file", gz.Bytes(), "Content-Encoding", "gzip")
+	if resp.StatusCode != 200 || len(delta) > 10000 {
+		t.Fatal("delta failed:", resp.Status, len(delta))
+	}
+	merged := new(bytes.Buffer)
+	if err = rsync.Patch(bytes.NewReader(delta), bytes.NewReader(old), merged); err != nil || !bytes.Equal(merged.Bytes(), content) {
+		t.Fatal("patch delta failed:", err)
+	}
+
+	// 文件修改后缓存的签名失效
+	newContent := append(append([]byte{}, content...), "appended"...)
+	ioutil.WriteFile(fn, newContent, 0640)
+	if _, sig = do("GET", "/sig/data/file", nil); bytes.Equal(sig, expect.Bytes()) {
+		t.Fatal("signature should be regenerated")
+	}
+
+	for _, c := range []struct {
+		method, path string
+		body         []byte
+		header       []string
+		code         int
+		msg          string
+	}{
+		{"POST", "/delta/data/file", []byte("bad"), nil, 400, "invalid signature"},
+		{"POST", "/delta/data/file", oldSig.Bytes(), []string{"Content-Encoding", "br"}, 415, "unsupported"},
+		{"GET", "/sig/data/none", nil, nil, 404, ""},
+		{"GET", "/sig/data", nil, nil, 400, "not a regular file"},
+		{"GET", "/sig/", nil, nil, 400, "no file"},
+		{"GET", "/delta/data/file", nil, nil, 405, ""},
+		{"GET", "/other/data/file", nil, nil, 404, ""},
+		{"GET", "/sig/link/file", nil, nil, 403, "symlink"},
+		{"GET", "/sig/data/link", nil, nil, 403, "symlink"},
+		{"POST", "/delta/link/file", oldSig.Bytes(), nil, 403, "symlink"},
+		{"POST", "/patch/data/file", oldSig.Bytes(), nil, 404, ""},
+	} {
+		resp, data = do(c.method, c.path, c.body, c.header...)
+		if resp.StatusCode != c.code || !strings.Contains(string(data), c.msg) {
+			t.Fatal(c.method, c.path, "should fail:", resp.Status, string(data))
+		}
+	}
+}
@@ -0,0 +1,259 @@
+package rsync
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+
+	"github.com/smtc/rollsum"
+)
+
+// target端的copy(self copy)
+//
+// delta中的COPY只能从basis文件中复制数据，当src文件内部有重复的内容(例如新增的一段数据被
+// 复制了几次)时，这些数据仍然是literal。self copy从已经patch生成的数据中复制，位置为
+// merged文件中的绝对位置，与当前位置的距离不能超过selfCopyWindow。
+//
+// 生成delta时，在不匹配的区域中查找与前面src数据相同的部分：对src每selfBlockLen字节计算
+// weak sum建立索引，在不匹配区域中滚动计算weak sum查找，找到后逐字节比较并向前后扩展。
+
+const (
+	selfCopyWindow = 1 << 22 // self copy的最大距离，也是patch时保留的历史数据大小
+	selfBlockLen   = 16      // 建立索引的block长度
+	minSelfCopy    = 32      // self copy的最小长度，太短的copy不如literal
+)
+
+// 在src中查找重复的数据
+type selfMatcher struct {
+	rd     *bufio.Reader
+	srcLen int64
+	buf    []byte // src[base:base+len(buf)]
+	base   int64
+	table  map[uint32]int64 // weak sum -> src中的位置
+	next   int64            // 下一个需要加入索引的位置
+}
+
+// 在不匹配的区域中查找self copy，将matchStat拆分为literal和self copy
+func (d *delta) findSelfCopies(src io.ReadSeeker, srcLen int64) (err error) {
+	var mss []matchStat
+
+	if _, err = src.Seek(0, 0); err != nil {
+		return
+	}
+	m := &selfMatcher{
+		rd:     bufio.NewReader(src),
+		srcLen: srcLen,
+		table:  make(map[uint32]int64),
+	}
+
+	for _, ms := range d.mss {
+		if ms.match != -1 {
+			mss = append(mss, ms)
+			continue
+		}
+		if mss, err = m.scan(mss, ms.pos, ms.pos+ms.length); err != nil {
+			return
+		}
+	}
+
+	if d.debug {
+		fmt.Printf("self copy: %d match stats before, %d after\n", len(d.mss), len(mss))
+	}
+	d.mss = mss
+	return
+}
+
+// 保证buf中包含src[off]
+func (m *selfMatcher) fill(off int64) (err error) {
+	var n int
+
+	for off >= m.base+int64(len(m.buf)) {
+		// 丢弃超出window的数据
+		if drop := int64(len(m.buf)) - 2*selfCopyWindow; drop > 0 && m.base+drop < m.next-selfCopyWindow-selfBlockLen {
+			m.buf = append(m.buf[:0], m.buf[drop:]...)
+			m.base += drop
+		}
+		l := len(m.buf)
+		if cap(m.buf)-l < 4096 {
+			nb := make([]byte, l, 2*cap(m.buf)+4096)
+			copy(nb, m.buf)
+			m.buf = nb
+		}
+		n, err = m.rd.Read(m.buf[l:cap(m.buf)])
+		m.buf = m.buf[0 : l+n]
+		if err != nil {
+			if err == io.EOF && n > 0 {
+				err = nil
+				continue
+			}
+			return
+		}
+	}
+	return
+}
+
+func (m *selfMatcher) at(off int64) byte {
+	return m.buf[off-m.base]
+}
+
+// 将[m.next, end)中对齐到selfBlockLen的位置加入索引
+func (m *selfMatcher) index(end int64) (err error) {
+	if r := m.next % selfBlockLen; r != 0 {
+		m.next += selfBlockLen - r
+	}
+	for ; m.next < end && m.next+selfBlockLen <= m.srcLen; m.next += selfBlockLen {
+		if err = m.fill(m.next + selfBlockLen - 1); err != nil {
+			return
+		}
+		off := m.next - m.base
+		m.table[weakSum(m.buf[off:off+selfBlockLen])] = m.next
+	}
+	if m.next < end {
+		m.next = end
+	}
+	return
+}
+
+// 扫描不匹配区域[start, end)
+func (m *selfMatcher) scan(mss []matchStat, start, end int64) (res []matchStat, err error) {
+	var (
+		rs       rollsum.Rollsum
+		i        = start
+		litStart = start
+		rolling  = false
+	)
+
+	res = mss
+	if err = m.index(start); err != nil {
+		return
+	}
+	for i+selfBlockLen <= end {
+		if err = m.fill(i + selfBlockLen - 1); err != nil {
+			return
+		}
+		if !rolling {
+			rs.Init()
+			off := i - m.base
+			rs.Update(m.buf[off : off+selfBlockLen])
+			rolling = true
+		}
+
+		cand, ok := m.table[rs.Digest()]
+		if ok && cand < i && i-cand <= selfCopyWindow {
+			var n, b int64
+			// 向后比较
+			for i+n < end && n < selfCopyWindow {
+				if err = m.fill(i + n); err != nil {
+					return
+				}
+				if m.at(cand+n) != m.at(i+n) {
+					break
+				}
+				n++
+			}
+			// 向前扩展到literal中
+			for i-b > litStart && cand-b > m.base && m.at(cand-b-1) == m.at(i-b-1) {
+				b++
+			}
+			if n+b >= minSelfCopy {
+				if i-b > litStart {
+					res = append(res, matchStat{match: -1, pos: litStart, length: i - b - litStart})
+				}
+				res = append(res, matchStat{match: 2, pos: cand - b, length: n + b})
+				if err = m.index(i + n); err != nil {
+					return
+				}
+				i += n
+				litStart = i
+				rolling = false
+				continue
+			}
+		}
+
+		if i%selfBlockLen == 0 && i >= m.next {
+			if err = m.index(i + 1); err != nil {
+				return
+			}
+		}
+		if i+selfBlockLen >= end {
+			break
+		}
+		if err = m.fill(i + selfBlockLen); err != nil {
+			return
+		}
+		rs.Rotate(m.at(i), m.at(i+selfBlockLen))
+		i++
+	}
+
+	if end > litStart {
+		res = append(res, matchStat{match: -1, pos: litStart, length: end - litStart})
+	}
+	err = m.index(end)
+	return
+}
+
+// 保存patch时最近selfCopyWindow字节的输出，用于self copy
+type history struct {
+	w    io.Writer
+	ring []byte
+	size int64 // 已经写入的总长度
+}
+
+func newHistory(w io.Writer) *history {
+	return &history{w: w}
+}
+
+func (h *history) Write(p []byte) (n int, err error) {
+	if n, err = h.w.Write(p); err != nil {
+		return
+	}
+	h.record(p[0:n])
+	return
+}
+
+func (h *history) record(p []byte) {
+	if len(h.ring) < selfCopyWindow && h.size+int64(len(p)) <= selfCopyWindow {
+		// ring还没有写满，直接追加
+		h.ring = append(h.ring, p...)
+		h.size += int64(len(p))
+		return
+	}
+	if len(h.ring) < selfCopyWindow {
+		h.ring = append(h.ring, make([]byte, selfCopyWindow-len(h.ring))...)
+	}
+	if len(p) > selfCopyWindow {
+		h.size += int64(len(p) - selfCopyWindow)
+		p = p[len(p)-selfCopyWindow:]
+	}
+	for len(p) > 0 {
+		l := copy(h.ring[h.size%selfCopyWindow:], p)
+		h.size += int64(l)
+		p = p[l:]
+	}
+}
+
+// 从历史数据的where位置读取len(p)字节
+func (h *history) readAt(p []byte, where int64) (err error) {
+	if where < h.size-int64(len(h.ring)) || where+int64(len(p)) > h.size {
+		return fmt.Errorf("self copy out of window: where=%d length=%d written=%d", where, len(p), h.size)
+	}
+	for len(p) > 0 {
+		l := copy(p, h.ring[where%selfCopyWindow:])
+		p = p[l:]
+		where += int64(l)
+	}
+	return
+}
+
+// 恢复历史数据：p为输出中[size-len(p), size)的数据，len(p)不小于min(size, selfCopyWindow)
+func (h *history) restore(p []byte, size int64) {
+	if int64(len(p)) > size {
+		p = p[int64(len(p))-size:]
+	}
+	h.ring = nil
+	h.size = size - int64(len(p))
+	if h.size > 0 {
+		h.ring = make([]byte, selfCopyWindow)
+	}
+	h.record(p)
+}
@@ -0,0 +1,67 @@
+package rsync
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSelfCopy(t *testing.T) {
+	basis := randBytes(7, 20000)
+
+	// 新的一段数据重复了4次
+	fresh := randBytes(8, 5000)
+	src := append([]byte{}, basis[0:3000]...)
+	for i := 0; i < 4; i++ {
+		src = append(src, fresh...)
+	}
+	src = append(src, basis[3000:]...)
+	for _, format := range []int{FormatRsync, FormatVCDIFF} {
+		if dl := roundTrip(t, basis, src, 256, &DeltaOptions{SelfCopy: true, Format: format}); dl > 5300 {
+			t.Fatalf("delta too large with self copy: format=%d length=%d", format, dl)
+		}
+	}
+
+	// 重叠的self copy
+	src = bytes.Repeat([]byte("abc"), 3000)
+	for _, format := range []int{FormatRsync, FormatVCDIFF} {
+		if dl := roundTrip(t, basis, src, 256, &DeltaOptions{SelfCopy: true, Format: format}); dl > 64 {
+			t.Fatalf("delta too large with overlap self copy: format=%d length=%d", format, dl)
+		}
+	}
+
+	for _, s1 := range ss {
+		for _, s2 := range chs {
+			roundTrip(t, []byte(s1), []byte(s2+s2+s2+s2), 256, &DeltaOptions{SelfCopy: true})
+		}
+	}
+}
+
+func TestHistory(t *testing.T) {
+	var (
+		out  = new(bytes.Buffer)
+		h    = newHistory(out)
+		data = randBytes(9, selfCopyWindow*2+1000)
+		buf  = make([]byte, 100)
+	)
+
+	h.Write(data[0:1000])
+	if err := h.readAt(buf, 900); err != nil || !bytes.Equal(buf, data[900:1000]) {
+		t.Fatal("history readAt failed:", err)
+	}
+	h.Write(data[1000 : selfCopyWindow+500])
+	h.Write(data[selfCopyWindow+500:])
+	if err := h.readAt(buf, int64(len(data))-100); err != nil || !bytes.Equal(buf, data[len(data)-100:]) {
+		t.Fatal("history readAt failed:", err)
+	}
+	// 跨越ring的结尾
+	at := int64(selfCopyWindow*2 - 50)
+	if err := h.readAt(buf, at); err != nil || !bytes.Equal(buf, data[at:at+100]) {
+		t.Fatal("history readAt failed:", err)
+	}
+	if err := h.readAt(buf, 0); err == nil {
+		t.Fatal("history readAt should fail when out of window")
+	}
+	if !bytes.Equal(out.Bytes(), data) {
+		t.Fatal("history should write through")
+	}
+}
@@ -184,6 +184,17 @@ func LoadSign(rd io.Reader, debug bool) (sig *Signature, err error) {
 	return
 }
 
+// 使用strong sum在签名中查找匹配的block
+func (sig *Signature) lookup(p []byte, pos int64, sum uint32) (matchAt int64) {
+	matchAt = -1
+	if blocks, ok := sig.block_sigs[sum]; ok {
+		ssum := strongSum(p, sig.strong_sum_len)
+		// 二分查找
+		matchAt = blockSlice(blocks).search(ssum, pos, sig.block_len)
+	}
+	return
+}
+
 type blockSlice []*rs_block_sig
 
 func (s blockSlice) Len() int {
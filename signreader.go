@@ -0,0 +1,92 @@
+package rsync
+
+import (
+	"fmt"
+	"io"
+)
+
+func (hdr *SignHdr) Magic() uint32 {
+	return hdr.magic
+}
+
+func (hdr *SignHdr) BlockLen() uint32 {
+	return hdr.blockLen
+}
+
+// strong sum length
+func (hdr *SignHdr) SumLen() uint32 {
+	return hdr.sumLen
+}
+
+// length of the file the signature generated from
+func (hdr *SignHdr) TotalLen() int64 {
+	return hdr.totalLen
+}
+
+// sums of a block in signature
+type BlockSum struct {
+	Weak   uint32
+	Strong []byte
+}
+
+// iterator of signature blocks
+type SignReader struct {
+	rd    io.Reader
+	hdr   SignHdr
+	count int
+}
+
+// read signature header and return a block iterator
+func NewSignReader(rd io.Reader) (r *SignReader, err error) {
+	var tlen uint64
+
+	r = &SignReader{rd: rd}
+	if r.hdr.magic, err = ntohl(rd); err != nil {
+		return nil, fmt.Errorf("read signature magic failed: %s", err.Error())
+	}
+	if r.hdr.magic != BlakeMagic && r.hdr.magic != Md4Magic {
+		return nil, fmt.Errorf("not signature file format: magic 0x%x", r.hdr.magic)
+	}
+	if r.hdr.blockLen, err = ntohl(rd); err != nil {
+		return nil, fmt.Errorf("read signature block length failed: %s", err.Error())
+	}
+	if r.hdr.sumLen, err = ntohl(rd); err != nil {
+		return nil, fmt.Errorf("read signature strong sum length failed: %s", err.Error())
+	}
+	if r.hdr.sumLen > 64 {
+		return nil, fmt.Errorf("invalid signature strong sum length: %d", r.hdr.sumLen)
+	}
+	if tlen, err = ntohll(rd); err != nil {
+		return nil, fmt.Errorf("read signature total length failed: %s", err.Error())
+	}
+	r.hdr.totalLen = int64(tlen)
+	return
+}
+
+func (r *SignReader) Header() SignHdr {
+	return r.hdr
+}
+
+// index of the block returned by the last Next
+func (r *SignReader) Index() int {
+	return r.count - 1
+}
+
+// next block sums, io.EOF at the end of signature
+func (r *SignReader) Next() (bs BlockSum, err error) {
+	if bs.Weak, err = ntohl(r.rd); err != nil {
+		if err == io.ErrUnexpectedEOF {
+			err = fmt.Errorf("read weak sum of block %d failed: %s", r.count, err.Error())
+		}
+		return
+	}
+	bs.Strong = make([]byte, r.hdr.sumLen)
+	if _, err = io.ReadFull(r.rd, bs.Strong); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return bs, fmt.Errorf("read strong sum of block %d failed: %s", r.count, err.Error())
+	}
+	r.count++
+	return
+}
@@ -0,0 +1,46 @@
+package rsync
+
+import (
+	"bytes"
+	"io"
+	"testing"
+)
+
+func TestSignReader(t *testing.T) {
+	data := randBytes(28, 10000)
+	sig := new(bytes.Buffer)
+	if err := GenSign(bytes.NewReader(data), int64(len(data)), 3000, sig); err != nil {
+		t.Fatal(err)
+	}
+
+	r, err := NewSignReader(sig)
+	if err != nil {
+		t.Fatal("NewSignReader failed:", err)
+	}
+	hdr := r.Header()
+	if hdr.Magic() != BlakeMagic || hdr.BlockLen() != 3000 || hdr.SumLen() != 64 || hdr.TotalLen() != 10000 {
+		t.Fatalf("signature header wrong: %+v", hdr)
+	}
+	for i := 0; ; i++ {
+		bs, err := r.Next()
+		if err == io.EOF {
+			if i != 4 {
+				t.Fatal("signature should have 4 blocks:", i)
+			}
+			break
+		} else if err != nil {
+			t.Fatal("SignReader.Next failed:", err)
+		}
+		end := (i + 1) * 3000
+		if end > len(data) {
+			end = len(data)
+		}
+		if r.Index() != i || bs.Weak != weakSum(data[i*3000:end]) || !bytes.Equal(bs.Strong, strongSum(data[i*3000:end], 64)) {
+			t.Fatalf("block %d sums wrong", i)
+		}
+	}
+
+	if _, err = NewSignReader(bytes.NewReader(htonl(DeltaMagic))); err == nil {
+		t.Fatal("NewSignReader should fail with delta magic")
+	}
+}
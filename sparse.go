@@ -0,0 +1,283 @@
+package rsync
+
+import (
+	"fmt"
+	"io"
+	"os"
+)
+
+// 稀疏文件
+//
+// 1 GenSignSparse: 生成签名时，完全在hole中的block不读取文件，直接使用全0 block的签名
+// 2 DeltaOptions.Sparse: src为*os.File时，匹配之后将src中的hole替换为RUN(0)命令，src仍然完整读取
+// 3 PatchOptions.Sparse: merged为*os.File时，全为0的数据seek跳过，不写入文件
+//
+// hole通过SEEK_DATA/SEEK_HOLE获取，不支持的系统或文件系统认为整个文件都是数据。
+
+const sparseBlockSize = 4096
+
+// 文件中的一段区域
+type region struct {
+	off    int64
+	length int64
+}
+
+// 根据数据区域计算[0, size)中的hole
+func holeRegions(f *os.File, size int64) (holes []region, err error) {
+	var (
+		data []region
+		off  int64
+	)
+
+	if data, err = dataRegions(f, size); err != nil {
+		return
+	}
+	for _, r := range data {
+		if r.off > off {
+			holes = append(holes, region{off, r.off - off})
+		}
+		off = r.off + r.length
+	}
+	if size > off {
+		holes = append(holes, region{off, size - off})
+	}
+	return
+}
+
+// generate signature for sparse file, the whole file is read from offset 0
+// blocks in holes are not read
+func GenSignSparse(f *os.File, blockLen uint32, result io.Writer) (err error) {
+	var (
+		n     int
+		fi    os.FileInfo
+		holes []region
+		hdr   SignHdr
+		buf   []byte
+		zeros = make(map[int][]byte) // 全0 block的签名，key为block长度
+	)
+
+	if blockLen == 0 {
+		blockLen = defaultBlockLen
+	}
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	size := fi.Size()
+	if holes, err = holeRegions(f, size); err != nil {
+		return
+	}
+
+	hdr = signHeader(size, defaultSumLen, blockLen)
+	if _, err = result.Write(hdr.toBytes()); err != nil {
+		return
+	}
+
+	buf = make([]byte, blockLen)
+	for off := int64(0); off < size; off += int64(blockLen) {
+		l := int64(blockLen)
+		if size-off < l {
+			l = size - off
+		}
+		// 跳过已经在当前block之前的hole
+		for len(holes) > 0 && holes[0].off+holes[0].length <= off {
+			holes = holes[1:]
+		}
+
+		var sum []byte
+		if len(holes) > 0 && holes[0].off <= off && holes[0].off+holes[0].length >= off+l {
+			if sum = zeros[int(l)]; sum == nil {
+				p := make([]byte, l)
+				sum = append(htonl(weakSum(p)), strongSum(p, defaultSumLen)...)
+				zeros[int(l)] = sum
+			}
+		} else {
+			if n, err = f.ReadAt(buf[0:l], off); int64(n) != l {
+				if err == nil || err == io.EOF {
+					err = io.ErrUnexpectedEOF
+				}
+				return
+			}
+			sum = append(htonl(weakSum(buf[0:l])), strongSum(buf[0:l], defaultSumLen)...)
+		}
+		if _, err = result.Write(sum); err != nil {
+			return
+		}
+	}
+	return nil
+}
+
+// src为*os.File时，将src中的hole替换为RUN(0)
+func (d *delta) findHoles(src io.ReadSeeker, srcLen int64) (err error) {
+	var holes []region
+
+	f, ok := src.(*os.File)
+	if !ok {
+		return
+	}
+	if holes, err = holeRegions(f, srcLen); err != nil {
+		return
+	}
+	d.markHoles(holes)
+	if d.debug {
+		fmt.Printf("sparse: %d holes, %d match stats\n", len(holes), len(d.mss))
+	}
+	return
+}
+
+// 将src中的hole替换为RUN(0)
+func (d *delta) markHoles(holes []region) {
+	var (
+		srcPos int64
+		mss    []matchStat
+	)
+
+	for _, ms := range d.mss {
+		start, end := srcPos, srcPos+ms.length
+		srcPos = end
+		for start < end {
+			for len(holes) > 0 && holes[0].off+holes[0].length <= start {
+				holes = holes[1:]
+			}
+			// 当前位置在hole中
+			if len(holes) > 0 && holes[0].off <= start {
+				l := holes[0].off + holes[0].length - start
+				if l > end-start {
+					l = end - start
+				}
+				mss = append(mss, matchStat{match: 3, pos: start, length: l})
+				start += l
+				continue
+			}
+			// hole之前的数据
+			l := end - start
+			if len(holes) > 0 && holes[0].off-start < l {
+				l = holes[0].off - start
+			}
+			piece := ms
+			piece.length = l
+			if ms.match != 3 {
+				piece.pos = ms.pos + (start - (end - ms.length))
+			} else {
+				piece.pos = start
+			}
+			mss = append(mss, piece)
+			start += l
+		}
+	}
+	d.mss = mergeMatchStats(mss)
+}
+
+// 稀疏文件的writer，全为0的数据不写入文件
+type sparseWriter struct {
+	f       *os.File
+	off     int64 // 当前位置
+	size    int64 // 开始时文件的长度，在此之前的hole需要punch
+	pending int64 // 还没有seek的hole长度
+}
+
+func newSparseWriter(f *os.File) (w *sparseWriter, err error) {
+	var fi os.FileInfo
+
+	w = &sparseWriter{f: f}
+	if w.off, err = f.Seek(0, 1); err != nil {
+		return
+	}
+	if fi, err = f.Stat(); err != nil {
+		return
+	}
+	w.size = fi.Size()
+	return
+}
+
+func (w *sparseWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		// 按照sparseBlockSize对齐切分
+		l := sparseBlockSize - int((w.off+w.pending)%sparseBlockSize)
+		if l > len(p) {
+			l = len(p)
+		}
+		if isZero(p[0:l]) {
+			w.pending += int64(l)
+		} else {
+			if err = w.seekHole(); err != nil {
+				return
+			}
+			var m int
+			m, err = w.f.Write(p[0:l])
+			w.off += int64(m)
+			if err != nil {
+				n += m
+				return
+			}
+		}
+		n += l
+		p = p[l:]
+	}
+	return
+}
+
+// 跳过pending的hole，覆盖已有的数据时punch hole
+func (w *sparseWriter) seekHole() (err error) {
+	if w.pending == 0 {
+		return
+	}
+	if w.off < w.size {
+		l := w.pending
+		if w.size-w.off < l {
+			l = w.size - w.off
+		}
+		if err = punchHole(w.f, w.off, l); err != nil {
+			// 不支持punch hole，写入0
+			if err = writeZeros(w.f, w.off, l); err != nil {
+				return
+			}
+		}
+	}
+	w.off += w.pending
+	w.pending = 0
+	_, err = w.f.Seek(w.off, 0)
+	return
+}
+
+// patch结束，文件以hole结尾时设置文件长度
+func (w *sparseWriter) finish() (err error) {
+	if w.pending == 0 {
+		return
+	}
+	end := w.off + w.pending
+	if err = w.seekHole(); err != nil {
+		return
+	}
+	if end > w.size {
+		if err = w.f.Truncate(end); err != nil {
+			err = fmt.Errorf("truncate sparse file failed: %s", err.Error())
+		}
+	}
+	return
+}
+
+func writeZeros(f *os.File, off, length int64) (err error) {
+	var buf [sparseBlockSize]byte
+
+	for length > 0 {
+		l := int64(len(buf))
+		if l > length {
+			l = length
+		}
+		if _, err = f.WriteAt(buf[0:l], off); err != nil {
+			return
+		}
+		off += l
+		length -= l
+	}
+	return
+}
+
+func isZero(p []byte) bool {
+	for _, c := range p {
+		if c != 0 {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,62 @@
+//go:build linux
+// +build linux
+
+package rsync
+
+import (
+	"os"
+	"syscall"
+)
+
+const (
+	seekData = 3 // SEEK_DATA
+	seekHole = 4 // SEEK_HOLE
+
+	fallocPunchHole = 0x03 // FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE
+)
+
+// 通过SEEK_DATA/SEEK_HOLE获取[0, size)中的数据区域，文件的读写位置不变
+// 文件系统不支持时，整个文件都是数据
+func dataRegions(f *os.File, size int64) (data []region, err error) {
+	var (
+		cur, off, end int64
+	)
+
+	if cur, err = f.Seek(0, 1); err != nil {
+		return
+	}
+	defer func() {
+		if _, e := f.Seek(cur, 0); err == nil {
+			err = e
+		}
+	}()
+
+	for off < size {
+		if off, err = f.Seek(off, seekData); err != nil {
+			if pe, ok := err.(*os.PathError); ok && pe.Err == syscall.ENXIO {
+				// off之后没有数据
+				err = nil
+				return
+			}
+			// 不支持SEEK_DATA
+			return []region{{0, size}}, nil
+		}
+		if off >= size {
+			break
+		}
+		if end, err = f.Seek(off, seekHole); err != nil {
+			return []region{{0, size}}, nil
+		}
+		if end > size {
+			end = size
+		}
+		data = append(data, region{off, end - off})
+		off = end
+	}
+	return
+}
+
+// 在[off, off+length)打洞，文件长度不变
+func punchHole(f *os.File, off, length int64) error {
+	return syscall.Fallocate(int(f.Fd()), fallocPunchHole, off, length)
+}
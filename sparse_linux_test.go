@@ -0,0 +1,111 @@
+package rsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"syscall"
+	"testing"
+)
+
+// 创建稀疏文件：data中全为0且对齐的block不写入
+func writeSparse(t *testing.T, path string, data []byte) *os.File {
+	f, err := os.OpenFile(path, os.O_RDWR|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	w, err := newSparseWriter(f)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = w.Write(data); err != nil {
+		t.Fatal(err)
+	}
+	if err = w.finish(); err != nil {
+		t.Fatal(err)
+	}
+	return f
+}
+
+func allocated(t *testing.T, f *os.File) int64 {
+	var st syscall.Stat_t
+	if err := syscall.Fstat(int(f.Fd()), &st); err != nil {
+		t.Fatal(err)
+	}
+	return st.Blocks * 512
+}
+
+func TestSparse(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-sparse")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basis := randBytes(11, 64<<10)
+	basis = append(basis, make([]byte, 4<<20)...)
+	basis = append(basis, randBytes(12, 64<<10)...)
+	basis = append(basis, make([]byte, 1<<20)...)
+
+	bf := writeSparse(t, filepath.Join(dir, "basis"), basis)
+	defer bf.Close()
+	content, _ := ioutil.ReadFile(bf.Name())
+	if !bytes.Equal(content, basis) {
+		t.Fatal("sparse writer result not equal")
+	}
+	if n := allocated(t, bf); n >= int64(len(basis))/2 {
+		t.Skipf("file system does not support sparse files: allocated=%d", n)
+	}
+
+	// 签名与GenSign相同
+	sig1, sig2 := new(bytes.Buffer), new(bytes.Buffer)
+	if err = GenSign(bytes.NewReader(basis), int64(len(basis)), 0, sig1); err != nil {
+		t.Fatal(err)
+	}
+	if err = GenSignSparse(bf, 0, sig2); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sig1.Bytes(), sig2.Bytes()) {
+		t.Fatal("GenSignSparse result not equal with GenSign")
+	}
+
+	// src中增加了一个新的hole
+	src := append([]byte{}, basis[0:32<<10]...)
+	src = append(src, make([]byte, 2<<20)...)
+	src = append(src, basis[32<<10:]...)
+	sf := writeSparse(t, filepath.Join(dir, "src"), src)
+	defer sf.Close()
+
+	sf.Seek(0, 0)
+	result := new(bytes.Buffer)
+	sig := bytes.NewReader(sig1.Bytes())
+	if err = GenDeltaWith(sig, sf, int64(len(src)), result, &DeltaOptions{Sparse: true}); err != nil {
+		t.Fatal(err)
+	}
+	if result.Len() > 64<<10 {
+		t.Fatalf("sparse delta too large: %d", result.Len())
+	}
+
+	// patch到已有的非稀疏文件上，多余的数据被punch hole
+	mf, err := os.Create(filepath.Join(dir, "merged"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer mf.Close()
+	if _, err = mf.Write(bytes.Repeat([]byte{'x'}, len(src)+100)); err != nil {
+		t.Fatal(err)
+	}
+	mf.Truncate(int64(len(src)))
+	mf.Seek(0, 0)
+	if err = PatchWith(result, bytes.NewReader(basis), mf, &PatchOptions{Sparse: true}); err != nil {
+		t.Fatal(err)
+	}
+	content, _ = ioutil.ReadFile(mf.Name())
+	if !bytes.Equal(content, src) {
+		t.Fatal("sparse patch result not equal")
+	}
+	if n := allocated(t, mf); n >= int64(len(src))/2 {
+		t.Fatalf("patch result should be sparse: allocated=%d size=%d", n, len(src))
+	}
+}
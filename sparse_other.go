@@ -0,0 +1,21 @@
+//go:build !linux
+// +build !linux
+
+package rsync
+
+import (
+	"errors"
+	"os"
+)
+
+// 不支持SEEK_DATA/SEEK_HOLE，整个文件都是数据
+func dataRegions(f *os.File, size int64) (data []region, err error) {
+	if size > 0 {
+		data = []region{{0, size}}
+	}
+	return
+}
+
+func punchHole(f *os.File, off, length int64) error {
+	return errors.New("punch hole is not supported")
+}
@@ -0,0 +1,93 @@
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+
+	"github.com/dchest/blake2b"
+)
+
+// delta trailer
+//
+// 普通的delta以结束命令0结尾，patch无法知道输出是否完整、是否正确。设置DeltaOptions.Trailer
+// 后，delta以RS_OP_TRAILER命令结尾，命令之后是trailer：
+//   length: 8字节，输出的总长度
+//   sumLen: 4字节，hash的长度，不超过64
+//   sum:    sumLen字节，输出数据的blake2b-512 hash
+//
+// trailer之后没有其他数据。Patch在delta结束时比较输出的长度和hash，不一致时返回
+// ErrLengthMismatch或ErrChecksumMismatch。没有trailer的delta不做校验。
+
+// trailer of delta
+type Trailer struct {
+	Length int64  // output length
+	Sum    []byte // blake2b-512 hash of output
+}
+
+// RS_OP_TRAILER命令已经读取
+func readTrailer(rd io.Reader) (t *Trailer, err error) {
+	var (
+		length uint64
+		sumLen uint32
+	)
+
+	if length, err = ntohll(rd); err != nil {
+		return nil, fmt.Errorf("read trailer length failed: %s", err.Error())
+	}
+	if sumLen, err = ntohl(rd); err != nil {
+		return nil, fmt.Errorf("read trailer sum length failed: %s", err.Error())
+	}
+	if sumLen > 64 {
+		return nil, fmt.Errorf("invalid trailer sum length: %d", sumLen)
+	}
+	t = &Trailer{Length: int64(length), Sum: make([]byte, sumLen)}
+	if _, err = io.ReadFull(rd, t.Sum); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read trailer sum failed: %s", err.Error())
+	}
+	return
+}
+
+// 比较输出的长度和hash
+func (t *Trailer) check(length int64, sum []byte) error {
+	if length != t.Length {
+		return fmt.Errorf("%w: expect %d, got %d", ErrLengthMismatch, t.Length, length)
+	}
+	if !bytes.Equal(sum, t.Sum) {
+		return fmt.Errorf("%w: expect %x, got %x", ErrChecksumMismatch, t.Sum, sum)
+	}
+	return nil
+}
+
+// write the end command with a trailer of output length and sum,
+// the underlying writer is not closed
+func (dw *DeltaWriter) CloseWithSum(sum []byte) (err error) {
+	var buf []byte
+
+	if len(sum) > 64 {
+		return fmt.Errorf("invalid trailer sum length: %d", len(sum))
+	}
+	buf = append(buf, RS_OP_TRAILER)
+	buf = append(buf, Htonll(uint64(dw.output))...)
+	buf = append(buf, htonl(uint32(len(sum)))...)
+	buf = append(buf, sum...)
+	if err = dw.write(buf); err == nil {
+		dw.err = errDeltaWriterClosed
+	}
+	return
+}
+
+// 重新读取src计算hash，写入带trailer的结束命令
+func (d *delta) flushTrailer(src io.ReadSeeker) (err error) {
+	if _, err = src.Seek(0, 0); err != nil {
+		return
+	}
+	h := blake2b.New512()
+	if _, err = io.CopyN(h, src, d.dw.OutputLength()); err != nil {
+		return
+	}
+	return d.dw.CloseWithSum(h.Sum(nil))
+}
@@ -0,0 +1,80 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"io/ioutil"
+	"testing"
+)
+
+func TestTrailer(t *testing.T) {
+	var (
+		old    = randBytes(41, 50000)
+		src    = append(append([]byte{}, old[:20000]...), randBytes(42, 3000)...)
+		result = new(bytes.Buffer)
+		merged = new(bytes.Buffer)
+	)
+	src = append(src, old[25000:]...)
+
+	if err := DiffWith(bytes.NewReader(old), bytes.NewReader(src), result, &DeltaOptions{Trailer: true}); err != nil {
+		t.Fatal("DiffWith failed:", err)
+	}
+	delta := result.Bytes()
+	// RS_OP_TRAILER + length + sumLen + sum
+	if delta[len(delta)-77] != RS_OP_TRAILER {
+		t.Fatalf("delta should end with trailer: % x", delta[len(delta)-77:])
+	}
+	if err := Patch(bytes.NewReader(delta), bytes.NewReader(old), merged); err != nil {
+		t.Fatal("Patch failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), src) {
+		t.Fatal("Patch result not equal")
+	}
+
+	// basis被修改，输出的hash与trailer不一致
+	bad := append([]byte{}, old...)
+	bad[100] ^= 0xff
+	err := Patch(bytes.NewReader(delta), bytes.NewReader(bad), new(bytes.Buffer))
+	if !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("Patch with modified basis should fail with ErrChecksumMismatch:", err)
+	}
+
+	// trailer中的长度错误
+	wrong := append([]byte{}, delta...)
+	wrong[len(delta)-70]++
+	err = Patch(bytes.NewReader(wrong), bytes.NewReader(old), new(bytes.Buffer))
+	if !errors.Is(err, ErrLengthMismatch) {
+		t.Fatal("Patch with wrong trailer length should fail with ErrLengthMismatch:", err)
+	}
+
+	// PatchReader和PatchedReader也检查trailer
+	if data, err := ioutil.ReadAll(NewPatchReader(bytes.NewReader(delta), bytes.NewReader(old))); err != nil || !bytes.Equal(data, src) {
+		t.Fatal("PatchReader failed:", err)
+	}
+	if _, err = ioutil.ReadAll(NewPatchReader(bytes.NewReader(delta), bytes.NewReader(bad))); !errors.Is(err, ErrChecksumMismatch) {
+		t.Fatal("PatchReader with modified basis should fail with ErrChecksumMismatch:", err)
+	}
+	if _, err = ioutil.ReadAll(NewPatchReader(bytes.NewReader(wrong), bytes.NewReader(old))); !errors.Is(err, ErrLengthMismatch) {
+		t.Fatal("PatchReader with wrong trailer length should fail with ErrLengthMismatch:", err)
+	}
+	if _, err = NewPatchedReader(bytes.NewReader(old), bytes.NewReader(delta), int64(len(delta))); err != nil {
+		t.Fatal("NewPatchedReader failed:", err)
+	}
+	if _, err = NewPatchedReader(bytes.NewReader(old), bytes.NewReader(wrong), int64(len(wrong))); !errors.Is(err, ErrLengthMismatch) {
+		t.Fatal("NewPatchedReader with wrong trailer length should fail with ErrLengthMismatch:", err)
+	}
+	if _, err = NewPatchedReader(bytes.NewReader(old), bytes.NewReader(delta), int64(len(delta)-10)); err == nil {
+		t.Fatal("NewPatchedReader with truncated trailer should fail")
+	}
+
+	// VCDIFF不支持trailer
+	opts := &DeltaOptions{Trailer: true, Format: FormatVCDIFF}
+	if err = DiffWith(bytes.NewReader(old), bytes.NewReader(src), new(bytes.Buffer), opts); err == nil {
+		t.Fatal("DiffWith VCDIFF with trailer should fail")
+	}
+	sig := new(bytes.Buffer)
+	GenSign(bytes.NewReader(old), int64(len(old)), 1024, sig)
+	if err = GenDeltaWith(sig, bytes.NewReader(src), int64(len(src)), new(bytes.Buffer), opts); err == nil {
+		t.Fatal("GenDeltaWith VCDIFF with trailer should fail")
+	}
+}
@@ -0,0 +1,745 @@
+package rsync
+
+import (
+	"bytes"
+	"compress/flate"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"time"
+)
+
+// 目录树的delta
+//
+// GenTreeDelta比较目录树签名(旧目录树)和新目录树，生成一个bundle文件，包括新增的文件(数据直接
+// 保存，可以压缩)、删除的路径、重命名的文件、权限和修改时间的变化，以及已有文件的delta。旧目录树
+// 中被删除的文件与新增的文件长度和签名相同时，记录为重命名，不再保存数据。长度、修改时间和权限
+// 都相同的文件被认为没有变化(TreeDeltaOptions.Checksum时比较签名)。
+//
+// ApplyTreeDelta分两步应用bundle：
+//   1 准备：新增的文件和patch的结果写入目录中的临时目录，目录树不变。delta带trailer，校验结果
+//   2 提交：按重命名、删除、创建目录、放置文件和符号链接、设置属性的顺序修改目录树，被删除和
+//     被替换的文件移动到临时目录中。任何一步出错时按相反的顺序撤销已经做的修改
+// 所以目录树要么是原来的，要么是完整的新目录树。提交过程中进程退出时，临时目录中保留被删除和
+// 被替换的文件。
+//
+// 格式：
+//   magic:   4字节，TreeDeltaMagic
+//   record...
+//   end:     1字节，0
+//
+// record:
+//   op:      1字节
+//   pathLen: 4字节
+//   path:    pathLen字节，相对路径，以/分隔
+//   除delete外: mode 4字节，mtime 8字节(unix纳秒)
+//   rename:  fromLen 4字节 + from，旧目录树中的路径
+//   symlink: linkLen 4字节 + link
+//   add:     compress 1字节(0: 不压缩，1: deflate) + dataLen 8字节 + data
+//   patch:   deltaLen 8字节 + delta，basis为旧目录树中的path
+
+const TreeDeltaMagic uint32 = 0x72730237
+
+// bundle中记录的类型
+const (
+	treeOpEnd = iota
+	treeOpDelete
+	treeOpMkdir
+	treeOpSymlink
+	treeOpAdd
+	treeOpRename
+	treeOpPatch
+	treeOpAttr
+)
+
+// 新增文件数据的压缩方式
+const (
+	treeDataRaw   = 0
+	treeDataFlate = 1
+)
+
+// tree delta options
+type TreeDeltaOptions struct {
+	// 新增文件的数据使用deflate压缩，压缩后没有变小时不压缩
+	Compress bool
+	// 长度、修改时间和权限都相同的文件也比较签名
+	Checksum bool
+}
+
+// bundle中的一条记录
+type treeOp struct {
+	op       int
+	path     string
+	from     string // rename
+	mode     os.FileMode
+	mtime    time.Time
+	link     string // symlink
+	compress byte   // add
+	dataLen  int64  // add, patch
+
+	staged string // 准备好的文件
+	backup string // 被删除或被替换的文件
+}
+
+func (o *treeOp) header() (res []byte) {
+	res = append(res, byte(o.op))
+	res = append(res, htonl(uint32(len(o.path)))...)
+	res = append(res, o.path...)
+	if o.op == treeOpDelete {
+		return
+	}
+	res = append(res, htonl(uint32(o.mode))...)
+	res = append(res, Htonll(uint64(o.mtime.UnixNano()))...)
+	switch o.op {
+	case treeOpRename:
+		res = append(res, htonl(uint32(len(o.from)))...)
+		res = append(res, o.from...)
+	case treeOpSymlink:
+		res = append(res, htonl(uint32(len(o.link)))...)
+		res = append(res, o.link...)
+	case treeOpAdd:
+		res = append(res, o.compress)
+		res = append(res, Htonll(uint64(o.dataLen))...)
+	case treeOpPatch:
+		res = append(res, Htonll(uint64(o.dataLen))...)
+	}
+	return
+}
+
+// 读取长度和字符串
+func readString(rd io.Reader) (s string, err error) {
+	var (
+		l uint32
+		b []byte
+	)
+
+	if l, err = ntohl(rd); err != nil {
+		return
+	}
+	if l > maxTreePathLen {
+		return "", fmt.Errorf("invalid string length: %d", l)
+	}
+	b, err = readBytes(rd, uint64(l))
+	return string(b), err
+}
+
+// 读取记录，add和patch的数据没有被读取
+func readTreeOp(rd io.Reader) (o *treeOp, err error) {
+	var (
+		op    uint8
+		mode  uint32
+		mtime uint64
+		l     uint64
+	)
+
+	if op, err = readByte(rd); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return
+	}
+	o = &treeOp{op: int(op)}
+	if o.op == treeOpEnd {
+		return
+	}
+	if o.op > treeOpAttr {
+		return nil, fmt.Errorf("invalid tree delta record: %d", op)
+	}
+	if o.path, err = readString(rd); err != nil {
+		return
+	}
+	if o.path, err = cleanTreePath(o.path); err != nil {
+		return
+	}
+	if o.op == treeOpDelete {
+		return
+	}
+	if mode, err = ntohl(rd); err != nil {
+		return
+	}
+	if mtime, err = ntohll(rd); err != nil {
+		return
+	}
+	o.mode = os.FileMode(mode)
+	o.mtime = time.Unix(0, int64(mtime))
+
+	switch o.op {
+	case treeOpRename:
+		if o.from, err = readString(rd); err == nil {
+			o.from, err = cleanTreePath(o.from)
+		}
+	case treeOpSymlink:
+		o.link, err = readString(rd)
+	case treeOpAdd:
+		if o.compress, err = readByte(rd); err != nil {
+			break
+		}
+		if o.compress != treeDataRaw && o.compress != treeDataFlate {
+			return nil, fmt.Errorf("invalid compression of %s: %d", o.path, o.compress)
+		}
+		l, err = ntohll(rd)
+		o.dataLen = int64(l)
+	case treeOpPatch:
+		l, err = ntohll(rd)
+		o.dataLen = int64(l)
+	}
+	if err == nil && o.dataLen < 0 {
+		err = fmt.Errorf("invalid data length of %s", o.path)
+	}
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+// 生成bundle时的状态
+type treeDelta struct {
+	ts      *TreeSign
+	root    string
+	result  io.Writer
+	opts    *TreeDeltaOptions
+	deleted map[string]bool        // 旧目录树中被删除或类型改变的路径
+	renamed map[string]bool        // 被重命名的文件
+	bySize  map[int64][]*TreeEntry // 被删除的文件，用于查找重命名
+}
+
+// generate a bundle of changes from the tree of signature ts to directory tree root.
+// opts may be nil
+func GenTreeDelta(ts *TreeSign, root string, result io.Writer, opts *TreeDeltaOptions) (err error) {
+	var (
+		entries  []*TreeEntry
+		files    []string
+		newPaths = make(map[string]*TreeEntry)
+	)
+
+	if opts == nil {
+		opts = &TreeDeltaOptions{}
+	}
+	d := &treeDelta{
+		ts:      ts,
+		root:    root,
+		result:  result,
+		opts:    opts,
+		deleted: make(map[string]bool),
+		renamed: make(map[string]bool),
+		bySize:  make(map[int64][]*TreeEntry),
+	}
+	err = walkTree(root, func(e *TreeEntry, fn string) error {
+		entries = append(entries, e)
+		files = append(files, fn)
+		newPaths[e.Path] = e
+		return nil
+	})
+	if err != nil {
+		return
+	}
+	for _, oe := range ts.Entries {
+		if ne := newPaths[oe.Path]; ne == nil || ne.Type != oe.Type {
+			d.deleted[oe.Path] = true
+			if oe.Type == TreeFile {
+				d.bySize[oe.Size] = append(d.bySize[oe.Size], oe)
+			}
+		}
+	}
+
+	if _, err = result.Write(htonl(TreeDeltaMagic)); err != nil {
+		return
+	}
+	for i, ne := range entries {
+		oe := ts.Lookup(ne.Path)
+		if oe != nil && d.deleted[oe.Path] {
+			oe = nil
+		}
+		attr := &treeOp{op: treeOpAttr, path: ne.Path, mode: ne.Mode, mtime: ne.ModTime}
+		switch ne.Type {
+		case TreeDir:
+			if oe == nil {
+				attr.op = treeOpMkdir
+				err = d.write(attr)
+			} else if oe.Mode != ne.Mode || !oe.ModTime.Equal(ne.ModTime) {
+				err = d.write(attr)
+			}
+		case TreeSymlink:
+			if oe == nil || oe.Link != ne.Link {
+				err = d.write(&treeOp{op: treeOpSymlink, path: ne.Path, mode: ne.Mode, mtime: ne.ModTime, link: ne.Link})
+			}
+		case TreeFile:
+			err = d.file(ne, oe, files[i])
+		}
+		if err != nil {
+			return
+		}
+	}
+
+	// 只删除最上层的路径，被重命名的文件已经移走
+	for _, oe := range ts.Entries {
+		if !d.deleted[oe.Path] || d.renamed[oe.Path] || d.deleted[path.Dir(oe.Path)] {
+			continue
+		}
+		if err = d.write(&treeOp{op: treeOpDelete, path: oe.Path}); err != nil {
+			return
+		}
+	}
+	_, err = result.Write([]byte{treeOpEnd})
+	return
+}
+
+func (d *treeDelta) write(o *treeOp) (err error) {
+	_, err = d.result.Write(o.header())
+	return
+}
+
+// 写入记录和数据
+func (d *treeDelta) writeData(o *treeOp, data *os.File) (err error) {
+	var fi os.FileInfo
+
+	if fi, err = data.Stat(); err != nil {
+		return
+	}
+	o.dataLen = fi.Size()
+	if err = d.write(o); err != nil {
+		return
+	}
+	if _, err = data.Seek(0, 0); err != nil {
+		return
+	}
+	_, err = io.CopyN(d.result, data, o.dataLen)
+	return
+}
+
+// 新目录树中的文件，oe为旧目录树中相同路径的文件
+func (d *treeDelta) file(ne, oe *TreeEntry, fn string) (err error) {
+	var sign []byte
+
+	if oe != nil && !d.opts.Checksum && oe.Size == ne.Size && oe.Mode == ne.Mode && oe.ModTime.Equal(ne.ModTime) {
+		return
+	}
+	if sign, err = fileSign(fn, ne.Size, d.ts.BlockLen); err != nil {
+		return
+	}
+	attr := &treeOp{op: treeOpAttr, path: ne.Path, mode: ne.Mode, mtime: ne.ModTime}
+	if oe != nil {
+		if !bytes.Equal(oe.Sign, sign) {
+			return d.patch(ne, oe, fn)
+		}
+		if oe.Mode != ne.Mode || !oe.ModTime.Equal(ne.ModTime) {
+			return d.write(attr)
+		}
+		return
+	}
+
+	// 内容相同的被删除的文件
+	for _, de := range d.bySize[ne.Size] {
+		if !d.renamed[de.Path] && bytes.Equal(de.Sign, sign) {
+			d.renamed[de.Path] = true
+			attr.op = treeOpRename
+			attr.from = de.Path
+			return d.write(attr)
+		}
+	}
+	return d.add(ne, fn)
+}
+
+func (d *treeDelta) patch(ne, oe *TreeEntry, fn string) (err error) {
+	var src, tmp *os.File
+
+	if src, err = os.Open(fn); err != nil {
+		return
+	}
+	defer src.Close()
+	if tmp, err = ioutil.TempFile("", "rsync-tree-"); err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+
+	err = GenDeltaWith(bytes.NewReader(oe.Sign), src, ne.Size, tmp, &DeltaOptions{Trailer: true})
+	if err != nil {
+		return
+	}
+	return d.writeData(&treeOp{op: treeOpPatch, path: ne.Path, mode: ne.Mode, mtime: ne.ModTime}, tmp)
+}
+
+func (d *treeDelta) add(ne *TreeEntry, fn string) (err error) {
+	var (
+		src, tmp *os.File
+		fw       *flate.Writer
+	)
+
+	if src, err = os.Open(fn); err != nil {
+		return
+	}
+	defer src.Close()
+	o := &treeOp{op: treeOpAdd, path: ne.Path, mode: ne.Mode, mtime: ne.ModTime, dataLen: ne.Size}
+	if !d.opts.Compress {
+		if err = d.write(o); err == nil {
+			_, err = io.CopyN(d.result, src, ne.Size)
+		}
+		return
+	}
+
+	if tmp, err = ioutil.TempFile("", "rsync-tree-"); err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		os.Remove(tmp.Name())
+	}()
+	if fw, err = flate.NewWriter(tmp, flate.DefaultCompression); err != nil {
+		return
+	}
+	if _, err = io.CopyN(fw, src, ne.Size); err != nil {
+		return
+	}
+	if err = fw.Close(); err != nil {
+		return
+	}
+	if fi, e := tmp.Stat(); e == nil && fi.Size() < ne.Size {
+		o.compress = treeDataFlate
+		return d.writeData(o, tmp)
+	}
+	// 压缩后没有变小
+	if _, err = src.Seek(0, 0); err != nil {
+		return
+	}
+	if err = d.write(o); err == nil {
+		_, err = io.CopyN(d.result, src, ne.Size)
+	}
+	return
+}
+
+// 应用bundle时的状态
+type treeApplier struct {
+	dir     string
+	staging string
+	ops     []*treeOp
+	undo    []func() error // 提交时已经做的修改的撤销操作
+	n       int            // 临时目录中的文件序号
+	// 提交前已经存在的目录的修改时间，目录中的文件改变后恢复
+	dirTimes map[string]time.Time
+	// bundle中创建的符号链接和目录，检查路径的父目录
+	links map[string]bool
+	dirs  map[string]bool
+}
+
+// apply a bundle generated by GenTreeDelta to dir. new files and patched files are prepared
+// in a temp directory in dir first, then the tree is changed by renames. if anything fails,
+// the changes already made are undone, so dir is either the old tree or the new tree
+func ApplyTreeDelta(bundle io.Reader, dir string) (err error) {
+	var magic uint32
+
+	if magic, err = ntohl(bundle); err != nil {
+		return fmt.Errorf("read tree delta magic failed: %s", err.Error())
+	}
+	if magic != TreeDeltaMagic {
+		return fmt.Errorf("not tree delta file format: magic 0x%x", magic)
+	}
+
+	a := &treeApplier{dir: dir}
+	if a.staging, err = ioutil.TempDir(dir, ".rsync-tree-"); err != nil {
+		return
+	}
+	keep := false
+	defer func() {
+		if !keep {
+			os.RemoveAll(a.staging)
+		}
+	}()
+
+	if err = a.prepare(bundle); err != nil {
+		return
+	}
+	if err = a.commit(); err != nil {
+		e := a.rollback()
+		a.restoreDirTimes()
+		if e != nil {
+			// 被删除和被替换的文件还在临时目录中
+			keep = true
+			err = fmt.Errorf("%s; rollback failed: %s, original files are kept in %s", err.Error(), e.Error(), a.staging)
+		}
+	}
+	return
+}
+
+func (a *treeApplier) target(p string) string {
+	return filepath.Join(a.dir, filepath.FromSlash(p))
+}
+
+// 临时目录中新的文件名
+func (a *treeApplier) tempName() string {
+	a.n++
+	return filepath.Join(a.staging, strconv.Itoa(a.n))
+}
+
+// 读取所有记录，准备新增的文件和patch的结果
+func (a *treeApplier) prepare(bundle io.Reader) (err error) {
+	var (
+		o  *treeOp
+		fi os.FileInfo
+	)
+
+	a.links = make(map[string]bool)
+	a.dirs = make(map[string]bool)
+	for {
+		if o, err = readTreeOp(bundle); err != nil {
+			return fmt.Errorf("read tree delta failed: %s", err.Error())
+		}
+		if o.op == treeOpEnd {
+			break
+		}
+		switch o.op {
+		case treeOpSymlink:
+			a.links[o.path] = true
+		case treeOpMkdir:
+			a.dirs[o.path] = true
+		}
+		if err = a.checkParents(o); err != nil {
+			return fmt.Errorf("prepare %s failed: %s", o.path, err.Error())
+		}
+		switch o.op {
+		case treeOpAdd, treeOpPatch:
+			if o.op == treeOpPatch {
+				// basis必须是目录树中的普通文件
+				if fi, err = os.Lstat(a.target(o.path)); err == nil && !fi.Mode().IsRegular() {
+					err = errors.New("basis is not a regular file")
+				}
+				if err != nil {
+					break
+				}
+			}
+			rd := &io.LimitedReader{R: bundle, N: o.dataLen}
+			if err = a.stage(o, rd); err == nil && rd.N > 0 {
+				err = errors.New("data is not used up")
+			}
+		case treeOpRename:
+			if fi, err = os.Lstat(a.target(o.from)); err == nil && !fi.Mode().IsRegular() {
+				err = errors.New("not a regular file")
+			}
+		}
+		if err != nil {
+			return fmt.Errorf("prepare %s failed: %s", o.path, err.Error())
+		}
+		a.ops = append(a.ops, o)
+	}
+
+	// 符号链接可能在使用它的路径之后，读取所有记录后再检查一次
+	for _, o := range a.ops {
+		if err = a.checkParents(o); err != nil {
+			return fmt.Errorf("prepare %s failed: %s", o.path, err.Error())
+		}
+	}
+	return
+}
+
+// 路径的父目录不能是符号链接(已经存在的或者bundle中创建的)。bundle中创建的目录可以替换已经
+// 存在的符号链接(先删除再创建)
+func (a *treeApplier) checkParents(o *treeOp) (err error) {
+	if err = CheckTreeParents(a.dir, o.path, a.links, a.dirs); err == nil && o.from != "" {
+		err = CheckTreeParents(a.dir, o.from, a.links, a.dirs)
+	}
+	return
+}
+
+// 新增的文件或patch的结果写入临时目录
+func (a *treeApplier) stage(o *treeOp, rd io.Reader) (err error) {
+	var (
+		out   *os.File
+		basis *os.File
+	)
+
+	o.staged = a.tempName()
+	if out, err = os.OpenFile(o.staged, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0600); err != nil {
+		return
+	}
+	defer func() {
+		if e := out.Close(); err == nil {
+			err = e
+		}
+	}()
+
+	switch {
+	case o.op == treeOpPatch:
+		if basis, err = os.Open(a.target(o.path)); err != nil {
+			return
+		}
+		defer basis.Close()
+		err = Patch(rd, basis, out)
+	case o.compress == treeDataFlate:
+		fr := flate.NewReader(rd)
+		_, err = io.Copy(out, fr)
+		fr.Close()
+	default:
+		_, err = io.Copy(out, rd)
+	}
+	if err != nil {
+		return
+	}
+	return out.Sync()
+}
+
+// 移动文件，记录撤销操作
+func (a *treeApplier) move(from, to string) (err error) {
+	if err = os.Rename(from, to); err != nil {
+		return
+	}
+	a.undo = append(a.undo, func() error {
+		return os.Rename(to, from)
+	})
+	return
+}
+
+// 修改目录树
+func (a *treeApplier) commit() (err error) {
+	var attrs []*treeOp
+
+	a.saveDirTimes()
+	// 重命名的文件先移到临时目录，它所在的目录可能被删除
+	for _, o := range a.ops {
+		if o.op == treeOpRename {
+			o.staged = a.tempName()
+			if err = a.move(a.target(o.from), o.staged); err != nil {
+				return
+			}
+		}
+	}
+	for _, o := range a.ops {
+		if o.op != treeOpDelete {
+			continue
+		}
+		if _, e := os.Lstat(a.target(o.path)); os.IsNotExist(e) {
+			continue
+		}
+		o.backup = a.tempName()
+		if err = a.move(a.target(o.path), o.backup); err != nil {
+			return
+		}
+	}
+	for _, o := range a.ops {
+		if o.op != treeOpMkdir {
+			continue
+		}
+		fn := a.target(o.path)
+		if err = os.Mkdir(fn, 0700); err != nil {
+			return
+		}
+		a.undo = append(a.undo, func() error {
+			return os.Remove(fn)
+		})
+	}
+
+	// 放置文件和符号链接，已经存在的文件移动到临时目录
+	for _, o := range a.ops {
+		if o.op != treeOpAdd && o.op != treeOpPatch && o.op != treeOpRename && o.op != treeOpSymlink {
+			continue
+		}
+		fn := a.target(o.path)
+		if fi, e := os.Lstat(fn); e == nil {
+			if fi.IsDir() {
+				return fmt.Errorf("place %s failed: is a directory", o.path)
+			}
+			o.backup = a.tempName()
+			if err = a.move(fn, o.backup); err != nil {
+				return
+			}
+		}
+		if o.op == treeOpSymlink {
+			if err = os.Symlink(o.link, fn); err != nil {
+				return
+			}
+			a.undo = append(a.undo, func() error {
+				return os.Remove(fn)
+			})
+			continue
+		}
+		if err = os.Chmod(o.staged, o.mode.Perm()); err != nil {
+			return
+		}
+		if err = os.Chtimes(o.staged, o.mtime, o.mtime); err != nil {
+			return
+		}
+		if err = a.move(o.staged, fn); err != nil {
+			return
+		}
+	}
+
+	// 属性最后设置，子目录在父目录之前，放置文件不会再改变目录的修改时间
+	a.restoreDirTimes()
+	for _, o := range a.ops {
+		if o.op == treeOpMkdir || o.op == treeOpAttr {
+			attrs = append(attrs, o)
+		}
+	}
+	for i := len(attrs) - 1; i >= 0; i-- {
+		if err = a.setAttr(attrs[i]); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 记录被修改的路径所在的目录的修改时间，不包括dir
+func (a *treeApplier) saveDirTimes() {
+	a.dirTimes = make(map[string]time.Time)
+	for _, o := range a.ops {
+		for _, p := range []string{o.path, o.from} {
+			if p == "" {
+				continue
+			}
+			for d := path.Dir(p); d != "."; d = path.Dir(d) {
+				if _, ok := a.dirTimes[d]; ok {
+					break
+				}
+				if fi, err := os.Lstat(a.target(d)); err == nil && fi.IsDir() {
+					a.dirTimes[d] = fi.ModTime()
+				}
+			}
+		}
+	}
+}
+
+func (a *treeApplier) restoreDirTimes() {
+	for d, mtime := range a.dirTimes {
+		os.Chtimes(a.target(d), mtime, mtime)
+	}
+}
+
+// 设置权限和修改时间，记录原来的属性
+func (a *treeApplier) setAttr(o *treeOp) (err error) {
+	var fi os.FileInfo
+
+	fn := a.target(o.path)
+	if fi, err = os.Lstat(fn); err != nil {
+		return
+	}
+	if fi.Mode()&os.ModeSymlink != 0 {
+		return
+	}
+	if err = os.Chmod(fn, o.mode.Perm()); err != nil {
+		return
+	}
+	a.undo = append(a.undo, func() error {
+		if err := os.Chmod(fn, fi.Mode().Perm()); err != nil {
+			return err
+		}
+		return os.Chtimes(fn, fi.ModTime(), fi.ModTime())
+	})
+	return os.Chtimes(fn, o.mtime, o.mtime)
+}
+
+// 按相反的顺序撤销，返回第一个错误
+func (a *treeApplier) rollback() (err error) {
+	for i := len(a.undo) - 1; i >= 0; i-- {
+		if e := a.undo[i](); e != nil && err == nil {
+			err = e
+		}
+	}
+	a.undo = nil
+	return
+}
@@ -0,0 +1,227 @@
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/dchest/blake2b"
+)
+
+// 目录树的内容，用于比较
+func treeContent(t *testing.T, root string) string {
+	var lines []string
+
+	err := walkTree(root, func(e *TreeEntry, fn string) error {
+		if strings.HasPrefix(e.Path, ".rsync-tree-") {
+			t.Fatal("temp dir is not removed:", e.Path)
+		}
+		line := e.Path + " " + e.Type.String() + " " + e.Mode.String() + " " + e.Link
+		if e.Type != TreeSymlink {
+			line += " " + e.ModTime.String()
+		}
+		if e.Type == TreeFile {
+			data, err := ioutil.ReadFile(fn)
+			if err != nil {
+				return err
+			}
+			line += fmt.Sprintf(" %x", blake2b.Sum512(data))[:17]
+		}
+		lines = append(lines, line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(lines)
+	return strings.Join(lines, "\n")
+}
+
+func writeTree(t *testing.T, root string, files map[string]string) {
+	mtime := time.Unix(1500000000, 0)
+	for fn, data := range files {
+		fn = filepath.Join(root, fn)
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		if err := ioutil.WriteFile(fn, []byte(data), 0644); err != nil {
+			t.Fatal(err)
+		}
+		os.Chtimes(fn, mtime, mtime)
+	}
+}
+
+// 目录的修改时间设置为固定值
+func fixDirTimes(root string) {
+	mtime := time.Unix(1500000000, 0)
+	walkTree(root, func(e *TreeEntry, fn string) error {
+		if e.Type == TreeDir {
+			os.Chtimes(fn, mtime, mtime)
+		}
+		return nil
+	})
+}
+
+func TestTreeDelta(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-treedelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+
+	big := string(randBytes(61, 40000))
+	moved := string(randBytes(62, 5000))
+	writeTree(t, oldDir, map[string]string{
+		"bin/app":        big,
+		"lib/old/moved":  moved,
+		"lib/old/remove": "removed file",
+		"conf":           "unchanged",
+		"mode":           "mode changed",
+		"type":           "file becomes dir",
+	})
+	os.Symlink("bin/app", filepath.Join(oldDir, "link"))
+	fixDirTimes(oldDir)
+
+	writeTree(t, newDir, map[string]string{
+		"bin/app":       big[:20000] + "patched" + big[20000:],
+		"lib/new/moved": moved,
+		"conf":          "unchanged",
+		"mode":          "mode changed",
+		"type/file":     "in dir",
+		"added":         strings.Repeat("compressible ", 1000),
+	})
+	os.Chmod(filepath.Join(newDir, "mode"), 0600)
+	os.Symlink("conf", filepath.Join(newDir, "link"))
+	fixDirTimes(newDir)
+
+	sig, bundle := new(bytes.Buffer), new(bytes.Buffer)
+	if err = GenTreeSign(oldDir, 1024, sig); err != nil {
+		t.Fatal(err)
+	}
+	ts, err := LoadTreeSign(sig)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = GenTreeDelta(ts, newDir, bundle, &TreeDeltaOptions{Compress: true}); err != nil {
+		t.Fatal("GenTreeDelta failed:", err)
+	}
+	// 重命名和patch的文件不保存数据，压缩后的新文件很小
+	if bundle.Len() > 5000 {
+		t.Fatal("tree delta too large:", bundle.Len())
+	}
+	data := bundle.Bytes()
+
+	// 损坏的bundle，目录树不变
+	before := treeContent(t, oldDir)
+	bad := append([]byte{}, data[:len(data)-1]...)
+	if err = ApplyTreeDelta(bytes.NewReader(bad), oldDir); err == nil {
+		t.Fatal("ApplyTreeDelta with truncated bundle should fail")
+	}
+	if treeContent(t, oldDir) != before {
+		t.Fatal("failed ApplyTreeDelta should not change the tree")
+	}
+
+	if err = ApplyTreeDelta(bytes.NewReader(data), oldDir); err != nil {
+		t.Fatal("ApplyTreeDelta failed:", err)
+	}
+	if got, expect := treeContent(t, oldDir), treeContent(t, newDir); got != expect {
+		t.Fatalf("ApplyTreeDelta result wrong:\n%s\nexpect:\n%s", got, expect)
+	}
+}
+
+func TestTreeDeltaRollback(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-treedelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	oldDir, newDir := filepath.Join(dir, "old"), filepath.Join(dir, "new")
+
+	writeTree(t, oldDir, map[string]string{"a/file": "old", "b": "deleted"})
+	writeTree(t, newDir, map[string]string{"a/file": "new", "c": "added", "d/file": "dir"})
+	fixDirTimes(oldDir)
+
+	sig, bundle := new(bytes.Buffer), new(bytes.Buffer)
+	GenTreeSign(oldDir, 0, sig)
+	ts, _ := LoadTreeSign(sig)
+	if err = GenTreeDelta(ts, newDir, bundle, nil); err != nil {
+		t.Fatal(err)
+	}
+
+	// 提交时创建目录d失败，已经做的修改被撤销
+	before := treeContent(t, oldDir)
+	ioutil.WriteFile(filepath.Join(oldDir, "d"), []byte("conflict"), 0644)
+	if err = ApplyTreeDelta(bytes.NewReader(bundle.Bytes()), oldDir); err == nil {
+		t.Fatal("ApplyTreeDelta should fail when mkdir fails")
+	}
+	os.Remove(filepath.Join(oldDir, "d"))
+	if treeContent(t, oldDir) != before {
+		t.Fatal("ApplyTreeDelta should roll back")
+	}
+}
+
+// 路径的父目录是符号链接时，不能修改目录树以外的文件
+func TestTreeDeltaSymlinkParent(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-treedelta")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	tree, outside := filepath.Join(dir, "tree"), filepath.Join(dir, "outside")
+	writeTree(t, outside, map[string]string{"file": "outside"})
+	writeTree(t, tree, map[string]string{"file": "inside"})
+	os.Symlink(outside, filepath.Join(tree, "ext"))
+
+	mtime := time.Unix(1500000000, 0)
+	bundle := func(ops ...*treeOp) []byte {
+		buf := htonl(TreeDeltaMagic)
+		for _, o := range ops {
+			o.mode, o.mtime = 0644, mtime
+			buf = append(buf, o.header()...)
+			if o.op == treeOpAdd {
+				buf = append(buf, make([]byte, o.dataLen)...)
+			}
+		}
+		return append(buf, treeOpEnd)
+	}
+	symlink := &treeOp{op: treeOpSymlink, path: "x", link: outside}
+	for i, ops := range [][]*treeOp{
+		{symlink, {op: treeOpAdd, path: "x/evil", dataLen: 4}},
+		{{op: treeOpAdd, path: "x/evil", dataLen: 4}, symlink},
+		{symlink, {op: treeOpMkdir, path: "x/d"}},
+		{{op: treeOpAdd, path: "ext/evil", dataLen: 4}},
+		{{op: treeOpDelete, path: "ext/file"}},
+		{{op: treeOpAttr, path: "ext/file"}},
+		{{op: treeOpRename, path: "moved", from: "ext/file"}},
+		{{op: treeOpPatch, path: "ext/file"}},
+		{{op: treeOpPatch, path: "ext"}},
+	} {
+		if err = ApplyTreeDelta(bytes.NewReader(bundle(ops...)), tree); err == nil {
+			t.Fatal("ApplyTreeDelta should fail with symlink parent:", i)
+		}
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(outside, "file")); err != nil || string(data) != "outside" {
+		t.Fatal("file outside the tree changed:", err)
+	}
+	if fis, _ := ioutil.ReadDir(outside); len(fis) != 1 {
+		t.Fatal("file written outside the tree:", len(fis))
+	}
+
+	// 符号链接替换为目录
+	ops := bundle(&treeOp{op: treeOpDelete, path: "ext"}, &treeOp{op: treeOpMkdir, path: "ext"},
+		&treeOp{op: treeOpAdd, path: "ext/file", dataLen: 4})
+	if err = ApplyTreeDelta(bytes.NewReader(ops), tree); err != nil {
+		t.Fatal("replace symlink with directory failed:", err)
+	}
+	if fi, err := os.Lstat(filepath.Join(tree, "ext/file")); err != nil || fi.Size() != 4 {
+		t.Fatal("file in new directory wrong:", err)
+	}
+	if data, _ := ioutil.ReadFile(filepath.Join(outside, "file")); string(data) != "outside" {
+		t.Fatal("file outside the tree changed")
+	}
+}
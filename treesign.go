@@ -0,0 +1,348 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// 目录树的签名
+//
+// 一个文件中包含目录树中每个文件的相对路径、类型、长度、权限、修改时间，以及普通文件的签名，
+// 远端根据这一个文件就可以为整个目录树生成delta。文件按filepath.Walk的顺序(字典序)排列，
+// 可以流式读写。不包括根目录本身，设备文件、socket等其他类型的文件被跳过。
+//
+// 格式：
+//   magic:    4字节，TreeSignMagic
+//   blockLen: 4字节，文件签名的block长度
+//   entry...
+//   end:      1字节，0
+//
+// entry:
+//   type:     1字节，TreeFile、TreeDir或TreeSymlink
+//   pathLen:  4字节
+//   path:     pathLen字节，相对路径，以/分隔
+//   mode:     4字节，os.FileMode
+//   mtime:    8字节，修改时间，unix纳秒
+//   size:     8字节，文件长度，目录为0
+//   TreeSymlink: linkLen 4字节 + link
+//   TreeFile:    signLen 8字节 + 签名，格式与GenSign相同
+
+const (
+	TreeSignMagic uint32 = 0x72730138
+
+	maxTreePathLen = 4096
+)
+
+// type of tree signature entry
+type TreeEntryType uint8
+
+const (
+	TreeFile    TreeEntryType = 1
+	TreeDir     TreeEntryType = 2
+	TreeSymlink TreeEntryType = 3
+)
+
+func (t TreeEntryType) String() string {
+	switch t {
+	case TreeFile:
+		return "file"
+	case TreeDir:
+		return "dir"
+	case TreeSymlink:
+		return "symlink"
+	}
+	return fmt.Sprintf("TreeEntryType(%d)", int(t))
+}
+
+// a file in tree signature
+type TreeEntry struct {
+	Path    string // relative path, separated by /
+	Type    TreeEntryType
+	Mode    os.FileMode
+	ModTime time.Time
+	Size    int64
+	Link    string // target of symlink
+	Sign    []byte // signature of file, in GenSign format
+}
+
+// entry除签名外的部分
+func (e *TreeEntry) header() (res []byte) {
+	res = append(res, byte(e.Type))
+	res = append(res, htonl(uint32(len(e.Path)))...)
+	res = append(res, e.Path...)
+	res = append(res, htonl(uint32(e.Mode))...)
+	res = append(res, Htonll(uint64(e.ModTime.UnixNano()))...)
+	res = append(res, Htonll(uint64(e.Size))...)
+	switch e.Type {
+	case TreeSymlink:
+		res = append(res, htonl(uint32(len(e.Link)))...)
+		res = append(res, e.Link...)
+	case TreeFile:
+		res = append(res, Htonll(uint64(len(e.Sign)))...)
+	}
+	return
+}
+
+// generate signature of directory tree root
+func GenTreeSign(root string, blockLen uint32, result io.Writer) (err error) {
+	if blockLen == 0 {
+		blockLen = defaultBlockLen
+	}
+	if _, err = result.Write(append(htonl(TreeSignMagic), htonl(blockLen)...)); err != nil {
+		return
+	}
+
+	err = walkTree(root, func(e *TreeEntry, fn string) (err error) {
+		if e.Type == TreeFile {
+			if e.Sign, err = fileSign(fn, e.Size, blockLen); err != nil {
+				return
+			}
+		}
+		if _, err = result.Write(e.header()); err == nil {
+			_, err = result.Write(e.Sign)
+		}
+		return
+	})
+	if err != nil {
+		return
+	}
+	_, err = result.Write([]byte{0})
+	return
+}
+
+// 按filepath.Walk的顺序遍历目录树，不包括根目录，跳过其他类型的文件。e中没有签名，fn为文件路径
+func walkTree(root string, walkFn func(e *TreeEntry, fn string) error) error {
+	return filepath.Walk(root, func(fn string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		rel, err := filepath.Rel(root, fn)
+		if err != nil || rel == "." {
+			return err
+		}
+		e := &TreeEntry{
+			Path:    filepath.ToSlash(rel),
+			Mode:    fi.Mode(),
+			ModTime: fi.ModTime(),
+		}
+		switch {
+		case fi.IsDir():
+			e.Type = TreeDir
+		case fi.Mode()&os.ModeSymlink != 0:
+			e.Type = TreeSymlink
+			if e.Link, err = os.Readlink(fn); err != nil {
+				return err
+			}
+		case fi.Mode().IsRegular():
+			e.Type = TreeFile
+			e.Size = fi.Size()
+		default:
+			return nil
+		}
+		return walkFn(e, fn)
+	})
+}
+
+// 文件的签名，只读取size字节
+func fileSign(fn string, size int64, blockLen uint32) (sign []byte, err error) {
+	var (
+		f   *os.File
+		buf bytes.Buffer
+	)
+
+	if f, err = os.Open(fn); err != nil {
+		return
+	}
+	defer f.Close()
+	if err = GenSign(io.LimitReader(f, size), size, blockLen, &buf); err != nil {
+		return
+	}
+	return buf.Bytes(), nil
+}
+
+// iterator of tree signature entries
+type TreeSignReader struct {
+	rd       io.Reader
+	blockLen uint32
+	end      bool
+}
+
+// read tree signature header and return an entry iterator
+func NewTreeSignReader(rd io.Reader) (r *TreeSignReader, err error) {
+	var magic uint32
+
+	if magic, err = ntohl(rd); err != nil {
+		return nil, fmt.Errorf("read tree signature magic failed: %s", err.Error())
+	}
+	if magic != TreeSignMagic {
+		return nil, fmt.Errorf("not tree signature file format: magic 0x%x", magic)
+	}
+	r = &TreeSignReader{rd: rd}
+	if r.blockLen, err = ntohl(rd); err != nil {
+		return nil, fmt.Errorf("read tree signature block length failed: %s", err.Error())
+	}
+	return
+}
+
+// block length of file signatures
+func (r *TreeSignReader) BlockLen() uint32 {
+	return r.blockLen
+}
+
+// next entry, io.EOF at the end of tree signature
+func (r *TreeSignReader) Next() (e *TreeEntry, err error) {
+	var (
+		typ   uint8
+		l     uint32
+		mode  uint32
+		mtime uint64
+		size  uint64
+		b     []byte
+	)
+
+	if r.end {
+		return nil, io.EOF
+	}
+	if typ, err = readByte(r.rd); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		return nil, fmt.Errorf("read tree signature entry failed: %s", err.Error())
+	}
+	if typ == 0 {
+		r.end = true
+		return nil, io.EOF
+	}
+
+	e = &TreeEntry{Type: TreeEntryType(typ)}
+	if e.Type != TreeFile && e.Type != TreeDir && e.Type != TreeSymlink {
+		return nil, fmt.Errorf("invalid tree signature entry type: %d", typ)
+	}
+	if l, err = ntohl(r.rd); err == nil {
+		if l > maxTreePathLen {
+			return nil, fmt.Errorf("invalid tree signature path length: %d", l)
+		}
+		b, err = readBytes(r.rd, uint64(l))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read tree signature path failed: %s", err.Error())
+	}
+	if e.Path, err = cleanTreePath(string(b)); err != nil {
+		return nil, err
+	}
+	if mode, err = ntohl(r.rd); err == nil {
+		if mtime, err = ntohll(r.rd); err == nil {
+			size, err = ntohll(r.rd)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read tree signature entry %s failed: %s", e.Path, err.Error())
+	}
+	e.Mode = os.FileMode(mode)
+	e.ModTime = time.Unix(0, int64(mtime))
+	e.Size = int64(size)
+
+	switch e.Type {
+	case TreeSymlink:
+		if l, err = ntohl(r.rd); err == nil {
+			if l > maxTreePathLen {
+				return nil, fmt.Errorf("invalid symlink length of %s: %d", e.Path, l)
+			}
+			b, err = readBytes(r.rd, uint64(l))
+			e.Link = string(b)
+		}
+	case TreeFile:
+		if size, err = ntohll(r.rd); err == nil {
+			e.Sign, err = readBytes(r.rd, size)
+		}
+	}
+	if err != nil {
+		return nil, fmt.Errorf("read tree signature entry %s failed: %s", e.Path, err.Error())
+	}
+	return
+}
+
+// 读取n字节，长度错误时不会一次分配很大的内存
+func readBytes(rd io.Reader, n uint64) (b []byte, err error) {
+	var buf bytes.Buffer
+
+	if n < 1<<20 {
+		buf.Grow(int(n))
+	}
+	if _, err = io.CopyN(&buf, rd, int64(n)); err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
+
+// 相对路径不能是绝对路径，不能包含..。不检查符号链接，写入时还需要检查父目录不是符号链接
+func cleanTreePath(p string) (string, error) {
+	cp := path.Clean(p)
+	if p == "" || cp == "." || path.IsAbs(cp) || cp == ".." || strings.HasPrefix(cp, "../") ||
+		strings.ContainsRune(p, 0) {
+		return "", fmt.Errorf("invalid tree path: %q", p)
+	}
+	return cp, nil
+}
+
+// check that no parent directory of relative path p in dir is a symlink, so writing p can not change files
+// outside dir. links are symlinks to be created, dirs are directories to be created (which replace existing
+// symlinks)
+func CheckTreeParents(dir, p string, links, dirs map[string]bool) error {
+	for d := path.Dir(p); d != "."; d = path.Dir(d) {
+		if links[d] {
+			return fmt.Errorf("parent %s is a symlink", d)
+		}
+		if dirs[d] {
+			continue
+		}
+		if fi, err := os.Lstat(filepath.Join(dir, filepath.FromSlash(d))); err == nil && fi.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("parent %s is a symlink", d)
+		}
+	}
+	return nil
+}
+
+// tree signature loaded in memory
+type TreeSign struct {
+	BlockLen uint32
+	Entries  []*TreeEntry
+	index    map[string]*TreeEntry
+}
+
+// load tree signature
+func LoadTreeSign(rd io.Reader) (ts *TreeSign, err error) {
+	var (
+		r *TreeSignReader
+		e *TreeEntry
+	)
+
+	if r, err = NewTreeSignReader(rd); err != nil {
+		return
+	}
+	ts = &TreeSign{BlockLen: r.BlockLen(), index: make(map[string]*TreeEntry)}
+	for {
+		if e, err = r.Next(); err == io.EOF {
+			return ts, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if _, ok := ts.index[e.Path]; ok {
+			return nil, errors.New("duplicate path in tree signature: " + e.Path)
+		}
+		ts.Entries = append(ts.Entries, e)
+		ts.index[e.Path] = e
+	}
+}
+
+// entry of relative path p, nil if not found
+func (ts *TreeSign) Lookup(p string) *TreeEntry {
+	return ts.index[path.Clean(filepath.ToSlash(p))]
+}
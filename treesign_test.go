@@ -0,0 +1,70 @@
+package rsync
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func TestTreeSign(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-treesign")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	basis := randBytes(51, 30000)
+	os.MkdirAll(filepath.Join(dir, "a/b"), 0755)
+	ioutil.WriteFile(filepath.Join(dir, "a/b/file"), basis, 0600)
+	ioutil.WriteFile(filepath.Join(dir, "empty"), nil, 0644)
+	os.Symlink("a/b/file", filepath.Join(dir, "link"))
+	mtime := time.Unix(1400000000, 123)
+	os.Chtimes(filepath.Join(dir, "a/b/file"), mtime, mtime)
+
+	result := new(bytes.Buffer)
+	if err = GenTreeSign(dir, 1024, result); err != nil {
+		t.Fatal("GenTreeSign failed:", err)
+	}
+	ts, err := LoadTreeSign(bytes.NewReader(result.Bytes()))
+	if err != nil {
+		t.Fatal("LoadTreeSign failed:", err)
+	}
+	var paths []string
+	for _, e := range ts.Entries {
+		paths = append(paths, e.Path+":"+e.Type.String())
+	}
+	if ts.BlockLen != 1024 || len(paths) != 5 || paths[0] != "a:dir" || paths[2] != "a/b/file:file" ||
+		paths[3] != "empty:file" || paths[4] != "link:symlink" {
+		t.Fatalf("tree signature entries wrong: %v", paths)
+	}
+	if e := ts.Lookup("link"); e == nil || e.Link != "a/b/file" {
+		t.Fatal("symlink entry wrong:", e)
+	}
+
+	// 使用文件的签名生成delta
+	e := ts.Lookup("a/b/file")
+	if e.Size != int64(len(basis)) || e.Mode.Perm() != 0600 || !e.ModTime.Equal(mtime) {
+		t.Fatalf("file entry wrong: %+v", e)
+	}
+	src := append(randBytes(52, 100), basis[5000:]...)
+	delta, merged := new(bytes.Buffer), new(bytes.Buffer)
+	if err = GenDelta(bytes.NewReader(e.Sign), bytes.NewReader(src), int64(len(src)), delta); err != nil {
+		t.Fatal(err)
+	}
+	if err = Patch(delta, bytes.NewReader(basis), merged); err != nil || !bytes.Equal(merged.Bytes(), src) {
+		t.Fatal("patch with tree signature entry failed:", err)
+	}
+
+	// 超出目录树的路径
+	bad := &TreeEntry{Path: "../passwd", Type: TreeDir}
+	data := append(append(htonl(TreeSignMagic), htonl(1024)...), bad.header()...)
+	if _, err = LoadTreeSign(bytes.NewReader(append(data, 0))); err == nil {
+		t.Fatal("LoadTreeSign should reject path outside tree")
+	}
+	if _, err = LoadTreeSign(bytes.NewReader(result.Bytes()[:result.Len()-1])); err == nil {
+		t.Fatal("LoadTreeSign should fail on truncated tree signature")
+	}
+}
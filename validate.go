@@ -0,0 +1,76 @@
+package rsync
+
+import (
+	"errors"
+	"fmt"
+	"io"
+)
+
+var ErrInvalidDelta = errors.New("invalid delta")
+
+// check a delta without patching: magic, every command and the end command, COPY ranges against basisLen
+// (not checked if basisLen < 0; MCOPY from other basis files is not checked), SELF copies within the patch window, and the trailer
+// if present. rd should contain exactly one delta. returns the output length.
+// errors of malformed delta wrap ErrInvalidDelta. VCDIFF delta is not supported
+func ValidateDelta(rd io.Reader, basisLen int64) (outputLen int64, err error) {
+	var (
+		dr    *DeltaReader
+		op    Op
+		magic uint32
+		buf   [1]byte
+	)
+
+	if magic, err = ntohl(rd); err != nil {
+		return 0, fmt.Errorf("%w: read delta magic failed: %s", ErrInvalidDelta, err.Error())
+	}
+	if magic == VcdiffMagic || magic == VcdiffExtMagic {
+		return 0, errors.New("VCDIFF delta is not supported by ValidateDelta")
+	}
+	if magic != DeltaMagic {
+		return 0, fmt.Errorf("%w: %s", ErrInvalidDelta, NotDeltaMagic.Error())
+	}
+	dr = newDeltaReader(rd, magic)
+	dr.SkipData = true
+	for {
+		if op, err = dr.Next(); err == io.EOF {
+			break
+		} else if err != nil {
+			return dr.OutputLength(), fmt.Errorf("%w: command at %d: %s", ErrInvalidDelta, dr.DeltaOffset(), err.Error())
+		}
+		// 参数超过int64时为负数
+		if op.Offset < 0 || op.Length < 0 || dr.OutputOffset() < 0 {
+			return dr.OutputOffset(), fmt.Errorf("%w: command at %d: %s offset=%d length=%d overflow",
+				ErrInvalidDelta, dr.DeltaOffset(), op.Kind, uint64(op.Offset), uint64(op.Length))
+		}
+		switch op.Kind {
+		case OpCopy, OpMultiCopy:
+			if basisLen >= 0 && op.Basis == 0 && (op.Offset > basisLen || op.Length > basisLen-op.Offset) {
+				return dr.OutputOffset(), fmt.Errorf("%w: command at %d: copy [%d, %d) out of basis length %d",
+					ErrInvalidDelta, dr.DeltaOffset(), op.Offset, op.Offset+op.Length, basisLen)
+			}
+		case OpSelf:
+			if dr.OutputOffset()-op.Offset > selfCopyWindow {
+				return dr.OutputOffset(), fmt.Errorf("%w: command at %d: self copy where=%d output=%d out of window",
+					ErrInvalidDelta, dr.DeltaOffset(), op.Offset, dr.OutputOffset())
+			}
+		}
+	}
+	err = nil
+	outputLen = dr.OutputLength()
+	if outputLen < 0 {
+		return outputLen, fmt.Errorf("%w: output length overflow", ErrInvalidDelta)
+	}
+	// 截断在命令之间的delta也能被读取，必须以结束命令结尾
+	if !dr.endCmd {
+		return outputLen, fmt.Errorf("%w: missing end command", ErrInvalidDelta)
+	}
+
+	if t := dr.Trailer(); t != nil && t.Length != outputLen {
+		return outputLen, fmt.Errorf("%w: trailer length %d, output length %d", ErrInvalidDelta, t.Length, outputLen)
+	}
+	// delta之后不应该有其他数据
+	if n, _ := io.ReadFull(rd, buf[:]); n > 0 {
+		return outputLen, fmt.Errorf("%w: trailing data after end command", ErrInvalidDelta)
+	}
+	return
+}
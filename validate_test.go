@@ -0,0 +1,67 @@
+package rsync
+
+import (
+	"bytes"
+	"errors"
+	"testing"
+)
+
+func TestValidateDelta(t *testing.T) {
+	var (
+		old    = randBytes(43, 40000)
+		src    = append(append([]byte{}, randBytes(44, 1000)...), old[5000:]...)
+		result = new(bytes.Buffer)
+	)
+
+	if err := DiffWith(bytes.NewReader(old), bytes.NewReader(src), result, &DeltaOptions{Trailer: true}); err != nil {
+		t.Fatal("DiffWith failed:", err)
+	}
+	delta := result.Bytes()
+	n, err := ValidateDelta(bytes.NewReader(delta), int64(len(old)))
+	if err != nil || n != int64(len(src)) {
+		t.Fatal("ValidateDelta failed:", n, err)
+	}
+	if n, err = ValidateDelta(bytes.NewReader(delta), -1); err != nil || n != int64(len(src)) {
+		t.Fatal("ValidateDelta without basis length failed:", n, err)
+	}
+
+	invalid := map[string][]byte{
+		"short basis":   nil,
+		"bad magic":     append([]byte{0, 1, 2, 3}, delta[4:]...),
+		"truncated":     delta[:len(delta)/2],
+		"trailing data": append(append([]byte{}, delta...), 0),
+		"bad command":   append(htonl(DeltaMagic), 0xff),
+		"magic only":    htonl(DeltaMagic),
+		// 在结束命令和trailer之前截断
+		"no end": delta[:len(delta)-1-8-4-64],
+	}
+	for name, d := range invalid {
+		basisLen := int64(len(old))
+		if d == nil {
+			d = delta
+			basisLen = 30000
+		}
+		if _, err = ValidateDelta(bytes.NewReader(d), basisLen); !errors.Is(err, ErrInvalidDelta) {
+			t.Fatalf("ValidateDelta %s should fail with ErrInvalidDelta: %v", name, err)
+		}
+	}
+
+	// 没有trailer的delta只缺少结束命令
+	result.Reset()
+	if err = Diff(bytes.NewReader(old), bytes.NewReader(src), result); err != nil {
+		t.Fatal("Diff failed:", err)
+	}
+	if _, err = ValidateDelta(bytes.NewReader(result.Bytes()[:result.Len()-1]), int64(len(old))); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatal("ValidateDelta without end command should fail:", err)
+	}
+
+	// self copy超出patch时保留的历史数据
+	result.Reset()
+	dw := NewDeltaWriter(result)
+	dw.Run(0, selfCopyWindow+10)
+	dw.Self(5, 10)
+	dw.Close()
+	if _, err = ValidateDelta(bytes.NewReader(result.Bytes()), 0); !errors.Is(err, ErrInvalidDelta) {
+		t.Fatal("ValidateDelta self copy out of window should fail:", err)
+	}
+}
@@ -0,0 +1,671 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"errors"
+	"fmt"
+	"hash/adler32"
+	"io"
+	"io/ioutil"
+)
+
+// VCDIFF (RFC 3284) 格式的delta
+//
+// 生成delta时，匹配块转换为VCDIFF的COPY指令(地址在source segment中)，不匹配的数据转换为
+// ADD指令，使用RFC中的默认code table和地址cache。整个basis文件作为每个window的source segment，
+// target按vcdWindowSize切分为多个window。
+//
+// Patch发现delta文件的magic为VCDIFF时，按VCDIFF格式解码。解码支持默认code table中的所有
+// 指令、地址cache、target window内部的COPY，以及adler32校验：标准格式(xdelta3)的校验和为4字节，
+// open-vcdiff的扩展格式(header version为'S')的校验和为变长整数，扩展格式还可以是interleaved，
+// 即data和address与指令交织在instructions section中。不支持二次压缩、自定义code table以及
+// VCD_TARGET window。
+
+const (
+	VcdiffMagic uint32 = 0xd6c3c400
+	// open-vcdiff的扩展格式，header version为'S'
+	VcdiffExtMagic uint32 = 0xd6c3c453
+
+	// Hdr_Indicator
+	VCD_DECOMPRESS uint8 = 0x01
+	VCD_CODETABLE  uint8 = 0x02
+	VCD_APPHEADER  uint8 = 0x04 // xdelta3扩展
+
+	// Win_Indicator
+	VCD_SOURCE  uint8 = 0x01
+	VCD_TARGET  uint8 = 0x02
+	VCD_ADLER32 uint8 = 0x04 // xdelta3/open-vcdiff扩展，open-vcdiff为VCD_CHECKSUM
+
+	// 指令类型
+	VCD_NOOP uint8 = 0
+	VCD_ADD  uint8 = 1
+	VCD_RUN  uint8 = 2
+	VCD_COPY uint8 = 3
+
+	// 地址模式
+	VCD_SELF uint8 = 0
+	VCD_HERE uint8 = 1
+
+	vcdNearSize = 4
+	vcdSameSize = 3
+
+	// 解码时允许的target window最大长度
+	maxVcdTargetWindow = 1 << 26
+)
+
+const (
+	FormatRsync  = iota // delta magic + rsync的COPY/LITERAL命令
+	FormatVCDIFF        // RFC 3284
+)
+
+var (
+	// 每个window的target数据最大长度
+	vcdWindowSize int64 = 1 << 22
+
+	vcdCodeTable   = defaultCodeTable()
+	vcdSingleIndex = make(map[vcdInst]int)
+	vcdDoubleIndex = make(map[[2]vcdInst]int)
+)
+
+// code table中的一条指令
+type vcdInst struct {
+	inst uint8
+	size uint8
+	mode uint8
+}
+
+type vcdCode [2]vcdInst
+
+func init() {
+	for i, c := range vcdCodeTable {
+		if c[1].inst == VCD_NOOP {
+			vcdSingleIndex[c[0]] = i
+		} else {
+			vcdDoubleIndex[[2]vcdInst(c)] = i
+		}
+	}
+}
+
+// RFC 3284 5.6 默认code table
+func defaultCodeTable() (table [256]vcdCode) {
+	var (
+		i    = 0
+		mode uint8
+		size uint8
+	)
+
+	table[i] = vcdCode{{VCD_RUN, 0, 0}}
+	i++
+	for size = 0; size <= 17; size++ {
+		table[i] = vcdCode{{VCD_ADD, size, 0}}
+		i++
+	}
+	for mode = 0; mode <= 8; mode++ {
+		table[i] = vcdCode{{VCD_COPY, 0, mode}}
+		i++
+		for size = 4; size <= 18; size++ {
+			table[i] = vcdCode{{VCD_COPY, size, mode}}
+			i++
+		}
+	}
+	for mode = 0; mode <= 5; mode++ {
+		for size = 1; size <= 4; size++ {
+			for csize := uint8(4); csize <= 6; csize++ {
+				table[i] = vcdCode{{VCD_ADD, size, 0}, {VCD_COPY, csize, mode}}
+				i++
+			}
+		}
+	}
+	for mode = 6; mode <= 8; mode++ {
+		for size = 1; size <= 4; size++ {
+			table[i] = vcdCode{{VCD_ADD, size, 0}, {VCD_COPY, 4, mode}}
+			i++
+		}
+	}
+	for mode = 0; mode <= 8; mode++ {
+		table[i] = vcdCode{{VCD_COPY, 4, mode}, {VCD_ADD, 1, 0}}
+		i++
+	}
+	return
+}
+
+// RFC 3284 2.2 变长整数：大端序，每字节7位，除最后一个字节外最高位为1
+func vcdPutInt(buf []byte, v uint64) []byte {
+	var tmp [10]byte
+
+	i := len(tmp) - 1
+	tmp[i] = byte(v & 0x7f)
+	for v >>= 7; v > 0; v >>= 7 {
+		i--
+		tmp[i] = byte(v&0x7f) | 0x80
+	}
+	return append(buf, tmp[i:]...)
+}
+
+func vcdReadInt(rd io.ByteReader) (v uint64, err error) {
+	var c byte
+
+	for i := 0; i < 10; i++ {
+		if c, err = rd.ReadByte(); err != nil {
+			return
+		}
+		v = v<<7 | uint64(c&0x7f)
+		if c&0x80 == 0 {
+			return
+		}
+	}
+	err = errors.New("vcdiff: integer overflow")
+	return
+}
+
+// 地址cache，RFC 3284 5.1
+type vcdAddrCache struct {
+	near     [vcdNearSize]uint64
+	nextSlot int
+	same     [vcdSameSize * 256]uint64
+}
+
+func (c *vcdAddrCache) reset() {
+	*c = vcdAddrCache{}
+}
+
+func (c *vcdAddrCache) update(addr uint64) {
+	c.near[c.nextSlot] = addr
+	c.nextSlot = (c.nextSlot + 1) % vcdNearSize
+	c.same[addr%(vcdSameSize*256)] = addr
+}
+
+// 选择编码最短的地址模式，返回mode和编码后的地址
+func (c *vcdAddrCache) encode(addr, here uint64) (mode uint8, buf []byte) {
+	// same模式只需要一个字节
+	if c.same[addr%(vcdSameSize*256)] == addr {
+		slot := addr % (vcdSameSize * 256)
+		mode = uint8(2 + vcdNearSize + slot/256)
+		buf = []byte{byte(slot % 256)}
+		c.update(addr)
+		return
+	}
+
+	mode = VCD_SELF
+	best := addr
+	if here-addr < best {
+		mode = VCD_HERE
+		best = here - addr
+	}
+	for i := 0; i < vcdNearSize; i++ {
+		if addr >= c.near[i] && addr-c.near[i] < best {
+			mode = uint8(2 + i)
+			best = addr - c.near[i]
+		}
+	}
+	buf = vcdPutInt(nil, best)
+	c.update(addr)
+	return
+}
+
+func (c *vcdAddrCache) decode(rd io.ByteReader, mode uint8, here uint64) (addr uint64, err error) {
+	var (
+		v uint64
+		b byte
+	)
+
+	switch {
+	case mode == VCD_SELF:
+		addr, err = vcdReadInt(rd)
+	case mode == VCD_HERE:
+		if v, err = vcdReadInt(rd); err == nil {
+			if v > here {
+				err = fmt.Errorf("vcdiff: invalid HERE address %d at %d", v, here)
+			}
+			addr = here - v
+		}
+	case mode < 2+vcdNearSize:
+		if v, err = vcdReadInt(rd); err == nil {
+			addr = c.near[mode-2] + v
+		}
+	case mode < 2+vcdNearSize+vcdSameSize:
+		if b, err = rd.ReadByte(); err == nil {
+			addr = c.same[uint64(mode-2-vcdNearSize)*256+uint64(b)]
+		}
+	default:
+		err = fmt.Errorf("vcdiff: invalid address mode %d", mode)
+	}
+	if err == nil {
+		c.update(addr)
+	}
+	return
+}
+
+// 一个window的编码器
+type vcdWindow struct {
+	srcLen uint64 // source segment长度
+	tgtLen uint64 // 已编码的target长度
+	data   []byte
+	inst   []byte
+	addr   []byte
+	cache  vcdAddrCache
+	// 还未写入inst的单条指令，可能与下一条指令合并
+	pending    bool
+	pendingIns vcdInst
+	pendingLen uint64
+}
+
+func (w *vcdWindow) reset(srcLen uint64) {
+	w.srcLen = srcLen
+	w.tgtLen = 0
+	w.data = w.data[:0]
+	w.inst = w.inst[:0]
+	w.addr = w.addr[:0]
+	w.cache.reset()
+	w.pending = false
+}
+
+func (w *vcdWindow) add(p []byte) {
+	w.data = append(w.data, p...)
+	w.emit(vcdInst{VCD_ADD, 0, 0}, uint64(len(p)))
+	w.tgtLen += uint64(len(p))
+}
+
+func (w *vcdWindow) run(b byte, length uint64) {
+	w.data = append(w.data, b)
+	w.emit(vcdInst{VCD_RUN, 0, 0}, length)
+	w.tgtLen += length
+}
+
+func (w *vcdWindow) copy(addr, length uint64) {
+	mode, buf := w.cache.encode(addr, w.srcLen+w.tgtLen)
+	w.addr = append(w.addr, buf...)
+	w.emit(vcdInst{VCD_COPY, 0, mode}, length)
+	w.tgtLen += length
+}
+
+// 写入指令，尽量使用code table中size不为0的指令，以及两条指令合并的指令
+func (w *vcdWindow) emit(ins vcdInst, length uint64) {
+	if w.pending {
+		if length < 256 {
+			next := vcdInst{ins.inst, uint8(length), ins.mode}
+			prev := vcdInst{w.pendingIns.inst, uint8(w.pendingLen), w.pendingIns.mode}
+			if w.pendingLen < 256 {
+				if idx, ok := vcdDoubleIndex[[2]vcdInst{prev, next}]; ok {
+					w.inst = append(w.inst, byte(idx))
+					w.pending = false
+					return
+				}
+			}
+		}
+		w.flushPending()
+	}
+	if ins.inst != VCD_RUN && length < 256 {
+		// 可能与下一条指令合并
+		w.pending = true
+		w.pendingIns = ins
+		w.pendingLen = length
+		return
+	}
+	w.writeSingle(ins, length)
+}
+
+func (w *vcdWindow) flushPending() {
+	if w.pending {
+		w.writeSingle(w.pendingIns, w.pendingLen)
+		w.pending = false
+	}
+}
+
+func (w *vcdWindow) writeSingle(ins vcdInst, length uint64) {
+	if length < 256 {
+		if idx, ok := vcdSingleIndex[vcdInst{ins.inst, uint8(length), ins.mode}]; ok {
+			w.inst = append(w.inst, byte(idx))
+			return
+		}
+	}
+	w.inst = append(w.inst, byte(vcdSingleIndex[vcdInst{ins.inst, 0, ins.mode}]))
+	w.inst = vcdPutInt(w.inst, length)
+}
+
+// 写入一个window
+func (w *vcdWindow) writeTo(wr io.Writer) (err error) {
+	var hdr, body []byte
+
+	w.flushPending()
+	if w.srcLen > 0 {
+		hdr = append(hdr, VCD_SOURCE)
+		hdr = vcdPutInt(hdr, w.srcLen)
+		hdr = vcdPutInt(hdr, 0)
+	} else {
+		hdr = append(hdr, 0)
+	}
+
+	body = vcdPutInt(body, w.tgtLen)
+	body = append(body, 0) // Delta_Indicator
+	body = vcdPutInt(body, uint64(len(w.data)))
+	body = vcdPutInt(body, uint64(len(w.inst)))
+	body = vcdPutInt(body, uint64(len(w.addr)))
+	hdr = vcdPutInt(hdr, uint64(len(body)+len(w.data)+len(w.inst)+len(w.addr)))
+
+	for _, p := range [][]byte{hdr, body, w.data, w.inst, w.addr} {
+		if _, err = wr.Write(p); err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 将matchStat按VCDIFF格式写入delta文件
+func (d *delta) flushVCDIFF(src io.ReadSeeker) (err error) {
+	var (
+		w      vcdWindow
+		srcPos int64 // 当前matchStat在src中的位置
+		winPos int64 // 当前window在src中的起始位置
+		buf    []byte
+	)
+
+	// header: magic + Hdr_Indicator
+	if _, err = d.outer.Write(append(htonl(VcdiffMagic), 0)); err != nil {
+		return
+	}
+
+	w.reset(uint64(d.sig.flength))
+	for _, ms := range d.mss {
+		off := int64(0) // 已经写入的ms长度
+		for off < ms.length {
+			if srcPos+off-winPos >= vcdWindowSize {
+				if err = w.writeTo(d.outer); err != nil {
+					return
+				}
+				w.reset(uint64(d.sig.flength))
+				winPos = srcPos + off
+			}
+			l := ms.length - off
+			if left := vcdWindowSize - (srcPos + off - winPos); l > left {
+				l = left
+			}
+
+			switch ms.match {
+			case 1:
+				w.copy(uint64(ms.pos+off), uint64(l))
+			case 3:
+				w.run(ms.value, uint64(l))
+			case 2:
+				if ms.pos+off >= winPos {
+					// 在当前target window中
+					w.copy(w.srcLen+uint64(ms.pos+off-winPos), uint64(l))
+					break
+				}
+				// 在之前的window中，转换为ADD
+				fallthrough
+			case -1:
+				if int64(cap(buf)) < l {
+					buf = make([]byte, l)
+				}
+				// self copy的数据与src当前位置的数据相同
+				at := srcPos + off
+				if ms.match == -1 {
+					at = ms.pos + off
+				}
+				if _, err = src.Seek(at, 0); err != nil {
+					return
+				}
+				if _, err = io.ReadFull(src, buf[0:l]); err != nil {
+					return
+				}
+				w.add(buf[0:l])
+			default:
+				return fmt.Errorf("unknown match kind %d: matchStat: %v", ms.match, ms)
+			}
+			off += l
+		}
+		srcPos += ms.length
+	}
+
+	if srcPos > winPos || len(d.mss) == 0 {
+		err = w.writeTo(d.outer)
+	}
+	return
+}
+
+// 将差异merged文件, 差异文件为VCDIFF格式
+// deltaRd: delta文件
+// target:  本地文件
+// merged:  合并后的文件
+func PatchVCDIFF(deltaRd io.Reader, target io.ReadSeeker, merged io.Writer, args ...bool) (err error) {
+	var magic uint32
+
+	if magic, err = ntohl(deltaRd); err != nil {
+		return fmt.Errorf("Read delta file magic failed: %s", err.Error())
+	}
+	if magic != VcdiffMagic && magic != VcdiffExtMagic {
+		return NotDeltaMagic
+	}
+	p := Patcher{deltaRd: deltaRd, target: target, hist: newHistory(merged), vcdExt: magic == VcdiffExtMagic}
+	p.merged = p.hist
+	if len(args) > 0 {
+		p.debug = args[0]
+	}
+	return p.patchVCDIFF()
+}
+
+// 已经读取了magic，解码header及所有window
+func (p *Patcher) patchVCDIFF() (err error) {
+	var (
+		hdrInd uint8
+		n      uint64
+	)
+
+	rd := bufio.NewReader(p.deltaRd)
+	if hdrInd, err = rd.ReadByte(); err != nil {
+		return fmt.Errorf("vcdiff: read header indicator failed: %s", err.Error())
+	}
+	if hdrInd&VCD_DECOMPRESS != 0 {
+		return errors.New("vcdiff: secondary compression is not supported")
+	}
+	if hdrInd&VCD_CODETABLE != 0 {
+		return errors.New("vcdiff: application-defined code table is not supported")
+	}
+	if hdrInd&VCD_APPHEADER != 0 {
+		if n, err = vcdReadInt(rd); err != nil {
+			return fmt.Errorf("vcdiff: read app header length failed: %s", err.Error())
+		}
+		if _, err = io.CopyN(ioutil.Discard, rd, int64(n)); err != nil {
+			return fmt.Errorf("vcdiff: read app header failed: %s", err.Error())
+		}
+	}
+
+	for {
+		if err = p.vcdWindow(rd); err == io.EOF {
+			return nil
+		} else if err != nil {
+			return
+		}
+	}
+}
+
+// 解码一个window
+func (p *Patcher) vcdWindow(rd *bufio.Reader) (err error) {
+	var (
+		winInd             uint8
+		segLen, segPos     uint64
+		encLen, tgtLen     uint64
+		deltaInd           uint8
+		dataLen, instLen   uint64
+		addrLen            uint64
+		checksum           uint32
+		data, inst, addr   []byte
+		cache              vcdAddrCache
+		code               vcdCode
+		size, address, pos uint64
+		c                  byte
+	)
+
+	if winInd, err = rd.ReadByte(); err != nil {
+		return // io.EOF: 没有更多window
+	}
+	if winInd&VCD_TARGET != 0 {
+		return errors.New("vcdiff: VCD_TARGET window is not supported")
+	}
+	if winInd&VCD_SOURCE != 0 {
+		if segLen, err = vcdReadInt(rd); err != nil {
+			return vcdErr("source segment length", err)
+		}
+		if segPos, err = vcdReadInt(rd); err != nil {
+			return vcdErr("source segment position", err)
+		}
+	}
+	if encLen, err = vcdReadInt(rd); err != nil {
+		return vcdErr("delta encoding length", err)
+	}
+	if tgtLen, err = vcdReadInt(rd); err != nil {
+		return vcdErr("target window length", err)
+	}
+	if tgtLen > maxVcdTargetWindow {
+		return fmt.Errorf("vcdiff: target window too large: %d", tgtLen)
+	}
+	if deltaInd, err = rd.ReadByte(); err != nil {
+		return vcdErr("delta indicator", err)
+	}
+	if deltaInd != 0 {
+		return errors.New("vcdiff: secondary compression is not supported")
+	}
+	if dataLen, err = vcdReadInt(rd); err != nil {
+		return vcdErr("data section length", err)
+	}
+	if instLen, err = vcdReadInt(rd); err != nil {
+		return vcdErr("instructions section length", err)
+	}
+	if addrLen, err = vcdReadInt(rd); err != nil {
+		return vcdErr("addresses section length", err)
+	}
+	// 分别比较，避免相加溢出
+	if dataLen > encLen || instLen > encLen-dataLen || addrLen > encLen-dataLen-instLen {
+		return errors.New("vcdiff: section length exceeds delta encoding length")
+	}
+	if dataLen > tgtLen {
+		return fmt.Errorf("vcdiff: data section longer than target window: %d > %d", dataLen, tgtLen)
+	}
+	if winInd&VCD_ADLER32 != 0 {
+		if p.vcdExt {
+			var v uint64
+			if v, err = vcdReadInt(rd); err == nil && v > 0xffffffff {
+				err = fmt.Errorf("value %d out of range", v)
+			}
+			checksum = uint32(v)
+		} else {
+			checksum, err = ntohl(rd)
+		}
+		if err != nil {
+			return vcdErr("adler32 checksum", err)
+		}
+	}
+	if data, err = vcdReadSection(rd, dataLen); err != nil {
+		return vcdErr("data section", err)
+	}
+	if inst, err = vcdReadSection(rd, instLen); err != nil {
+		return vcdErr("instructions section", err)
+	}
+	if addr, err = vcdReadSection(rd, addrLen); err != nil {
+		return vcdErr("addresses section", err)
+	}
+
+	dataRd := bytes.NewReader(data)
+	instRd := bytes.NewReader(inst)
+	addrRd := bytes.NewReader(addr)
+	if p.vcdExt && dataLen == 0 && addrLen == 0 {
+		// interleaved：data和address在每条指令之后
+		dataRd, addrRd = instRd, instRd
+	}
+	tgt := make([]byte, 0, tgtLen)
+	for instRd.Len() > 0 {
+		if c, err = instRd.ReadByte(); err != nil {
+			return
+		}
+		code = vcdCodeTable[c]
+		for _, ins := range code {
+			if ins.inst == VCD_NOOP {
+				continue
+			}
+			if size = uint64(ins.size); size == 0 {
+				if size, err = vcdReadInt(instRd); err != nil {
+					return vcdErr("instruction size", err)
+				}
+			}
+			pos = uint64(len(tgt))
+			if pos+size > tgtLen {
+				return fmt.Errorf("vcdiff: instruction exceeds target window: %d+%d>%d", pos, size, tgtLen)
+			}
+			switch ins.inst {
+			case VCD_ADD:
+				if uint64(dataRd.Len()) < size {
+					return errors.New("vcdiff: ADD exceeds data section")
+				}
+				tgt = tgt[0 : pos+size]
+				dataRd.Read(tgt[pos:])
+			case VCD_RUN:
+				if c, err = dataRd.ReadByte(); err != nil {
+					return vcdErr("RUN byte", err)
+				}
+				for i := uint64(0); i < size; i++ {
+					tgt = append(tgt, c)
+				}
+			case VCD_COPY:
+				if address, err = cache.decode(addrRd, ins.mode, segLen+pos); err != nil {
+					return
+				}
+				if address >= segLen+pos || (address < segLen && address+size > segLen) {
+					return fmt.Errorf("vcdiff: invalid COPY address %d size %d", address, size)
+				}
+				if address < segLen {
+					p.recordCopy(int64(segPos+address), int64(size), p.hist.size+int64(pos))
+					tgt = tgt[0 : pos+size]
+					if err = p.readTarget(tgt[pos:], int64(segPos+address)); err != nil {
+						return
+					}
+				} else {
+					// target window内的copy，可能重叠，逐字节复制
+					for i := address - segLen; size > 0; i++ {
+						tgt = append(tgt, tgt[i])
+						size--
+					}
+				}
+			}
+		}
+	}
+	if uint64(len(tgt)) != tgtLen {
+		return fmt.Errorf("vcdiff: target window length mismatch: %d != %d", len(tgt), tgtLen)
+	}
+	if winInd&VCD_ADLER32 != 0 && adler32.Checksum(tgt) != checksum {
+		return errors.New("vcdiff: adler32 checksum mismatch")
+	}
+	if p.debug {
+		fmt.Printf("vcdiff window: source=[%d,%d] target=%d data=%d inst=%d addr=%d\n",
+			segPos, segLen, tgtLen, dataLen, instLen, addrLen)
+	}
+	_, err = p.merged.Write(tgt)
+	return
+}
+
+// 从basis文件中读取source segment的数据
+func (p *Patcher) readTarget(buf []byte, where int64) (err error) {
+	if _, err = p.target.Seek(where, 0); err != nil {
+		return fmt.Errorf("seek target failed: where=%d error=%s", where, err.Error())
+	}
+	if _, err = io.ReadFull(p.target, buf); err != nil {
+		err = fmt.Errorf("read target failed: where=%d length=%d error=%s", where, len(buf), err.Error())
+	}
+	return
+}
+
+// 读取长度为n的section。n来自delta文件，按实际读到的数据分配内存
+func vcdReadSection(rd io.Reader, n uint64) (p []byte, err error) {
+	if p, err = ioutil.ReadAll(io.LimitReader(rd, int64(n&(1<<63-1)))); err == nil && uint64(len(p)) != n {
+		err = io.ErrUnexpectedEOF
+	}
+	return
+}
+
+func vcdErr(field string, err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return fmt.Errorf("vcdiff: read %s failed: %s", field, err.Error())
+}
@@ -0,0 +1,192 @@
+package rsync
+
+import (
+	"bytes"
+	"hash/adler32"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+)
+
+func TestVcdiffRoundTrip(t *testing.T) {
+	for _, s1 := range ss {
+		for _, s2 := range chs {
+			for _, bl := range []uint32{1, 2, 3, 16} {
+				roundTrip(t, []byte(s1), []byte(s2), bl, &DeltaOptions{Format: FormatVCDIFF})
+				roundTrip(t, []byte(s2), []byte(s1), bl, &DeltaOptions{Format: FormatVCDIFF})
+			}
+		}
+	}
+
+	old := randBytes(5, 50000)
+	cur := append(append([]byte{}, old[10000:30000]...), old[0:12000]...)
+	cur = append(cur, randBytes(6, 3000)...)
+
+	// 多个window
+	size := vcdWindowSize
+	vcdWindowSize = 4000
+	defer func() { vcdWindowSize = size }()
+	roundTrip(t, old, cur, 64, &DeltaOptions{Format: FormatVCDIFF})
+
+	// Diff输出VCDIFF
+	result := new(bytes.Buffer)
+	merged := new(bytes.Buffer)
+	if err := DiffWith(bytes.NewReader(old), bytes.NewReader(cur), result, &DeltaOptions{Format: FormatVCDIFF}); err != nil {
+		t.Fatal("Diff failed:", err)
+	}
+	if err := PatchVCDIFF(result, bytes.NewReader(old), merged); err != nil {
+		t.Fatal("PatchVCDIFF failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), cur) {
+		t.Fatal("patch result not equal")
+	}
+}
+
+func TestVcdiffDecode(t *testing.T) {
+	var (
+		source = []byte("abcdefghij")
+		expect = []byte("abcdZZZZZabcdZZZZZa")
+		merged = new(bytes.Buffer)
+	)
+
+	// COPY 4 (SELF 0), RUN 5 'Z', COPY 10 (SELF 10, target window内重叠的copy)
+	data := []byte{'Z'}
+	inst := []byte{20, 0, 5, 26}
+	addr := []byte{0, 10}
+	body := []byte{byte(len(expect)), 0, byte(len(data)), byte(len(inst)), byte(len(addr))}
+	body = append(body, htonl(adler32.Checksum(expect))...)
+	body = append(append(append(body, data...), inst...), addr...)
+
+	delta := []byte{0xd6, 0xc3, 0xc4, 0x00, 0x00}
+	delta = append(delta, VCD_SOURCE|VCD_ADLER32, byte(len(source)), 0, byte(len(body)))
+	delta = append(delta, body...)
+
+	if err := Patch(bytes.NewReader(delta), bytes.NewReader(source), merged); err != nil {
+		t.Fatal("Patch failed:", err)
+	}
+	if !bytes.Equal(merged.Bytes(), expect) {
+		t.Fatalf("decode result %q, expect %q", merged.Bytes(), expect)
+	}
+
+	// 校验和错误
+	delta[len(delta)-len(addr)-len(inst)-len(data)-1] ^= 0xff
+	if err := Patch(bytes.NewReader(delta), bytes.NewReader(source), new(bytes.Buffer)); err == nil {
+		t.Fatal("Patch should fail when adler32 mismatch")
+	}
+
+	// open-vcdiff扩展格式：interleaved，校验和为变长整数
+	inter := []byte{20, 0, 0, 5, 'Z', 26, 10}
+	body = []byte{byte(len(expect)), 0, 0, byte(len(inter)), 0}
+	body = append(vcdPutInt(body, uint64(adler32.Checksum(expect))), inter...)
+	delta = []byte{0xd6, 0xc3, 0xc4, 'S', 0x00}
+	delta = append(delta, VCD_SOURCE|VCD_ADLER32, byte(len(source)), 0, byte(len(body)))
+	delta = append(delta, body...)
+	merged.Reset()
+	if err := Patch(bytes.NewReader(delta), bytes.NewReader(source), merged); err != nil || !bytes.Equal(merged.Bytes(), expect) {
+		t.Fatalf("decode extended format failed: %v %q", err, merged.Bytes())
+	}
+
+	// section长度相加溢出，或者超过实际的数据
+	for _, lens := range [][3]uint64{
+		{1<<64 - 1, 1<<64 - 1, 2},
+		{1, 1<<64 - 1, 2},
+		{0, 1 << 62, 0},
+	} {
+		delta = []byte{0xd6, 0xc3, 0xc4, 0x00, 0x00, VCD_SOURCE, byte(len(source)), 0}
+		delta = vcdPutInt(delta, 1<<63)
+		delta = append(delta, byte(len(expect)), 0)
+		for _, l := range lens {
+			delta = vcdPutInt(delta, l)
+		}
+		if err := Patch(bytes.NewReader(delta), bytes.NewReader(source), new(bytes.Buffer)); err == nil {
+			t.Fatal("Patch should fail with section lengths", lens)
+		}
+	}
+
+	// 变长整数
+	for _, v := range []uint64{0, 1, 127, 128, 16383, 16384, 123456789, 1<<63 + 5} {
+		buf := vcdPutInt(nil, v)
+		if r, err := vcdReadInt(bytes.NewReader(buf)); err != nil || r != v {
+			t.Fatalf("vcdiff integer %d: got %d error %v", v, r, err)
+		}
+	}
+	if !bytes.Equal(vcdPutInt(nil, 123456789), []byte{0xba, 0xef, 0x9a, 0x15}) {
+		t.Fatal("vcdiff integer encoding wrong")
+	}
+}
+
+// 与xdelta3和open-vcdiff互相解码，没有安装时跳过
+func TestVcdiffInterop(t *testing.T) {
+	var (
+		old = randBytes(21, 300000)
+		cur = append(append(append([]byte{}, old[:100000]...), randBytes(22, 5000)...), old[120000:]...)
+	)
+	tools := map[string][2][]string{
+		// 编码参数, 解码参数：SOURCE TARGET DELTA 依次替换为文件名
+		"xdelta3": {
+			{"-e", "-f", "-S", "none", "-s", "SOURCE", "TARGET", "DELTA"},
+			{"-d", "-f", "-s", "SOURCE", "DELTA", "TARGET"},
+		},
+		"vcdiff": {
+			{"encode", "-dictionary", "SOURCE", "-target", "TARGET", "-delta", "DELTA", "-checksum", "-interleaved"},
+			{"decode", "-dictionary", "SOURCE", "-delta", "DELTA", "-target", "TARGET"},
+		},
+	}
+	dir, err := ioutil.TempDir("", "vcdiff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	src := filepath.Join(dir, "source")
+	ioutil.WriteFile(src, old, 0644)
+
+	run := func(tool string, args []string, target, delta string) {
+		var a []string
+		for _, arg := range args {
+			switch arg {
+			case "SOURCE":
+				arg = src
+			case "TARGET":
+				arg = target
+			case "DELTA":
+				arg = delta
+			}
+			a = append(a, arg)
+		}
+		if out, err := exec.Command(tool, a...).CombinedOutput(); err != nil {
+			t.Fatal(tool, "failed:", err, string(out))
+		}
+	}
+
+	for tool, args := range tools {
+		if _, err = exec.LookPath(tool); err != nil {
+			t.Log(tool, "not found, skipped")
+			continue
+		}
+		// 工具编码，Patch解码
+		target := filepath.Join(dir, tool+".target")
+		delta := filepath.Join(dir, tool+".delta")
+		ioutil.WriteFile(target, cur, 0644)
+		run(tool, args[0], target, delta)
+		data, _ := ioutil.ReadFile(delta)
+		merged := new(bytes.Buffer)
+		if err = Patch(bytes.NewReader(data), bytes.NewReader(old), merged); err != nil || !bytes.Equal(merged.Bytes(), cur) {
+			t.Fatal("patch delta of", tool, "failed:", err)
+		}
+
+		// GenDeltaWith编码，工具解码
+		sig, result := new(bytes.Buffer), new(bytes.Buffer)
+		GenSign(bytes.NewReader(old), int64(len(old)), 1024, sig)
+		if err = GenDeltaWith(sig, bytes.NewReader(cur), int64(len(cur)), result, &DeltaOptions{Format: FormatVCDIFF}); err != nil {
+			t.Fatal(err)
+		}
+		ioutil.WriteFile(delta, result.Bytes(), 0644)
+		os.Remove(target)
+		run(tool, args[1], target, delta)
+		if data, _ = ioutil.ReadFile(target); !bytes.Equal(data, cur) {
+			t.Fatal(tool, "decode result wrong")
+		}
+	}
+}
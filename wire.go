@@ -0,0 +1,1309 @@
+package rsync
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// 兼容rsync的传输协议
+//
+// rsync 3.x使用的协议版本30和31的客户端，可以从没有修改的rsync --daemon或者rsync --server拉取或者
+// 推送目录树(见wiresync.go)。只支持rsync -rltp的功能：递归、符号链接、修改时间和权限，不支持所有者、
+// 设备文件、硬链接、压缩、增量递归(incremental recursion)和过滤规则。
+//
+// 连接daemon时先交换文本行：
+//   daemon  @RSYNCD: 31.0
+//   客户端  @RSYNCD: 31.0
+//   客户端  MODULE
+//   daemon  MOTD...，@RSYNCD: AUTHREQD CHALLENGE时客户端回复 USER base64(md5(PASSWORD CHALLENGE))
+//   daemon  @RSYNCD: OK 或 @ERROR: MESSAGE
+//   客户端  参数，每个以\0结束，最后是一个空参数
+// 通过remote shell运行rsync --server时参数在命令行中(见WireServerArgs)，双方先交换4字节的协议版本。
+//
+// 之后是二进制协议，整数为小端序：
+//   服务端  compat flags(varint)，checksum seed(4字节)
+//   之后双向的数据都是多路复用的：4字节头 (7+tag)<<24 | 长度，tag 0是数据，其他是错误、日志等消息
+//   客户端  过滤规则，只发送结束标志 int32 0，推送时只在--delete时发送
+//   发送方  文件列表：flags 名字 长度 修改时间 权限 [符号链接]，以0结束，双方按相同的规则排序，之后
+//           用排序后的序号(ndx)指代文件
+//   接收方  需要更新的文件：ndx iflags sum head(count blength s2length remainder)，每个block的
+//           rolling checksum(4字节)和md5(s2length字节，包括checksum seed)
+//   发送方  ndx iflags sum head，token：正数n后面是n字节literal，负数-(i+1)复制第i个block，0结束，
+//           最后是整个文件的md5
+// 每个阶段结束时接收方发送NDX_DONE，发送方回复，共三个阶段；拉取时发送方最后发送统计数据，双方再
+// 交换一次NDX_DONE作为结束。
+
+const (
+	WireProtocolVersion = 31
+
+	wireMinVersion   = 30
+	wireMplexBase    = 7
+	wireMaxFrame     = 0xffffff
+	wireChunkLen     = 32 << 10 // literal token的最大长度
+	wireBlockLen     = 700
+	wireMaxBlockLen  = 128 << 10
+	wireSumLen       = 16
+	wireMaxLine      = 4096
+	wireCapabilities = ".LsfxC" // 客户端支持的compat flags，不包括增量递归i和varint flags v
+)
+
+// 多路复用的消息
+const (
+	msgData        = 0
+	msgErrorXfer   = 1
+	msgInfo        = 2
+	msgError       = 3
+	msgWarning     = 4
+	msgErrorSocket = 5
+	msgLog         = 6
+	msgClient      = 7
+	msgErrorUTF8   = 8
+	msgRedo        = 9
+	msgStats       = 10
+	msgIOError     = 22
+	msgIOTimeout   = 33
+	msgNoop        = 42
+	msgErrorExit   = 86
+	msgSuccess     = 100
+	msgDeleted     = 101
+	msgNoSend      = 102
+)
+
+// 文件列表的flags
+const (
+	xmitTopDir         = 1 << 0
+	xmitSameMode       = 1 << 1
+	xmitExtendedFlags  = 1 << 2
+	xmitSameName       = 1 << 5
+	xmitLongName       = 1 << 6
+	xmitSameTime       = 1 << 7
+	xmitHlinked        = 1 << 9
+	xmitIOErrorEndList = 1 << 12
+	xmitModNsec        = 1 << 13
+)
+
+// iflags
+const (
+	itemBasisTypeFollows = 1 << 11
+	itemXnameFollows     = 1 << 12
+	itemTransfer         = 1 << 15
+)
+
+const (
+	ndxDone     = -1
+	ndxDelStats = -3
+
+	cfIncRecurse       = 1 << 0
+	cfChksumSeedFix    = 1 << 5
+	cfVarintFlistFlags = 1 << 7
+
+	sIFMT  = 0170000
+	sIFDIR = 0040000
+	sIFREG = 0100000
+	sIFLNK = 0120000
+)
+
+var (
+	// errors of rsync wire protocol wrap ErrWireProtocol
+	ErrWireProtocol = errors.New("rsync wire protocol error")
+
+	// read_varint中第一个字节(除以4)之后的字节数
+	wireByteExtra = [64]int{
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0, 0,
+		1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1, 1,
+		2, 2, 2, 2, 2, 2, 2, 2, 3, 3, 3, 3, 4, 4, 5, 6,
+	}
+)
+
+// options of WirePull and WirePush
+type WireOptions struct {
+	Module   string    // module of rsync daemon, empty when talking to rsync --server
+	User     string    // daemon user, default nobody
+	Password string    // daemon password
+	Delete   bool      // delete extraneous files in destination
+	Log      io.Writer // MOTD and messages of remote, nil to discard
+}
+
+// statistics of WirePull and WirePush
+type WireStats struct {
+	Files   int   // regular files in file list
+	Updated int   // files transferred
+	Deleted int   // files deleted by WirePull
+	Literal int64 // literal data transferred
+	Matched int64 // data copied from basis files
+}
+
+// arguments of rsync --server for pull (sender is true) or push. With daemon the
+// path is MODULE/PATH. For remote shell run: ssh HOST rsync ARGS...
+func WireServerArgs(sender bool, remotePath string, opts *WireOptions) (args []string) {
+	if opts == nil {
+		opts = &WireOptions{}
+	}
+	args = append(args, "--server")
+	if sender {
+		args = append(args, "--sender")
+	}
+	args = append(args, "-ltpre"+wireCapabilities)
+	if opts.Delete && !sender {
+		args = append(args, "--delete")
+	}
+	p := remotePath
+	if opts.Module != "" {
+		p = opts.Module
+		if remotePath != "" {
+			p += "/" + strings.TrimPrefix(remotePath, "/")
+		}
+	}
+	return append(args, ".", p)
+}
+
+// 读取rsync协议的数据。出错后的读取返回0，第一个错误保存在err中，调用者在适当的位置检查
+type wireReader struct {
+	rd      *bufio.Reader
+	mux     bool
+	left    int // 当前数据帧剩余的长度
+	err     error
+	buf     [9]byte
+	ndxPos  int32
+	ndxNeg  int32
+	log     io.Writer
+	lastErr string // 最后一个错误消息
+	ioError int32
+	read    int64
+}
+
+func newWireReader(rd io.Reader) *wireReader {
+	return &wireReader{rd: bufio.NewReaderSize(rd, 64<<10), ndxPos: -1, ndxNeg: 1}
+}
+
+func (r *wireReader) fail(err error) {
+	if r.err == nil {
+		r.err = err
+	}
+}
+
+// 多路复用时读取数据帧，处理其他消息
+func (r *wireReader) Read(p []byte) (n int, err error) {
+	if !r.mux {
+		n, err = r.rd.Read(p)
+		r.read += int64(n)
+		return
+	}
+	for r.left == 0 {
+		var hdr [4]byte
+		if _, err = io.ReadFull(r.rd, hdr[:]); err != nil {
+			return
+		}
+		v := binary.LittleEndian.Uint32(hdr[:])
+		tag, size := int(v>>24)-wireMplexBase, int(v&wireMaxFrame)
+		r.read += 4
+		if tag == msgData {
+			r.left = size
+			continue
+		}
+		if tag < 0 {
+			return 0, fmt.Errorf("%w: invalid multiplexed header 0x%x", ErrWireProtocol, v)
+		}
+		data := make([]byte, size)
+		if _, err = io.ReadFull(r.rd, data); err != nil {
+			return
+		}
+		r.read += int64(size)
+		if err = r.message(tag, data); err != nil {
+			return
+		}
+	}
+	if len(p) > r.left {
+		p = p[:r.left]
+	}
+	n, err = r.rd.Read(p)
+	r.left -= n
+	r.read += int64(n)
+	return
+}
+
+func (r *wireReader) message(tag int, data []byte) error {
+	switch tag {
+	case msgErrorXfer, msgError, msgErrorSocket, msgErrorUTF8:
+		r.lastErr = strings.TrimSpace(string(data))
+		fallthrough
+	case msgInfo, msgWarning, msgLog, msgClient:
+		if r.log != nil {
+			r.log.Write(data)
+		}
+	case msgErrorExit:
+		code := 0
+		if len(data) == 4 {
+			code = int(binary.LittleEndian.Uint32(data))
+		}
+		if code == 0 {
+			return nil
+		}
+		msg := fmt.Sprintf("remote rsync exited with code %d", code)
+		if r.lastErr != "" {
+			msg += ": " + r.lastErr
+		}
+		return &RemoteError{Msg: msg}
+	case msgIOError:
+		if len(data) == 4 {
+			r.ioError |= int32(binary.LittleEndian.Uint32(data))
+		}
+	case msgDeleted:
+		if r.log != nil {
+			fmt.Fprintf(r.log, "deleting %s\n", strings.TrimRight(string(data), "\x00"))
+		}
+	case msgNoSend:
+		if r.log != nil && len(data) == 4 {
+			fmt.Fprintf(r.log, "remote can not send file %d\n", binary.LittleEndian.Uint32(data))
+		}
+	case msgRedo, msgStats, msgIOTimeout, msgNoop, msgSuccess:
+	default:
+		return fmt.Errorf("%w: unknown message %d", ErrWireProtocol, tag)
+	}
+	return nil
+}
+
+func (r *wireReader) full(p []byte) {
+	if r.err != nil {
+		for i := range p {
+			p[i] = 0
+		}
+		return
+	}
+	if _, err := io.ReadFull(r, p); err != nil {
+		if err == io.EOF {
+			err = io.ErrUnexpectedEOF
+		}
+		r.fail(err)
+	}
+}
+
+func (r *wireReader) byte() byte {
+	r.full(r.buf[:1])
+	return r.buf[0]
+}
+
+func (r *wireReader) short() int32 {
+	r.full(r.buf[:2])
+	return int32(binary.LittleEndian.Uint16(r.buf[:2]))
+}
+
+func (r *wireReader) int32() int32 {
+	r.full(r.buf[:4])
+	return int32(binary.LittleEndian.Uint32(r.buf[:4]))
+}
+
+func (r *wireReader) varint() int32 {
+	var u [5]byte
+
+	ch := r.byte()
+	extra := wireByteExtra[ch/4]
+	if extra == 0 {
+		return int32(ch)
+	}
+	if extra >= len(u) {
+		r.fail(fmt.Errorf("%w: varint overflow", ErrWireProtocol))
+		return 0
+	}
+	r.full(u[:extra])
+	u[extra] = ch & (1<<uint(8-extra) - 1)
+	return int32(binary.LittleEndian.Uint32(u[:4]))
+}
+
+func (r *wireReader) varlong(minBytes int) int64 {
+	var u [9]byte
+
+	b := r.buf[:minBytes]
+	r.full(b)
+	copy(u[:], b[1:])
+	extra := wireByteExtra[b[0]/4]
+	if extra == 0 {
+		u[minBytes-1] = b[0]
+	} else {
+		if minBytes+extra > len(u) {
+			r.fail(fmt.Errorf("%w: varlong overflow", ErrWireProtocol))
+			return 0
+		}
+		first := b[0]
+		r.full(u[minBytes-1 : minBytes-1+extra])
+		u[minBytes+extra-1] = first & (1<<uint(8-extra) - 1)
+	}
+	return int64(binary.LittleEndian.Uint64(u[:8]))
+}
+
+// 长度不超过max的数据
+func (r *wireReader) bytes(n, max int) []byte {
+	if n < 0 || n > max {
+		r.fail(fmt.Errorf("%w: invalid length %d", ErrWireProtocol, n))
+		return nil
+	}
+	p := make([]byte, n)
+	r.full(p)
+	return p
+}
+
+// 文件序号，与上一个序号的差值编码
+func (r *wireReader) ndx() int32 {
+	var b [4]byte
+
+	prev := &r.ndxPos
+	ch := r.byte()
+	if ch == 0xff {
+		ch = r.byte()
+		prev = &r.ndxNeg
+	} else if ch == 0 {
+		return ndxDone
+	}
+	var num int32
+	if ch == 0xfe {
+		r.full(b[:2])
+		if b[0]&0x80 != 0 {
+			b[3] = b[0] &^ 0x80
+			b[0] = b[1]
+			r.full(b[1:3])
+			num = int32(binary.LittleEndian.Uint32(b[:]))
+		} else {
+			num = int32(b[0])<<8 + int32(b[1]) + *prev
+		}
+	} else {
+		num = int32(ch) + *prev
+	}
+	*prev = num
+	if prev == &r.ndxNeg {
+		num = -num
+	}
+	return num
+}
+
+// 文本行，不包括换行符
+func (r *wireReader) line() string {
+	var line []byte
+	for r.err == nil {
+		ch := r.byte()
+		if ch == '\n' {
+			break
+		}
+		if len(line) >= wireMaxLine {
+			r.fail(fmt.Errorf("%w: line too long", ErrWireProtocol))
+		}
+		line = append(line, ch)
+	}
+	return strings.TrimSuffix(string(line), "\r")
+}
+
+// 写入rsync协议的数据，出错后的写入被忽略，第一个错误保存在err中
+type wireWriter struct {
+	w       *bufio.Writer
+	raw     io.Writer
+	err     error
+	buf     [9]byte
+	ndxPos  int32
+	ndxNeg  int32
+	written int64
+}
+
+func newWireWriter(w io.Writer) *wireWriter {
+	ww := &wireWriter{raw: w, ndxPos: -1, ndxNeg: 1}
+	ww.w = bufio.NewWriterSize(&wireCounter{w, &ww.written}, wireChunkLen)
+	return ww
+}
+
+type wireCounter struct {
+	w io.Writer
+	n *int64
+}
+
+func (c *wireCounter) Write(p []byte) (n int, err error) {
+	n, err = c.w.Write(p)
+	*c.n += int64(n)
+	return
+}
+
+// 之后的数据作为多路复用的数据帧发送
+func (w *wireWriter) multiplex() {
+	w.flush()
+	w.w = bufio.NewWriterSize(&wireMuxWriter{&wireCounter{w.raw, &w.written}}, wireChunkLen)
+}
+
+type wireMuxWriter struct {
+	w io.Writer
+}
+
+func (m *wireMuxWriter) Write(p []byte) (n int, err error) {
+	for len(p) > 0 {
+		l := len(p)
+		if l > wireMaxFrame {
+			l = wireMaxFrame
+		}
+		var hdr [4]byte
+		binary.LittleEndian.PutUint32(hdr[:], uint32(wireMplexBase+msgData)<<24|uint32(l))
+		if _, err = m.w.Write(append(hdr[:], p[:l]...)); err != nil {
+			return
+		}
+		n += l
+		p = p[l:]
+	}
+	return
+}
+
+// 发送tag的消息，之前的数据先发送
+func (w *wireWriter) msg(tag int, data []byte) {
+	var hdr [4]byte
+
+	if w.flush() != nil {
+		return
+	}
+	binary.LittleEndian.PutUint32(hdr[:], uint32(wireMplexBase+tag)<<24|uint32(len(data)))
+	_, w.err = (&wireCounter{w.raw, &w.written}).Write(append(hdr[:], data...))
+}
+
+func (w *wireWriter) write(p []byte) {
+	if w.err == nil {
+		_, w.err = w.w.Write(p)
+	}
+}
+
+func (w *wireWriter) flush() error {
+	if w.err == nil {
+		w.err = w.w.Flush()
+	}
+	return w.err
+}
+
+func (w *wireWriter) byte(b byte) {
+	w.buf[0] = b
+	w.write(w.buf[:1])
+}
+
+func (w *wireWriter) short(v int32) {
+	binary.LittleEndian.PutUint16(w.buf[:2], uint16(v))
+	w.write(w.buf[:2])
+}
+
+func (w *wireWriter) int32(v int32) {
+	binary.LittleEndian.PutUint32(w.buf[:4], uint32(v))
+	w.write(w.buf[:4])
+}
+
+func (w *wireWriter) varint(x int32) {
+	var b [5]byte
+
+	binary.LittleEndian.PutUint32(b[1:], uint32(x))
+	cnt := 4
+	for cnt > 1 && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << uint(7-cnt+1)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > 1 {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	w.write(b[:cnt])
+}
+
+func (w *wireWriter) varlong(x int64, minBytes int) {
+	var b [9]byte
+
+	binary.LittleEndian.PutUint64(b[1:], uint64(x))
+	cnt := 8
+	for cnt > minBytes && b[cnt] == 0 {
+		cnt--
+	}
+	bit := byte(1) << uint(7-cnt+minBytes)
+	if b[cnt] >= bit {
+		cnt++
+		b[0] = ^(bit - 1)
+	} else if cnt > minBytes {
+		b[0] = b[cnt] | ^(bit*2 - 1)
+	} else {
+		b[0] = b[cnt]
+	}
+	w.write(b[:cnt])
+}
+
+func (w *wireWriter) ndx(ndx int32) {
+	var (
+		b    []byte
+		diff int32
+	)
+
+	if ndx >= 0 {
+		diff = ndx - w.ndxPos
+		w.ndxPos = ndx
+	} else if ndx == ndxDone {
+		w.byte(0)
+		return
+	} else {
+		b = append(b, 0xff)
+		ndx = -ndx
+		diff = ndx - w.ndxNeg
+		w.ndxNeg = ndx
+	}
+	if diff > 0 && diff < 0xfe {
+		b = append(b, byte(diff))
+	} else if diff < 0 || diff > 0x7fff {
+		b = append(b, 0xfe, byte(ndx>>24)|0x80, byte(ndx), byte(ndx>>8), byte(ndx>>16))
+	} else {
+		b = append(b, 0xfe, byte(diff>>8), byte(diff))
+	}
+	w.write(b)
+}
+
+// 协议的连接
+type wireConn struct {
+	r       *wireReader
+	w       *wireWriter
+	version int
+	compat  int32
+	seed    uint32
+}
+
+// daemon的握手，或者与rsync --server交换协议版本，然后读取compat flags和checksum seed
+func newWireConn(rw io.ReadWriter, args []string, opts *WireOptions) (c *wireConn, err error) {
+	c = &wireConn{r: newWireReader(rw), w: newWireWriter(rw)}
+	c.r.log = opts.Log
+	if opts.Module != "" {
+		err = c.daemonHandshake(args, opts)
+	} else {
+		c.w.int32(WireProtocolVersion)
+		if err = c.w.flush(); err == nil {
+			err = c.setVersion(int(c.r.int32()))
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if opts.Module != "" {
+		// 参数错误时daemon返回@ERROR
+		if p, e := c.r.rd.Peek(1); e == nil && p[0] == '@' {
+			line := c.r.line()
+			return nil, &RemoteError{Msg: strings.TrimPrefix(line, "@ERROR: ")}
+		}
+	}
+	c.compat = c.r.varint()
+	c.seed = uint32(c.r.int32())
+	if c.r.err != nil {
+		return nil, c.r.err
+	}
+	if c.compat&(cfIncRecurse|cfVarintFlistFlags) != 0 {
+		return nil, fmt.Errorf("%w: unsupported compat flags 0x%x", ErrWireProtocol, c.compat)
+	}
+	// 协议30以上双向都是多路复用的
+	c.r.mux = true
+	c.w.multiplex()
+	return
+}
+
+func (c *wireConn) setVersion(remote int) error {
+	if c.r.err != nil {
+		return c.r.err
+	}
+	c.version = WireProtocolVersion
+	if remote < c.version {
+		c.version = remote
+	}
+	if c.version < wireMinVersion {
+		return fmt.Errorf("%w: remote protocol version %d not supported", ErrWireProtocol, remote)
+	}
+	return nil
+}
+
+func (c *wireConn) daemonHandshake(args []string, opts *WireOptions) (err error) {
+	line := c.r.line()
+	if c.r.err != nil {
+		return c.r.err
+	}
+	if !strings.HasPrefix(line, "@RSYNCD: ") {
+		return fmt.Errorf("%w: invalid daemon greeting %q", ErrWireProtocol, line)
+	}
+	ver := strings.Fields(line[len("@RSYNCD: "):])
+	if len(ver) == 0 {
+		return fmt.Errorf("%w: invalid daemon greeting %q", ErrWireProtocol, line)
+	}
+	remote, e := strconv.Atoi(strings.SplitN(ver[0], ".", 2)[0])
+	if e != nil {
+		return fmt.Errorf("%w: invalid daemon greeting %q", ErrWireProtocol, line)
+	}
+	if err = c.setVersion(remote); err != nil {
+		return
+	}
+	fmt.Fprintf(c.w.w, "@RSYNCD: %d.0\n%s\n", c.version, opts.Module)
+	if err = c.w.flush(); err != nil {
+		return
+	}
+
+	for {
+		line = c.r.line()
+		if c.r.err != nil {
+			return c.r.err
+		}
+		switch {
+		case strings.HasPrefix(line, "@RSYNCD: AUTHREQD "):
+			user := opts.User
+			if user == "" {
+				user = "nobody"
+			}
+			sum := md5.Sum([]byte(opts.Password + line[len("@RSYNCD: AUTHREQD "):]))
+			fmt.Fprintf(c.w.w, "%s %s\n", user, base64.RawStdEncoding.EncodeToString(sum[:]))
+			if err = c.w.flush(); err != nil {
+				return
+			}
+			continue
+		case line == "@RSYNCD: OK":
+		case line == "@RSYNCD: EXIT":
+			return &RemoteError{Msg: "daemon closed connection"}
+		case strings.HasPrefix(line, "@ERROR"):
+			return &RemoteError{Msg: strings.TrimLeft(line[len("@ERROR"):], ": ")}
+		default:
+			// MOTD
+			if opts.Log != nil {
+				fmt.Fprintln(opts.Log, line)
+			}
+			continue
+		}
+		break
+	}
+
+	for _, arg := range args {
+		c.w.write(append([]byte(arg), 0))
+	}
+	c.w.byte(0)
+	return c.w.flush()
+}
+
+// 文件列表中的文件
+type wireFile struct {
+	name  string // 相对路径，根目录为.
+	mode  uint32 // unix mode
+	size  int64
+	mtime int64
+	nsec  int32
+	link  string
+	top   bool
+	path  string // 推送时本地的路径
+}
+
+func (f *wireFile) isDir() bool {
+	return f.mode&sIFMT == sIFDIR
+}
+
+func (f *wireFile) isReg() bool {
+	return f.mode&sIFMT == sIFREG
+}
+
+func (f *wireFile) isLink() bool {
+	return f.mode&sIFMT == sIFLNK
+}
+
+func wireMode(m os.FileMode) (mode uint32) {
+	mode = uint32(m.Perm())
+	if m&os.ModeSetuid != 0 {
+		mode |= 04000
+	}
+	if m&os.ModeSetgid != 0 {
+		mode |= 02000
+	}
+	if m&os.ModeSticky != 0 {
+		mode |= 01000
+	}
+	switch {
+	case m.IsDir():
+		mode |= sIFDIR
+	case m&os.ModeSymlink != 0:
+		mode |= sIFLNK
+	default:
+		mode |= sIFREG
+	}
+	return
+}
+
+func (f *wireFile) fileMode() (m os.FileMode) {
+	m = os.FileMode(f.mode & 0777)
+	if f.mode&04000 != 0 {
+		m |= os.ModeSetuid
+	}
+	if f.mode&02000 != 0 {
+		m |= os.ModeSetgid
+	}
+	if f.mode&01000 != 0 {
+		m |= os.ModeSticky
+	}
+	switch {
+	case f.isDir():
+		m |= os.ModeDir
+	case f.isLink():
+		m |= os.ModeSymlink
+	}
+	return
+}
+
+// 文件列表排序的一级：目录中的路径(后面还有子路径的目录名)或者文件名
+type wireNamePart struct {
+	path bool
+	name string
+}
+
+func (f *wireFile) nameParts() (parts []wireNamePart) {
+	if f.name == "." {
+		return []wireNamePart{{false, ""}}
+	}
+	names := strings.Split(f.name, "/")
+	for i, name := range names {
+		parts = append(parts, wireNamePart{i < len(names)-1 || f.isDir(), name})
+	}
+	if f.isDir() {
+		parts = append(parts, wireNamePart{false, ""})
+	}
+	return
+}
+
+// rsync的文件列表排序(f_name_cmp)：根目录.在最前，同一目录中的文件在子目录之前，目录名按后面
+// 加上/比较
+func wireCompare(a, b *wireFile) int {
+	pa, pb := a.nameParts(), b.nameParts()
+	for i := 0; i < len(pa) && i < len(pb); i++ {
+		x, y := pa[i], pb[i]
+		if x.path != y.path {
+			if x.path {
+				return 1
+			}
+			return -1
+		}
+		if x.path {
+			x.name += "/"
+			y.name += "/"
+		}
+		if c := strings.Compare(x.name, y.name); c != 0 {
+			return c
+		}
+	}
+	return len(pa) - len(pb)
+}
+
+func sortWireFiles(files []*wireFile) {
+	sort.SliceStable(files, func(i, j int) bool {
+		return wireCompare(files[i], files[j]) < 0
+	})
+}
+
+// 发送文件列表
+func (c *wireConn) sendFileList(files []*wireFile) error {
+	var (
+		w        = c.w
+		lastName string
+		lastMode uint32
+		lastTime int64
+	)
+
+	for i, f := range files {
+		var flags int32
+		if f.top {
+			flags |= xmitTopDir
+		}
+		if i > 0 && f.mode == lastMode {
+			flags |= xmitSameMode
+		}
+		if i > 0 && f.mtime == lastTime {
+			flags |= xmitSameTime
+		}
+		if c.version >= 31 && f.nsec != 0 {
+			flags |= xmitModNsec
+		}
+		l1 := 0
+		for l1 < len(lastName) && l1 < len(f.name) && l1 < 255 && lastName[l1] == f.name[l1] {
+			l1++
+		}
+		l2 := len(f.name) - l1
+		if l1 > 0 {
+			flags |= xmitSameName
+		}
+		if l2 > 255 {
+			flags |= xmitLongName
+		}
+		// flags不能为0，否则是文件列表的结束
+		if flags == 0 && !f.isDir() {
+			flags |= xmitTopDir
+		}
+		if flags&0xff00 != 0 || flags == 0 {
+			flags |= xmitExtendedFlags
+			w.short(flags)
+		} else {
+			w.byte(byte(flags))
+		}
+		if flags&xmitSameName != 0 {
+			w.byte(byte(l1))
+		}
+		if flags&xmitLongName != 0 {
+			w.varint(int32(l2))
+		} else {
+			w.byte(byte(l2))
+		}
+		w.write([]byte(f.name[l1:]))
+		w.varlong(f.size, 3)
+		if flags&xmitSameTime == 0 {
+			w.varlong(f.mtime, 4)
+		}
+		if flags&xmitModNsec != 0 {
+			w.varint(f.nsec)
+		}
+		if flags&xmitSameMode == 0 {
+			w.int32(int32(f.mode))
+		}
+		if f.isLink() {
+			w.varint(int32(len(f.link)))
+			w.write([]byte(f.link))
+		}
+		lastName, lastMode, lastTime = f.name, f.mode, f.mtime
+	}
+	w.byte(0)
+	return w.err
+}
+
+// 读取文件列表并排序
+func (c *wireConn) recvFileList() (files []*wireFile, err error) {
+	var (
+		r        = c.r
+		lastName string
+		lastMode uint32
+		lastTime int64
+	)
+
+	for {
+		flags := int32(r.byte())
+		if flags == 0 {
+			break
+		}
+		if flags&xmitExtendedFlags != 0 {
+			flags |= int32(r.byte()) << 8
+		}
+		if flags == xmitExtendedFlags|xmitIOErrorEndList {
+			r.ioError |= r.varint()
+			break
+		}
+		if flags&xmitHlinked != 0 {
+			return nil, fmt.Errorf("%w: hard links not supported", ErrWireProtocol)
+		}
+
+		l1 := 0
+		if flags&xmitSameName != 0 {
+			l1 = int(r.byte())
+		}
+		var l2 int
+		if flags&xmitLongName != 0 {
+			l2 = int(r.varint())
+		} else {
+			l2 = int(r.byte())
+		}
+		if l1 > len(lastName) {
+			return nil, fmt.Errorf("%w: invalid file name prefix %d", ErrWireProtocol, l1)
+		}
+		f := &wireFile{name: lastName[:l1] + string(r.bytes(l2, maxTreePathLen)), top: flags&xmitTopDir != 0}
+		f.size = r.varlong(3)
+		f.mtime = lastTime
+		if flags&xmitSameTime == 0 {
+			f.mtime = r.varlong(4)
+		}
+		if flags&xmitModNsec != 0 {
+			f.nsec = r.varint()
+		}
+		f.mode = lastMode
+		if flags&xmitSameMode == 0 {
+			f.mode = uint32(r.int32())
+		}
+		if f.isLink() {
+			f.link = string(r.bytes(int(r.varint()), maxTreePathLen))
+		}
+		if r.err != nil {
+			return nil, r.err
+		}
+		lastName, lastMode, lastTime = f.name, f.mode, f.mtime
+
+		if f.name != "." {
+			if f.name, err = cleanTreePath(f.name); err != nil {
+				return nil, fmt.Errorf("%w: %v", ErrWireProtocol, err)
+			}
+		}
+		files = append(files, f)
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	sortWireFiles(files)
+	return
+}
+
+// ndx和iflags，basis type和xname只用于回复
+type wireItem struct {
+	ndx       int32
+	iflags    int32
+	basisType byte
+	xname     []byte
+}
+
+// 读取下一个文件，跳过删除统计
+func (c *wireConn) readItem() (it wireItem) {
+	r := c.r
+	for r.err == nil {
+		if it.ndx = r.ndx(); it.ndx != ndxDelStats {
+			break
+		}
+		for i := 0; i < 5; i++ {
+			r.varint()
+		}
+	}
+	if it.ndx < 0 {
+		if it.ndx != ndxDone {
+			r.fail(fmt.Errorf("%w: invalid file index %d", ErrWireProtocol, it.ndx))
+		}
+		return
+	}
+	it.iflags = r.short()
+	if it.iflags&itemBasisTypeFollows != 0 {
+		it.basisType = r.byte()
+	}
+	if it.iflags&itemXnameFollows != 0 {
+		n := int(r.byte())
+		if n&0x80 != 0 {
+			n = (n&^0x80)<<8 + int(r.byte())
+		}
+		it.xname = r.bytes(n, maxTreePathLen)
+	}
+	return
+}
+
+func (c *wireConn) writeItem(it wireItem) {
+	w := c.w
+	w.ndx(it.ndx)
+	w.short(it.iflags)
+	if it.iflags&itemBasisTypeFollows != 0 {
+		w.byte(it.basisType)
+	}
+	if it.iflags&itemXnameFollows != 0 {
+		if len(it.xname) > 0x7f {
+			w.byte(byte(len(it.xname)>>8) | 0x80)
+		}
+		w.byte(byte(len(it.xname)))
+		w.write(it.xname)
+	}
+}
+
+// sum head和每个block的checksum
+type wireSums struct {
+	count     int32
+	blength   int32
+	s2length  int32
+	remainder int32
+	weak      map[uint32][]int32
+	strong    [][]byte
+}
+
+// block的长度
+func (s *wireSums) blockLen(i int32) int64 {
+	if i == s.count-1 && s.remainder != 0 {
+		return int64(s.remainder)
+	}
+	return int64(s.blength)
+}
+
+// rsync的rolling checksum，字节是有符号的
+func wireSum1(p []byte) uint32 {
+	var s1, s2 uint32
+	for i, b := range p {
+		v := uint32(int8(b))
+		s1 += v
+		s2 += uint32(len(p)-i) * v
+	}
+	return s1&0xffff | s2<<16
+}
+
+// block的md5，包括checksum seed
+func (c *wireConn) sum2(p []byte) []byte {
+	var seed [4]byte
+
+	h := md5.New()
+	binary.LittleEndian.PutUint32(seed[:], c.seed)
+	if c.seed != 0 && c.compat&cfChksumSeedFix != 0 {
+		h.Write(seed[:])
+	}
+	h.Write(p)
+	if c.seed != 0 && c.compat&cfChksumSeedFix == 0 {
+		h.Write(seed[:])
+	}
+	return h.Sum(nil)
+}
+
+// block长度约为文件长度的平方根，8的倍数
+func wireBlockLength(size int64) int32 {
+	if size <= wireBlockLen*wireBlockLen {
+		return wireBlockLen
+	}
+	c, cnt := int32(1), 0
+	for l := size; l>>2 != 0; l >>= 2 {
+		c <<= 1
+		cnt++
+	}
+	if c < 0 || c >= wireMaxBlockLen {
+		return wireMaxBlockLen
+	}
+	blength := int32(0)
+	for c >= 8 {
+		blength |= c
+		if size < int64(blength)*int64(blength) {
+			blength &^= c
+		}
+		c >>= 1
+	}
+	if blength < wireBlockLen {
+		blength = wireBlockLen
+	}
+	return blength
+}
+
+// 接收方发送basis的sum head和checksum，basis为nil时发送全0的sum head，请求整个文件
+func (c *wireConn) writeSums(basis io.Reader, size int64) error {
+	w := c.w
+	if basis == nil || size == 0 {
+		for i := 0; i < 4; i++ {
+			w.int32(0)
+		}
+		return w.err
+	}
+	blength := wireBlockLength(size)
+	remainder := int32(size % int64(blength))
+	count := int32(size / int64(blength))
+	if remainder != 0 {
+		count++
+	}
+	w.int32(count)
+	w.int32(blength)
+	w.int32(wireSumLen)
+	w.int32(remainder)
+
+	buf := make([]byte, blength)
+	for i := int32(0); i < count && w.err == nil; i++ {
+		n := int64(blength)
+		if i == count-1 && remainder != 0 {
+			n = int64(remainder)
+		}
+		if _, err := io.ReadFull(basis, buf[:n]); err != nil {
+			return err
+		}
+		w.int32(int32(wireSum1(buf[:n])))
+		w.write(c.sum2(buf[:n]))
+	}
+	return w.err
+}
+
+// 发送方读取sum head和checksum
+func (c *wireConn) readSums() (s *wireSums, err error) {
+	r := c.r
+	s = &wireSums{count: r.int32(), blength: r.int32(), s2length: r.int32(), remainder: r.int32()}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if s.count < 0 || s.blength < 0 || s.blength > wireMaxBlockLen || s.s2length < 0 || s.s2length > wireSumLen ||
+		s.remainder < 0 || s.remainder > s.blength || (s.count > 0 && s.blength == 0) {
+		return nil, fmt.Errorf("%w: invalid sum head %d %d %d %d", ErrWireProtocol, s.count, s.blength, s.s2length, s.remainder)
+	}
+	s.weak = make(map[uint32][]int32)
+	for i := int32(0); i < s.count && r.err == nil; i++ {
+		weak := uint32(r.int32())
+		s.weak[weak] = append(s.weak[weak], i)
+		s.strong = append(s.strong, r.bytes(int(s.s2length), wireSumLen))
+	}
+	return s, r.err
+}
+
+func (c *wireConn) writeSumHead(s *wireSums) {
+	c.w.int32(s.count)
+	c.w.int32(s.blength)
+	c.w.int32(s.s2length)
+	c.w.int32(s.remainder)
+}
+
+// 发送方对rd与接收方的checksum比较，发送sum head、token和整个文件的md5
+func (c *wireConn) sendData(s *wireSums, rd io.Reader, st *WireStats) error {
+	var (
+		w     = c.w
+		h     = md5.New()
+		buf   []byte // buf[0]在文件中位置之后的数据，buf[:k]为没有发送的literal
+		k     int
+		eof   bool
+		sum   uint32
+		s1    uint32
+		s2    uint32
+		valid bool // s1、s2是buf[k:k+blength]的checksum
+		last  = int32(-1)
+	)
+
+	c.writeSumHead(s)
+	blen := int(s.blength)
+	if s.count == 0 {
+		blen = 0
+	}
+	// 读取数据直到buf中至少有k+n字节或者文件结束
+	fill := func(n int) error {
+		for !eof && len(buf) < k+n {
+			p := make([]byte, wireChunkLen+blen)
+			m, err := io.ReadFull(rd, p)
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof, err = true, nil
+			}
+			if err != nil {
+				return err
+			}
+			h.Write(p[:m])
+			buf = append(buf, p[:m]...)
+		}
+		return nil
+	}
+	literal := func(p []byte) {
+		for len(p) > 0 {
+			n := len(p)
+			if n > wireChunkLen {
+				n = wireChunkLen
+			}
+			w.int32(int32(n))
+			w.write(p[:n])
+			st.Literal += int64(n)
+			p = p[n:]
+		}
+	}
+
+	for w.err == nil {
+		if err := fill(blen + 1); err != nil {
+			return err
+		}
+		if k == len(buf) {
+			break
+		}
+		// 窗口为buf[k:k+n]，文件结尾时窗口缩小
+		n := blen
+		if k+n > len(buf) {
+			n = len(buf) - k
+		}
+		if blen > 0 && !valid {
+			sum = wireSum1(buf[k : k+n])
+			s1, s2 = sum&0xffff, sum>>16
+			valid = true
+		}
+		matched := int32(-1)
+		if blen > 0 {
+			sum = s1&0xffff | s2<<16
+			var strong []byte
+			for _, i := range s.weak[sum] {
+				if s.blockLen(i) != int64(n) {
+					continue
+				}
+				if strong == nil {
+					strong = c.sum2(buf[k : k+n])
+				}
+				if bytes.Equal(strong[:s.s2length], s.strong[i]) {
+					// 优先选择上一个匹配块之后的block
+					if matched < 0 || i == last+1 {
+						matched = i
+					}
+				}
+			}
+		}
+		if matched >= 0 {
+			literal(buf[:k])
+			w.int32(-(matched + 1))
+			st.Matched += int64(n)
+			buf = buf[k+n:]
+			k, valid, last = 0, false, matched
+			continue
+		}
+
+		// 移动一个字节
+		out := uint32(int8(buf[k]))
+		k++
+		if blen > 0 {
+			s1 -= out
+			s2 -= uint32(n) * out
+			if k+n-1 < len(buf) {
+				in := uint32(int8(buf[k+n-1]))
+				s1 += in
+				s2 += s1
+			}
+		}
+		if k >= wireChunkLen {
+			literal(buf[:k])
+			buf = buf[k:]
+			k = 0
+		}
+	}
+	literal(buf[:k])
+	w.int32(0)
+	w.write(h.Sum(nil))
+	return w.err
+}
+
+// 接收方读取sum head和token，用basis生成文件写入out。文件的md5不一致时ok为false
+func (c *wireConn) recvData(basis io.ReaderAt, out io.Writer, st *WireStats) (ok bool, err error) {
+	r := c.r
+	s := &wireSums{count: r.int32(), blength: r.int32(), s2length: r.int32(), remainder: r.int32()}
+	if r.err != nil {
+		return false, r.err
+	}
+	if s.blength < 0 || s.blength > wireMaxBlockLen {
+		return false, fmt.Errorf("%w: invalid block length %d", ErrWireProtocol, s.blength)
+	}
+
+	h := md5.New()
+	w := io.MultiWriter(out, h)
+	buf := make([]byte, wireChunkLen)
+	for {
+		token := r.int32()
+		if r.err != nil {
+			return false, r.err
+		}
+		if token == 0 {
+			break
+		}
+		if token > 0 {
+			if token > wireChunkLen {
+				return false, fmt.Errorf("%w: literal too long %d", ErrWireProtocol, token)
+			}
+			r.full(buf[:token])
+			if r.err != nil {
+				return false, r.err
+			}
+			if _, err = w.Write(buf[:token]); err != nil {
+				return
+			}
+			st.Literal += int64(token)
+			continue
+		}
+		i := -(token + 1)
+		if i >= s.count || basis == nil {
+			return false, fmt.Errorf("%w: invalid block %d", ErrWireProtocol, i)
+		}
+		n := s.blockLen(i)
+		if _, err = io.Copy(w, io.NewSectionReader(basis, int64(i)*int64(s.blength), n)); err != nil {
+			return
+		}
+		st.Matched += n
+	}
+	sum := r.bytes(wireSumLen, wireSumLen)
+	if r.err != nil {
+		return false, r.err
+	}
+	return bytes.Equal(sum, h.Sum(nil)), nil
+}
@@ -0,0 +1,221 @@
+package rsync
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+func TestWireVarint(t *testing.T) {
+	buf := new(bytes.Buffer)
+	w := newWireWriter(buf)
+	for _, v := range []int32{0, 0x7f, 0x80, 0x1234, -1} {
+		w.varint(v)
+	}
+	w.varlong(0, 3)
+	w.varlong(5, 3)
+	w.varlong(0x1000000, 3)
+	w.varlong(0x5f000000, 4)
+	w.varlong(1<<40, 3)
+	for _, v := range []int32{0, 1, 2, 5, 300, 100000, ndxDone, 0, ndxDelStats} {
+		w.ndx(v)
+	}
+	w.flush()
+	expect := "00" + "7f" + "8080" + "9234" + "f0ffffffff" +
+		"000000" + "000500" + "81000000" + "5f000000" + "e10000000000" +
+		"01" + "01" + "01" + "03" + "fe0127" + "fe80a08601" + "00" + "fe80000000" + "ff02"
+	if got := hex.EncodeToString(buf.Bytes()); got != expect {
+		t.Fatal("encoding wrong:", got)
+	}
+
+	r := newWireReader(bytes.NewReader(buf.Bytes()))
+	for _, v := range []int32{0, 0x7f, 0x80, 0x1234, -1} {
+		if got := r.varint(); got != v {
+			t.Fatal("varint wrong:", got, v)
+		}
+	}
+	for _, c := range []struct {
+		v   int64
+		min int
+	}{{0, 3}, {5, 3}, {0x1000000, 3}, {0x5f000000, 4}, {1 << 40, 3}} {
+		if got := r.varlong(c.min); got != c.v {
+			t.Fatal("varlong wrong:", got, c.v)
+		}
+	}
+	for _, v := range []int32{0, 1, 2, 5, 300, 100000, ndxDone, 0, ndxDelStats} {
+		if got := r.ndx(); got != v {
+			t.Fatal("ndx wrong:", got, v)
+		}
+	}
+	if r.err != nil {
+		t.Fatal(r.err)
+	}
+	r.byte()
+	if r.err != io.ErrUnexpectedEOF {
+		t.Fatal("read after end should fail:", r.err)
+	}
+}
+
+func TestWireSort(t *testing.T) {
+	var files []*wireFile
+	for _, name := range []string{"a/sub/y", "b", "a/sub", "a", "a/z", "a.txt", ".", "a/x"} {
+		mode := uint32(sIFREG | 0644)
+		if name == "." || name == "a" || name == "a/sub" {
+			mode = sIFDIR | 0755
+		}
+		files = append(files, &wireFile{name: name, mode: mode})
+	}
+	sortWireFiles(files)
+	var names []string
+	for _, f := range files {
+		names = append(names, f.name)
+	}
+	// 同一目录中文件在子目录之前
+	if got := strings.Join(names, " "); got != ". a.txt b a a/x a/z a/sub a/sub/y" {
+		t.Fatal("order wrong:", got)
+	}
+
+	if s := wireSum1([]byte("abcd")); s != 0x03d4018a {
+		t.Fatalf("rolling checksum wrong: %x", s)
+	}
+	if s := wireSum1([]byte{0xff}); s != 0xffffffff {
+		t.Fatalf("rolling checksum should use signed bytes: %x", s)
+	}
+	for size, blength := range map[int64]int32{100: 700, 490000: 700, 1000000: 1000, 1 << 40: 128 << 10} {
+		if got := wireBlockLength(size); got != blength {
+			t.Fatal("block length wrong:", size, got)
+		}
+	}
+}
+
+// 多路复用的帧
+func wireFrame(tag int, data string) string {
+	n := len(data)
+	return string([]byte{byte(n), byte(n >> 8), byte(n >> 16), byte(wireMplexBase + tag)}) + data
+}
+
+func unhex(s string) string {
+	b, err := hex.DecodeString(strings.Replace(s, " ", "", -1))
+	if err != nil {
+		panic(err)
+	}
+	return string(b)
+}
+
+// 读取按协议构造的服务端数据(手工编写，不是真实rsync的录制，与rsync的互通见TestWireRsync)，保存客户端的数据
+type wireTranscript struct {
+	io.Reader
+	mu    sync.Mutex
+	out   bytes.Buffer
+	wrote chan struct{}
+}
+
+func (t *wireTranscript) Write(p []byte) (int, error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	select {
+	case t.wrote <- struct{}{}:
+	default:
+	}
+	return t.out.Write(p)
+}
+
+func (t *wireTranscript) String() string {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return t.out.String()
+}
+
+// rsync --daemon拉取一个文件和一个符号链接的记录
+func TestWireTranscript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-wire")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	flist := unhex("01 01 2e 000000 5f000000 ed410000") + // . 目录
+		unhex("80 04") + "file" + unhex("000500 a4810000") + // file，修改时间相同
+		unhex("80 04") + "link" + unhex("000000 ffa10000 04") + "file" + // link -> file
+		unhex("00")
+	sum := md5.Sum([]byte("hello"))
+	data := unhex("02 0080") + strings.Repeat("\x00", 16) + // ndx 1，sum head
+		unhex("05000000") + "hello" + unhex("00000000") + string(sum[:]) +
+		unhex("00 00 00") + strings.Repeat("\x00", 15) + unhex("00") // 阶段结束，统计数据，goodbye
+	request := wireFrame(msgData, unhex("02 0080")+strings.Repeat("\x00", 16)+unhex("00"))
+	pr, pw := io.Pipe()
+	rw := &wireTranscript{Reader: pr, wrote: make(chan struct{}, 1)}
+	go func() {
+		pw.Write([]byte("@RSYNCD: 31.0\n" +
+			"welcome\n@RSYNCD: AUTHREQD abc\n@RSYNCD: OK\n" +
+			unhex("28 04030201") + wireFrame(msgInfo, "hello from server\n") + wireFrame(msgData, flist)))
+		// 客户端请求之后发送文件
+		for !strings.Contains(rw.String(), request) {
+			<-rw.wrote
+		}
+		pw.Write([]byte(wireFrame(msgData, data)))
+	}()
+
+	log := new(bytes.Buffer)
+	opts := &WireOptions{Module: "mod", User: "alice", Password: "secret", Log: log}
+	st, err := WirePull(rw, "/", dir, opts)
+	if err != nil {
+		t.Fatal("WirePull failed:", err)
+	}
+	if st.Files != 1 || st.Updated != 1 || st.Literal != 5 {
+		t.Fatalf("stats wrong: %+v", st)
+	}
+	if log.String() != "welcome\nhello from server\n" {
+		t.Fatal("log wrong:", log.String())
+	}
+	fn := filepath.Join(dir, "file")
+	if got, err := ioutil.ReadFile(fn); err != nil || string(got) != "hello" {
+		t.Fatal("file wrong:", string(got), err)
+	}
+	if fi, err := os.Stat(fn); err != nil || fi.ModTime().Unix() != 0x5f000000 || fi.Mode().Perm() != 0644 {
+		t.Fatal("file attributes wrong:", fi.ModTime(), fi.Mode(), err)
+	}
+	if link, err := os.Readlink(filepath.Join(dir, "link")); err != nil || link != "file" {
+		t.Fatal("link wrong:", link, err)
+	}
+
+	auth := md5.Sum([]byte("secretabc"))
+	out := rw.String()
+	expect := "@RSYNCD: 31.0\nmod\nalice " + base64.RawStdEncoding.EncodeToString(auth[:]) + "\n" +
+		"--server\x00--sender\x00-ltpre.LsfxC\x00.\x00mod/\x00\x00"
+	if !strings.HasPrefix(out, expect) {
+		t.Fatalf("client output wrong: %q", out)
+	}
+	// 过滤规则，请求ndx 1，空sum head，三个阶段和goodbye
+	if got := out[len(expect):]; got != wireFrame(msgData, unhex("00000000"))+request+
+		wireFrame(msgData, unhex("00"))+wireFrame(msgData, unhex("00"))+wireFrame(msgData, unhex("00")) {
+		t.Fatalf("client requests wrong: %x", got)
+	}
+
+	for greeting, msg := range map[string]string{
+		"@RSYNCD: 31.0\n@ERROR: Unknown module 'mod'\n": "Unknown module",
+		"@RSYNCD: 29\n":              "not supported",
+		"HTTP/1.0 400 Bad Request\n": "invalid daemon greeting",
+		"@RSYNCD: 31.0\n@RSYNCD: OK\n@ERROR: module is read only\n": "read only",
+		"@RSYNCD: 31.0\n@RSYNCD: OK\n" + unhex("01 00000000"):       "compat flags",
+	} {
+		rw = &wireTranscript{Reader: strings.NewReader(greeting)}
+		if _, err = WirePull(rw, "/", dir, opts); err == nil || !strings.Contains(err.Error(), msg) {
+			t.Fatal("pull should fail:", greeting, err)
+		}
+	}
+	rw = &wireTranscript{Reader: strings.NewReader("@RSYNCD: 31.0\n@ERROR: denied\n")}
+	var re *RemoteError
+	if _, err = WirePull(rw, "/", dir, opts); !errors.As(err, &re) {
+		t.Fatal("daemon error should be RemoteError:", err)
+	}
+}
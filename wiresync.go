@@ -0,0 +1,525 @@
+package rsync
+
+import (
+	"encoding/binary"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// pull remotePath from rsync daemon (opts.Module is set) or rsync --server started with
+// WireServerArgs(true, ...) into directory dst. rw is the connection to the remote.
+// A remote path ending with / pulls the contents of the directory.
+func WirePull(rw io.ReadWriter, remotePath, dst string, opts *WireOptions) (st *WireStats, err error) {
+	var (
+		c     *wireConn
+		files []*wireFile
+		reqs  []int32
+	)
+
+	if opts == nil {
+		opts = &WireOptions{}
+	}
+	if c, err = newWireConn(rw, WireServerArgs(true, remotePath, opts), opts); err != nil {
+		return
+	}
+	// 过滤规则
+	c.w.int32(0)
+	if err = c.w.flush(); err != nil {
+		return
+	}
+	if files, err = c.recvFileList(); err != nil {
+		return
+	}
+
+	st = &WireStats{}
+	if reqs, err = wirePrepare(files, dst, st); err != nil {
+		return
+	}
+	// 发送方读取文件出错时不删除
+	if opts.Delete && c.r.ioError == 0 {
+		if err = wireDeleteExtra(dst, files, st, opts.Log); err != nil {
+			return
+		}
+	}
+
+	// generator发送请求，接收方每进入一个阶段通知generator，附带需要重新请求的文件
+	phases := make(chan []int32, 1)
+	gen := make(chan error, 1)
+	go func() {
+		gen <- c.generate(files, reqs, dst, phases)
+	}()
+	if err = c.receive(files, dst, st, phases); err == nil {
+		// 统计数据：读取、写入、文件总长度、生成和传输文件列表的时间
+		for i := 0; i < 5; i++ {
+			c.r.varlong(3)
+		}
+		if err = c.r.err; err == nil {
+			phases <- nil
+		}
+	}
+	close(phases)
+	// 出错时generator可能阻塞在写入，调用者关闭连接后退出
+	if err != nil {
+		return
+	}
+	if err = <-gen; err != nil {
+		return
+	}
+
+	if err = wireSetDirs(files, dst); err != nil {
+		return
+	}
+	if c.version >= 31 {
+		if it := c.readItem(); c.r.err == nil && it.ndx != ndxDone {
+			return nil, fmt.Errorf("%w: invalid packet at end of run %d", ErrWireProtocol, it.ndx)
+		}
+	}
+	if err = c.r.err; err == nil && c.r.ioError != 0 {
+		err = &RemoteError{Msg: fmt.Sprintf("remote I/O error %d: %s", c.r.ioError, c.r.lastErr)}
+	}
+	return
+}
+
+// 创建文件列表中的目录和符号链接，返回需要更新的普通文件
+func wirePrepare(files []*wireFile, dst string, st *WireStats) (reqs []int32, err error) {
+	if err = os.MkdirAll(dst, 0755); err != nil {
+		return
+	}
+	// 远端的文件列表可能包含符号链接x和x/file，父目录是符号链接的文件不能写入
+	links := make(map[string]bool)
+	dirs := make(map[string]bool)
+	for _, f := range files {
+		if f.isLink() {
+			links[f.name] = true
+		} else if f.isDir() {
+			dirs[f.name] = true
+		}
+	}
+	for _, f := range files {
+		if err = CheckTreeParents(dst, f.name, links, dirs); err != nil {
+			return nil, fmt.Errorf("%w: %s: %s", ErrWireProtocol, f.name, err.Error())
+		}
+	}
+	for i, f := range files {
+		fn := filepath.Join(dst, filepath.FromSlash(f.name))
+		switch {
+		case f.isDir():
+			err = wireMkdir(fn)
+		case f.isLink():
+			err = wireSymlink(fn, f.link)
+		case f.isReg():
+			st.Files++
+			fi, e := os.Lstat(fn)
+			if e == nil && fi.Mode().IsRegular() && fi.Size() == f.size && fi.ModTime().Unix() == f.mtime {
+				err = os.Chmod(fn, f.fileMode())
+				break
+			}
+			reqs = append(reqs, int32(i))
+		}
+		if err != nil {
+			return
+		}
+	}
+	return
+}
+
+// 设置目录的权限和修改时间，子目录在前
+func wireSetDirs(files []*wireFile, dst string) error {
+	for i := len(files) - 1; i >= 0; i-- {
+		f := files[i]
+		if !f.isDir() {
+			continue
+		}
+		fn := filepath.Join(dst, filepath.FromSlash(f.name))
+		mtime := time.Unix(f.mtime, int64(f.nsec))
+		if err := os.Chmod(fn, f.fileMode()); err != nil {
+			return err
+		}
+		if err := os.Chtimes(fn, mtime, mtime); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 请求需要更新的文件，之后接收方每进入一个阶段发送NDX_DONE，最后一次为goodbye
+func (c *wireConn) generate(files []*wireFile, reqs []int32, dst string, phases chan []int32) error {
+	w := c.w
+	for _, ndx := range reqs {
+		fn := filepath.Join(dst, filepath.FromSlash(files[ndx].name))
+		w.ndx(ndx)
+		w.short(itemTransfer)
+		f, fi, err := openBasis(fn)
+		if err != nil {
+			err = c.writeSums(nil, 0)
+		} else {
+			err = c.writeSums(f, fi.Size())
+			f.Close()
+		}
+		if err != nil {
+			return err
+		}
+	}
+	w.ndx(ndxDone)
+	if err := w.flush(); err != nil {
+		return err
+	}
+
+	for phase := 1; phase <= 3; phase++ {
+		redo, ok := <-phases
+		if !ok {
+			return nil
+		}
+		// 重新请求整个文件
+		for _, ndx := range redo {
+			w.ndx(ndx)
+			w.short(itemTransfer)
+			c.writeSums(nil, 0)
+		}
+		w.ndx(ndxDone)
+		if err := w.flush(); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// 接收文件数据直到发送方结束
+func (c *wireConn) receive(files []*wireFile, dst string, st *WireStats, phases chan []int32) (err error) {
+	var (
+		phase int
+		redo  []int32
+	)
+
+	for {
+		it := c.readItem()
+		if err = c.r.err; err != nil {
+			return
+		}
+		if it.ndx == ndxDone {
+			if phase++; phase > 2 {
+				break
+			}
+			phases <- redo
+			redo = nil
+			continue
+		}
+		if int(it.ndx) >= len(files) {
+			return fmt.Errorf("%w: invalid file index %d", ErrWireProtocol, it.ndx)
+		}
+		if it.iflags&itemTransfer == 0 {
+			continue
+		}
+		f := files[it.ndx]
+		if !f.isReg() {
+			return fmt.Errorf("%w: invalid file index %d", ErrWireProtocol, it.ndx)
+		}
+		ok, e := c.recvFile(f, filepath.Join(dst, filepath.FromSlash(f.name)), st)
+		if e != nil {
+			return e
+		}
+		if !ok {
+			if phase > 0 {
+				return fmt.Errorf("%w: %s", ErrChecksumMismatch, f.name)
+			}
+			redo = append(redo, it.ndx)
+		}
+	}
+	return
+}
+
+// 接收文件写入临时文件，md5一致时替换fn
+func (c *wireConn) recvFile(f *wireFile, fn string, st *WireStats) (ok bool, err error) {
+	var (
+		basis *os.File
+		tmp   *os.File
+	)
+
+	if basis, _, err = openBasis(fn); err == nil {
+		defer basis.Close()
+	}
+	if tmp, err = ioutil.TempFile(filepath.Dir(fn), "."+filepath.Base(fn)+"."); err != nil {
+		return
+	}
+	defer func() {
+		tmp.Close()
+		if !ok || err != nil {
+			os.Remove(tmp.Name())
+		}
+	}()
+
+	if basis != nil {
+		ok, err = c.recvData(basis, tmp, st)
+	} else {
+		ok, err = c.recvData(nil, tmp, st)
+	}
+	if !ok || err != nil {
+		return
+	}
+	if err = tmp.Chmod(f.fileMode()); err != nil {
+		return
+	}
+	if err = tmp.Close(); err != nil {
+		return
+	}
+	mtime := time.Unix(f.mtime, int64(f.nsec))
+	if err = os.Chtimes(tmp.Name(), mtime, mtime); err != nil {
+		return
+	}
+	if err = os.Rename(tmp.Name(), fn); err == nil {
+		st.Updated++
+	}
+	return
+}
+
+// 打开dst中的普通文件作为basis。不跟随符号链接，否则会把dst以外的文件的校验和发送给远端
+func openBasis(fn string) (f *os.File, fi os.FileInfo, err error) {
+	var lfi os.FileInfo
+
+	if lfi, err = os.Lstat(fn); err != nil {
+		return
+	}
+	if !lfi.Mode().IsRegular() {
+		return nil, nil, fmt.Errorf("%s is not a regular file", fn)
+	}
+	if f, err = os.Open(fn); err != nil {
+		return
+	}
+	// Lstat之后被替换
+	if fi, err = f.Stat(); err == nil && !os.SameFile(lfi, fi) {
+		err = fmt.Errorf("%s is changed", fn)
+	}
+	if err != nil {
+		f.Close()
+		return nil, nil, err
+	}
+	return
+}
+
+func wireMkdir(fn string) error {
+	if fi, err := os.Lstat(fn); err == nil {
+		if fi.IsDir() {
+			return nil
+		}
+		if err = os.Remove(fn); err != nil {
+			return err
+		}
+	}
+	return os.MkdirAll(fn, 0755)
+}
+
+func wireSymlink(fn, link string) error {
+	if fi, err := os.Lstat(fn); err == nil {
+		if target, e := os.Readlink(fn); e == nil && target == link {
+			return nil
+		}
+		if fi.IsDir() {
+			err = os.RemoveAll(fn)
+		} else {
+			err = os.Remove(fn)
+		}
+		if err != nil {
+			return err
+		}
+	}
+	return os.Symlink(link, fn)
+}
+
+// 删除文件列表的目录中不在文件列表里的文件
+func wireDeleteExtra(dst string, files []*wireFile, st *WireStats, log io.Writer) error {
+	names := make(map[string]bool)
+	for _, f := range files {
+		names[f.name] = true
+	}
+	for _, f := range files {
+		if !f.isDir() {
+			continue
+		}
+		dir := filepath.Join(dst, filepath.FromSlash(f.name))
+		fis, err := ioutil.ReadDir(dir)
+		if err != nil {
+			return err
+		}
+		for _, fi := range fis {
+			name := fi.Name()
+			if f.name != "." {
+				name = f.name + "/" + name
+			}
+			if names[name] {
+				continue
+			}
+			if log != nil {
+				fmt.Fprintf(log, "deleting %s\n", name)
+			}
+			if err = os.RemoveAll(filepath.Join(dir, fi.Name())); err != nil {
+				return err
+			}
+			st.Deleted++
+		}
+	}
+	return nil
+}
+
+// push local src to remotePath of rsync daemon (opts.Module is set) or rsync --server started
+// with WireServerArgs(false, ...). rw is the connection to the remote. A src ending with /
+// pushes the contents of the directory.
+func WirePush(rw io.ReadWriter, src, remotePath string, opts *WireOptions) (st *WireStats, err error) {
+	var (
+		c     *wireConn
+		files []*wireFile
+	)
+
+	if opts == nil {
+		opts = &WireOptions{}
+	}
+	if files, err = wireLocalFiles(src); err != nil {
+		return
+	}
+	if c, err = newWireConn(rw, WireServerArgs(false, remotePath, opts), opts); err != nil {
+		return
+	}
+	// 接收方删除文件时需要过滤规则
+	if opts.Delete {
+		c.w.int32(0)
+	}
+	if err = c.sendFileList(files); err != nil {
+		return
+	}
+	if err = c.w.flush(); err != nil {
+		return
+	}
+
+	st = &WireStats{}
+	for _, f := range files {
+		if f.isReg() {
+			st.Files++
+		}
+	}
+	if err = c.send(files, st); err != nil {
+		return
+	}
+
+	// goodbye
+	it := c.readItem()
+	if err = c.r.err; err != nil {
+		return
+	}
+	if it.ndx != ndxDone {
+		return nil, fmt.Errorf("%w: invalid packet at end of run %d", ErrWireProtocol, it.ndx)
+	}
+	if c.version >= 31 {
+		c.w.ndx(ndxDone)
+	}
+	err = c.w.flush()
+	return
+}
+
+// 回复generator的请求，发送文件数据
+func (c *wireConn) send(files []*wireFile, st *WireStats) (err error) {
+	phase := 0
+	for {
+		it := c.readItem()
+		if err = c.r.err; err != nil {
+			return
+		}
+		if it.ndx == ndxDone {
+			if phase++; phase > 2 {
+				break
+			}
+			c.w.ndx(ndxDone)
+			if err = c.w.flush(); err != nil {
+				return
+			}
+			continue
+		}
+		if int(it.ndx) >= len(files) {
+			return fmt.Errorf("%w: invalid file index %d", ErrWireProtocol, it.ndx)
+		}
+		if it.iflags&itemTransfer == 0 {
+			c.writeItem(it)
+			continue
+		}
+		f := files[it.ndx]
+		if !f.isReg() {
+			return fmt.Errorf("%w: invalid file index %d", ErrWireProtocol, it.ndx)
+		}
+		var s *wireSums
+		if s, err = c.readSums(); err != nil {
+			return
+		}
+		fd, e := os.Open(f.path)
+		if e != nil {
+			// 文件已经不存在
+			var b [4]byte
+			binary.LittleEndian.PutUint32(b[:], uint32(it.ndx))
+			c.w.msg(msgNoSend, b[:])
+			continue
+		}
+		c.writeItem(it)
+		err = c.sendData(s, io.LimitReader(fd, f.size), st)
+		fd.Close()
+		if err != nil {
+			return
+		}
+		st.Updated++
+	}
+	c.w.ndx(ndxDone)
+	return c.w.flush()
+}
+
+// 本地的文件列表，src以/结尾时为目录中的文件，否则包括src本身
+func wireLocalFiles(src string) (files []*wireFile, err error) {
+	fi, err := os.Lstat(src)
+	if err != nil {
+		return
+	}
+	prefix := filepath.Base(src)
+	if strings.HasSuffix(src, "/") && fi.IsDir() {
+		prefix = "."
+	}
+	files = append(files, wireLocalFile(prefix, src, fi))
+	files[0].top = true
+	if fi.Mode()&os.ModeSymlink != 0 {
+		if files[0].link, err = os.Readlink(src); err != nil {
+			return
+		}
+	}
+	if fi.IsDir() {
+		err = walkTree(src, func(e *TreeEntry, fn string) error {
+			name := e.Path
+			if prefix != "." {
+				name = prefix + "/" + name
+			}
+			f := &wireFile{
+				name:  name,
+				mode:  wireMode(e.Mode),
+				size:  e.Size,
+				mtime: e.ModTime.Unix(),
+				link:  e.Link,
+				path:  fn,
+			}
+			files = append(files, f)
+			return nil
+		})
+	}
+	sortWireFiles(files)
+	return
+}
+
+func wireLocalFile(name, fn string, fi os.FileInfo) *wireFile {
+	f := &wireFile{
+		name:  name,
+		mode:  wireMode(fi.Mode()),
+		mtime: fi.ModTime().Unix(),
+		path:  fn,
+	}
+	if fi.Mode().IsRegular() {
+		f.size = fi.Size()
+	}
+	return f
+}
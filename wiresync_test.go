@@ -0,0 +1,361 @@
+package rsync
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// 模拟rsync --daemon的一个连接，模块mod的路径为root。模块evil和evil2发送恶意的文件列表：
+// y/evil改名为x/evil，x是指向目录树以外的符号链接(evil)或者本地已经存在的符号链接(evil2)
+func fakeWireDaemon(conn net.Conn, root string) (err error) {
+	defer conn.Close()
+
+	c := &wireConn{r: newWireReader(conn), w: newWireWriter(conn), version: WireProtocolVersion,
+		compat: cfChksumSeedFix | 8, seed: 0x12345678}
+	fmt.Fprintf(c.w.w, "@RSYNCD: %d.0\n", WireProtocolVersion)
+	c.w.flush()
+	c.r.line()
+	module := c.r.line()
+	if module != "mod" && module != "evil" && module != "evil2" {
+		fmt.Fprintf(c.w.w, "@ERROR: Unknown module '%s'\n", module)
+		return c.w.flush()
+	}
+	fmt.Fprintf(c.w.w, "@RSYNCD: OK\n")
+	c.w.flush()
+
+	var args []string
+	for c.r.err == nil {
+		var arg []byte
+		for b := c.r.byte(); b != 0 && c.r.err == nil; b = c.r.byte() {
+			arg = append(arg, b)
+		}
+		if len(arg) == 0 {
+			break
+		}
+		args = append(args, string(arg))
+	}
+	all := strings.Join(args, " ")
+	p := root + strings.TrimPrefix(args[len(args)-1], module)
+	if module != "mod" {
+		p = filepath.Join(root, "evil") + "/"
+	}
+
+	c.w.varint(c.compat)
+	c.w.int32(int32(c.seed))
+	c.r.mux = true
+	c.w.multiplex()
+	st := &WireStats{}
+	if strings.Contains(all, "--sender") {
+		c.r.int32()
+		files, err := wireLocalFiles(p)
+		if err != nil {
+			return err
+		}
+		if module != "mod" {
+			var evil []*wireFile
+			for _, f := range files {
+				switch {
+				case f.name == "y" || module == "evil2" && f.name == "x":
+				case f.name == "y/evil":
+					f.name = "x/evil"
+					evil = append(evil, f)
+				default:
+					evil = append(evil, f)
+				}
+			}
+			files = evil
+		}
+		c.sendFileList(files)
+		c.w.flush()
+		if err = c.send(files, st); err != nil {
+			return err
+		}
+		for i := 0; i < 5; i++ {
+			c.w.varlong(0, 3)
+		}
+		c.w.flush()
+		if it := c.readItem(); it.ndx != ndxDone {
+			return fmt.Errorf("invalid goodbye %d", it.ndx)
+		}
+		c.w.ndx(ndxDone)
+		return c.w.flush()
+	}
+
+	if strings.Contains(all, "--delete") {
+		c.r.int32()
+	}
+	files, err := c.recvFileList()
+	if err != nil {
+		return
+	}
+	reqs, err := wirePrepare(files, p, st)
+	if err != nil {
+		return
+	}
+	if strings.Contains(all, "--delete") {
+		wireDeleteExtra(p, files, st, nil)
+	}
+	phases := make(chan []int32, 1)
+	gen := make(chan error, 1)
+	go func() {
+		gen <- c.generate(files, reqs, p, phases)
+	}()
+	err = c.receive(files, p, st, phases)
+	if err == nil {
+		phases <- nil
+	}
+	close(phases)
+	if err == nil {
+		err = <-gen
+	}
+	if it := c.readItem(); err == nil && it.ndx != ndxDone {
+		err = fmt.Errorf("invalid goodbye %d", it.ndx)
+	}
+	return
+}
+
+func TestWireSync(t *testing.T) {
+	dir, err := ioutil.TempDir("", "rsync-wiresync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	remote := filepath.Join(dir, "remote")
+	done := make(chan error, 1)
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			done <- fakeWireDaemon(conn, remote)
+		}
+	}()
+	dial := func() net.Conn {
+		conn, err := net.Dial("tcp", l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		return conn
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	big := randBytes(81, 300000)
+	writeTree := func(root string, files map[string][]byte) {
+		for name, data := range files {
+			fn := filepath.Join(root, name)
+			os.MkdirAll(filepath.Dir(fn), 0755)
+			ioutil.WriteFile(fn, data, 0640)
+			os.Chtimes(fn, mtime, mtime)
+		}
+	}
+	writeTree(remote, map[string][]byte{"a/big": big, "b": []byte("small"), "empty": nil})
+	os.Mkdir(filepath.Join(remote, "dir"), 0750)
+	os.Symlink("b", filepath.Join(remote, "link"))
+
+	// 本地有修改过的big，作为basis
+	local := filepath.Join(dir, "local")
+	changed := append(append(append([]byte{}, big[:100000]...), "inserted"...), big[100000:]...)
+	writeTree(local, map[string][]byte{"a/big": changed, "extra/file": []byte("extra")})
+	os.Chtimes(filepath.Join(local, "a/big"), time.Now(), time.Now())
+
+	conn := dial()
+	st, err := WirePull(conn, "/", local, &WireOptions{Module: "mod", Delete: true})
+	conn.Close()
+	if e := <-done; err != nil || e != nil {
+		t.Fatal("pull failed:", err, e)
+	}
+	if st.Files != 3 || st.Updated != 3 || st.Deleted != 1 || st.Matched < 290000 || st.Literal > 10000 {
+		t.Fatalf("pull stats wrong: %+v", st)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(local, "a/big")); !bytes.Equal(got, big) {
+		t.Fatal("pulled file wrong")
+	}
+	if fi, err := os.Stat(filepath.Join(local, "dir")); err != nil || !fi.IsDir() || fi.Mode().Perm() != 0750 {
+		t.Fatal("pulled dir wrong:", err)
+	}
+	if link, _ := os.Readlink(filepath.Join(local, "link")); link != "b" {
+		t.Fatal("pulled link wrong:", link)
+	}
+	if fi, err := os.Stat(filepath.Join(local, "b")); err != nil || !fi.ModTime().Equal(mtime) || fi.Mode().Perm() != 0640 {
+		t.Fatal("pulled attributes wrong:", err)
+	}
+	if _, err = os.Lstat(filepath.Join(local, "extra")); !os.IsNotExist(err) {
+		t.Fatal("extra should be deleted")
+	}
+
+	// 没有变化时不传输
+	conn = dial()
+	st, err = WirePull(conn, "/", local, &WireOptions{Module: "mod"})
+	conn.Close()
+	if e := <-done; err != nil || e != nil || st.Updated != 0 {
+		t.Fatal("pull again failed:", err, e, st)
+	}
+
+	// 推送目录local到远端的dst，删除多余的文件
+	writeTree(local, map[string][]byte{"a/big": changed, "c": []byte("new")})
+	writeTree(remote, map[string][]byte{"dst/local/a/big": big, "dst/local/stale": []byte("stale")})
+	conn = dial()
+	st, err = WirePush(conn, local, "dst", &WireOptions{Module: "mod", Delete: true})
+	conn.Close()
+	if e := <-done; err != nil || e != nil {
+		t.Fatal("push failed:", err, e)
+	}
+	if st.Files != 4 || st.Updated != 4 || st.Matched < 290000 {
+		t.Fatalf("push stats wrong: %+v", st)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(remote, "dst/local/a/big")); !bytes.Equal(got, changed) {
+		t.Fatal("pushed file wrong")
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(remote, "dst/local/c")); string(got) != "new" {
+		t.Fatal("pushed new file wrong")
+	}
+	if _, err = os.Lstat(filepath.Join(remote, "dst/local/stale")); !os.IsNotExist(err) {
+		t.Fatal("stale should be deleted")
+	}
+
+	// 远端的文件列表通过符号链接写入目录树以外
+	outside := filepath.Join(dir, "outside")
+	os.Mkdir(outside, 0755)
+	writeTree(remote, map[string][]byte{"evil/y/evil": []byte("evil")})
+	os.Symlink(outside, filepath.Join(remote, "evil/x"))
+	os.Symlink(outside, filepath.Join(local, "x"))
+	for _, module := range []string{"evil", "evil2"} {
+		conn = dial()
+		_, err = WirePull(conn, "/", local, &WireOptions{Module: module})
+		conn.Close()
+		<-done
+		if err == nil || !strings.Contains(err.Error(), "symlink") {
+			t.Fatal("pull through symlink should fail:", module, err)
+		}
+		if fis, _ := ioutil.ReadDir(outside); len(fis) != 0 {
+			t.Fatal("file written outside the tree:", module)
+		}
+	}
+
+	// 本地的文件是指向目录树以外的符号链接，不作为basis
+	ioutil.WriteFile(filepath.Join(outside, "secret"), big, 0600)
+	os.Remove(filepath.Join(local, "a/big"))
+	os.Symlink(filepath.Join(outside, "secret"), filepath.Join(local, "a/big"))
+	conn = dial()
+	st, err = WirePull(conn, "/", local, &WireOptions{Module: "mod"})
+	conn.Close()
+	if e := <-done; err != nil || e != nil || st.Matched != 0 {
+		t.Fatal("symlink should not be used as basis:", err, e, st)
+	}
+	if fi, err := os.Lstat(filepath.Join(local, "a/big")); err != nil || !fi.Mode().IsRegular() {
+		t.Fatal("symlink should be replaced:", err)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(outside, "secret")); !bytes.Equal(got, big) {
+		t.Fatal("file outside the tree changed")
+	}
+
+	conn = dial()
+	_, err = WirePull(conn, "/", local, &WireOptions{Module: "none"})
+	conn.Close()
+	<-done
+	if err == nil || !strings.Contains(err.Error(), "Unknown module") {
+		t.Fatal("unknown module should fail:", err)
+	}
+}
+
+// 与真实的rsync互相同步(remote shell模式，直接运行rsync --server)，没有安装rsync时跳过
+func TestWireRsync(t *testing.T) {
+	if _, err := exec.LookPath("rsync"); err != nil {
+		t.Skip("rsync not found")
+	}
+	dir, err := ioutil.TempDir("", "rsync-wirersync")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	start := func(sender bool, remotePath string, opts *WireOptions) (*exec.Cmd, io.ReadWriter, *bytes.Buffer) {
+		stderr := new(bytes.Buffer)
+		cmd := exec.Command("rsync", WireServerArgs(sender, remotePath, opts)...)
+		cmd.Stderr = stderr
+		stdin, _ := cmd.StdinPipe()
+		stdout, _ := cmd.StdoutPipe()
+		if err := cmd.Start(); err != nil {
+			t.Fatal("start rsync failed:", err)
+		}
+		return cmd, struct {
+			io.Reader
+			io.WriteCloser
+		}{stdout, stdin}, stderr
+	}
+	finish := func(cmd *exec.Cmd, rw io.ReadWriter, stderr *bytes.Buffer, err error) {
+		rw.(io.Closer).Close()
+		if e := cmd.Wait(); err != nil || e != nil {
+			t.Fatal("sync with rsync failed:", err, e, stderr.String())
+		}
+	}
+
+	mtime := time.Unix(1500000000, 0)
+	big := randBytes(83, 300000)
+	changed := append(append(append([]byte{}, big[:100000]...), "inserted"...), big[100000:]...)
+	write := func(fn string, data []byte) {
+		os.MkdirAll(filepath.Dir(fn), 0755)
+		ioutil.WriteFile(fn, data, 0640)
+		os.Chtimes(fn, mtime, mtime)
+	}
+	remote, local := filepath.Join(dir, "remote"), filepath.Join(dir, "local")
+	write(filepath.Join(remote, "a/big"), big)
+	write(filepath.Join(remote, "b"), []byte("small"))
+	os.Symlink("b", filepath.Join(remote, "link"))
+	write(filepath.Join(local, "a/big"), changed)
+	write(filepath.Join(local, "extra"), []byte("extra"))
+	os.Chtimes(filepath.Join(local, "a/big"), time.Now(), time.Now())
+
+	// 从rsync拉取
+	opts := &WireOptions{Delete: true}
+	cmd, rw, stderr := start(true, remote+"/", opts)
+	st, err := WirePull(rw, remote+"/", local, opts)
+	finish(cmd, rw, stderr, err)
+	if st.Updated != 2 || st.Deleted != 1 || st.Matched < 290000 {
+		t.Fatalf("pull stats wrong: %+v", st)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(local, "a/big")); !bytes.Equal(got, big) {
+		t.Fatal("pulled file wrong")
+	}
+	if link, _ := os.Readlink(filepath.Join(local, "link")); link != "b" {
+		t.Fatal("pulled link wrong:", link)
+	}
+	if fi, err := os.Stat(filepath.Join(local, "b")); err != nil || !fi.ModTime().Equal(mtime) || fi.Mode().Perm() != 0640 {
+		t.Fatal("pulled attributes wrong:", err)
+	}
+
+	// 推送到rsync
+	write(filepath.Join(local, "a/big"), changed)
+	write(filepath.Join(local, "c"), []byte("new"))
+	write(filepath.Join(remote, "stale"), []byte("stale"))
+	cmd, rw, stderr = start(false, remote+"/", opts)
+	st, err = WirePush(rw, local+"/", remote+"/", opts)
+	finish(cmd, rw, stderr, err)
+	if st.Updated != 2 || st.Matched < 290000 {
+		t.Fatalf("push stats wrong: %+v", st)
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(remote, "a/big")); !bytes.Equal(got, changed) {
+		t.Fatal("pushed file wrong")
+	}
+	if got, _ := ioutil.ReadFile(filepath.Join(remote, "c")); string(got) != "new" {
+		t.Fatal("pushed new file wrong")
+	}
+	if _, err = os.Lstat(filepath.Join(remote, "stale")); !os.IsNotExist(err) {
+		t.Fatal("stale should be deleted")
+	}
+}